@@ -0,0 +1,236 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// AccountStatus is the state of the user account.
+type AccountStatus int
+
+const (
+	// Account can be used normally.
+	StatusActive AccountStatus = iota
+	// Account can not be used to log in and GetUser fails with
+	// ErrAccountSuspended. Deliveries are deferred.
+	StatusSuspended
+	// Account can be used to log in, but all mailboxes are read-only and
+	// changes fail with ErrAccountReadOnly. Deliveries are accepted.
+	StatusReadOnly
+	// Account is about to be deleted. It can not be used to log in and
+	// deliveries are rejected.
+	StatusPendingDeletion
+)
+
+var (
+	ErrAccountSuspended       = errors.New("imapsql: account is suspended")
+	ErrAccountReadOnly        = errors.New("imapsql: account is read-only")
+	ErrAccountPendingDeletion = errors.New("imapsql: account is pending deletion")
+)
+
+// DefaultLockoutDuration is used if Opts.LockoutDuration is not set.
+const DefaultLockoutDuration = 15 * time.Minute
+
+func (s AccountStatus) String() string {
+	switch s {
+	case StatusActive:
+		return "active"
+	case StatusSuspended:
+		return "suspended"
+	case StatusReadOnly:
+		return "read-only"
+	case StatusPendingDeletion:
+		return "pending-deletion"
+	}
+	return "AccountStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// ParseAccountStatus returns the AccountStatus for the string returned by
+// AccountStatus.String.
+func ParseAccountStatus(s string) (AccountStatus, error) {
+	for _, status := range []AccountStatus{StatusActive, StatusSuspended, StatusReadOnly, StatusPendingDeletion} {
+		if status.String() == s {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("imapsql: unknown account status: %s", s)
+}
+
+// statusErr returns the error GetUser should fail with for the account in
+// the status, nil if the account can be used.
+func (s AccountStatus) statusErr() error {
+	switch s {
+	case StatusSuspended:
+		return ErrAccountSuspended
+	case StatusPendingDeletion:
+		return ErrAccountPendingDeletion
+	}
+	return nil
+}
+
+func (b *Backend) prepareAccountStmts() error {
+	var err error
+	b.setUserStatus, err = b.db.Prepare(`
+		UPDATE users
+		SET status = ?
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "setUserStatus prep")
+	}
+	b.userLoginState, err = b.db.Prepare(`
+		SELECT id, status, failedLogins, lockedUntil
+		FROM users
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "userLoginState prep")
+	}
+	b.addFailedLogin, err = b.db.Prepare(`
+		UPDATE users
+		SET failedLogins = failedLogins + 1
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "addFailedLogin prep")
+	}
+	b.lockUser, err = b.db.Prepare(`
+		UPDATE users
+		SET failedLogins = 0, lockedUntil = ?
+		WHERE id = ? AND failedLogins >= ?`)
+	if err != nil {
+		return wrapErr(err, "lockUser prep")
+	}
+	b.resetFailedLogins, err = b.db.Prepare(`
+		UPDATE users
+		SET failedLogins = 0, lockedUntil = 0
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "resetFailedLogins prep")
+	}
+	return nil
+}
+
+// AccountState is the status of the user account and its login lockout
+// state.
+type AccountState struct {
+	Status AccountStatus
+	// Amount of failed logins since the last successful login or lockout.
+	FailedLogins int
+	// Zero if the account is not locked.
+	LockedUntil time.Time
+}
+
+// UserState returns the status of the user account. Unlike GetUser, it works
+// for accounts in any status.
+func (b *Backend) UserState(username string) (AccountState, error) {
+	var (
+		state       AccountState
+		uid         uint64
+		lockedUntil int64
+	)
+	err := b.userLoginState.QueryRow(normalizeUsername(username)).Scan(&uid, &state.Status, &state.FailedLogins, &lockedUntil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return AccountState{}, ErrUserDoesntExists
+		}
+		return AccountState{}, wrapErr(err, "UserState")
+	}
+	if lockedUntil > time.Now().Unix() {
+		state.LockedUntil = time.Unix(lockedUntil, 0)
+	}
+	return state, nil
+}
+
+// SetUserStatus changes the status of the user account.
+//
+// Objects returned by GetUser earlier are not affected by the change.
+func (b *Backend) SetUserStatus(username string, status AccountStatus) error {
+	res, err := b.setUserStatus.Exec(status, normalizeUsername(username))
+	if err != nil {
+		return wrapErr(err, "SetUserStatus")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "SetUserStatus")
+	}
+	if affected == 0 {
+		return ErrUserDoesntExists
+	}
+	return nil
+}
+
+// UnlockUser resets failed logins counter of the user account and removes
+// the lockout, if any.
+func (b *Backend) UnlockUser(username string) error {
+	uid, _, _, err := b.getUserMeta(context.Background(), nil, normalizeUsername(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "UnlockUser")
+	}
+	if _, err := b.resetFailedLogins.Exec(uid); err != nil {
+		return wrapErr(err, "UnlockUser")
+	}
+	return nil
+}
+
+// loginState returns the failed logins counter of the account and whether
+// it is locked. uid is zero for accounts that do not exist.
+func (b *Backend) loginState(accountName string) (uid uint64, failedLogins int, locked bool, err error) {
+	var (
+		status      AccountStatus
+		lockedUntil int64
+	)
+	err = b.userLoginState.QueryRow(accountName).Scan(&uid, &status, &failedLogins, &lockedUntil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, false, nil
+		}
+		return 0, 0, false, wrapErr(err, "Login (userLoginState)")
+	}
+	return uid, failedLogins, lockedUntil > time.Now().Unix(), nil
+}
+
+// recordFailedLogin increments the failed logins counter of the account
+// and locks it if Opts.MaxFailedLogins is reached.
+func (b *Backend) recordFailedLogin(uid uint64) {
+	if b.Opts.MaxFailedLogins <= 0 || uid == 0 {
+		return
+	}
+	if _, err := b.addFailedLogin.Exec(uid); err != nil {
+		b.Opts.Log.Printf("Login: failed to record failed login: %v", err)
+		return
+	}
+
+	duration := b.Opts.LockoutDuration
+	if duration == 0 {
+		duration = DefaultLockoutDuration
+	}
+	res, err := b.lockUser.Exec(time.Now().Add(duration).Unix(), uid, b.Opts.MaxFailedLogins)
+	if err != nil {
+		b.Opts.Log.Printf("Login: failed to lock account: %v", err)
+		return
+	}
+	if affected, _ := res.RowsAffected(); affected != 0 {
+		b.Opts.Log.Printf("Login: account (id %d) locked for %v after %d failed logins", uid, duration, b.Opts.MaxFailedLogins)
+	}
+}
+
+// effectiveStatus returns the status of the account in the suspended domain.
+func effectiveStatus(status AccountStatus, domSuspended int) AccountStatus {
+	if domSuspended != 0 && status != StatusPendingDeletion {
+		return StatusSuspended
+	}
+	return status
+}
+
+// checkWritable returns ErrAccountReadOnly for read-only accounts.
+func (u *User) checkWritable() error {
+	if u.status == StatusReadOnly {
+		return ErrAccountReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestAccountStatus(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	u, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.(*User).SetPassword("secret"))
+
+	for _, status := range []AccountStatus{StatusActive, StatusSuspended, StatusReadOnly, StatusPendingDeletion} {
+		parsed, err := ParseAccountStatus(status.String())
+		assert.NilError(t, err)
+		assert.Equal(t, parsed, status)
+	}
+	_, err = ParseAccountStatus("deleted")
+	assert.Assert(t, err != nil)
+
+	assert.Equal(t, b.SetUserStatus("nobody@example.org", StatusSuspended), ErrUserDoesntExists)
+
+	assert.NilError(t, b.SetUserStatus("user@example.org", StatusSuspended))
+	state, err := b.UserState("user@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, state.Status, StatusSuspended)
+	_, err = b.GetUser("user@example.org")
+	assert.Equal(t, err, ErrAccountSuspended)
+	_, err = b.GetOrCreateUser("user@example.org")
+	assert.Equal(t, err, ErrAccountSuspended)
+	_, err = b.Login(nil, "user@example.org", "secret")
+	assert.Equal(t, err, ErrAccountSuspended)
+	_, err = b.Login(nil, "user@example.org", "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	assert.NilError(t, b.SetUserStatus("user@example.org", StatusPendingDeletion))
+	_, err = b.Login(nil, "user@example.org", "secret")
+	assert.Equal(t, err, ErrAccountPendingDeletion)
+
+	assert.NilError(t, b.SetUserStatus("user@example.org", StatusActive))
+	_, err = b.Login(nil, "user@example.org", "secret")
+	assert.NilError(t, err)
+}
+
+func TestAccountStatus_ReadOnly(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	u, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.CreateMailbox("Archive"))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	assert.NilError(t, b.SetUserStatus("user@example.org", StatusReadOnly))
+	u, err = b.GetUser("user@example.org")
+	assert.NilError(t, err)
+
+	assert.Equal(t, u.CreateMailbox("Test"), ErrAccountReadOnly)
+	assert.Equal(t, u.RenameMailbox("Archive", "Test"), ErrAccountReadOnly)
+	assert.Equal(t, u.DeleteMailbox("Archive"), ErrAccountReadOnly)
+	assert.Equal(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil), ErrAccountReadOnly)
+
+	status, mbox, err := u.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	assert.Assert(t, status.ReadOnly)
+	seq, _ := imap.ParseSeqSet("1")
+	assert.Equal(t, mbox.UpdateMessagesFlags(false, seq, imap.AddFlags, true, []string{imap.SeenFlag}), ErrAccountReadOnly)
+	assert.Equal(t, mbox.CopyMessages(false, seq, "Archive"), ErrAccountReadOnly)
+	assert.Equal(t, mbox.Expunge(), ErrAccountReadOnly)
+
+	// Deliveries are still accepted.
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt("user@example.org", textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+	status, err = u.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(2))
+}
+
+func TestDelivery_AccountStatus(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("suspended@example.org"))
+	assert.NilError(t, b.CreateUser("deleted@example.org"))
+	assert.NilError(t, b.CreateAlias("alias@example.org", "deleted@example.org", ""))
+	assert.NilError(t, b.SetUserStatus("suspended@example.org", StatusSuspended))
+	assert.NilError(t, b.SetUserStatus("deleted@example.org", StatusPendingDeletion))
+
+	delivery := b.NewDelivery()
+	assert.Equal(t, delivery.AddRcpt("suspended@example.org", textproto.Header{}), ErrAccountSuspended)
+	assert.Equal(t, delivery.AddRcpt("deleted@example.org", textproto.Header{}), ErrAccountPendingDeletion)
+	assert.Equal(t, delivery.AddRcpt("alias@example.org", textproto.Header{}), ErrAccountPendingDeletion)
+	assert.NilError(t, delivery.Abort())
+
+	assert.Equal(t, rcptFailureStatus(ErrAccountSuspended), RcptTempFailed)
+	assert.Equal(t, rcptFailureStatus(ErrAccountPendingDeletion), RcptPermFailed)
+}
+
+func TestLogin_Lockout(t *testing.T) {
+	b := initTestBackendOpts(Opts{MaxFailedLogins: 3}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	u, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.(*User).SetPassword("secret"))
+
+	// Successful login resets the counter.
+	for i := 0; i < 2; i++ {
+		_, err = b.Login(nil, "user@example.org", "wrong")
+		assert.Equal(t, err, backend.ErrInvalidCredentials)
+	}
+	state, err := b.UserState("user@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, state.FailedLogins, 2)
+	_, err = b.Login(nil, "user@example.org", "secret")
+	assert.NilError(t, err)
+	state, err = b.UserState("user@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, state.FailedLogins, 0)
+
+	for i := 0; i < 3; i++ {
+		_, err = b.Login(nil, "user@example.org", "wrong")
+		assert.Equal(t, err, backend.ErrInvalidCredentials)
+	}
+	_, err = b.Login(nil, "user@example.org", "secret")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	state, err = b.UserState("user@example.org")
+	assert.NilError(t, err)
+	assert.Assert(t, state.LockedUntil.After(time.Now().Add(DefaultLockoutDuration-time.Minute)))
+	lockedUntil := state.LockedUntil
+
+	// Failed logins during the lockout do not extend it.
+	_, err = b.Login(nil, "user@example.org", "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	state, err = b.UserState("user@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, state.FailedLogins, 0)
+	assert.Equal(t, state.LockedUntil, lockedUntil)
+
+	assert.NilError(t, b.UnlockUser("user@example.org"))
+	_, err = b.Login(nil, "user@example.org", "secret")
+	assert.NilError(t, err)
+
+	// Expired lockout.
+	_, err = b.DB.Exec(`UPDATE users SET lockedUntil = 1`)
+	assert.NilError(t, err)
+	_, err = b.Login(nil, "user@example.org", "secret")
+	assert.NilError(t, err)
+}
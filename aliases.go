@@ -0,0 +1,231 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Aliases map additional addresses to user accounts. They are used by
+// Delivery.AddRcpt and, if Opts.LoginAliases is set, by Login.
+
+var ErrAliasAlreadyExists = errors.New("imapsql: alias already exists")
+var ErrAliasDoesntExists = errors.New("imapsql: alias doesn't exists")
+
+// Alias is the address mapped to the user account.
+type Alias struct {
+	// Address, or "@domain" for the catch-all alias that matches all
+	// addresses in the domain that do not match an account or a
+	// more specific alias.
+	Alias string
+	// Target account.
+	Username string
+	// Mailbox messages for the alias are delivered into. Empty if the
+	// mailbox selected by Delivery is used.
+	Mailbox string
+}
+
+func (b *Backend) initAliases() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS aliases (
+			alias VARCHAR(255) NOT NULL PRIMARY KEY,
+			userId BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			mailbox VARCHAR(255) DEFAULT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table aliases")
+	}
+	return nil
+}
+
+func (b *Backend) prepareAliasStmts() error {
+	var err error
+	b.getAlias, err = b.db.Prepare(`
+		SELECT users.id, users.inboxId, users.username, users.status, coalesce(domains.suspended, 0), aliases.mailbox
+		FROM aliases
+		INNER JOIN users
+		ON aliases.userId = users.id
+		LEFT JOIN domains
+		ON users.domainId = domains.id
+		WHERE alias = ?`)
+	if err != nil {
+		return wrapErr(err, "getAlias prep")
+	}
+	b.addAlias, err = b.db.Prepare(`
+		INSERT INTO aliases(alias, userId, mailbox)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addAlias prep")
+	}
+	b.delAlias, err = b.db.Prepare(`
+		DELETE FROM aliases
+		WHERE alias = ?`)
+	if err != nil {
+		return wrapErr(err, "delAlias prep")
+	}
+	b.listAliases, err = b.db.Prepare(`
+		SELECT aliases.alias, users.username, aliases.mailbox
+		FROM aliases
+		INNER JOIN users
+		ON aliases.userId = users.id
+		ORDER BY aliases.alias`)
+	if err != nil {
+		return wrapErr(err, "listAliases prep")
+	}
+	return nil
+}
+
+// CreateAlias maps the alias address to the existing user account. If
+// mailbox is not empty, messages delivered to the alias are stored into it
+// instead of INBOX.
+//
+// Use "@domain" alias to create the catch-all alias for the domain.
+//
+// Accounts take precedence over aliases with the same name.
+func (b *Backend) CreateAlias(alias, username, mailbox string) error {
+	alias = normalizeUsername(alias)
+	username = normalizeUsername(username)
+	if alias == "" || alias == "@" {
+		return errors.New("imapsql: empty alias")
+	}
+
+	uid, _, _, err := b.getUserMeta(context.Background(), nil, username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "CreateAlias")
+	}
+
+	mboxName := sql.NullString{String: mailbox, Valid: mailbox != ""}
+	if _, err := b.addAlias.Exec(alias, uid, mboxName); err != nil {
+		if isForeignKeyErr(err) {
+			return ErrAliasAlreadyExists
+		}
+		return wrapErr(err, "CreateAlias")
+	}
+	return nil
+}
+
+// DeleteAlias removes the alias.
+func (b *Backend) DeleteAlias(alias string) error {
+	stats, err := b.delAlias.Exec(normalizeUsername(alias))
+	if err != nil {
+		return wrapErr(err, "DeleteAlias")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "DeleteAlias")
+	}
+	if affected == 0 {
+		return ErrAliasDoesntExists
+	}
+	return nil
+}
+
+// ListAliases returns all aliases sorted by the alias address.
+func (b *Backend) ListAliases() ([]Alias, error) {
+	var res []Alias
+	rows, err := b.listAliases.Query()
+	if err != nil {
+		return res, wrapErr(err, "ListAliases")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			alias   Alias
+			mailbox sql.NullString
+		)
+		if err := rows.Scan(&alias.Alias, &alias.Username, &mailbox); err != nil {
+			return res, wrapErr(err, "ListAliases")
+		}
+		alias.Mailbox = mailbox.String
+		res = append(res, alias)
+	}
+	if err := rows.Err(); err != nil {
+		return res, wrapErr(err, "ListAliases")
+	}
+	return res, nil
+}
+
+// rcptAccount is the account the recipient address is resolved to.
+type rcptAccount struct {
+	uid, inboxId uint64
+	username     string
+	status       AccountStatus
+	// Mailbox from the alias, if any.
+	mailbox string
+	// Subaddress detail, if any.
+	detail string
+}
+
+// scanAlias reads the account from the getAlias query result.
+func scanAlias(row *sql.Row) (rcptAccount, error) {
+	var (
+		acct         rcptAccount
+		domSuspended int
+		mailbox      sql.NullString
+	)
+	if err := row.Scan(&acct.uid, &acct.inboxId, &acct.username, &acct.status, &domSuspended, &mailbox); err != nil {
+		return rcptAccount{}, err
+	}
+	acct.status = effectiveStatus(acct.status, domSuspended)
+	acct.mailbox = mailbox.String
+	return acct, nil
+}
+
+// lookupAccount resolves the exact username or alias to the account.
+// sql.ErrNoRows is returned if there is no match.
+func (b *Backend) lookupAccount(ctx context.Context, name string) (rcptAccount, error) {
+	acct := rcptAccount{username: name}
+	var err error
+	acct.uid, acct.inboxId, acct.status, err = b.getUserMeta(ctx, nil, name)
+	if err != sql.ErrNoRows {
+		return acct, err
+	}
+
+	return scanAlias(b.getAlias.QueryRowContext(ctx, name))
+}
+
+// resolveRcpt resolves the recipient address to the account trying, in
+// order, the exact account name or alias, the address without the
+// subaddress detail and the catch-all alias for the domain.
+func (b *Backend) resolveRcpt(ctx context.Context, addr string) (rcptAccount, error) {
+	acct, err := b.lookupAccount(ctx, addr)
+	if err != sql.ErrNoRows {
+		return acct, err
+	}
+
+	if base, detail := b.SplitSubaddress(addr); detail != "" {
+		acct, err = b.lookupAccount(ctx, base)
+		acct.detail = detail
+		if err != sql.ErrNoRows {
+			return acct, err
+		}
+	}
+
+	at := strings.LastIndexByte(addr, '@')
+	if at == -1 {
+		return rcptAccount{}, sql.ErrNoRows
+	}
+	return scanAlias(b.getAlias.QueryRowContext(ctx, addr[at:]))
+}
+
+// loginAccount returns the account name for the login name, resolving
+// exact aliases if Opts.LoginAliases is set. Name is returned as is if it
+// is not an alias.
+func (b *Backend) loginAccount(name string) (string, error) {
+	name = normalizeUsername(name)
+	if !b.Opts.LoginAliases {
+		return name, nil
+	}
+	acct, err := b.lookupAccount(context.Background(), name)
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	if err != nil {
+		return "", wrapErr(err, "Login (lookupAccount)")
+	}
+	return acct.username, nil
+}
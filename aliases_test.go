@@ -0,0 +1,126 @@
+package imapsql
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestAliases(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+
+	assert.Equal(t, b.CreateAlias("alias@example.org", "nobody@example.org", ""), ErrUserDoesntExists)
+	assert.NilError(t, b.CreateAlias("Alias@example.org", "user@example.org", ""))
+	assert.Equal(t, b.CreateAlias("alias@example.org", "user@example.org", ""), ErrAliasAlreadyExists)
+	assert.NilError(t, b.CreateAlias("@example.org", "user@example.org", "Catch-all"))
+
+	list, err := b.ListAliases()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, list, []Alias{
+		{Alias: "@example.org", Username: "user@example.org", Mailbox: "Catch-all"},
+		{Alias: "alias@example.org", Username: "user@example.org"},
+	})
+
+	assert.NilError(t, b.DeleteAlias("@example.org"))
+	assert.Equal(t, b.DeleteAlias("@example.org"), ErrAliasDoesntExists)
+	list, err = b.ListAliases()
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 1)
+}
+
+func TestDelivery_Aliases(t *testing.T) {
+	b := initTestBackendOpts(Opts{SubaddressSeparator: "+"}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.CreateUser("other@example.org"))
+	assert.NilError(t, b.CreateAlias("alias@example.org", "user@example.org", ""))
+	assert.NilError(t, b.CreateAlias("sales@example.org", "user@example.org", "Sales"))
+	assert.NilError(t, b.CreateAlias("@example.org", "other@example.org", ""))
+
+	delivery := b.NewDelivery()
+	for _, rcpt := range []string{
+		"user@example.org", "alias@example.org", "alias+tag@example.org",
+		"sales@example.org", "random@example.org",
+	} {
+		hdr := textproto.Header{}
+		hdr.Add("Delivered-To", rcpt)
+		assert.NilError(t, delivery.AddRcpt(rcpt, hdr))
+	}
+	assert.Equal(t, delivery.AddRcpt("user@example.com", textproto.Header{}), ErrUserDoesntExists)
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	res := delivery.Results()
+	assert.Equal(t, res[2].Username, "user@example.org")
+	assert.Equal(t, res[2].Detail, "tag")
+	assert.Equal(t, res[4].Username, "other@example.org")
+
+	for _, r := range res {
+		assert.Equal(t, r.Status, RcptDelivered)
+	}
+
+	// Addresses of the same account get a single copy per mailbox.
+	assert.DeepEqual(t, headerValues(t, b, "user@example.org", "INBOX", "Delivered-To"), []string{"user@example.org"})
+	assert.DeepEqual(t, headerValues(t, b, "user@example.org", "Sales", "Delivered-To"), []string{"sales@example.org"})
+	assert.DeepEqual(t, headerValues(t, b, "other@example.org", "INBOX", "Delivered-To"), []string{"random@example.org"})
+}
+
+// headerValues returns values of the header field for all messages in the
+// mailbox.
+func headerValues(t *testing.T, b *Backend, username, mboxName, field string) []string {
+	t.Helper()
+	u, err := b.GetUser(username)
+	assert.NilError(t, err)
+	_, mbox, err := u.GetMailbox(mboxName, true, nil)
+	assert.NilError(t, err)
+	section, err := imap.ParseBodySectionName("BODY.PEEK[HEADER]")
+	assert.NilError(t, err)
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{section.FetchItem()}, ch))
+
+	var values []string
+	for msg := range ch {
+		for _, literal := range msg.Body {
+			hdr, err := textproto.ReadHeader(bufio.NewReader(literal))
+			assert.NilError(t, err)
+			values = append(values, hdr.Get(field))
+		}
+	}
+	return values
+}
+
+func TestLogin_Aliases(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	u, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.(*User).SetPassword("secret"))
+	assert.NilError(t, b.CreateAlias("alias@example.org", "user@example.org", ""))
+	assert.NilError(t, b.CreateAlias("@example.org", "user@example.org", ""))
+
+	_, err = b.Login(nil, "alias@example.org", "secret")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	b.Opts.LoginAliases = true
+	u, err = b.Login(nil, "alias@example.org", "secret")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Username(), "user@example.org")
+	_, err = b.Login(nil, "random@example.org", "secret")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	// Aliases should not be turned into accounts.
+	b.Opts.AutoCreateUsers = true
+	_, err = b.Login(nil, "alias@example.org", "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.GetUser("alias@example.org")
+	assert.Equal(t, err, ErrUserDoesntExists)
+}
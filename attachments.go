@@ -0,0 +1,245 @@
+package imapsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	nettextproto "net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Pseudo-header fields that can be used in SEARCH HEADER criteria to match
+// messages by attachments. They are evaluated using the cached body
+// structure and never match real header fields.
+//
+//	SEARCH HEADER X-Imapsql-Attachment-Type application/pdf
+//	SEARCH HEADER X-Imapsql-Largest-Part 5242880
+const (
+	// Matches if there is an attachment with filename containing the value
+	// (case-insensitive).
+	SearchAttachmentName = "X-Imapsql-Attachment-Name"
+	// Matches if there is an attachment of the specified MIME type. Value
+	// can be the full type ("image/png") or the top-level type followed by
+	// slash ("image/").
+	SearchAttachmentType = "X-Imapsql-Attachment-Type"
+	// Matches if the size of the largest leaf part is larger than the value
+	// (in bytes).
+	SearchLargestPart = "X-Imapsql-Largest-Part"
+)
+
+func isAttachmentCriterion(key string) bool {
+	switch nettextproto.CanonicalMIMEHeaderKey(key) {
+	case SearchAttachmentName, SearchAttachmentType, SearchLargestPart:
+		return true
+	}
+	return false
+}
+
+// Attachment describes the message part presented to the user as an
+// attachment: the one with Content-Disposition: attachment or with the
+// file name specified.
+type Attachment struct {
+	// Part path, as used in BODY[] sections.
+	Part     []int
+	Filename string
+	// Lowercase MIME type, e.g. "application/pdf".
+	MIMEType string
+	// Size of the part in the encoded form (e.g. base64).
+	Size uint32
+}
+
+// MessageAttachments is the list of attachments of a message.
+type MessageAttachments struct {
+	Mailbox string
+	UID     uint32
+	// RFC822.SIZE of the message.
+	Size uint32
+	// Size of the largest non-multipart part in the encoded form.
+	LargestPart uint32
+	Attachments []Attachment
+}
+
+// AttachmentFilter specifies conditions attachments should match. All set
+// conditions should be satisfied by the same attachment.
+type AttachmentFilter struct {
+	// Case-insensitive substring of the filename.
+	Filename string
+	// MIME type, either full ("application/pdf") or top-level type followed
+	// by slash ("image/").
+	MIMEType string
+	// Minimal size of the attachment in the encoded form, exclusive.
+	LargerThan uint32
+}
+
+// Matches reports whether the attachment satisfies the filter.
+func (f AttachmentFilter) Matches(att Attachment) bool {
+	if f.Filename != "" && !strings.Contains(strings.ToLower(att.Filename), strings.ToLower(f.Filename)) {
+		return false
+	}
+	if f.MIMEType != "" && !matchMIMEType(att.MIMEType, f.MIMEType) {
+		return false
+	}
+	if att.Size <= f.LargerThan {
+		return false
+	}
+	return true
+}
+
+func matchMIMEType(mimeType, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "*"))
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(mimeType, pattern)
+	}
+	return mimeType == pattern
+}
+
+// attachmentsFromBodyStructure returns the list of attachments and the size
+// of the largest non-multipart part.
+func attachmentsFromBodyStructure(bs *imap.BodyStructure) (atts []Attachment, largestPart uint32) {
+	bs.Walk(func(path []int, part *imap.BodyStructure) bool {
+		if len(part.Parts) != 0 {
+			return true
+		}
+		if part.Size > largestPart {
+			largestPart = part.Size
+		}
+
+		filename, _ := part.Filename()
+		if filename == "" && !strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+		atts = append(atts, Attachment{
+			Part:     path,
+			Filename: filename,
+			MIMEType: strings.ToLower(part.MIMEType + "/" + part.MIMESubType),
+			Size:     part.Size,
+		})
+		return true
+	})
+	return atts, largestPart
+}
+
+func parseAttachments(bodyStructBlob []byte) ([]Attachment, uint32, error) {
+	var bs imap.BodyStructure
+	if err := json.Unmarshal(bodyStructBlob, &bs); err != nil {
+		return nil, 0, err
+	}
+	atts, largestPart := attachmentsFromBodyStructure(&bs)
+	return atts, largestPart, nil
+}
+
+// matchAttachmentCriterion checks the value of the pseudo-header criterion
+// against message attachments.
+func matchAttachmentCriterion(key, value string, atts []Attachment, largestPart uint32) bool {
+	switch nettextproto.CanonicalMIMEHeaderKey(key) {
+	case SearchAttachmentName:
+		return matchAnyAttachment(AttachmentFilter{Filename: value}, atts)
+	case SearchAttachmentType:
+		return matchAnyAttachment(AttachmentFilter{MIMEType: value}, atts)
+	case SearchLargestPart:
+		size, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return false
+		}
+		return largestPart > uint32(size)
+	}
+	return false
+}
+
+func matchAnyAttachment(filter AttachmentFilter, atts []Attachment) bool {
+	for _, att := range atts {
+		if filter.Matches(att) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListAttachments returns attachments of messages in the seqset. Messages
+// without attachments are skipped.
+//
+// Only cached body structure is used, message bodies are not read.
+func (m *Mailbox) ListAttachments(uid bool, seqset *imap.SeqSet) ([]MessageAttachments, error) {
+	seqset, err := m.handle.ResolveSeq(uid, seqset)
+	if err != nil {
+		if uid {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var res []MessageAttachments
+	for _, seq := range seqset.Set {
+		rows, err := m.parent.bodyStructUid.Query(m.id, seq.Start, seq.Stop)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "ListAttachments", uid, seqset)
+			return nil, wrapErr(err, "ListAttachments")
+		}
+		res, err = m.parent.scanAttachments(rows, AttachmentFilter{}, m.name, res)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "ListAttachments", uid, seqset)
+			return nil, wrapErr(err, "ListAttachments")
+		}
+	}
+	return res, nil
+}
+
+// FindAttachments returns attachments matching the filter in all mailboxes
+// of the user. Messages without matching attachments are skipped.
+//
+// Only cached body structure is used, message bodies are not read.
+func (u *User) FindAttachments(filter AttachmentFilter) ([]MessageAttachments, error) {
+	rows, err := u.parent.userBodyStructs.Query(u.id)
+	if err != nil {
+		u.parent.logUserErr(u, err, "FindAttachments")
+		return nil, wrapErr(err, "FindAttachments")
+	}
+	res, err := u.parent.scanAttachments(rows, filter, "", nil)
+	if err != nil {
+		u.parent.logUserErr(u, err, "FindAttachments")
+		return nil, wrapErr(err, "FindAttachments")
+	}
+	return res, nil
+}
+
+// scanAttachments reads rows returned by bodyStructUid or userBodyStructs
+// and appends messages with attachments matching the filter to res.
+//
+// If mboxName is empty, rows are expected to contain mailbox name as the
+// first column.
+func (b *Backend) scanAttachments(rows *sql.Rows, filter AttachmentFilter, mboxName string, res []MessageAttachments) ([]MessageAttachments, error) {
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			msg            = MessageAttachments{Mailbox: mboxName}
+			bodyStructBlob []byte
+			err            error
+		)
+		if mboxName == "" {
+			err = rows.Scan(&msg.Mailbox, &msg.UID, &msg.Size, &bodyStructBlob)
+		} else {
+			err = rows.Scan(&msg.UID, &msg.Size, &bodyStructBlob)
+		}
+		if err != nil {
+			return res, err
+		}
+
+		atts, largestPart, err := parseAttachments(bodyStructBlob)
+		if err != nil {
+			b.Opts.Log.Printf("failed to parse body structure of %s/%d, skipping: %v", msg.Mailbox, msg.UID, err)
+			continue
+		}
+		msg.LargestPart = largestPart
+		for _, att := range atts {
+			if filter.Matches(att) {
+				msg.Attachments = append(msg.Attachments, att)
+			}
+		}
+		if len(msg.Attachments) != 0 {
+			res = append(res, msg)
+		}
+	}
+	return res, rows.Err()
+}
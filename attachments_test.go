@@ -0,0 +1,88 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+const testAttachmentMsg = "Subject: Report\r\n" +
+	"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"Report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQKJcOkw7zDtsOfCjIgMCBvYmoKPDwvTGVuZ3RoIDMgMCBSL0ZpbHRlci9GbGF0ZURlY29kZT4+\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: image/png; name=\"logo.png\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--BOUNDARY--\r\n"
+
+func TestAttachments(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usrI, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	usr := usrI.(*User)
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	assert.NilError(t, usr.CreateMailbox("Archive"))
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader("Subject: Plain\r\n\r\nHello!\r\n"), mbox))
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testAttachmentMsg), mbox))
+	assert.NilError(t, usr.CreateMessage("Archive", []string{}, time.Now(), strings.NewReader(testAttachmentMsg), nil))
+	assert.NilError(t, mbox.Poll(true))
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	msgs, err := mbox.ListAttachments(true, seq)
+	assert.NilError(t, err)
+	assert.Equal(t, len(msgs), 1)
+	assert.Equal(t, msgs[0].UID, uint32(2))
+	assert.Equal(t, msgs[0].LargestPart, uint32(84))
+	assert.DeepEqual(t, msgs[0].Attachments, []Attachment{
+		{Part: []int{2}, Filename: "Report.pdf", MIMEType: "application/pdf", Size: 84},
+		{Part: []int{3}, Filename: "logo.png", MIMEType: "image/png", Size: 12},
+	})
+
+	msgs, err = usr.FindAttachments(AttachmentFilter{MIMEType: "image/", LargerThan: 10})
+	assert.NilError(t, err)
+	assert.Equal(t, len(msgs), 2)
+	assert.Equal(t, msgs[0].Mailbox, "Archive")
+	assert.Equal(t, msgs[1].Mailbox, "INBOX")
+	assert.Equal(t, msgs[1].Attachments[0].Filename, "logo.png")
+
+	msgs, err = usr.FindAttachments(AttachmentFilter{MIMEType: "application/pdf", LargerThan: 100})
+	assert.NilError(t, err)
+	assert.Equal(t, len(msgs), 0)
+
+	search := func(crit *imap.SearchCriteria) []uint32 {
+		res, err := mbox.SearchMessages(true, crit)
+		assert.NilError(t, err)
+		return res
+	}
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{SearchAttachmentType: {"application/pdf"}}}), []uint32{2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{"x-imapsql-attachment-name": {"report"}}}), []uint32{2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{SearchLargestPart: {"50"}}}), []uint32{2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{SearchLargestPart: {"100"}}}), []uint32(nil))
+	assert.DeepEqual(t, search(&imap.SearchCriteria{
+		Not: []*imap.SearchCriteria{{Header: map[string][]string{SearchAttachmentType: {"image/"}}}},
+	}), []uint32{1})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{
+		SearchAttachmentType: {"image/"},
+		"Subject":            {"report"},
+	}}), []uint32{2})
+}
@@ -0,0 +1,149 @@
+package imapsql
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Authenticator checks user credentials for Backend.Login.
+type Authenticator interface {
+	// Authenticate checks the credentials and returns the username of the
+	// storage account the user should be logged in as. It can differ from
+	// the login name (e.g. if the directory uses a different naming
+	// scheme).
+	//
+	// backend.ErrInvalidCredentials should be returned if the credentials
+	// are not valid. Other errors are returned from Login as is.
+	Authenticate(connInfo *imap.ConnInfo, username, password string) (string, error)
+}
+
+// AuthenticatorFunc is an adapter to allow use of ordinary functions as
+// Authenticator. It can be used to wrap another Authenticator to map login
+// names to account names.
+type AuthenticatorFunc func(connInfo *imap.ConnInfo, username, password string) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(connInfo *imap.ConnInfo, username, password string) (string, error) {
+	return f(connInfo, username, password)
+}
+
+// HtpasswdAuthenticator checks credentials against the htpasswd-style file
+// with "username:hash" lines. bcrypt ("htpasswd -B") and argon2id (PHC
+// string format) hashes are supported. Lines starting with # are ignored.
+//
+// The file is read again when its modification time changes.
+type HtpasswdAuthenticator struct {
+	Path string
+
+	lock    sync.RWMutex
+	modTime time.Time
+	hashes  map[string]string
+}
+
+// NewHtpasswdAuthenticator loads the file and returns the
+// HtpasswdAuthenticator using it.
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	ha := &HtpasswdAuthenticator{Path: path}
+	if err := ha.Reload(); err != nil {
+		return nil, err
+	}
+	return ha, nil
+}
+
+// Reload reads the file if it was changed since the last load.
+func (ha *HtpasswdAuthenticator) Reload() error {
+	info, err := os.Stat(ha.Path)
+	if err != nil {
+		return err
+	}
+
+	ha.lock.RLock()
+	upToDate := ha.hashes != nil && info.ModTime().Equal(ha.modTime)
+	ha.lock.RUnlock()
+	if upToDate {
+		return nil
+	}
+
+	hashes, err := readHtpasswd(ha.Path)
+	if err != nil {
+		return err
+	}
+
+	ha.lock.Lock()
+	ha.hashes = hashes
+	ha.modTime = info.ModTime()
+	ha.lock.Unlock()
+	return nil
+}
+
+func readHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	scnr := bufio.NewScanner(f)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("imapsql: %s:%d: malformed line", path, lineNum)
+		}
+
+		var hash string
+		switch {
+		case strings.HasPrefix(parts[1], "$2a$"), strings.HasPrefix(parts[1], "$2b$"), strings.HasPrefix(parts[1], "$2y$"):
+			hash = "bcrypt:" + parts[1]
+		case strings.HasPrefix(parts[1], "$argon2id$"):
+			hash = "argon2id:" + parts[1]
+		default:
+			return nil, fmt.Errorf("imapsql: %s:%d: unsupported hash algorithm", path, lineNum)
+		}
+		hashes[normalizeUsername(parts[0])] = hash
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func (ha *HtpasswdAuthenticator) Authenticate(_ *imap.ConnInfo, username, password string) (string, error) {
+	if err := ha.Reload(); err != nil {
+		ha.lock.RLock()
+		loaded := ha.hashes != nil
+		ha.lock.RUnlock()
+		// Keep using the last successfully loaded version.
+		if !loaded {
+			return "", err
+		}
+	}
+	username = normalizeUsername(username)
+
+	ha.lock.RLock()
+	hash, ok := ha.hashes[username]
+	ha.lock.RUnlock()
+	if !ok {
+		verifyDummyPassword(password)
+		return "", backend.ErrInvalidCredentials
+	}
+
+	ok, err := verifyPassword(hash, password)
+	if err != nil || !ok {
+		return "", backend.ErrInvalidCredentials
+	}
+	return username, nil
+}
@@ -0,0 +1,110 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"gotest.tools/assert"
+)
+
+func writeHtpasswd(t *testing.T, path string, modTime time.Time, users map[string]string) {
+	t.Helper()
+	lines := []string{"# comment", ""}
+	for name, pass := range users {
+		algo := "bcrypt"
+		if strings.HasPrefix(name, "argon") {
+			algo = "argon2id"
+		}
+		hash, err := hashPassword(algo, pass)
+		assert.NilError(t, err)
+		lines = append(lines, name+":"+strings.TrimPrefix(hash, algo+":"))
+	}
+	assert.NilError(t, ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600))
+	assert.NilError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-sql-htpasswd-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+
+	writeHtpasswd(t, path, time.Unix(1000, 0), map[string]string{
+		"User":   "secret",
+		"argon2": "secret2",
+	})
+	ha, err := NewHtpasswdAuthenticator(path)
+	assert.NilError(t, err)
+
+	name, err := ha.Authenticate(nil, "user", "secret")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "user")
+	name, err = ha.Authenticate(nil, "argon2", "secret2")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "argon2")
+	_, err = ha.Authenticate(nil, "user", "secret2")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = ha.Authenticate(nil, "nobody", "secret")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	writeHtpasswd(t, path, time.Unix(2000, 0), map[string]string{
+		"user": "changed",
+	})
+	_, err = ha.Authenticate(nil, "user", "secret")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = ha.Authenticate(nil, "user", "changed")
+	assert.NilError(t, err)
+
+	// Broken file does not replace the loaded one.
+	assert.NilError(t, ioutil.WriteFile(path, []byte("user:plaintext\n"), 0600))
+	_, err = ha.Authenticate(nil, "user", "changed")
+	assert.NilError(t, err)
+	_, err = NewHtpasswdAuthenticator(path)
+	assert.Assert(t, err != nil)
+}
+
+func TestLogin_Authenticator(t *testing.T) {
+	b := initTestBackendOpts(Opts{
+		Authenticator: AuthenticatorFunc(func(_ *imap.ConnInfo, username, password string) (string, error) {
+			if password != "directory-pass" {
+				return "", backend.ErrInvalidCredentials
+			}
+			return username + "@example.org", nil
+		}),
+	}).(*Backend)
+	defer cleanBackend(b)
+
+	_, err := b.Login(nil, "user", "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	// Account does not exist.
+	_, err = b.Login(nil, "user", "directory-pass")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	b.Opts.AutoCreateUsers = true
+	u, err := b.Login(nil, "user", "directory-pass")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Username(), "user@example.org")
+
+	b.Opts.AutoCreateUsers = false
+	u, err = b.Login(nil, "user", "directory-pass")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Username(), "user@example.org")
+
+	// Stored password is not used if Authenticator is set.
+	assert.NilError(t, u.(*User).SetPassword("stored-pass"))
+	_, err = b.Login(nil, "user@example.org", "stored-pass")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	// Account name returned by Authenticator is not an alias.
+	b.Opts.LoginAliases = true
+	assert.NilError(t, b.CreateAlias("staff@example.org", "user@example.org", ""))
+	_, err = b.Login(nil, "staff", "directory-pass")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+}
@@ -1,6 +1,7 @@
 package imapsql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -21,7 +22,7 @@ import (
 const VersionStr = "0.4.0"
 
 // SchemaVersion is incremented each time DB schema changes.
-const SchemaVersion = 6
+const SchemaVersion = 10
 
 var (
 	ErrUserAlreadyExists = errors.New("imap: user already exists")
@@ -40,6 +41,45 @@ func (se SerializationError) Error() string {
 	return "imapsql: serialization failure, try again later"
 }
 
+// DeadlineError is returned when the operation is aborted because the
+// passed context.Context is cancelled or its deadline is exceeded.
+type DeadlineError struct {
+	// Operation that was aborted, e.g. "ListMessages".
+	Op  string
+	Err error
+}
+
+func (de DeadlineError) Unwrap() error {
+	return de.Err
+}
+
+func (de DeadlineError) Error() string {
+	if !de.Timeout() {
+		return "imapsql: " + de.Op + ": operation cancelled"
+	}
+	return "imapsql: " + de.Op + ": deadline exceeded"
+}
+
+// Timeout reports whether the deadline was exceeded, it is false if the
+// context was cancelled. It is provided for compatibility with net.Error.
+func (de DeadlineError) Timeout() bool {
+	return errors.Is(de.Err, context.DeadlineExceeded)
+}
+
+// deadlineErr converts context.DeadlineExceeded and context.Canceled errors
+// into DeadlineError. Errors that are already DeadlineError are returned as
+// is, nil is returned for all other errors.
+func deadlineErr(err error, op string) error {
+	var de DeadlineError
+	if errors.As(err, &de) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return DeadlineError{Op: op, Err: err}
+	}
+	return nil
+}
+
 type Rand interface {
 	Uint32() uint32
 }
@@ -102,6 +142,121 @@ type Opts struct {
 	// performance significantly.
 	DisableRecent bool
 
+	// Maintain full-text index of message texts (header fields and text
+	// parts) and use it to speed up SEARCH with BODY, TEXT and HEADER
+	// criteria. Use Reindex to add existing messages to the index.
+	//
+	// SQLite3 index uses FTS5 and requires go-sqlite3 built with sqlite_fts5
+	// tag. PostgreSQL index requires pg_trgm extension, MySQL index uses
+	// ngram parser.
+	FullTextSearch bool
+
+	// Amount of goroutines used to read and match message bodies when
+	// SEARCH criteria can't be checked without them. Bodies are processed
+	// sequentially if it is 0 or 1.
+	//
+	// Increasing it helps when ExternalStore has high latency (e.g. network
+	// storage).
+	SearchWorkers int
+
+	// If non-zero, repeated deliveries of the same message to the same
+	// mailbox within this time window are silently skipped. See
+	// Delivery.IdempotencyKey for how messages are identified.
+	DeliveryDedupWindow time.Duration
+
+	// External search engine used to speed up SEARCH with BODY, TEXT and
+	// HEADER criteria. Changes are recorded in the database and passed to
+	// the index asynchronously, see SearchIndex documentation for details.
+	SearchIndex SearchIndex
+
+	// Interval of SearchIndex updates in addition to updates performed after
+	// each change. Defaults to 1 minute. If negative, changes are not passed
+	// to the index automatically and SyncSearchIndex should be called
+	// instead.
+	SearchIndexInterval time.Duration
+
+	// Amount of bytes of the message body Delivery.BodyRaw keeps in memory,
+	// larger bodies are written to a temporary file in SpoolDir. Default is
+	// DefaultSpoolMemoryLimit. To always use the file, use -1.
+	SpoolMemoryLimit int
+
+	// Directory for temporary files used by Delivery.BodyRaw. Defaults to
+	// os.TempDir().
+	SpoolDir string
+
+	// Characters that separate the username from the subaddress detail in
+	// recipient addresses passed to Delivery.AddRcpt (e.g. "+" for
+	// user+lists@example.org). Any of the characters is recognized as a
+	// separator. If empty, subaddresses are not recognized.
+	//
+	// See User.EnableSubaddressing for how messages are routed.
+	SubaddressSeparator string
+
+	// Password hashing algorithm used for new passwords. Defaults to
+	// "bcrypt", "argon2id" is also supported. Algorithms can be added using
+	// RegisterPassHashAlgo.
+	PassHashAlgo string
+
+	// Used by Login to check user credentials. Defaults to checking
+	// passwords stored in the database (see User.SetPassword).
+	Authenticator Authenticator
+
+	// Resolve aliases (see CreateAlias) in Login so users can log in using
+	// any of their addresses. Catch-all aliases are not used. Account names
+	// returned by Authenticator are not resolved.
+	LoginAliases bool
+
+	// Create user accounts that do not exist on Login.
+	//
+	// If Authenticator is not set, the password used for the first login is
+	// set as the account password. Otherwise, the account is created once
+	// Authenticator accepts the credentials.
+	AutoCreateUsers bool
+
+	// Lock the account for LockoutDuration after this amount of consecutive
+	// failed logins. Locked accounts can not be used to log in even with the
+	// correct password until the lockout expires or Backend.UnlockUser is
+	// called, Login reports them as invalid credentials. Failed logins during
+	// the lockout do not extend it. If zero, accounts are never locked.
+	//
+	// Failed logins are counted for the account with the login name (after
+	// alias resolution, see LoginAliases), names returned by Authenticator
+	// are not used.
+	MaxFailedLogins int
+
+	// How long the account stays locked after MaxFailedLogins failed
+	// logins. Defaults to DefaultLockoutDuration.
+	LockoutDuration time.Duration
+
+	// Hooks called in order for each message added using CreateMessage or
+	// Delivery before it is written to the storage. They can reject the
+	// message, modify its header or set flags on it. See IngestHook.
+	//
+	// If any hooks are set, messages added using CreateMessage are read into
+	// memory before they are processed.
+	IngestHooks []IngestHook
+
+	// Interval of retries for blobs that failed to be deleted from
+	// ExternalStore. Defaults to 1 minute. If negative, failed deletions are
+	// retried only on startup and by ProcessPendingDeletions calls.
+	BlobDeletionInterval time.Duration
+
+	// Keep expunged messages and deleted mailboxes for this long so they can
+	// be restored using User.RestoreMessages and User.RestoreMailbox. Their
+	// blobs are kept in ExternalStore too. If zero, messages are removed
+	// immediately.
+	DeletedRetention time.Duration
+
+	// Interval of checks for messages and mailboxes kept longer than
+	// DeletedRetention. Defaults to 1 hour. If negative, they are purged only
+	// on startup and by PurgeDeleted calls.
+	PurgeInterval time.Duration
+
+	// Interval of checks for messages to be removed according to retention
+	// policies (see SetRetentionPolicy). Defaults to 1 hour. If negative,
+	// policies are applied only by ApplyRetentionPolicies calls.
+	RetentionInterval time.Duration
+
 	Log Logger
 }
 
@@ -119,6 +274,13 @@ type Backend struct {
 	// - CompressAlgoParams
 	// Changes for the following options have no effect after backend initialization:
 	// - CompressAlgo
+	// - FullTextSearch
+	// - SearchIndex
+	// - DeliveryDedupWindow
+	// - SearchIndexInterval
+	// - BlobDeletionInterval
+	// - PurgeInterval
+	// - RetentionInterval
 	// - ExclusiveLock
 	// - CacheSize
 	// - NoWAL
@@ -132,9 +294,12 @@ type Backend struct {
 
 	// Shitton of pre-compiled SQL statements.
 	userMeta           *sql.Stmt
+	userPassHash       *sql.Stmt
+	setUserPassHash    *sql.Stmt
 	listUsers          *sql.Stmt
 	addUser            *sql.Stmt
 	delUser            *sql.Stmt
+	renameUser         *sql.Stmt
 	listMboxes         *sql.Stmt
 	listSubbedMboxes   *sql.Stmt
 	createMboxExistsOk *sql.Stmt
@@ -196,7 +361,34 @@ type Backend struct {
 	setMboxMsgSizeLimit *sql.Stmt
 	mboxMsgSizeLimit    *sql.Stmt
 
-	searchFetchNoSeq *sql.Stmt
+	searchFetchNoSeq    *sql.Stmt
+	searchFetchUidRange *sql.Stmt
+
+	bodyStructUid   *sql.Stmt
+	userBodyStructs *sql.Stmt
+
+	// Full-text index, nil if Opts.FullTextSearch is not set.
+	searchFetchText *sql.Stmt
+	addText         *sql.Stmt
+	addTextContent  *sql.Stmt
+	delText         *sql.Stmt
+	unindexedKeys   *sql.Stmt
+
+	// External search index change log, nil if Opts.SearchIndex is not set.
+	logIndexChange        *sql.Stmt
+	logIndexAddUid        *sql.Stmt
+	logIndexRemoveMarked  *sql.Stmt
+	logIndexRemoveDeleted *sql.Stmt
+	logIndexRemoveExpired *sql.Stmt
+	logIndexRemoveMbox    *sql.Stmt
+	logIndexRemoveUser    *sql.Stmt
+	logIndexAddAll        *sql.Stmt
+	unsequencedIndexLog   *sql.Stmt
+	sequenceIndexLog      *sql.Stmt
+	indexChanges          *sql.Stmt
+	pruneIndexLog         *sql.Stmt
+	indexLag              *sql.Stmt
+	pendingIndexUids      *sql.Stmt
 
 	flagsSearchStmtsLck   sync.RWMutex
 	flagsSearchStmtsCache map[string]*sql.Stmt
@@ -206,6 +398,8 @@ type Backend struct {
 	addFlagsStmtsCache    map[string]*sql.Stmt
 	remFlagsStmtsLck      sync.RWMutex
 	remFlagsStmtsCache    map[string]*sql.Stmt
+	sortStmtsLck          sync.RWMutex
+	sortStmtsCache        map[string]*sql.Stmt
 
 	// extkeys table
 	addExtKey             *sql.Stmt
@@ -230,7 +424,131 @@ type Backend struct {
 
 	cachedHeaderUid *sql.Stmt
 
+	// deliveryKeys table
+	delExpiredDeliveryKey *sql.Stmt
+	addDeliveryKey        *sql.Stmt
+	cleanupDeliveryKeys   *sql.Stmt
+
+	// sieveScripts table
+	getSieveScript *sql.Stmt
+	delSieveScript *sql.Stmt
+	addSieveScript *sql.Stmt
+
+	// aliases table
+	getAlias    *sql.Stmt
+	addAlias    *sql.Stmt
+	delAlias    *sql.Stmt
+	listAliases *sql.Stmt
+
+	// Account status and login lockout
+	setUserStatus     *sql.Stmt
+	userLoginState    *sql.Stmt
+	addFailedLogin    *sql.Stmt
+	lockUser          *sql.Stmt
+	resetFailedLogins *sql.Stmt
+
+	// domains table
+	addDomain             *sql.Stmt
+	delDomain             *sql.Stmt
+	getDomain             *sql.Stmt
+	listDomains           *sql.Stmt
+	setDomainMaxUsers     *sql.Stmt
+	setDomainMsgSizeLimit *sql.Stmt
+	setDomainSuspended    *sql.Stmt
+	linkDomainUsers       *sql.Stmt
+	setUserDomain         *sql.Stmt
+	domainUsers           *sql.Stmt
+	domainUsersCount      *sql.Stmt
+	userDomainId          *sql.Stmt
+	addDomainUser         *sql.Stmt
+	delDomainUser         *sql.Stmt
+	setDomainUsersCount   *sql.Stmt
+	domainMboxStats       *sql.Stmt
+	domainMsgStats        *sql.Stmt
+	delDomainAliases      *sql.Stmt
+
+	// pendingDeletions table
+	addPendingDeletion      *sql.Stmt
+	duePendingDeletions     *sql.Stmt
+	delPendingDeletion      *sql.Stmt
+	delPendingDeletionKey   *sql.Stmt
+	retryPendingDeletion    *sql.Stmt
+	retryPendingDeletionKey *sql.Stmt
+	pendingDeletionsCount   *sql.Stmt
+
+	// deletedMsgs, deletedFlags, deletedMboxes tables
+	tombstoneExpunged      *sql.Stmt
+	tombstoneExpungedFlags *sql.Stmt
+	tombstoneMarked        *sql.Stmt
+	tombstoneMarkedFlags   *sql.Stmt
+	tombstoneMbox          *sql.Stmt
+	tombstoneMboxMsgs      *sql.Stmt
+	tombstoneMboxFlags     *sql.Stmt
+	restoreMsgs            *sql.Stmt
+	restoreFlags           *sql.Stmt
+	delRestoredMsgs        *sql.Stmt
+	deletedMsgsCount       *sql.Stmt
+	getDeletedMbox         *sql.Stmt
+	delDeletedMbox         *sql.Stmt
+	listDeletedMboxes      *sql.Stmt
+	purgeDecreaseRef       *sql.Stmt
+	purgeZeroRef           *sql.Stmt
+	purgeDeleteZeroRef     *sql.Stmt
+	purgeMsgs              *sql.Stmt
+	purgeMboxes            *sql.Stmt
+
+	// retentionPolicies table
+	addRetentionPolicy       *sql.Stmt
+	delRetentionPolicy       *sql.Stmt
+	delUserRetentionPolicies *sql.Stmt
+	listRetentionPolicies    *sql.Stmt
+	allRetentionPolicies     *sql.Stmt
+	retentionMboxes          *sql.Stmt
+	expiredUids              *sql.Stmt
+	tombstoneExpired         *sql.Stmt
+	tombstoneExpiredFlags    *sql.Stmt
+	decreaseRefForExpired    *sql.Stmt
+	delExpired               *sql.Stmt
+
+	// legalHolds table
+	addLegalHold       *sql.Stmt
+	setLegalHoldReason *sql.Stmt
+	delLegalHold       *sql.Stmt
+	isOnLegalHold      *sql.Stmt
+	listLegalHolds     *sql.Stmt
+	domainLegalHolds   *sql.Stmt
+
+	// journal table
+	setJournal    *sql.Stmt
+	delJournal    *sql.Stmt
+	getJournal    *sql.Stmt
+	journalTarget *sql.Stmt
+	addJournalMsg *sql.Stmt
+
+	// subaddressing table
+	getSubaddressing *sql.Stmt
+	delSubaddressing *sql.Stmt
+	addSubaddressing *sql.Stmt
+
 	sqliteOptimizeLoopStop chan struct{}
+
+	// Names of accounts renamed by RenameUser, see User.Username.
+	renamedLck sync.RWMutex
+	renamed    map[uint64]string
+
+	searchIndexLck      sync.Mutex
+	searchIndexNotify   chan struct{}
+	searchIndexLoopStop chan struct{}
+
+	deliveryKeysLoopStop chan struct{}
+
+	pendingDeletionsLck      sync.Mutex
+	pendingDeletionsLoopStop chan struct{}
+
+	purgeLoopStop chan struct{}
+
+	retentionLck      sync.Mutex
+	retentionLoopStop chan struct{}
 }
 
 var defaultPassHashAlgo = "bcrypt"
@@ -248,9 +566,21 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 		flagsSearchStmtsCache: make(map[string]*sql.Stmt),
 		addFlagsStmtsCache:    make(map[string]*sql.Stmt),
 		remFlagsStmtsCache:    make(map[string]*sql.Stmt),
+		sortStmtsCache:        make(map[string]*sql.Stmt),
 
 		sqliteOptimizeLoopStop: make(chan struct{}),
 
+		searchIndexNotify:   make(chan struct{}, 1),
+		searchIndexLoopStop: make(chan struct{}),
+
+		deliveryKeysLoopStop: make(chan struct{}),
+
+		pendingDeletionsLoopStop: make(chan struct{}),
+
+		purgeLoopStop: make(chan struct{}),
+
+		retentionLoopStop: make(chan struct{}),
+
 		extStore: extStore,
 		Opts:     opts,
 
@@ -335,6 +665,30 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 	if b.db.driver == "sqlite3" {
 		go b.sqliteOptimizeLoop()
 	}
+	if b.Opts.SearchIndex != nil && b.Opts.SearchIndexInterval >= 0 {
+		go b.searchIndexLoop()
+	}
+	if b.Opts.DeliveryDedupWindow > 0 {
+		go b.deliveryKeysCleanupLoop()
+	}
+
+	// Finish deletions interrupted by the previous shutdown, including ones
+	// waiting for retry.
+	if _, err := b.db.Exec(`UPDATE pendingDeletions SET nextAttempt = 0`); err != nil {
+		return nil, wrapErr(err, "NewBackend (pendingDeletions)")
+	}
+	b.processPendingDeletions()
+	if b.Opts.BlobDeletionInterval >= 0 {
+		go b.pendingDeletionsLoop()
+	}
+
+	b.purgeExpired()
+	if b.Opts.PurgeInterval >= 0 {
+		go b.purgeLoop()
+	}
+	if b.Opts.RetentionInterval >= 0 {
+		go b.retentionLoop()
+	}
 
 	return b, nil
 }
@@ -359,6 +713,22 @@ func (b *Backend) sqliteOptimizeLoop() {
 }
 
 func (b *Backend) Close() error {
+	if b.Opts.SearchIndex != nil && b.Opts.SearchIndexInterval >= 0 {
+		b.searchIndexLoopStop <- struct{}{}
+	}
+	if b.Opts.DeliveryDedupWindow > 0 {
+		b.deliveryKeysLoopStop <- struct{}{}
+	}
+	if b.Opts.BlobDeletionInterval >= 0 {
+		b.pendingDeletionsLoopStop <- struct{}{}
+	}
+	if b.Opts.PurgeInterval >= 0 {
+		b.purgeLoopStop <- struct{}{}
+	}
+	if b.Opts.RetentionInterval >= 0 {
+		b.retentionLoopStop <- struct{}{}
+	}
+
 	if b.db.driver == "sqlite3" {
 		// These operations are not critical, so it's not a problem if they fail.
 		if b.Opts.MinimizeOnClose {
@@ -373,17 +743,18 @@ func (b *Backend) Close() error {
 	return b.db.Close()
 }
 
-func (b *Backend) getUserMeta(tx *sql.Tx, username string) (id uint64, inboxId uint64, err error) {
+func (b *Backend) getUserMeta(ctx context.Context, tx *sql.Tx, username string) (id uint64, inboxId uint64, status AccountStatus, err error) {
 	var row *sql.Row
 	if tx != nil {
-		row = tx.Stmt(b.userMeta).QueryRow(username)
+		row = tx.Stmt(b.userMeta).QueryRowContext(ctx, username)
 	} else {
-		row = b.userMeta.QueryRow(username)
+		row = b.userMeta.QueryRowContext(ctx, username)
 	}
-	if err := row.Scan(&id, &inboxId); err != nil {
-		return 0, 0, err
+	var domSuspended int
+	if err := row.Scan(&id, &inboxId, &status, &domSuspended); err != nil {
+		return 0, 0, 0, err
 	}
-	return id, inboxId, nil
+	return id, inboxId, effectiveStatus(status, domSuspended), nil
 }
 
 func normalizeUsername(u string) string {
@@ -414,11 +785,18 @@ func (b *Backend) createUser(tx *sql.Tx, username string) (uid, inboxId uint64,
 	}
 
 	// TODO: Cut additional query here by using RETURNING on PostgreSQL.
-	uid, _, err = b.getUserMeta(tx, username)
+	uid, _, _, err = b.getUserMeta(context.Background(), tx, username)
 	if err != nil {
 		return 0, 0, wrapErr(err, "CreateUser")
 	}
 
+	if err := b.linkUserDomain(context.Background(), tx, uid, username, true); err != nil {
+		if err == ErrDomainFull {
+			return 0, 0, err
+		}
+		return 0, 0, wrapErr(err, "CreateUser")
+	}
+
 	// Every new user needs to have at least one mailbox (INBOX).
 	if _, err := tx.Stmt(b.createMbox).Exec(uid, "INBOX", b.prng.Uint32(), nil); err != nil {
 		return 0, 0, wrapErr(err, "CreateUser")
@@ -442,51 +820,223 @@ func (b *Backend) createUser(tx *sql.Tx, username string) (uid, inboxId uint64,
 //
 // It is error to delete account that doesn't exist, ErrUserDoesntExists will
 // be returned in this case.
+//
+// Accounts on legal hold are not deleted, their status is set to
+// StatusPendingDeletion instead.
 func (b *Backend) DeleteUser(username string) error {
+	return b.DeleteUserContext(context.Background(), username)
+}
+
+// DeleteUserContext is a variant of DeleteUser that aborts the transaction
+// once ctx is cancelled.
+func (b *Backend) DeleteUserContext(ctx context.Context, username string) error {
 	username = strings.ToLower(username)
 
-	tx, err := b.db.BeginLevel(sql.LevelReadCommitted, false)
+	tx, err := b.db.BeginLevelContext(ctx, sql.LevelReadCommitted, false)
 	if err != nil {
 		return wrapErr(err, "DeleteUser")
 	}
 	defer tx.Rollback()
 
+	uid, _, _, err := b.getUserMeta(ctx, tx, username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "DeleteUser")
+	}
+	held, err := b.onLegalHold(ctx, tx, uid)
+	if err != nil {
+		return wrapErr(err, "DeleteUser")
+	}
+	if held {
+		if _, err := tx.Stmt(b.setUserStatus).ExecContext(ctx, StatusPendingDeletion, username); err != nil {
+			return wrapErr(err, "DeleteUser")
+		}
+		b.Opts.Log.Printf("DeleteUser: %s is on legal hold, marked for deletion instead", username)
+		return wrapErr(tx.Commit(), "DeleteUser")
+	}
+
+	keys, err := b.deleteUser(ctx, tx, uid, username)
+	if err != nil {
+		if err == ErrUserDoesntExists {
+			return err
+		}
+		return wrapErr(err, "DeleteUser")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.searchIndexChanged()
+	b.deleteQueuedBlobs(keys)
+	return nil
+}
+
+// deleteUser deletes the account in the transaction and returns keys of
+// blobs queued for deletion. Legal hold is not checked.
+func (b *Backend) deleteUser(ctx context.Context, tx *sql.Tx, uid uint64, username string) ([]string, error) {
 	// TODO: These queries definitely can be merged on PostgreSQL.
 	var keys []string
-	rows, err := tx.Stmt(b.refUser).Query(username)
+	rows, err := tx.Stmt(b.refUser).QueryContext(ctx, username)
 	if err != nil {
-		return wrapErr(err, "DeleteUser")
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var key string
 		if err := rows.Scan(&key); err != nil {
-			return wrapErr(err, "DeleteUser")
+			return nil, err
 		}
 		keys = append(keys, key)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := b.logIndex(ctx, tx, b.logIndexRemoveUser, username); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Stmt(b.delUserRetentionPolicies).ExecContext(ctx, username); err != nil {
+		return nil, err
+	}
+
+	var domId sql.NullInt64
+	if err := tx.Stmt(b.userDomainId).QueryRowContext(ctx, uid).Scan(&domId); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserDoesntExists
+		}
+		return nil, err
+	}
+	if domId.Valid {
+		if _, err := tx.Stmt(b.delDomainUser).ExecContext(ctx, domId.Int64); err != nil {
+			return nil, err
+		}
+	}
 
-	stats, err := tx.Stmt(b.delUser).Exec(username)
+	stats, err := tx.Stmt(b.delUser).ExecContext(ctx, username)
 	if err != nil {
-		return wrapErr(err, "DeleteUser")
+		return nil, err
 	}
 	affected, err := stats.RowsAffected()
 	if err != nil {
-		return wrapErr(err, "DeleteUser")
+		return nil, err
 	}
 	if affected == 0 {
-		return ErrUserDoesntExists
+		return nil, ErrUserDoesntExists
 	}
 
-	if err := b.extStore.Delete(keys); err != nil {
-		return wrapErr(err, "DeleteUser")
+	if err := b.queueBlobDeletion(ctx, tx, keys); err != nil {
+		return nil, err
 	}
 
-	if _, err := tx.Stmt(b.deleteUserRef).Exec(username); err != nil {
-		return wrapErr(err, "DeleteUser")
+	if _, err := tx.Stmt(b.deleteUserRef).ExecContext(ctx, username); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RenameUser changes the username of the account. All account data is kept
+// as is.
+//
+// ErrUserDoesntExists is returned if there is no account with oldName,
+// ErrUserAlreadyExists is returned if there is an account with newName.
+// The account is moved to the domain of newName, ErrDomainFull is returned
+// if it has the maximum amount of accounts.
+// Alias with newName pointing to the same account is removed, if it points to
+// a different account, ErrAliasAlreadyExists is returned. If keepAlias is
+// set, oldName is added as the alias for the account so messages for it are
+// still delivered.
+//
+// Sessions of the user are not interrupted since all data is referenced by the
+// account ID. User objects (and mailboxes opened using them) created before
+// the rename return newName from Username once RenameUser returns.
+func (b *Backend) RenameUser(oldName, newName string, keepAlias bool) error {
+	oldName = normalizeUsername(oldName)
+	newName = normalizeUsername(newName)
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "RenameUser")
 	}
+	defer tx.Rollback()
 
-	return tx.Commit()
+	uid, _, _, err := b.getUserMeta(context.Background(), tx, oldName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "RenameUser")
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, _, _, err := b.getUserMeta(context.Background(), tx, newName); err != sql.ErrNoRows {
+		if err == nil {
+			return ErrUserAlreadyExists
+		}
+		return wrapErr(err, "RenameUser")
+	}
+
+	alias, err := scanAlias(tx.Stmt(b.getAlias).QueryRow(newName))
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return wrapErr(err, "RenameUser")
+	case alias.uid != uid:
+		return ErrAliasAlreadyExists
+	default:
+		if _, err := tx.Stmt(b.delAlias).Exec(newName); err != nil {
+			return wrapErr(err, "RenameUser")
+		}
+	}
+
+	if _, err := tx.Stmt(b.renameUser).Exec(newName, uid); err != nil {
+		if isForeignKeyErr(err) {
+			return ErrUserAlreadyExists
+		}
+		return wrapErr(err, "RenameUser")
+	}
+	if err := b.linkUserDomain(context.Background(), tx, uid, newName, false); err != nil {
+		if err == ErrDomainFull {
+			return err
+		}
+		return wrapErr(err, "RenameUser")
+	}
+
+	if keepAlias {
+		if _, err := tx.Stmt(b.addAlias).Exec(oldName, uid, sql.NullString{}); err != nil {
+			if isForeignKeyErr(err) {
+				return ErrAliasAlreadyExists
+			}
+			return wrapErr(err, "RenameUser")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return wrapErr(err, "RenameUser")
+	}
+
+	b.renamedLck.Lock()
+	defer b.renamedLck.Unlock()
+	if b.renamed == nil {
+		b.renamed = make(map[uint64]string)
+	}
+	b.renamed[uid] = newName
+	return nil
+}
+
+// currentUsername returns the name of the account with the specified ID
+// if it was renamed by RenameUser, name is returned otherwise.
+func (b *Backend) currentUsername(uid uint64, name string) string {
+	b.renamedLck.RLock()
+	defer b.renamedLck.RUnlock()
+	if renamed, ok := b.renamed[uid]; ok {
+		return renamed
+	}
+	return name
 }
 
 // ListUsers returns list of existing usernames.
@@ -513,17 +1063,29 @@ func (b *Backend) ListUsers() ([]string, error) {
 }
 
 // GetUser creates backend.User object for the user credentials.
+//
+// ErrAccountSuspended or ErrAccountPendingDeletion is returned if the account
+// can not be used, see SetUserStatus.
 func (b *Backend) GetUser(username string) (backend.User, error) {
+	return b.GetUserContext(context.Background(), username)
+}
+
+// GetUserContext is a variant of GetUser that aborts the database query once
+// ctx is cancelled.
+func (b *Backend) GetUserContext(ctx context.Context, username string) (backend.User, error) {
 	username = normalizeUsername(username)
 
-	uid, inboxId, err := b.getUserMeta(nil, username)
+	uid, inboxId, status, err := b.getUserMeta(ctx, nil, username)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrUserDoesntExists
 		}
+		return nil, wrapErr(err, "GetUser")
+	}
+	if err := status.statusErr(); err != nil {
 		return nil, err
 	}
-	return &User{id: uid, username: username, parent: b, inboxId: inboxId}, nil
+	return &User{id: uid, username: username, parent: b, inboxId: inboxId, status: status}, nil
 }
 
 // GetOrCreateUser is a convenience wrapper for GetUser and CreateUser.
@@ -531,15 +1093,21 @@ func (b *Backend) GetUser(username string) (backend.User, error) {
 // All database operations are executed within one transaction so
 // this method is atomic as defined by used RDBMS.
 func (b *Backend) GetOrCreateUser(username string) (backend.User, error) {
+	return b.GetOrCreateUserContext(context.Background(), username)
+}
+
+// GetOrCreateUserContext is a variant of GetOrCreateUser that aborts the
+// transaction once ctx is cancelled.
+func (b *Backend) GetOrCreateUserContext(ctx context.Context, username string) (backend.User, error) {
 	username = normalizeUsername(username)
 
-	tx, err := b.db.Begin(false)
+	tx, err := b.db.BeginContext(ctx, false)
 	if err != nil {
-		return nil, err
+		return nil, wrapErr(err, "GetOrCreateUser")
 	}
 	defer tx.Rollback()
 
-	uid, inboxId, err := b.getUserMeta(tx, username)
+	uid, inboxId, status, err := b.getUserMeta(ctx, tx, username)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			b.Opts.Log.Println("auto-creating storage account", username)
@@ -550,15 +1118,137 @@ func (b *Backend) GetOrCreateUser(username string) (backend.User, error) {
 			return nil, err
 		}
 	}
-	return &User{id: uid, username: username, parent: b, inboxId: inboxId}, tx.Commit()
+	if err := status.statusErr(); err != nil {
+		return nil, err
+	}
+	return &User{id: uid, username: username, parent: b, inboxId: inboxId, status: status}, tx.Commit()
 }
 
-func (b *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+// Login authenticates the user using Opts.Authenticator (stored password
+// hashes by default) and returns the account of the user.
+//
+// backend.ErrInvalidCredentials is returned if the credentials are not
+// valid or the account does not exist. See Opts.AutoCreateUsers for handling
+// of non-existent accounts.
+//
+// backend.ErrInvalidCredentials is also returned for accounts locked after
+// Opts.MaxFailedLogins failed logins, even if the password is correct, so the
+// lockout can not be told apart from a wrong password. Use UserState to check
+// the lockout. Errors from GetUser are returned for accounts that can not be
+// used.
+func (b *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	auth := b.Opts.Authenticator
+	if auth == nil {
+		auth = b
+	}
+
+	var (
+		lockUid      uint64
+		failedLogins int
+		locked       bool
+	)
+	if b.Opts.MaxFailedLogins > 0 {
+		loginName, err := b.loginAccount(username)
+		if err != nil {
+			return nil, err
+		}
+		lockUid, failedLogins, locked, err = b.loginState(loginName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Credentials are checked for locked accounts too so they take the same
+	// time to reject.
+	accountName, err := auth.Authenticate(connInfo, username, password)
+	if err == nil && locked {
+		b.Opts.Log.Printf("Login: %s is locked", username)
+		return nil, backend.ErrInvalidCredentials
+	}
+	if err != nil {
+		if err == backend.ErrInvalidCredentials && !locked {
+			b.recordFailedLogin(lockUid)
+		}
+		if err == backend.ErrInvalidCredentials && auth == Authenticator(b) && b.Opts.AutoCreateUsers && password != "" {
+			accountName, err := b.loginAccount(username)
+			if err != nil {
+				return nil, err
+			}
+			if _, _, _, err := b.getUserMeta(context.Background(), nil, accountName); err == sql.ErrNoRows {
+				return b.loginAutoCreate(accountName, password)
+			}
+		}
+		return nil, err
+	}
+
+	// Aliases are resolved by Authenticate for the built-in password check,
+	// names returned by Opts.Authenticator are used as is.
+	u, err := b.GetUser(accountName)
+	if err == ErrUserDoesntExists {
+		if !b.Opts.AutoCreateUsers {
+			b.Opts.Log.Printf("Login: %s is authenticated as %s, but the account does not exist", username, accountName)
+			return nil, backend.ErrInvalidCredentials
+		}
+		u, err = b.GetOrCreateUser(accountName)
+		if err == nil {
+			b.Opts.Log.Debugln(accountName, "created on login")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if failedLogins != 0 {
+		if _, err := b.resetFailedLogins.Exec(lockUid); err != nil {
+			b.Opts.Log.Printf("Login: failed to reset failed logins counter: %v", err)
+		}
+	}
+
+	b.Opts.Log.Debugln(username, "logged in as", u.Username())
+	return u, nil
+}
+
+// Authenticate checks the password against the hash stored for the user
+// account. It is the default Authenticator used if Opts.Authenticator is not
+// set.
+func (b *Backend) Authenticate(_ *imap.ConnInfo, username, password string) (string, error) {
+	username, err := b.loginAccount(username)
+	if err != nil {
+		return "", err
+	}
+
+	var passHash sql.NullString
+	err = b.userPassHash.QueryRow(username).Scan(&passHash)
+	if err != nil && err != sql.ErrNoRows {
+		return "", wrapErr(err, "Authenticate")
+	}
+
+	if !passHash.Valid {
+		// Spend the same time as for the existing account so it can not be
+		// told whether the account exists.
+		verifyDummyPassword(password)
+		return "", backend.ErrInvalidCredentials
+	}
+	ok, err := verifyPassword(passHash.String, password)
+	if err != nil {
+		b.Opts.Log.Printf("Authenticate: cannot verify password of %s: %v", username, err)
+		return "", backend.ErrInvalidCredentials
+	}
+	if !ok {
+		return "", backend.ErrInvalidCredentials
+	}
+	return username, nil
+}
+
+func (b *Backend) loginAutoCreate(username, password string) (backend.User, error) {
 	u, err := b.GetOrCreateUser(username)
 	if err != nil {
 		return nil, err
 	}
-	b.Opts.Log.Debugln(username, "logged in")
+	if err := u.(*User).SetPassword(password); err != nil {
+		return nil, err
+	}
+	b.Opts.Log.Debugln(username, "created on login")
 	return u, nil
 }
 
@@ -0,0 +1,273 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// Blobs of removed messages are not deleted from ExternalStore directly.
+// Instead, their keys are added to the pendingDeletions table in the same
+// transaction that removes the rows referencing them and are deleted after
+// the transaction is committed. Failed deletions are retried later, so the
+// store may keep unreferenced blobs for a while, but blobs referenced by
+// the database are never deleted.
+
+const (
+	pendingDeletionsBatch = 100
+
+	// Maximum delay between retries of the failed deletion.
+	maxDeletionBackoff = time.Hour
+)
+
+func (b *Backend) initPendingDeletions() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS pendingDeletions (
+			id BIGSERIAL NOT NULL PRIMARY KEY AUTOINCREMENT,
+			extKey VARCHAR(255) NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			nextAttempt BIGINT NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table pendingDeletions")
+	}
+	return nil
+}
+
+func (b *Backend) preparePendingDeletionsStmts() error {
+	var err error
+	b.addPendingDeletion, err = b.db.Prepare(`
+		INSERT INTO pendingDeletions(extKey)
+		VALUES (?)`)
+	if err != nil {
+		return wrapErr(err, "addPendingDeletion prep")
+	}
+	b.duePendingDeletions, err = b.db.Prepare(`
+		SELECT id, extKey, attempts
+		FROM pendingDeletions
+		WHERE nextAttempt <= ?
+		ORDER BY id
+		LIMIT ` + strconv.Itoa(pendingDeletionsBatch))
+	if err != nil {
+		return wrapErr(err, "duePendingDeletions prep")
+	}
+	b.delPendingDeletion, err = b.db.Prepare(`
+		DELETE FROM pendingDeletions
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "delPendingDeletion prep")
+	}
+	b.delPendingDeletionKey, err = b.db.Prepare(`
+		DELETE FROM pendingDeletions
+		WHERE extKey = ?`)
+	if err != nil {
+		return wrapErr(err, "delPendingDeletionKey prep")
+	}
+	b.retryPendingDeletion, err = b.db.Prepare(`
+		UPDATE pendingDeletions
+		SET attempts = attempts + 1, nextAttempt = ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "retryPendingDeletion prep")
+	}
+	b.retryPendingDeletionKey, err = b.db.Prepare(`
+		UPDATE pendingDeletions
+		SET attempts = attempts + 1, nextAttempt = ?
+		WHERE extKey = ?`)
+	if err != nil {
+		return wrapErr(err, "retryPendingDeletionKey prep")
+	}
+	b.pendingDeletionsCount, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM pendingDeletions`)
+	if err != nil {
+		return wrapErr(err, "pendingDeletionsCount prep")
+	}
+	return nil
+}
+
+// queueBlobDeletion records keys for deletion from ExternalStore. Call
+// deleteQueuedBlobs with the same keys after the transaction is committed.
+func (b *Backend) queueBlobDeletion(ctx context.Context, tx *sql.Tx, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	stmt := tx.Stmt(b.addPendingDeletion)
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if _, err := stmt.ExecContext(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteQueuedBlobs deletes blobs queued by queueBlobDeletion. It should be
+// called after the transaction that queued them is committed. Only the
+// passed keys are deleted so the caller does not wait for the blobs queued
+// by others. Failures are logged and deletion is retried later by
+// ProcessPendingDeletions.
+func (b *Backend) deleteQueuedBlobs(keys []string) {
+	nonEmpty := keys[:0:0]
+	for _, key := range keys {
+		if key != "" {
+			nonEmpty = append(nonEmpty, key)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return
+	}
+
+	if err := b.extStore.Delete(nonEmpty); err != nil {
+		b.Opts.Log.Printf("failed to delete blobs, retrying in %v: %v", time.Minute, err)
+		for _, key := range nonEmpty {
+			if _, err := b.retryPendingDeletionKey.Exec(time.Now().Add(time.Minute).Unix(), key); err != nil {
+				b.Opts.Log.Printf("failed to reschedule deletion of blob %s: %v", key, err)
+				return
+			}
+		}
+		return
+	}
+	for _, key := range nonEmpty {
+		if _, err := b.delPendingDeletionKey.Exec(key); err != nil {
+			b.Opts.Log.Printf("failed to remove blob %s from deletion queue: %v", key, err)
+			return
+		}
+	}
+}
+
+// processPendingDeletions calls ProcessPendingDeletions and logs the error.
+func (b *Backend) processPendingDeletions() {
+	if _, err := b.ProcessPendingDeletions(); err != nil {
+		b.Opts.Log.Printf("%v", err)
+	}
+}
+
+type pendingDeletion struct {
+	id       uint64
+	key      string
+	attempts int
+}
+
+// ProcessPendingDeletions deletes blobs of removed messages from the
+// ExternalStore and returns the amount of deleted blobs. Blobs that failed to
+// be deleted recently are skipped.
+//
+// It is called on startup and, unless Opts.BlobDeletionInterval is negative,
+// periodically in background.
+func (b *Backend) ProcessPendingDeletions() (int, error) {
+	b.pendingDeletionsLck.Lock()
+	defer b.pendingDeletionsLck.Unlock()
+
+	total := 0
+	for {
+		batch, err := b.duePendingDeletionsBatch()
+		if err != nil {
+			return total, wrapErr(err, "ProcessPendingDeletions")
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		deleted, err := b.deletePendingBatch(batch)
+		total += deleted
+		if err != nil {
+			return total, wrapErr(err, "ProcessPendingDeletions")
+		}
+		if len(batch) < pendingDeletionsBatch {
+			return total, nil
+		}
+	}
+}
+
+func (b *Backend) duePendingDeletionsBatch() ([]pendingDeletion, error) {
+	rows, err := b.duePendingDeletions.Query(time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []pendingDeletion
+	for rows.Next() {
+		var pd pendingDeletion
+		if err := rows.Scan(&pd.id, &pd.key, &pd.attempts); err != nil {
+			return nil, err
+		}
+		batch = append(batch, pd)
+	}
+	return batch, rows.Err()
+}
+
+// deletePendingBatch deletes the blobs and removes them from the queue. If
+// the store fails to delete the whole batch, blobs are deleted one by one
+// and failed ones are rescheduled.
+func (b *Backend) deletePendingBatch(batch []pendingDeletion) (int, error) {
+	keys := make([]string, 0, len(batch))
+	for _, pd := range batch {
+		keys = append(keys, pd.key)
+	}
+
+	if err := b.extStore.Delete(keys); err == nil {
+		for _, pd := range batch {
+			if _, err := b.delPendingDeletion.Exec(pd.id); err != nil {
+				return 0, err
+			}
+		}
+		return len(batch), nil
+	}
+
+	deleted := 0
+	var lastErr error
+	for _, pd := range batch {
+		if err := b.extStore.Delete([]string{pd.key}); err != nil {
+			backoff := time.Minute << uint(pd.attempts)
+			if backoff > maxDeletionBackoff || backoff <= 0 {
+				backoff = maxDeletionBackoff
+			}
+			b.Opts.Log.Printf("failed to delete blob %s (attempt %d), retrying in %v: %v", pd.key, pd.attempts+1, backoff, err)
+			if _, err := b.retryPendingDeletion.Exec(time.Now().Add(backoff).Unix(), pd.id); err != nil {
+				return deleted, err
+			}
+			lastErr = err
+			continue
+		}
+		if _, err := b.delPendingDeletion.Exec(pd.id); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	// Stop if the store seems to be unavailable.
+	if lastErr != nil && deleted == 0 {
+		return 0, lastErr
+	}
+	return deleted, nil
+}
+
+// PendingDeletions returns the amount of blobs waiting to be deleted.
+func (b *Backend) PendingDeletions() (int, error) {
+	var count int
+	if err := b.pendingDeletionsCount.QueryRow().Scan(&count); err != nil {
+		return 0, wrapErr(err, "PendingDeletions")
+	}
+	return count, nil
+}
+
+func (b *Backend) pendingDeletionsLoop() {
+	interval := b.Opts.BlobDeletionInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.processPendingDeletions()
+		case <-b.pendingDeletionsLoopStop:
+			return
+		}
+	}
+}
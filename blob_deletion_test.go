@@ -0,0 +1,120 @@
+package imapsql
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+type failingDeleteStore struct {
+	ExternalStore
+	fail bool
+}
+
+func (s *failingDeleteStore) Delete(keys []string) error {
+	if s.fail {
+		return errors.New("store is down")
+	}
+	return s.ExternalStore.Delete(keys)
+}
+
+func TestPendingDeletions(t *testing.T) {
+	b := initTestBackendOpts(Opts{BlobDeletionInterval: -1}).(*Backend)
+	fsStore := b.extStore
+	defer func() {
+		b.extStore = fsStore
+		cleanBackend(b)
+	}()
+	store := &failingDeleteStore{ExternalStore: fsStore}
+	b.extStore = store
+
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox("Box"))
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, usr.CreateMessage("Box", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	store.fail = true
+	_, mbox, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	assert.NilError(t, mbox.Expunge())
+	assert.NilError(t, mbox.Close())
+	assert.NilError(t, usr.DeleteMailbox("Box"))
+
+	// Blobs are kept until the store is available again.
+	files, err := ioutil.ReadDir(fsStore.(*FSStore).Root)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 2)
+	pending, err := b.PendingDeletions()
+	assert.NilError(t, err)
+	assert.Equal(t, pending, 2)
+
+	// Removal deletes only its own blobs, others wait for the retry.
+	store.fail = false
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	_, mbox, err = usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	assert.NilError(t, mbox.Expunge())
+	assert.NilError(t, mbox.Close())
+	files, err = ioutil.ReadDir(fsStore.(*FSStore).Root)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 2)
+	pending, err = b.PendingDeletions()
+	assert.NilError(t, err)
+	assert.Equal(t, pending, 2)
+
+	// Failed deletions are not retried immediately.
+	deleted, err := b.ProcessPendingDeletions()
+	assert.NilError(t, err)
+	assert.Equal(t, deleted, 0)
+
+	_, err = b.DB.Exec(`UPDATE pendingDeletions SET nextAttempt = 0`)
+	assert.NilError(t, err)
+	deleted, err = b.ProcessPendingDeletions()
+	assert.NilError(t, err)
+	assert.Equal(t, deleted, 2)
+	files, err = ioutil.ReadDir(fsStore.(*FSStore).Root)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 0)
+}
+
+func TestPendingDeletions_Startup(t *testing.T) {
+	if TestDB != "" && TestDB != "sqlite3" {
+		t.Skip("Test reopens SQLite database")
+	}
+
+	dir, err := ioutil.TempDir("", "go-imap-sql-tests-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "test.db")
+	fsStore := &FSStore{Root: filepath.Join(dir, "store")}
+	assert.NilError(t, os.MkdirAll(fsStore.Root, os.ModePerm))
+	store := &failingDeleteStore{ExternalStore: fsStore}
+
+	b, err := New("sqlite3", dsn, store, Opts{Log: DummyLogger{}, BlobDeletionInterval: -1})
+	assert.NilError(t, err)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	store.fail = true
+	assert.NilError(t, b.DeleteUser(t.Name()))
+	assert.NilError(t, b.Close())
+
+	// All pending deletions are retried on startup.
+	b, err = New("sqlite3", dsn, fsStore, Opts{Log: DummyLogger{}, BlobDeletionInterval: -1})
+	assert.NilError(t, err)
+	defer b.Close()
+	pending, err := b.PendingDeletions()
+	assert.NilError(t, err)
+	assert.Equal(t, pending, 0)
+	assert.Assert(t, checkKeysCount(b, 0))
+}
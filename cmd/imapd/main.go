@@ -36,7 +36,7 @@ func (s stdLogger) Debugln(v ...interface{}) {
 
 func main() {
 	if len(os.Args) < 5 {
-		fmt.Fprintf(os.Stderr, "imapd - Dumb IMAP4rev1 server providing unauthenticated access a go-imap-sql db\n")
+		fmt.Fprintf(os.Stderr, "imapd - Dumb IMAP4rev1 server providing access to a go-imap-sql db\n")
 		fmt.Fprintf(os.Stderr, "Usage: %s <endpoint> <driver> <dsn> <fsstore>\n", os.Args[0])
 		os.Exit(2)
 	}
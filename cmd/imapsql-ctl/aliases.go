@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+func aliasesList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	list, err := backend.ListAliases()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No aliases.")
+	}
+
+	for _, alias := range list {
+		if alias.Mailbox != "" {
+			fmt.Printf("%s -> %s (%s)\n", alias.Alias, alias.Username, alias.Mailbox)
+		} else {
+			fmt.Printf("%s -> %s\n", alias.Alias, alias.Username)
+		}
+	}
+	return nil
+}
+
+func aliasesAdd(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	alias := ctx.Args().First()
+	if alias == "" {
+		return errors.New("Error: ALIAS is required")
+	}
+	username := ctx.Args().Get(1)
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	return backend.CreateAlias(alias, username, ctx.String("mailbox"))
+}
+
+func aliasesRemove(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	alias := ctx.Args().First()
+	if alias == "" {
+		return errors.New("Error: ALIAS is required")
+	}
+
+	return backend.DeleteAlias(alias)
+}
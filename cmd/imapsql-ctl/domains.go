@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+func domainsList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	list, err := backend.ListDomains()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No domains.")
+	}
+
+	for _, dom := range list {
+		if dom.Suspended {
+			fmt.Println(dom.Name, "(suspended)")
+		} else {
+			fmt.Println(dom.Name)
+		}
+	}
+	return nil
+}
+
+func domainsCreate(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	name := ctx.Args().First()
+	if name == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+
+	return backend.CreateDomain(name)
+}
+
+func domainsRemove(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("unsafe") {
+		return errors.New("Error: Refusing to edit user accounts without --unsafe")
+	}
+
+	name := ctx.Args().First()
+	if name == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+
+	users, err := backend.ListDomainUsers(name)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("yes") {
+		q := fmt.Sprintf("Are you sure you want to delete this domain and %d user accounts in it?", len(users))
+		if !Confirmation(q, false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return backend.DeleteDomain(name)
+}
+
+func domainsInfo(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	name := ctx.Args().First()
+	if name == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+
+	dom, err := backend.GetDomain(name)
+	if err != nil {
+		return err
+	}
+	stats, err := backend.GetDomainStats(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Suspended:", dom.Suspended)
+	if dom.MaxUsers != 0 {
+		fmt.Printf("Accounts: %d (max %d)\n", stats.Users, dom.MaxUsers)
+	} else {
+		fmt.Println("Accounts:", stats.Users)
+	}
+	if dom.MessageLimit != nil {
+		fmt.Println("Default APPENDLIMIT:", *dom.MessageLimit)
+	}
+	if dom.CatchAll != "" {
+		fmt.Println("Catch-all:", dom.CatchAll)
+	}
+	fmt.Println("Mailboxes:", stats.Mailboxes)
+	fmt.Println("Messages:", stats.Messages)
+	fmt.Println("Total size:", stats.Bytes)
+	return nil
+}
+
+func domainsUsers(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	name := ctx.Args().First()
+	if name == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+
+	list, err := backend.ListDomainUsers(name)
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No users.")
+	}
+
+	for _, user := range list {
+		fmt.Println(user)
+	}
+	return nil
+}
+
+func domainsSet(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	name := ctx.Args().First()
+	if name == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+
+	if ctx.IsSet("max-users") {
+		if err := backend.SetDomainMaxUsers(name, ctx.Int("max-users")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("appendlimit") {
+		var val *uint32
+		if limit := ctx.Int("appendlimit"); limit >= 0 {
+			v := uint32(limit)
+			val = &v
+		}
+		if err := backend.SetDomainMessageLimit(name, val); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("catch-all") {
+		if err := backend.SetDomainCatchAll(name, ctx.String("catch-all")); err != nil {
+			return err
+		}
+	}
+	switch {
+	case ctx.Bool("suspend"):
+		return backend.SetDomainSuspended(name, true)
+	case ctx.Bool("unsuspend"):
+		return backend.SetDomainSuspended(name, false)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func holdList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	holds, err := backend.LegalHolds()
+	if err != nil {
+		return err
+	}
+
+	if len(holds) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No accounts on legal hold.")
+	}
+
+	for _, hold := range holds {
+		fmt.Printf("%s\tsince %v\t%s\n", hold.Username, hold.Since.Format(time.RFC3339), hold.Reason)
+	}
+	return nil
+}
+
+func holdSet(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	return backend.SetLegalHold(username, ctx.String("reason"))
+}
+
+func holdRelease(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	return backend.ReleaseLegalHold(username)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+func journalShow(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username, mailbox, err := backend.Journal()
+	if err != nil {
+		return err
+	}
+
+	if username == "" {
+		if !ctx.GlobalBool("quiet") {
+			fmt.Fprintln(os.Stderr, "Journaling is disabled.")
+		}
+		return nil
+	}
+	fmt.Printf("%s\t%s\n", username, mailbox)
+	return nil
+}
+
+func journalSet(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	mailbox := ctx.Args().Get(1)
+	if mailbox == "" {
+		return errors.New("Error: MAILBOX is required")
+	}
+
+	return backend.SetJournal(username, mailbox)
+}
+
+func journalDisable(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	return backend.DisableJournal()
+}
@@ -34,6 +34,10 @@ func connectToDB(ctx *cli.Context) error {
 
 	opts := imapsql.Opts{}
 	opts.NoWAL = ctx.GlobalIsSet("no-wal")
+	opts.FullTextSearch = ctx.GlobalBool("full-text-search")
+	opts.DeletedRetention = ctx.GlobalDuration("keep-deleted")
+	opts.PurgeInterval = -1
+	opts.RetentionInterval = -1
 
 	var err error
 	backend, err = imapsql.New(driver, dsn, &imapsql.FSStore{Root: fsstore}, opts)
@@ -93,6 +97,16 @@ func main() {
 			Usage:  "Use fsstore with specified directory",
 			EnvVar: "IMAPSQL_FSSTORE",
 		},
+		cli.BoolFlag{
+			Name:   "full-text-search",
+			Usage:  "Add new messages to the full-text index",
+			EnvVar: "IMAPSQL_FULL_TEXT_SEARCH",
+		},
+		cli.DurationFlag{
+			Name:   "keep-deleted",
+			Usage:  "Keep removed messages and mailboxes for the specified time so they can be restored\n\t\tShould match the server configuration",
+			EnvVar: "IMAPSQL_KEEP_DELETED",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -127,7 +141,7 @@ func main() {
 				{
 					Name:        "remove",
 					Usage:       "Remove mailbox (requires --unsafe)",
-					Description: "WARNING: All contents of mailbox will be irrecoverably lost.",
+					Description: "WARNING: All contents of mailbox will be irrecoverably lost unless --keep-deleted is used.",
 					ArgsUsage:   "USERNAME MAILBOX",
 					Flags: []cli.Flag{
 						cli.BoolFlag{
@@ -290,6 +304,132 @@ func main() {
 					},
 					Action: msgsDump,
 				},
+				{
+					Name:        "attachments",
+					Usage:       "List message attachments",
+					Description: "If MAILBOX is not specified - all mailboxes of the user are searched. Output columns are: mailbox, UID, part, size (in bytes, encoded), MIME type and filename.",
+					ArgsUsage:   "USERNAME [MAILBOX [SEQSET]]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "uid,u",
+							Usage: "Use UIDs for SEQSET instead of sequence numbers",
+						},
+						cli.StringFlag{
+							Name:  "name,n",
+							Usage: "Only show attachments with filename containing the value",
+						},
+						cli.StringFlag{
+							Name:  "type,t",
+							Usage: "Only show attachments of the MIME type (e.g. application/pdf or image/)",
+						},
+						cli.UintFlag{
+							Name:  "larger,l",
+							Usage: "Only show attachments larger than the value (in bytes)",
+						},
+					},
+					Action: msgsAttachments,
+				},
+			},
+		},
+		{
+			Name:  "aliases",
+			Usage: "Address aliases management",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List aliases",
+					Action: aliasesList,
+				},
+				{
+					Name:        "add",
+					Usage:       "Map alias address to user account",
+					Description: "Use @domain as ALIAS to create the catch-all alias for the domain.",
+					ArgsUsage:   "ALIAS USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "mailbox,m",
+							Usage: "Deliver messages for the alias into the specified mailbox instead of INBOX",
+						},
+					},
+					Action: aliasesAdd,
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove alias",
+					ArgsUsage: "ALIAS",
+					Action:    aliasesRemove,
+				},
+			},
+		},
+		{
+			Name:  "domains",
+			Usage: "Domains management",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List domains",
+					Action: domainsList,
+				},
+				{
+					Name:        "create",
+					Usage:       "Create domain",
+					Description: "Existing user accounts with usernames in the domain are added to it.",
+					ArgsUsage:   "DOMAIN",
+					Action:      domainsCreate,
+				},
+				{
+					Name:        "remove",
+					Usage:       "Delete domain and all user accounts in it (requires --unsafe)",
+					Description: "Aliases with addresses in the domain are also removed.",
+					ArgsUsage:   "DOMAIN",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: domainsRemove,
+				},
+				{
+					Name:      "info",
+					Usage:     "Show domain settings and usage statistics",
+					ArgsUsage: "DOMAIN",
+					Action:    domainsInfo,
+				},
+				{
+					Name:      "users",
+					Usage:     "List user accounts in the domain",
+					ArgsUsage: "DOMAIN",
+					Action:    domainsUsers,
+				},
+				{
+					Name:      "set",
+					Usage:     "Change domain settings",
+					ArgsUsage: "DOMAIN",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "max-users",
+							Usage: "Set maximum amount of accounts in the domain, 0 means no limit",
+						},
+						cli.IntFlag{
+							Name:  "appendlimit",
+							Usage: "Set APPENDLIMIT for new accounts in the domain (in bytes), -1 means no limit",
+						},
+						cli.StringFlag{
+							Name:  "catch-all",
+							Usage: "Deliver messages for unknown addresses in the domain to the specified account, empty to disable",
+						},
+						cli.BoolFlag{
+							Name:  "suspend",
+							Usage: "Suspend all accounts in the domain",
+						},
+						cli.BoolFlag{
+							Name:  "unsuspend",
+							Usage: "Remove domain suspension",
+						},
+					},
+					Action: domainsSet,
+				},
 			},
 		},
 		{
@@ -308,9 +448,28 @@ func main() {
 					Action:    usersCreate,
 				},
 				{
-					Name:      "remove",
-					Usage:     "Delete user account (requires --unsafe)",
-					ArgsUsage: "USERNAME",
+					Name:        "password",
+					Usage:       "Set user's password",
+					Description: "Password is read from the terminal.",
+					ArgsUsage:   "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "hash",
+							Usage: "Password hashing algorithm to use (bcrypt, argon2id)",
+							Value: "bcrypt",
+						},
+						cli.BoolFlag{
+							Name:  "remove",
+							Usage: "Remove the password, disabling login",
+						},
+					},
+					Action: usersPassword,
+				},
+				{
+					Name:        "remove",
+					Usage:       "Delete user account (requires --unsafe)",
+					Description: "Accounts on legal hold are only marked for deletion.",
+					ArgsUsage:   "USERNAME",
 					Flags: []cli.Flag{
 						cli.BoolFlag{
 							Name:  "yes,y",
@@ -319,6 +478,19 @@ func main() {
 					},
 					Action: usersRemove,
 				},
+				{
+					Name:        "rename",
+					Usage:       "Change username of the user account (requires --unsafe)",
+					Description: "All account data is kept. Alias with NEWNAME for the same account is removed.",
+					ArgsUsage:   "USERNAME NEWNAME",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "alias,a",
+							Usage: "Keep the old username as the alias for the account",
+						},
+					},
+					Action: usersRename,
+				},
 				{
 					Name:      "appendlimit",
 					Usage:     "Query or set user's APPENDLIMIT value",
@@ -331,7 +503,228 @@ func main() {
 					},
 					Action: usersAppendLimit,
 				},
+				{
+					Name:        "sieve",
+					Usage:       "Query or set user's Sieve filtering script",
+					Description: "Without flags, current script is printed.",
+					ArgsUsage:   "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "file,f",
+							Usage: "Set script to the contents of the specified file, use - to read it from stdin",
+						},
+						cli.BoolFlag{
+							Name:  "remove",
+							Usage: "Remove the script",
+						},
+					},
+					Action: usersSieve,
+				},
+				{
+					Name:        "subaddress",
+					Usage:       "Query or set user's subaddress routing",
+					Description: "Without flags, current settings are printed.\n\nIf enabled, messages sent to user+detail are stored into the mailbox named PREFIX+detail, if it exists.",
+					ArgsUsage:   "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "prefix,p",
+							Usage: "Enable routing and use the specified prefix for mailbox names",
+						},
+						cli.BoolFlag{
+							Name:  "disable",
+							Usage: "Disable routing",
+						},
+					},
+					Action: usersSubaddress,
+				},
+				{
+					Name:        "status",
+					Usage:       "Query or set user's account status",
+					Description: "Without flags, current status and login lockout state are printed.\n\nSTATUS is one of: active, suspended, read-only, pending-deletion.",
+					ArgsUsage:   "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "set,s",
+							Usage: "Change account status to STATUS",
+						},
+					},
+					Action: usersStatus,
+				},
+				{
+					Name:      "unlock",
+					Usage:     "Remove login lockout caused by failed login attempts",
+					ArgsUsage: "USERNAME",
+					Action:    usersUnlock,
+				},
+			},
+		},
+		{
+			Name:  "restore",
+			Usage: "Restore removed messages and mailboxes",
+			Subcommands: []cli.Command{
+				{
+					Name:      "list",
+					Usage:     "Show removed mailboxes and messages that can be restored",
+					ArgsUsage: "USERNAME",
+					Action:    restoreList,
+				},
+				{
+					Name:        "messages",
+					Usage:       "Restore messages expunged from mailbox (requires --unsafe)",
+					Description: "Restored messages are added to the end of the mailbox with new UIDs.",
+					ArgsUsage:   "USERNAME MAILBOX",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "since,s",
+							Usage: "Restore only messages expunged during the specified time, e.g. 24h",
+						},
+					},
+					Action: restoreMessages,
+				},
+				{
+					Name:        "mailbox",
+					Usage:       "Restore removed mailbox",
+					Description: "If the mailbox was removed several times, the latest version is restored.",
+					ArgsUsage:   "USERNAME MAILBOX",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "as",
+							Usage: "Restore mailbox under a different name",
+						},
+					},
+					Action: restoreMailbox,
+				},
+				{
+					Name:        "purge",
+					Usage:       "Permanently remove messages and mailboxes kept for restoration",
+					Description: "By default, all removed messages and mailboxes are purged.",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "older-than,o",
+							Usage: "Purge only messages and mailboxes removed earlier than the specified time ago",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: restorePurge,
+				},
+			},
+		},
+		{
+			Name:        "retention",
+			Usage:       "Retention policies management",
+			Description: "MAILBOX is a mailbox name or a SPECIAL-USE attribute, such as \\Trash. Messages older than MAXAGE are removed from matching mailboxes.",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "Show retention policies",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "user,u",
+							Usage: "Use the policy of the specified user instead of the global one",
+						},
+					},
+					Action: retentionList,
+				},
+				{
+					Name:        "set",
+					Usage:       "Set retention policy for mailbox",
+					Description: "MAXAGE is a duration, e.g. 720h for 30 days.",
+					ArgsUsage:   "MAILBOX MAXAGE",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "user,u",
+							Usage: "Use the policy of the specified user instead of the global one",
+						},
+					},
+					Action: retentionSet,
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove retention policy for mailbox",
+					ArgsUsage: "MAILBOX",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "user,u",
+							Usage: "Use the policy of the specified user instead of the global one",
+						},
+					},
+					Action: retentionRemove,
+				},
+				{
+					Name:   "apply",
+					Usage:  "Remove expired messages now (requires --unsafe)",
+					Action: retentionApply,
+				},
+			},
+		},
+		{
+			Name:        "hold",
+			Usage:       "Legal hold management",
+			Description: "Messages and mailboxes removed from accounts on legal hold are kept until the hold is released, accounts are only marked for deletion.",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "Show accounts on legal hold",
+					Action: holdList,
+				},
+				{
+					Name:      "set",
+					Usage:     "Place account on legal hold",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "reason,r",
+							Usage: "Description of the hold, such as the case number",
+						},
+					},
+					Action: holdSet,
+				},
+				{
+					Name:      "release",
+					Usage:     "Remove legal hold from account",
+					ArgsUsage: "USERNAME",
+					Action:    holdRelease,
+				},
+			},
+		},
+		{
+			Name:        "journal",
+			Usage:       "Journaling management",
+			Description: "A copy of each delivered or appended message is stored in the journal mailbox.",
+			Subcommands: []cli.Command{
+				{
+					Name:   "show",
+					Usage:  "Show journal account and mailbox",
+					Action: journalShow,
+				},
+				{
+					Name:      "set",
+					Usage:     "Journal all messages into mailbox",
+					ArgsUsage: "USERNAME MAILBOX",
+					Action:    journalSet,
+				},
+				{
+					Name:   "disable",
+					Usage:  "Stop journaling messages",
+					Action: journalDisable,
+				},
+			},
+		},
+		{
+			Name:        "reindex",
+			Usage:       "Add messages to the full-text index",
+			Description: "Only messages of the specified user are processed. If USERNAME is not specified - messages of all users are processed.",
+			ArgsUsage:   "[USERNAME]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "rebuild",
+					Usage: "Recreate index entries for all messages, not only for missing ones",
+				},
 			},
+			Action: reindex,
 		},
 	}
 
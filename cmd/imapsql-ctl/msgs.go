@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	eimap "github.com/emersion/go-imap"
@@ -337,3 +339,66 @@ func msgsDump(ctx *cli.Context) error {
 	}
 	return err
 }
+
+func msgsAttachments(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	mboxName := ctx.Args().Get(1)
+	seqset := ctx.Args().Get(2)
+	if seqset == "" {
+		seqset = "*"
+	}
+
+	seq, err := eimap.ParseSeqSet(seqset)
+	if err != nil {
+		return err
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	filter := imapsql.AttachmentFilter{
+		Filename:   ctx.String("name"),
+		MIMEType:   ctx.String("type"),
+		LargerThan: uint32(ctx.Uint("larger")),
+	}
+
+	var msgs []imapsql.MessageAttachments
+	if mboxName == "" {
+		msgs, err = u.(*imapsql.User).FindAttachments(filter)
+	} else {
+		_, mbox, err := u.GetMailbox(mboxName, true, nil)
+		if err != nil {
+			return err
+		}
+		msgs, err = mbox.(*imapsql.Mailbox).ListAttachments(ctx.Bool("uid"), seq)
+		if err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		for _, att := range msg.Attachments {
+			if !filter.Matches(att) {
+				continue
+			}
+			part := make([]string, 0, len(att.Part))
+			for _, num := range att.Part {
+				part = append(part, strconv.Itoa(num))
+			}
+			fmt.Printf("%s\t%d\t%s\t%d\t%s\t%s\n", msg.Mailbox, msg.UID, strings.Join(part, "."), att.Size, att.MIMEType, att.Filename)
+		}
+	}
+	return nil
+}
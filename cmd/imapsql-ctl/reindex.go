@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+func reindex(ctx *cli.Context) error {
+	// Index tables are created only if full-text search is enabled.
+	if err := ctx.GlobalSet("full-text-search", "true"); err != nil {
+		return err
+	}
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	count, err := backend.Reindex(ctx.Args().First(), ctx.Bool("rebuild"))
+	if err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Indexed", count, "messages.")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+func restoreList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+	usr := u.(*imapsql.User)
+
+	deleted, err := usr.ListDeletedMailboxes()
+	if err != nil {
+		return err
+	}
+	mboxes, err := usr.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, mbox := range deleted {
+		found = true
+		fmt.Printf("%s\tdeleted at %v\t%d messages\n", mbox.Name, mbox.DeletedAt.Format(time.RFC3339), mbox.Messages)
+	}
+	for _, info := range mboxes {
+		count, err := usr.DeletedMessages(info.Name)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+		found = true
+		fmt.Printf("%s\t%d expunged messages\n", info.Name, count)
+	}
+
+	if !found && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Nothing to restore.")
+	}
+	return nil
+}
+
+func restoreMessages(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("unsafe") {
+		return errors.New("Error: Refusing to edit mailboxes without --unsafe")
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("Error: MAILBOX is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if ctx.IsSet("since") {
+		since = time.Now().Add(-ctx.Duration("since"))
+	}
+
+	restored, err := u.(*imapsql.User).RestoreMessages(name, since)
+	if err != nil {
+		return err
+	}
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintf(os.Stderr, "Restored %d messages.\n", restored)
+	}
+	return nil
+}
+
+func restoreMailbox(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("Error: MAILBOX is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	return u.(*imapsql.User).RestoreMailbox(name, ctx.String("as"))
+}
+
+func restorePurge(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	before := time.Now().Add(-ctx.Duration("older-than"))
+
+	if !ctx.Bool("yes") {
+		if !Confirmation("Messages and mailboxes will be irrecoverably lost. Are you sure?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	purged, err := backend.PurgeDeleted(before)
+	if err != nil {
+		return err
+	}
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintf(os.Stderr, "Purged %d messages.\n", purged)
+	}
+	return nil
+}
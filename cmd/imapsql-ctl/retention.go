@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+func retentionUser(ctx *cli.Context) (*imapsql.User, error) {
+	u, err := backend.GetUser(ctx.String("user"))
+	if err != nil {
+		return nil, err
+	}
+	return u.(*imapsql.User), nil
+}
+
+func retentionList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	var (
+		policies []imapsql.RetentionPolicy
+		err      error
+	)
+	if ctx.IsSet("user") {
+		u, err := retentionUser(ctx)
+		if err != nil {
+			return err
+		}
+		policies, err = u.RetentionPolicies()
+	} else {
+		policies, err = backend.RetentionPolicies()
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(policies) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No retention policies.")
+	}
+
+	for _, policy := range policies {
+		fmt.Printf("%s\t%v\n", policy.Mailbox, policy.MaxAge)
+	}
+	return nil
+}
+
+func retentionSet(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	if ctx.NArg() != 2 {
+		return errors.New("Error: MAILBOX and MAXAGE are required")
+	}
+	mailbox := ctx.Args().Get(0)
+	maxAge, err := time.ParseDuration(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("Error: invalid MAXAGE: %v", err)
+	}
+
+	if ctx.IsSet("user") {
+		u, err := retentionUser(ctx)
+		if err != nil {
+			return err
+		}
+		return u.SetRetentionPolicy(mailbox, maxAge)
+	}
+	return backend.SetRetentionPolicy(mailbox, maxAge)
+}
+
+func retentionRemove(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	mailbox := ctx.Args().First()
+	if mailbox == "" {
+		return errors.New("Error: MAILBOX is required")
+	}
+
+	if ctx.IsSet("user") {
+		u, err := retentionUser(ctx)
+		if err != nil {
+			return err
+		}
+		return u.RemoveRetentionPolicy(mailbox)
+	}
+	return backend.RemoveRetentionPolicy(mailbox)
+}
+
+func retentionApply(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("unsafe") {
+		return errors.New("Error: Refusing to edit mailboxes without --unsafe")
+	}
+
+	removed, err := backend.ApplyRetentionPolicies()
+	if err != nil {
+		return err
+	}
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintf(os.Stderr, "Removed %d messages.\n", removed)
+	}
+	return nil
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"time"
 
+	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/urfave/cli"
 )
 
@@ -46,6 +49,45 @@ func usersCreate(ctx *cli.Context) error {
 	return backend.CreateUser(username)
 }
 
+func usersPassword(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+	user := u.(*imapsql.User)
+
+	if ctx.Bool("remove") {
+		return user.SetPassword("")
+	}
+
+	pass, err := ReadPassword("Enter new password")
+	if err != nil {
+		return err
+	}
+	if pass == "" {
+		return errors.New("Error: Password is empty, use --remove to remove it")
+	}
+	confirm, err := ReadPassword("Repeat new password")
+	if err != nil {
+		return err
+	}
+	if pass != confirm {
+		return errors.New("Error: Passwords don't match")
+	}
+
+	backend.Opts.PassHashAlgo = ctx.String("hash")
+	return user.SetPassword(pass)
+}
+
 func usersRemove(ctx *cli.Context) error {
 	if err := connectToDB(ctx); err != nil {
 		return err
@@ -60,7 +102,8 @@ func usersRemove(ctx *cli.Context) error {
 		return errors.New("Error: USERNAME is required")
 	}
 
-	_, err := backend.GetUser(username)
+	// UserState also works for accounts that can't be used.
+	_, err := backend.UserState(username)
 	if err != nil {
 		return errors.New("Error: User doesn't exists")
 	}
@@ -74,6 +117,22 @@ func usersRemove(ctx *cli.Context) error {
 	return backend.DeleteUser(username)
 }
 
+func usersRename(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("unsafe") {
+		return errors.New("Error: Refusing to edit user accounts without --unsafe")
+	}
+
+	if ctx.NArg() != 2 {
+		return errors.New("Error: USERNAME and NEWNAME are required")
+	}
+
+	return backend.RenameUser(ctx.Args().Get(0), ctx.Args().Get(1), ctx.Bool("alias"))
+}
+
 func usersAppendLimit(ctx *cli.Context) error {
 	if err := connectToDB(ctx); err != nil {
 		return err
@@ -114,3 +173,127 @@ func usersAppendLimit(ctx *cli.Context) error {
 
 	return nil
 }
+
+func usersSieve(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+	user := u.(*imapsql.User)
+
+	switch {
+	case ctx.Bool("remove"):
+		return user.SetSieveScript("")
+	case ctx.IsSet("file"):
+		var script []byte
+		if path := ctx.String("file"); path == "-" {
+			script, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			script, err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			return err
+		}
+		if len(script) == 0 {
+			return errors.New("Error: Script is empty, use --remove to remove it")
+		}
+		return user.SetSieveScript(string(script))
+	}
+
+	script, err := user.SieveScript()
+	if err != nil {
+		return err
+	}
+	if script == "" && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No script.")
+	}
+	fmt.Print(script)
+	return nil
+}
+
+func usersSubaddress(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+	user := u.(*imapsql.User)
+
+	switch {
+	case ctx.Bool("disable"):
+		return user.DisableSubaddressing()
+	case ctx.IsSet("prefix"):
+		return user.EnableSubaddressing(ctx.String("prefix"))
+	}
+
+	prefix, enabled, err := user.Subaddressing()
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		fmt.Println("Disabled")
+		return nil
+	}
+	fmt.Printf("Enabled, prefix: %q\n", prefix)
+	return nil
+}
+
+func usersStatus(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	if ctx.IsSet("set") {
+		status, err := imapsql.ParseAccountStatus(ctx.String("set"))
+		if err != nil {
+			return err
+		}
+		return backend.SetUserStatus(username, status)
+	}
+
+	state, err := backend.UserState(username)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Status:", state.Status)
+	fmt.Println("Failed logins:", state.FailedLogins)
+	if !state.LockedUntil.IsZero() {
+		fmt.Println("Locked until:", state.LockedUntil.Format(time.RFC1123Z))
+	}
+	return nil
+}
+
+func usersUnlock(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	return backend.UnlockUser(username)
+}
@@ -23,23 +23,42 @@ func (d db) Query(req string, args ...interface{}) (*sql.Rows, error) {
 	return d.DB.Query(d.rewriteSQL(req), args...)
 }
 
+func (d db) QueryContext(ctx context.Context, req string, args ...interface{}) (*sql.Rows, error) {
+	return d.DB.QueryContext(ctx, d.rewriteSQL(req), args...)
+}
+
 func (d db) QueryRow(req string, args ...interface{}) *sql.Row {
 	return d.DB.QueryRow(d.rewriteSQL(req), args...)
 }
 
+func (d db) QueryRowContext(ctx context.Context, req string, args ...interface{}) *sql.Row {
+	return d.DB.QueryRowContext(ctx, d.rewriteSQL(req), args...)
+}
+
 func (d db) Exec(req string, args ...interface{}) (sql.Result, error) {
 	return d.DB.Exec(d.rewriteSQL(req), args...)
 }
 
+func (d db) ExecContext(ctx context.Context, req string, args ...interface{}) (sql.Result, error) {
+	return d.DB.ExecContext(ctx, d.rewriteSQL(req), args...)
+}
+
 func (d db) Begin(readOnly bool) (*sql.Tx, error) {
-	return d.DB.BeginTx(context.TODO(), &sql.TxOptions{
-		Isolation: sql.LevelRepeatableRead,
-		ReadOnly:  readOnly,
-	})
+	return d.BeginContext(context.Background(), readOnly)
+}
+
+// BeginContext starts the transaction that is rolled back if ctx is
+// cancelled before it is committed.
+func (d db) BeginContext(ctx context.Context, readOnly bool) (*sql.Tx, error) {
+	return d.BeginLevelContext(ctx, sql.LevelRepeatableRead, readOnly)
 }
 
 func (d db) BeginLevel(isolation sql.IsolationLevel, readOnly bool) (*sql.Tx, error) {
-	return d.DB.BeginTx(context.TODO(), &sql.TxOptions{
+	return d.BeginLevelContext(context.Background(), isolation, readOnly)
+}
+
+func (d db) BeginLevelContext(ctx context.Context, isolation sql.IsolationLevel, readOnly bool) (*sql.Tx, error) {
+	return d.DB.BeginTx(ctx, &sql.TxOptions{
 		Isolation: isolation,
 		ReadOnly:  readOnly,
 	})
@@ -136,3 +155,17 @@ func (db db) aggrValuesSet(expr, separator string) string {
 	}
 	panic("Unsupported driver")
 }
+
+// binaryString returns the column type for strings that are compared
+// byte-wise by the SQL engine, the same way Go compares strings.
+func (db db) binaryString(size int) string {
+	typ := "VARCHAR(" + strconv.Itoa(size) + ")"
+	switch db.driver {
+	case "postgres":
+		return typ + ` COLLATE "C"`
+	case "mysql":
+		return typ + " CHARACTER SET utf8mb4 COLLATE utf8mb4_bin"
+	}
+	// SQLite uses BINARY collation by default.
+	return typ
+}
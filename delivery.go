@@ -3,10 +3,12 @@ package imapsql
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"time"
 
 	"github.com/emersion/go-imap/backend"
@@ -29,27 +31,188 @@ var ErrDeliveryInterrupted = errors.New("sql: delivery transaction interrupted,
 // In that case, either Body* or Commit will return ErrDeliveryInterrupt.
 // Sender should retry delivery after a short delay.
 func (b *Backend) NewDelivery() Delivery {
-	return Delivery{b: b, perRcptHeader: map[string]textproto.Header{}}
+	return b.NewDeliveryContext(context.Background())
+}
+
+// NewDeliveryContext is a variant of NewDelivery that binds all database and
+// ExternalStore operations of the delivery to ctx.
+//
+// If ctx is cancelled before Commit, the delivery transaction is rolled back
+// and further calls fail with DeadlineError.
+func (b *Backend) NewDeliveryContext(ctx context.Context) Delivery {
+	return Delivery{ctx: ctx, b: b}
 }
 
 func (d *Delivery) clean() {
+	d.tx = nil
+	d.perRcpt = false
+	d.finished = true
 	d.users = d.users[0:0]
+	d.rcpts = d.rcpts[0:0]
 	d.mboxes = d.mboxes[0:0]
 	d.extKey = ""
-	for k := range d.perRcptHeader {
-		delete(d.perRcptHeader, k)
+	d.journalKey = ""
+	d.stored = d.stored[0:0]
+	d.idemKey = ""
+	d.envelopeFrom = ""
+	if d.spool != nil {
+		if err := d.spool.Remove(); err != nil {
+			d.b.Opts.Log.Println("delivery: failed to remove spool file:", err)
+		}
+		d.spool = nil
 	}
+	d.perRcptHeader = d.perRcptHeader[0:0]
 }
 
 type Delivery struct {
+	ctx           context.Context
 	b             *Backend
 	tx            *sql.Tx
 	users         []User
-	mboxes        []Mailbox
+	rcpts         []rcptAccount
+	mboxes        []rcptMailbox
 	extKey        string
-	perRcptHeader map[string]textproto.Header
+	perRcptHeader []textproto.Header
 	flagOverrides map[string][]string
 	mboxOverrides map[string]string
+	idemKey       string
+	envelopeFrom  string
+	spool         *SpoolBuffer
+
+	// Messages added by the current delivery, the first one is journaled.
+	stored     []storedMsg
+	journalKey string
+
+	perRcpt  bool
+	results  []RcptResult
+	finished bool
+}
+
+// rcptMailbox is the mailbox selected for the recipient, rcpt is its index
+// in users.
+type rcptMailbox struct {
+	Mailbox
+	rcpt int
+}
+
+type storedMsg struct {
+	mboxId     uint64
+	msgId      uint32
+	extBodyKey string
+}
+
+// RcptStatus is the outcome of the delivery for a single recipient.
+type RcptStatus int
+
+const (
+	// Delivery to the recipient was not attempted yet.
+	RcptPending RcptStatus = iota
+	RcptDelivered
+	// Delivery failed but may succeed if retried later, e.g. the mailbox was
+	// deleted concurrently or the database is temporary unavailable.
+	RcptTempFailed
+	// Delivery failed and should not be retried, e.g. the message is larger
+	// than the APPEND limit of the mailbox.
+	RcptPermFailed
+)
+
+func (s RcptStatus) String() string {
+	switch s {
+	case RcptPending:
+		return "pending"
+	case RcptDelivered:
+		return "delivered"
+	case RcptTempFailed:
+		return "temporary failure"
+	case RcptPermFailed:
+		return "permanent failure"
+	}
+	return "RcptStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// RcptResult is the delivery outcome for the recipient added using AddRcpt.
+type RcptResult struct {
+	Username string
+	Status   RcptStatus
+	// Cause of the failure, nil if Status is RcptDelivered or RcptPending.
+	Err error
+	// Subaddress detail of the recipient address, see
+	// Opts.SubaddressSeparator.
+	Detail string
+}
+
+func rcptFailureStatus(err error) RcptStatus {
+	if errors.Is(err, backend.ErrTooBig) || errors.Is(err, ErrUserDoesntExists) || errors.Is(err, ErrAccountPendingDeletion) {
+		return RcptPermFailed
+	}
+	var rejected RejectedError
+	if errors.As(err, &rejected) && !rejected.Temporary {
+		return RcptPermFailed
+	}
+	return RcptTempFailed
+}
+
+// PerRecipient enables delivery mode where each recipient is delivered
+// independently. It should be called before AddRcpt.
+//
+// In that mode, failures specific to a recipient do not terminate the
+// delivery, instead the recipient is excluded from it and the reason is
+// reported by Results. Message size limits are also enforced in that mode.
+// Errors not related to a particular recipient are still returned by Body*
+// and Commit.
+//
+// The mode is reset once Commit or Abort is called.
+func (d *Delivery) PerRecipient() {
+	d.perRcpt = true
+}
+
+// Results returns the delivery outcome for each recipient, in the order
+// they were added using AddRcpt.
+//
+// After Commit or Abort, results of the finished delivery are returned until
+// AddRcpt is called again. If Commit fails, all recipients are reported as
+// temporary failed.
+func (d *Delivery) Results() []RcptResult {
+	res := make([]RcptResult, len(d.results))
+	copy(res, d.results)
+	return res
+}
+
+// setResult records the outcome for the recipient. Since the message may be
+// stored into several mailboxes for it, the recipient is reported as
+// delivered only if none of these failed.
+func (d *Delivery) setResult(rcpt int, status RcptStatus, err error) {
+	res := &d.results[rcpt]
+	if res.Status == RcptPending || (res.Status == RcptDelivered && status != RcptDelivered) {
+		res.Status = status
+		res.Err = err
+	}
+}
+
+// failRemaining marks all recipients that were not failed already as
+// temporary failed.
+func (d *Delivery) failRemaining(err error) {
+	for i := range d.results {
+		if d.results[i].Status == RcptDelivered || d.results[i].Status == RcptPending {
+			d.results[i].Status = RcptTempFailed
+			d.results[i].Err = err
+		}
+	}
+}
+
+// rcptSelected reports whether mailboxes were selected for recipients using
+// Mailbox or SpecialMailbox. In per-recipient mode, all of them may fail to
+// be selected.
+func (d *Delivery) rcptSelected() bool {
+	if len(d.mboxes) != 0 {
+		return true
+	}
+	for _, res := range d.results {
+		if res.Status != RcptPending {
+			return true
+		}
+	}
+	return false
 }
 
 // AddRcpt adds the recipient username/mailbox pair to the delivery.
@@ -65,19 +228,47 @@ type Delivery struct {
 // Fields from userHeader, if any, will be prepended to the message header
 // *only* for that recipient. Use this to add Received and Delivered-To
 // fields with recipient-specific information (e.g. its address).
+//
+// Recipients that resolve to the same account and mailbox (e.g. the account
+// name and its aliases) get a single copy of the message, fields from
+// userHeader of the first of them are added to it. Results are still
+// reported for each recipient.
+//
+// If there is no account with the specified username, aliases are checked
+// (see Backend.CreateAlias). If Opts.SubaddressSeparator is set, the
+// subaddress detail is then removed from it (e.g. user+lists@example.org is
+// delivered to user@example.org) and the message is routed as described in
+// User.EnableSubaddressing. Use Backend.SplitSubaddress to include the detail
+// in userHeader. Catch-all alias for the domain is checked last.
+//
+// ErrAccountSuspended is returned for suspended accounts and the delivery
+// should be retried later. ErrAccountPendingDeletion is returned for accounts
+// pending deletion and the message should be rejected. Read-only accounts
+// accept deliveries.
 func (d *Delivery) AddRcpt(username string, userHeader textproto.Header) error {
 	username = normalizeUsername(username)
 
-	uid, inboxId, err := d.b.getUserMeta(nil, username)
+	if d.finished {
+		d.results = d.results[:0]
+		d.finished = false
+	}
+
+	acct, err := d.b.resolveRcpt(d.ctx, username)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return ErrUserDoesntExists
 		}
+		return wrapErr(err, "AddRcpt")
+	}
+	if err := acct.status.statusErr(); err != nil {
 		return err
 	}
-	d.users = append(d.users, User{id: uid, username: username, parent: d.b, inboxId: inboxId})
+	username = acct.username
+	d.users = append(d.users, User{id: acct.uid, username: username, parent: d.b, inboxId: acct.inboxId})
+	d.rcpts = append(d.rcpts, acct)
+	d.results = append(d.results, RcptResult{Username: username, Detail: acct.detail})
 
-	d.perRcptHeader[username] = userHeader
+	d.perRcptHeader = append(d.perRcptHeader, userHeader)
 
 	return nil
 }
@@ -89,40 +280,75 @@ func (d *Delivery) AddRcpt(username string, userHeader textproto.Header) error {
 //
 // If it is not called, it defaults to INBOX. If mailbox doesn't
 // exist for some users - it will created.
+//
+// Recipients with subaddress routing enabled get the message into the
+// mailbox for the subaddress instead, if it exists. Recipients resolved
+// using the alias with the mailbox set get the message into that mailbox.
 func (d *Delivery) Mailbox(name string) error {
 	if cap(d.mboxes) < len(d.users) {
-		d.mboxes = make([]Mailbox, 0, len(d.users))
+		d.mboxes = make([]rcptMailbox, 0, len(d.users))
 	}
 
-	for _, u := range d.users {
+	for i, u := range d.users {
 		if mboxName := d.mboxOverrides[u.username]; mboxName != "" {
-			_, mbox, err := u.GetMailbox(mboxName, true, nil)
+			_, mbox, err := u.GetMailboxContext(d.ctx, mboxName, true, nil)
 			if err == nil {
-				d.mboxes = append(d.mboxes, *mbox.(*Mailbox))
+				d.mboxes = append(d.mboxes, rcptMailbox{*mbox.(*Mailbox), i})
 				continue
 			}
 		}
 
-		_, mbox, err := u.GetMailbox(name, true, nil)
+		subMbox, err := d.subaddressMailbox(u, d.rcpts[i].detail)
+		if err != nil {
+			if d.perRcpt {
+				d.setResult(i, rcptFailureStatus(err), err)
+				continue
+			}
+			d.mboxes = nil
+			return err
+		}
+		if subMbox != nil {
+			d.mboxes = append(d.mboxes, rcptMailbox{*subMbox, i})
+			continue
+		}
+
+		rcptName := name
+		if d.rcpts[i].mailbox != "" {
+			rcptName = d.rcpts[i].mailbox
+		}
+
+		_, mbox, err := u.GetMailboxContext(d.ctx, rcptName, true, nil)
 		if err != nil {
 			if err != backend.ErrNoSuchMailbox {
+				if d.perRcpt {
+					d.setResult(i, rcptFailureStatus(err), err)
+					continue
+				}
 				d.mboxes = nil
 				return err
 			}
 
-			if err := u.CreateMailbox(name); err != nil && err != backend.ErrMailboxAlreadyExists {
+			if err := u.CreateMailbox(rcptName); err != nil && err != backend.ErrMailboxAlreadyExists {
+				if d.perRcpt {
+					d.setResult(i, rcptFailureStatus(err), err)
+					continue
+				}
 				d.mboxes = nil
 				return err
 			}
 
-			_, mbox, err = u.GetMailbox(name, true, nil)
+			_, mbox, err = u.GetMailboxContext(d.ctx, rcptName, true, nil)
 			if err != nil {
+				if d.perRcpt {
+					d.setResult(i, rcptFailureStatus(err), err)
+					continue
+				}
 				d.mboxes = nil
 				return err
 			}
 		}
 
-		d.mboxes = append(d.mboxes, *mbox.(*Mailbox))
+		d.mboxes = append(d.mboxes, rcptMailbox{*mbox.(*Mailbox), i})
 	}
 	return nil
 }
@@ -137,41 +363,53 @@ func (d *Delivery) Mailbox(name string) error {
 // during multi-recipient delivery.
 func (d *Delivery) SpecialMailbox(attribute, fallbackName string) error {
 	if cap(d.mboxes) < len(d.users) {
-		d.mboxes = make([]Mailbox, 0, len(d.users))
+		d.mboxes = make([]rcptMailbox, 0, len(d.users))
 	}
-	for _, u := range d.users {
+	for i, u := range d.users {
 		if mboxName := d.mboxOverrides[u.username]; mboxName != "" {
-			_, mbox, err := u.GetMailbox(mboxName, true, nil)
+			_, mbox, err := u.GetMailboxContext(d.ctx, mboxName, true, nil)
 			if err == nil {
-				d.mboxes = append(d.mboxes, *mbox.(*Mailbox))
+				d.mboxes = append(d.mboxes, rcptMailbox{*mbox.(*Mailbox), i})
 				continue
 			}
 		}
 
 		var mboxId uint64
 		var mboxName string
-		err := d.b.specialUseMbox.QueryRow(u.id, attribute).Scan(&mboxName, &mboxId)
+		err := d.b.specialUseMbox.QueryRowContext(d.ctx, u.id, attribute).Scan(&mboxName, &mboxId)
 		if err != nil {
 			if err != sql.ErrNoRows {
+				if d.perRcpt {
+					d.setResult(i, rcptFailureStatus(err), err)
+					continue
+				}
 				d.mboxes = nil
 				return err
 			}
 
 			if err := u.CreateMailboxSpecial(fallbackName, attribute); err != nil && err != backend.ErrMailboxAlreadyExists {
+				if d.perRcpt {
+					d.setResult(i, rcptFailureStatus(err), err)
+					continue
+				}
 				d.mboxes = nil
 				return err
 			}
 
-			_, mbox, err := u.GetMailbox(fallbackName, true, nil)
+			_, mbox, err := u.GetMailboxContext(d.ctx, fallbackName, true, nil)
 			if err != nil {
+				if d.perRcpt {
+					d.setResult(i, rcptFailureStatus(err), err)
+					continue
+				}
 				d.mboxes = nil
 				return err
 			}
-			d.mboxes = append(d.mboxes, *mbox.(*Mailbox))
+			d.mboxes = append(d.mboxes, rcptMailbox{*mbox.(*Mailbox), i})
 			continue
 		}
 
-		d.mboxes = append(d.mboxes, Mailbox{user: u, id: mboxId, name: mboxName, parent: d.b})
+		d.mboxes = append(d.mboxes, rcptMailbox{Mailbox{user: u, id: mboxId, name: mboxName, parent: d.b}, i})
 	}
 	return nil
 }
@@ -196,10 +434,11 @@ func (mb memoryBuffer) Open() (io.ReadCloser, error) {
 	return ioutil.NopCloser(bytes.NewReader(mb.slice)), nil
 }
 
-// BodyRaw is convenience wrapper for BodyParsed. Use it only for most simple cases (e.g. for tests).
+// BodyRaw is convenience wrapper for BodyParsed that parses the message header
+// and stores the body in SpoolBuffer.
 //
-// You want to use BodyParsed in most cases. It is much more efficient. BodyRaw reads the entire message
-// into memory.
+// Bodies larger than Opts.SpoolMemoryLimit are written to a temporary file
+// that is removed when Commit or Abort is called.
 func (d *Delivery) BodyRaw(message io.Reader) error {
 	bufferedMsg := bufio.NewReader(message)
 	hdr, err := textproto.ReadHeader(bufferedMsg)
@@ -207,12 +446,16 @@ func (d *Delivery) BodyRaw(message io.Reader) error {
 		return err
 	}
 
-	blob, err := ioutil.ReadAll(bufferedMsg)
+	memLimit := d.b.Opts.SpoolMemoryLimit
+	if memLimit == 0 {
+		memLimit = DefaultSpoolMemoryLimit
+	}
+	body, err := NewSpoolBuffer(bufferedMsg, memLimit, d.b.Opts.SpoolDir)
 	if err != nil {
-		return err
+		return wrapErr(err, "BodyRaw (spool)")
 	}
 
-	return d.BodyParsed(hdr, len(blob), memoryBuffer{slice: blob})
+	return d.BodyParsed(hdr, body.Len(), body)
 }
 
 // Buffer is the temporary storage for the message body.
@@ -220,19 +463,52 @@ type Buffer interface {
 	Open() (io.ReadCloser, error)
 }
 
+// BodyParsed adds the message to the recipients mailboxes.
+//
+// body is opened once for each recipient. If it is SpoolBuffer, it is
+// removed when Commit or Abort is called.
 func (d *Delivery) BodyParsed(header textproto.Header, bodyLen int, body Buffer) error {
-	if len(d.mboxes) == 0 {
+	if spool, ok := body.(*SpoolBuffer); ok {
+		d.spool = spool
+	}
+
+	if !d.rcptSelected() {
 		if err := d.Mailbox("INBOX"); err != nil {
 			return err
 		}
 	}
 
+	var hookFlags []string
+	if len(d.b.Opts.IngestHooks) != 0 {
+		header = header.Copy()
+		var err error
+		hookFlags, err = d.ingestDelivery(&header, bodyLen, body)
+		if err != nil {
+			if d.perRcpt {
+				for i := range d.results {
+					d.setResult(i, rcptFailureStatus(err), err)
+				}
+			}
+			return err
+		}
+	}
+
+	targets, err := d.filterTargets(header, bodyLen)
+	if err != nil {
+		return err
+	}
+	if len(hookFlags) != 0 {
+		for i := range targets {
+			targets[i].flags = mergeFlags(targets[i].flags, hookFlags)
+		}
+	}
+
 	// Make sure all auto-generated statements are generated before we start transaction
 	// so it will not cause deadlocks on SQlite when statement is prepared outside
 	// of transaction while transaction is running.
-	for _, mbox := range d.mboxes {
-		if len(d.flagOverrides[mbox.user.username]) != 0 {
-			_, err := d.b.getFlagsAddStmt(len(d.flagOverrides[mbox.user.username]))
+	for _, target := range targets {
+		if len(target.flags) != 0 {
+			_, err := d.b.getFlagsAddStmt(len(target.flags))
 			if err != nil {
 				return wrapErr(err, "Body")
 			}
@@ -241,54 +517,189 @@ func (d *Delivery) BodyParsed(header textproto.Header, bodyLen int, body Buffer)
 
 	date := time.Now()
 
-	var err error
-	d.tx, err = d.b.db.BeginLevel(sql.LevelReadCommitted, false)
+	dedupKey, err := d.deliveryKey(header.Get("Message-Id"), body)
+	if err != nil {
+		return wrapErr(err, "Body (deliveryKey)")
+	}
+
+	d.tx, err = d.b.db.BeginLevelContext(d.ctx, sql.LevelReadCommitted, false)
 	if err != nil {
 		return wrapErr(err, "Body")
 	}
 
-	for _, mbox := range d.mboxes {
-		var flagsStmt *sql.Stmt
-		if len(d.flagOverrides[mbox.user.username]) != 0 {
-			flagsStmt, err = d.b.getFlagsAddStmt(len(d.flagOverrides[mbox.user.username]))
-			if err != nil {
-				return wrapErr(err, "Body")
+	for i := 0; i < len(targets); {
+		if !d.perRcpt {
+			if err := d.rcptDelivery(header, targets[i], int64(bodyLen), body, date, dedupKey); err != nil {
+				return err
 			}
+			i++
+			continue
 		}
 
-		err = d.mboxDelivery(header, mbox, int64(bodyLen), body, date, flagsStmt)
+		// Targets of the same recipient are adjacent. Each recipient is
+		// delivered within its own savepoint so failed recipient changes,
+		// including targets stored before the failure, can be reverted
+		// without affecting others.
+		user := targets[i].mbox.user
+		end := i + 1
+		for end < len(targets) && targets[end].mbox.user.id == user.id {
+			end++
+		}
+
+		if _, err := d.tx.ExecContext(d.ctx, `SAVEPOINT rcpt`); err != nil {
+			return wrapErr(err, "Body (savepoint)")
+		}
+		stored := len(d.stored)
+		var rcptErr error
+		for _, target := range targets[i:end] {
+			if rcptErr = d.rcptDelivery(header, target, int64(bodyLen), body, date, dedupKey); rcptErr != nil {
+				break
+			}
+		}
+		if rcptErr != nil {
+			if _, rbErr := d.tx.ExecContext(d.ctx, `ROLLBACK TO SAVEPOINT rcpt`); rbErr != nil {
+				return wrapErr(rbErr, "Body (rollback to savepoint)")
+			}
+			// Blobs of targets stored before the failure are not referenced
+			// anymore.
+			reverted := make([]string, 0, len(d.stored)-stored)
+			for _, msg := range d.stored[stored:] {
+				reverted = append(reverted, msg.extBodyKey)
+			}
+			d.stored = d.stored[:stored]
+			if len(reverted) != 0 {
+				if err := d.b.extStore.Delete(reverted); err != nil {
+					d.b.Opts.Log.Printf("delivery: failed to delete reverted blobs %v: %v", reverted, err)
+				}
+			}
+			d.b.Opts.Log.Printf("delivery: failed for %s, skipping: %v", user.username, rcptErr)
+		}
+		for _, target := range targets[i:end] {
+			for _, rcpt := range target.rcpts {
+				if rcptErr != nil {
+					d.setResult(rcpt, rcptFailureStatus(rcptErr), rcptErr)
+				} else {
+					d.setResult(rcpt, RcptDelivered, nil)
+				}
+			}
+		}
+		if _, err := d.tx.ExecContext(d.ctx, `RELEASE SAVEPOINT rcpt`); err != nil {
+			return wrapErr(err, "Body (release savepoint)")
+		}
+		i = end
+	}
+	if !d.perRcpt {
+		for i := range d.results {
+			d.results[i].Status = RcptDelivered
+		}
+	}
+
+	if len(d.stored) != 0 {
+		msg := d.stored[0]
+		d.journalKey, err = d.b.journalMessage(d.ctx, d.tx, msg.mboxId, msg.msgId, msg.extBodyKey)
 		if err != nil {
-			return err
+			return wrapErr(err, "Body (journal)")
 		}
 	}
 
 	return nil
 }
 
-func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen int64, body Buffer, date time.Time, flagsStmt *sql.Stmt) (err error) {
+func (d *Delivery) rcptDelivery(header textproto.Header, target deliveryTarget, bodyLen int64, body Buffer, date time.Time, dedupKey string) error {
+	mbox := target.mbox
+	if dedupKey != "" {
+		dup, err := d.b.recordDeliveryKey(d.ctx, d.tx, mbox.id, dedupKey, date)
+		if err != nil {
+			return wrapErr(err, "Body (recordDeliveryKey)")
+		}
+		if dup {
+			d.b.Opts.Log.Debugln("delivery: duplicate of", dedupKey, "for mboxId", mbox.id, "skipped")
+			return nil
+		}
+	}
+
+	var flagsStmt *sql.Stmt
+	if len(target.flags) != 0 {
+		var err error
+		flagsStmt, err = d.b.getFlagsAddStmt(len(target.flags))
+		if err != nil {
+			return wrapErr(err, "Body")
+		}
+	}
+
+	return d.mboxDelivery(d.rcptHeader(header, target.rcpts[0]), mbox, bodyLen, body, date, target.flags, flagsStmt)
+}
+
+// rcptHeader returns the message header with recipient-specific fields
+// added.
+func (d *Delivery) rcptHeader(header textproto.Header, rcpt int) textproto.Header {
 	header = header.Copy()
-	userHeader := d.perRcptHeader[mbox.user.username]
+	userHeader := d.perRcptHeader[rcpt]
 	for fields := userHeader.Fields(); fields.Next(); {
 		header.Add(fields.Key(), fields.Value())
 	}
+	return header
+}
 
+// checkRcptLimit is a variant of Mailbox.checkAppendLimit that uses the
+// delivery transaction and reports mailboxes deleted concurrently.
+func (d *Delivery) checkRcptLimit(mbox Mailbox, length int64) error {
+	var mboxLimit, userLimit sql.NullInt64
+	if err := d.tx.Stmt(d.b.mboxMsgSizeLimit).QueryRowContext(d.ctx, mbox.id).Scan(&mboxLimit); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrDeliveryInterrupted
+		}
+		return wrapErr(err, "Body (checkRcptLimit)")
+	}
+	if err := d.tx.Stmt(d.b.userMsgSizeLimit).QueryRowContext(d.ctx, mbox.user.id).Scan(&userLimit); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrDeliveryInterrupted
+		}
+		return wrapErr(err, "Body (checkRcptLimit)")
+	}
+
+	var limit *uint32
+	switch {
+	case mboxLimit.Valid:
+		val := uint32(mboxLimit.Int64)
+		limit = &val
+	case userLimit.Valid:
+		val := uint32(userLimit.Int64)
+		limit = &val
+	default:
+		limit = d.b.Opts.MaxMsgBytes
+	}
+	if limit != nil && length > int64(*limit) {
+		return backend.ErrTooBig
+	}
+	return nil
+}
+
+func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen int64, body Buffer, date time.Time, flags []string, flagsStmt *sql.Stmt) (err error) {
 	headerBlob := bytes.Buffer{}
 	if err := textproto.WriteHeader(&headerBlob, header); err != nil {
 		return wrapErr(err, "Body (WriteHeader)")
 	}
 
 	length := int64(headerBlob.Len()) + bodyLen
+	if d.perRcpt {
+		if err := d.checkRcptLimit(mbox, length); err != nil {
+			return err
+		}
+	}
+
 	bodyReader, err := body.Open()
 	if err != nil {
 		return err
 	}
+	defer bodyReader.Close()
 
-	bodyStruct, cachedHeader, extBodyKey, err := d.b.processParsedBody(headerBlob.Bytes(), header, bodyReader, bodyLen)
+	bodyStruct, cachedHeader, keys, extBodyKey, err := d.b.processParsedBody(d.ctx, headerBlob.Bytes(), header, bodyReader, bodyLen)
 	if err != nil {
 		return err
 	}
 
-	if _, err = d.tx.Stmt(d.b.addExtKey).Exec(extBodyKey, mbox.user.id, 1); err != nil {
+	if _, err = d.tx.Stmt(d.b.addExtKey).ExecContext(d.ctx, extBodyKey, mbox.user.id, 1); err != nil {
 		d.b.extStore.Delete([]string{extBodyKey})
 		return wrapErr(err, "Body (addExtKey)")
 	}
@@ -298,7 +709,7 @@ func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen i
 	// serialization.
 
 	// --- operations that involve mboxes table ---
-	msgId, err := mbox.incrementMsgCounters(d.tx)
+	msgId, err := mbox.incrementMsgCounters(d.ctx, d.tx)
 	if err != nil {
 		d.b.extStore.Delete([]string{extBodyKey})
 		return wrapErr(err, "Body (incrementMsgCounters)")
@@ -310,34 +721,43 @@ func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen i
 		persistRecent = 1
 	}
 
-	_, err = d.tx.Stmt(d.b.addMsg).Exec(
+	_, err = d.tx.Stmt(d.b.addMsg).ExecContext(d.ctx, append([]interface{}{
 		mbox.id, msgId, date.Unix(),
 		length,
 		bodyStruct, cachedHeader, extBodyKey,
 		0, d.b.Opts.CompressAlgo, persistRecent,
-	)
+	}, keys.values(date)...)...)
 	if err != nil {
 		d.b.extStore.Delete([]string{extBodyKey})
 		return wrapErr(err, "Body (addMsg)")
 	}
+	if err := d.b.indexText(d.ctx, d.tx, extBodyKey, d.b.Opts.CompressAlgo); err != nil {
+		d.b.extStore.Delete([]string{extBodyKey})
+		return wrapErr(err, "Body (indexText)")
+	}
+	if err := d.b.logIndex(d.ctx, d.tx, d.b.logIndexChange, IndexAdd, mbox.id, msgId); err != nil {
+		d.b.extStore.Delete([]string{extBodyKey})
+		return wrapErr(err, "Body (logIndex)")
+	}
 	// --- end of operations that involve msgs table ---
 
 	// --- operations that involve flags table ---
-	flags := d.flagOverrides[mbox.user.username]
 	if len(flags) != 0 {
 
 		params := mbox.makeFlagsAddStmtArgs(flags, msgId, msgId)
-		if _, err := d.tx.Stmt(flagsStmt).Exec(params...); err != nil {
+		if _, err := d.tx.Stmt(flagsStmt).ExecContext(d.ctx, params...); err != nil {
 			d.b.extStore.Delete([]string{extBodyKey})
 			return wrapErr(err, "Body (flagsStmt)")
 		}
 	}
 	// --- end operations that involve flags table ---
 
+	d.stored = append(d.stored, storedMsg{mboxId: mbox.id, msgId: msgId, extBodyKey: extBodyKey})
 	return nil
 }
 
 func (d *Delivery) Abort() error {
+	d.failRemaining(ErrDeliveryInterrupted)
 	if d.tx != nil {
 		if err := d.tx.Rollback(); err != nil {
 			return err
@@ -348,6 +768,11 @@ func (d *Delivery) Abort() error {
 			return err
 		}
 	}
+	if d.journalKey != "" {
+		if err := d.b.extStore.Delete([]string{d.journalKey}); err != nil {
+			return err
+		}
+	}
 
 	d.clean()
 	return nil
@@ -363,18 +788,23 @@ func (d *Delivery) Abort() error {
 func (d *Delivery) Commit() error {
 	if d.tx != nil {
 		if err := d.tx.Commit(); err != nil {
+			if ctxErr := d.ctx.Err(); ctxErr != nil {
+				err = wrapErr(ctxErr, "Commit")
+			}
+			d.failRemaining(err)
 			return err
 		}
+		d.b.searchIndexChanged()
 	}
 
 	d.clean()
 	return nil
 }
 
-func (b *Backend) processParsedBody(headerInput []byte, header textproto.Header, bodyLiteral io.Reader, bodyLen int64) (bodyStruct, cachedHeader []byte, extBodyKey string, err error) {
+func (b *Backend) processParsedBody(ctx context.Context, headerInput []byte, header textproto.Header, bodyLiteral io.Reader, bodyLen int64) (bodyStruct, cachedHeader []byte, keys sortKeys, extBodyKey string, err error) {
 	extBodyKey, err = randomKey()
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 
 	objSize := int64(len(headerInput)) + bodyLen
@@ -382,28 +812,28 @@ func (b *Backend) processParsedBody(headerInput []byte, header textproto.Header,
 		objSize = -1
 	}
 
-	extWriter, err := b.extStore.Create(extBodyKey, objSize)
+	extWriter, err := b.extCreate(ctx, extBodyKey, objSize)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 	defer extWriter.Close()
 
 	compressW, err := b.compressAlgo.WrapCompress(extWriter, b.Opts.CompressAlgoParams)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 	defer compressW.Close()
 
 	if _, err := compressW.Write(headerInput); err != nil {
 		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 
 	bufferedBody := bufio.NewReader(io.TeeReader(bodyLiteral, compressW))
-	bodyStruct, cachedHeader, err = extractCachedData(header, bufferedBody)
+	bodyStruct, cachedHeader, keys, err = extractCachedData(header, bufferedBody)
 	if err != nil {
 		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 
 	// Consume all remaining body so io.TeeReader used with external store will
@@ -411,11 +841,11 @@ func (b *Backend) processParsedBody(headerInput []byte, header textproto.Header,
 	_, err = io.Copy(ioutil.Discard, bufferedBody)
 	if err != nil {
 		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 
 	if err := extWriter.Sync(); err != nil {
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 
 	return
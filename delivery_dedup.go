@@ -0,0 +1,145 @@
+package imapsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// Delivery idempotency keys are recorded per recipient mailbox and a
+// repeated delivery with the same key is silently skipped for that mailbox
+// until the key expires (see Opts.DeliveryDedupWindow).
+
+func (b *Backend) initDeliveryKeys() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS deliveryKeys (
+			mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+			idemKey VARCHAR(255) NOT NULL,
+			expires BIGINT NOT NULL,
+
+			PRIMARY KEY(mboxId, idemKey)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table deliveryKeys")
+	}
+	if err := b.createIndex("deliveryKeys_expires", "deliveryKeys", "expires"); err != nil {
+		return wrapErr(err, "create index deliveryKeys_expires")
+	}
+	return nil
+}
+
+func (b *Backend) prepareDeliveryKeysStmts() error {
+	var err error
+	b.delExpiredDeliveryKey, err = b.db.Prepare(`
+		DELETE FROM deliveryKeys
+		WHERE mboxId = ? AND idemKey = ? AND expires <= ?`)
+	if err != nil {
+		return wrapErr(err, "delExpiredDeliveryKey prep")
+	}
+	b.addDeliveryKey, err = b.db.Prepare(`
+		INSERT INTO deliveryKeys(mboxId, idemKey, expires)
+		VALUES (?, ?, ?) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return wrapErr(err, "addDeliveryKey prep")
+	}
+	b.cleanupDeliveryKeys, err = b.db.Prepare(`
+		DELETE FROM deliveryKeys
+		WHERE expires <= ?`)
+	if err != nil {
+		return wrapErr(err, "cleanupDeliveryKeys prep")
+	}
+	return nil
+}
+
+// IdempotencyKey sets the key used to detect repeated deliveries of the
+// same message. It should be called before BodyParsed/BodyRaw.
+//
+// If it is not called, the key is derived from the Message-Id header field
+// and the message body. Messages without Message-Id are never considered
+// duplicates in this case.
+//
+// Key is used only if Opts.DeliveryDedupWindow is set.
+func (d *Delivery) IdempotencyKey(key string) {
+	d.idemKey = key
+}
+
+// deliveryKey returns the idempotency key to use for the message, empty
+// string if there is none.
+func (d *Delivery) deliveryKey(messageId string, body Buffer) (string, error) {
+	if d.b.Opts.DeliveryDedupWindow <= 0 {
+		return "", nil
+	}
+	if d.idemKey != "" {
+		return d.idemKey, nil
+	}
+	if messageId == "" {
+		return "", nil
+	}
+
+	bodyReader, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer bodyReader.Close()
+
+	hash := sha256.New()
+	hash.Write([]byte(messageId))
+	hash.Write([]byte{0})
+	if _, err := io.Copy(hash, bodyReader); err != nil {
+		return "", err
+	}
+	return "msgid-sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// recordDeliveryKey saves the idempotency key for the mailbox and reports
+// whether the message was already delivered to it with the same key.
+func (b *Backend) recordDeliveryKey(ctx context.Context, tx *sql.Tx, mboxId uint64, key string, now time.Time) (bool, error) {
+	if _, err := tx.Stmt(b.delExpiredDeliveryKey).ExecContext(ctx, mboxId, key, now.Unix()); err != nil {
+		return false, err
+	}
+	stats, err := tx.Stmt(b.addDeliveryKey).ExecContext(ctx, mboxId, key, now.Add(b.Opts.DeliveryDedupWindow).Unix())
+	if err != nil {
+		return false, err
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 0, nil
+}
+
+// CleanupDeliveryKeys removes expired delivery idempotency keys and returns
+// the amount of removed keys.
+//
+// It is called automatically in background if Opts.DeliveryDedupWindow is
+// set.
+func (b *Backend) CleanupDeliveryKeys() (int64, error) {
+	stats, err := b.cleanupDeliveryKeys.Exec(time.Now().Unix())
+	if err != nil {
+		return 0, wrapErr(err, "CleanupDeliveryKeys")
+	}
+	affected, err := stats.RowsAffected()
+	return affected, wrapErr(err, "CleanupDeliveryKeys")
+}
+
+func (b *Backend) deliveryKeysCleanupLoop() {
+	interval := b.Opts.DeliveryDedupWindow
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := b.CleanupDeliveryKeys(); err != nil {
+				b.Opts.Log.Printf("%v", err)
+			}
+		case <-b.deliveryKeysLoopStop:
+			return
+		}
+	}
+}
@@ -2,9 +2,13 @@ package imapsql
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"io/ioutil"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -361,3 +365,223 @@ func TestDelivery_UserHeader(t *testing.T) {
 		assert.Check(t, is.Equal(hdr.Get("Test-Header"), "2"), "wrong user header stored")
 	}
 }
+
+func TestDelivery_Dedup(t *testing.T) {
+	b := initTestBackendOpts(Opts{DeliveryDedupWindow: time.Hour}).(*Backend)
+	defer cleanBackend(b)
+	for i := 1; i <= 3; i++ {
+		assert.NilError(t, b.CreateUser(t.Name()+"-"+strconv.Itoa(i)))
+	}
+
+	msgCount := func(i int) uint32 {
+		t.Helper()
+		u, err := b.GetUser(t.Name() + "-" + strconv.Itoa(i))
+		assert.NilError(t, err)
+		status, err := u.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+		assert.NilError(t, err)
+		return status.Messages
+	}
+	deliver := func(key, msg string, rcpts ...int) {
+		t.Helper()
+		delivery := b.NewDelivery()
+		for _, i := range rcpts {
+			assert.NilError(t, delivery.AddRcpt(t.Name()+"-"+strconv.Itoa(i), textproto.Header{}))
+		}
+		if key != "" {
+			delivery.IdempotencyKey(key)
+		}
+		assert.NilError(t, delivery.BodyRaw(strings.NewReader(msg)))
+		assert.NilError(t, delivery.Commit())
+	}
+
+	msg := "Message-Id: <1@example.org>\r\n" + testMsg
+	deliver("", msg, 1, 2)
+	deliver("", msg, 1, 2, 3)
+	assert.Equal(t, msgCount(1), uint32(1))
+	assert.Equal(t, msgCount(2), uint32(1))
+	assert.Equal(t, msgCount(3), uint32(1))
+
+	// Same Message-Id, different body.
+	deliver("", "Message-Id: <1@example.org>\r\n"+testMsgHeader+"Other body\r\n", 1)
+	assert.Equal(t, msgCount(1), uint32(2))
+
+	// Messages without Message-Id are not deduplicated unless the key is
+	// set explicitly.
+	deliver("", testMsg, 1)
+	deliver("", testMsg, 1)
+	assert.Equal(t, msgCount(1), uint32(4))
+	deliver("key", testMsg, 1)
+	deliver("key", testMsg, 1)
+	assert.Equal(t, msgCount(1), uint32(5))
+
+	count, err := b.CleanupDeliveryKeys()
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(0))
+
+	_, err = b.DB.Exec(`UPDATE deliveryKeys SET expires = 0`)
+	assert.NilError(t, err)
+	deliver("key", testMsg, 1)
+	assert.Equal(t, msgCount(1), uint32(6))
+	count, err = b.CleanupDeliveryKeys()
+	assert.NilError(t, err)
+	assert.Equal(t, count, int64(4))
+}
+
+type ctxKey struct{}
+
+// ctxStore is the ContextExternalStore that records values of ctxKey from
+// contexts passed to it.
+type ctxStore struct {
+	*FSStore
+	seen []interface{}
+}
+
+func (s *ctxStore) CreateContext(ctx context.Context, key string, objectSize int64) (ExtStoreObj, error) {
+	s.seen = append(s.seen, ctx.Value(ctxKey{}))
+	return s.Create(key, objectSize)
+}
+
+func (s *ctxStore) OpenContext(ctx context.Context, key string) (ExtStoreObj, error) {
+	s.seen = append(s.seen, ctx.Value(ctxKey{}))
+	return s.Open(key)
+}
+
+func TestDelivery_Context(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+
+	store := &ctxStore{FSStore: b.extStore.(*FSStore)}
+	b.extStore = store
+	defer func() { b.extStore = store.FSStore }()
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "delivery")
+	delivery := b.NewDeliveryContext(ctx)
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+	assert.DeepEqual(t, store.seen, []interface{}{"delivery"})
+
+	u, err := b.GetUserContext(ctx, t.Name())
+	assert.NilError(t, err)
+	_, mbox, err := u.(*User).GetMailboxContext(ctx, "INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 10)
+	fetchCtx := context.WithValue(context.Background(), ctxKey{}, "fetch")
+	err = mbox.(*Mailbox).ListMessagesContext(fetchCtx, false, seq, []imap.FetchItem{imap.FetchRFC822}, ch)
+	assert.NilError(t, err)
+	assert.Equal(t, len(ch), 1)
+	assert.DeepEqual(t, store.seen, []interface{}{"delivery", "fetch"})
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = mbox.(*Mailbox).ListMessagesContext(cancelled, false, seq, []imap.FetchItem{imap.FetchRFC822}, make(chan *imap.Message, 10))
+	assert.Assert(t, errors.Is(err, context.Canceled), "err = %v", err)
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = b.GetUserContext(expired, t.Name())
+	var deadlineErr DeadlineError
+	assert.Assert(t, errors.As(err, &deadlineErr), "err = %v", err)
+	assert.Assert(t, deadlineErr.Timeout())
+	assert.Equal(t, deadlineErr.Op, "GetUser")
+
+	delivery = b.NewDeliveryContext(expired)
+	err = delivery.AddRcpt(t.Name(), textproto.Header{})
+	assert.Assert(t, errors.As(err, &deadlineErr), "err = %v", err)
+	assert.Equal(t, len(store.seen), 2)
+}
+
+func TestContext_Cancelled(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	u, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	usr := u.(*User)
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	checkCancelled := func(err error, op string) {
+		t.Helper()
+		var deadlineErr DeadlineError
+		assert.Assert(t, errors.As(err, &deadlineErr), "%s: err = %v", op, err)
+		assert.Assert(t, errors.Is(err, context.Canceled), "%s: err = %v", op, err)
+		assert.Assert(t, !deadlineErr.Timeout(), op)
+	}
+
+	seq, _ := imap.ParseSeqSet("1")
+	checkCancelled(usr.CreateMailboxContext(ctx, "Box"), "CreateMailbox")
+	checkCancelled(usr.CreateMessageContext(ctx, "INBOX", nil, time.Now(), strings.NewReader(testMsg)), "CreateMessage")
+	checkCancelled(mbox.CopyMessagesContext(ctx, true, seq, "INBOX"), "CopyMessages")
+	checkCancelled(mbox.UpdateMessagesFlagsContext(ctx, true, seq, imap.AddFlags, true, []string{imap.FlaggedFlag}), "UpdateMessagesFlags")
+	checkCancelled(mbox.ExpungeContext(ctx), "Expunge")
+	_, err = usr.ListMailboxesContext(ctx, false)
+	checkCancelled(err, "ListMailboxes")
+	checkCancelled(b.DeleteUserContext(ctx, t.Name()), "DeleteUser")
+
+	// Nothing was changed.
+	assert.NilError(t, mbox.Poll(true))
+	status, err := usr.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(1))
+	mboxes, err := usr.ListMailboxes(false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(mboxes), 1)
+	assert.Assert(t, checkKeysCount(b, 1))
+}
+
+func TestDelivery_PerRecipient(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	for i := 1; i <= 3; i++ {
+		assert.NilError(t, b.CreateUser(t.Name()+"-"+strconv.Itoa(i)))
+	}
+	u2, err := b.GetUser(t.Name() + "-2")
+	assert.NilError(t, err)
+	limit := uint32(10)
+	assert.NilError(t, u2.(*User).SetMessageLimit(&limit))
+
+	delivery := b.NewDelivery()
+	delivery.PerRecipient()
+	for i := 1; i <= 3; i++ {
+		assert.NilError(t, delivery.AddRcpt(t.Name()+"-"+strconv.Itoa(i), textproto.Header{}))
+	}
+	assert.NilError(t, b.DeleteUser(t.Name()+"-3"))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+
+	results := delivery.Results()
+	assert.Equal(t, len(results), 3)
+	assert.Equal(t, results[0].Status, RcptDelivered)
+	assert.NilError(t, results[0].Err)
+	assert.Equal(t, results[1].Status, RcptPermFailed)
+	assert.Assert(t, errors.Is(results[1].Err, backend.ErrTooBig))
+	assert.Equal(t, results[2].Status, RcptTempFailed, "err = %v", results[2].Err)
+
+	assert.NilError(t, delivery.Commit())
+	for i, res := range delivery.Results() {
+		assert.Equal(t, res.Status, results[i].Status)
+	}
+
+	for i, count := range []uint32{1, 0} {
+		u, err := b.GetUser(t.Name() + "-" + strconv.Itoa(i+1))
+		assert.NilError(t, err)
+		status, err := u.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+		assert.NilError(t, err)
+		assert.Equal(t, status.Messages, count)
+	}
+
+	// Results are reset once the delivery is reused.
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", textproto.Header{}))
+	assert.DeepEqual(t, delivery.Results(), []RcptResult{{Username: strings.ToLower(t.Name()) + "-1"}})
+	assert.NilError(t, delivery.Abort())
+	assert.Equal(t, delivery.Results()[0].Status, RcptTempFailed)
+}
@@ -0,0 +1,583 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Domains group user accounts with the same domain part of the username
+// (everything after the last @) and provide defaults and limits for them.
+// Accounts are linked to the domain on creation or rename, and when the
+// domain is created.
+
+var (
+	ErrDomainAlreadyExists = errors.New("imapsql: domain already exists")
+	ErrDomainDoesntExists  = errors.New("imapsql: domain doesn't exists")
+	ErrDomainFull          = errors.New("imapsql: maximum amount of accounts in the domain is reached")
+)
+
+// Domain describes the domain and its settings.
+//
+// There is no default storage quota for the domain since storage quotas are
+// not supported at all, DomainStats can be used to enforce them externally.
+type Domain struct {
+	Name string
+	// Maximum amount of accounts in the domain, 0 if unlimited.
+	MaxUsers int
+	// APPENDLIMIT value set for new accounts in the domain, nil if no limit
+	// is set.
+	MessageLimit *uint32
+	// All accounts in the domain are handled as if they were suspended
+	// (see StatusSuspended). Accounts pending deletion are not affected.
+	Suspended bool
+	// Account that gets messages for addresses in the domain that do not
+	// match any account or alias. Empty if not set. See CreateAlias.
+	CatchAll string
+}
+
+// DomainStats contains usage statistics for the domain.
+type DomainStats struct {
+	Users     int
+	Mailboxes int
+	Messages  int
+	// Total size of all messages in bytes.
+	Bytes int64
+}
+
+func (b *Backend) initDomains() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS domains (
+			id BIGSERIAL NOT NULL PRIMARY KEY AUTOINCREMENT,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			maxUsers INTEGER NOT NULL DEFAULT 0,
+			msgsizelimit INTEGER DEFAULT NULL,
+			suspended INTEGER NOT NULL DEFAULT 0,
+			usersCount INTEGER NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table domains")
+	}
+	if err := b.createIndex("users_domainId", "users", "domainId"); err != nil {
+		return wrapErr(err, "create index users_domainId")
+	}
+	return nil
+}
+
+func (b *Backend) prepareDomainStmts() error {
+	var err error
+	b.addDomain, err = b.db.Prepare(`
+		INSERT INTO domains(name)
+		VALUES (?)`)
+	if err != nil {
+		return wrapErr(err, "addDomain prep")
+	}
+	b.delDomain, err = b.db.Prepare(`
+		DELETE FROM domains
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "delDomain prep")
+	}
+	b.getDomain, err = b.db.Prepare(`
+		SELECT id, name, maxUsers, msgsizelimit, suspended
+		FROM domains
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "getDomain prep")
+	}
+	b.listDomains, err = b.db.Prepare(`
+		SELECT id, name, maxUsers, msgsizelimit, suspended
+		FROM domains
+		ORDER BY name`)
+	if err != nil {
+		return wrapErr(err, "listDomains prep")
+	}
+	b.setDomainMaxUsers, err = b.db.Prepare(`
+		UPDATE domains
+		SET maxUsers = ?
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "setDomainMaxUsers prep")
+	}
+	b.setDomainMsgSizeLimit, err = b.db.Prepare(`
+		UPDATE domains
+		SET msgsizelimit = ?
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "setDomainMsgSizeLimit prep")
+	}
+	b.setDomainSuspended, err = b.db.Prepare(`
+		UPDATE domains
+		SET suspended = ?
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "setDomainSuspended prep")
+	}
+	b.linkDomainUsers, err = b.db.Prepare(`
+		UPDATE users
+		SET domainId = ?
+		WHERE username LIKE ?`)
+	if err != nil {
+		return wrapErr(err, "linkDomainUsers prep")
+	}
+	b.setUserDomain, err = b.db.Prepare(`
+		UPDATE users
+		SET domainId = ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "setUserDomain prep")
+	}
+	b.domainUsers, err = b.db.Prepare(`
+		SELECT username
+		FROM users
+		WHERE domainId = ?
+		ORDER BY id`)
+	if err != nil {
+		return wrapErr(err, "domainUsers prep")
+	}
+	b.domainUsersCount, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM users
+		WHERE domainId = ?`)
+	if err != nil {
+		return wrapErr(err, "domainUsersCount prep")
+	}
+	b.userDomainId, err = b.db.Prepare(`
+		SELECT domainId
+		FROM users
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "userDomainId prep")
+	}
+	// usersCount is checked and changed in one statement so concurrent
+	// transactions can not exceed maxUsers.
+	b.addDomainUser, err = b.db.Prepare(`
+		UPDATE domains
+		SET usersCount = usersCount + 1
+		WHERE id = ? AND (maxUsers = 0 OR usersCount < maxUsers)`)
+	if err != nil {
+		return wrapErr(err, "addDomainUser prep")
+	}
+	b.delDomainUser, err = b.db.Prepare(`
+		UPDATE domains
+		SET usersCount = usersCount - 1
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "delDomainUser prep")
+	}
+	b.setDomainUsersCount, err = b.db.Prepare(`
+		UPDATE domains
+		SET usersCount = (SELECT count(*) FROM users WHERE domainId = ?)
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "setDomainUsersCount prep")
+	}
+	b.domainMboxStats, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM mboxes
+		INNER JOIN users
+		ON mboxes.uid = users.id
+		WHERE users.domainId = ?`)
+	if err != nil {
+		return wrapErr(err, "domainMboxStats prep")
+	}
+	b.domainMsgStats, err = b.db.Prepare(`
+		SELECT count(*), coalesce(sum(msgs.bodyLen), 0)
+		FROM msgs
+		INNER JOIN mboxes
+		ON msgs.mboxId = mboxes.id
+		INNER JOIN users
+		ON mboxes.uid = users.id
+		WHERE users.domainId = ?`)
+	if err != nil {
+		return wrapErr(err, "domainMsgStats prep")
+	}
+	b.delDomainAliases, err = b.db.Prepare(`
+		DELETE FROM aliases
+		WHERE alias LIKE ?`)
+	if err != nil {
+		return wrapErr(err, "delDomainAliases prep")
+	}
+	return nil
+}
+
+// userDomain returns the domain part of the username.
+func userDomain(username string) string {
+	at := strings.LastIndexByte(username, '@')
+	if at == -1 {
+		return ""
+	}
+	return username[at+1:]
+}
+
+func checkDomainName(name string) error {
+	// % and _ are LIKE wildcards.
+	if name == "" || strings.ContainsAny(name, "@%_ ") {
+		return errors.New("imapsql: invalid domain name")
+	}
+	return nil
+}
+
+func scanDomain(row interface{ Scan(...interface{}) error }) (uint64, Domain, error) {
+	var (
+		id        uint64
+		dom       Domain
+		limit     sql.NullInt64
+		suspended int
+	)
+	if err := row.Scan(&id, &dom.Name, &dom.MaxUsers, &limit, &suspended); err != nil {
+		return 0, Domain{}, err
+	}
+	if limit.Valid {
+		val := uint32(limit.Int64)
+		dom.MessageLimit = &val
+	}
+	dom.Suspended = suspended != 0
+	return id, dom, nil
+}
+
+// CreateDomain creates the domain with default settings. Existing accounts
+// with usernames in the domain are linked to it.
+func (b *Backend) CreateDomain(name string) error {
+	name = normalizeUsername(name)
+	if err := checkDomainName(name); err != nil {
+		return err
+	}
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "CreateDomain")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(b.addDomain).Exec(name); err != nil {
+		if isForeignKeyErr(err) {
+			return ErrDomainAlreadyExists
+		}
+		return wrapErr(err, "CreateDomain")
+	}
+	id, _, err := scanDomain(tx.Stmt(b.getDomain).QueryRow(name))
+	if err != nil {
+		return wrapErr(err, "CreateDomain")
+	}
+	if _, err := tx.Stmt(b.linkDomainUsers).Exec(id, "%@"+name); err != nil {
+		return wrapErr(err, "CreateDomain")
+	}
+	// New domain has no account limit, but it is counted for the one set
+	// later.
+	if _, err := tx.Stmt(b.setDomainUsersCount).Exec(id, id); err != nil {
+		return wrapErr(err, "CreateDomain")
+	}
+
+	return tx.Commit()
+}
+
+// GetDomain returns the domain with its settings.
+func (b *Backend) GetDomain(name string) (Domain, error) {
+	_, dom, err := scanDomain(b.getDomain.QueryRow(normalizeUsername(name)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Domain{}, ErrDomainDoesntExists
+		}
+		return Domain{}, wrapErr(err, "GetDomain")
+	}
+	if dom.CatchAll, err = b.domainCatchAll(dom.Name); err != nil {
+		return Domain{}, wrapErr(err, "GetDomain")
+	}
+	return dom, nil
+}
+
+// ListDomains returns all domains sorted by name.
+func (b *Backend) ListDomains() ([]Domain, error) {
+	var res []Domain
+	rows, err := b.listDomains.Query()
+	if err != nil {
+		return res, wrapErr(err, "ListDomains")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		_, dom, err := scanDomain(rows)
+		if err != nil {
+			return res, wrapErr(err, "ListDomains")
+		}
+		res = append(res, dom)
+	}
+	if err := rows.Err(); err != nil {
+		return res, wrapErr(err, "ListDomains")
+	}
+	rows.Close()
+
+	for i := range res {
+		if res[i].CatchAll, err = b.domainCatchAll(res[i].Name); err != nil {
+			return res, wrapErr(err, "ListDomains")
+		}
+	}
+	return res, nil
+}
+
+func (b *Backend) domainCatchAll(name string) (string, error) {
+	acct, err := scanAlias(b.getAlias.QueryRow("@" + name))
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return acct.username, err
+}
+
+func (b *Backend) domainId(op, name string) (uint64, error) {
+	id, _, err := scanDomain(b.getDomain.QueryRow(name))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrDomainDoesntExists
+		}
+		return 0, wrapErr(err, op)
+	}
+	return id, nil
+}
+
+// ListDomainUsers returns usernames of accounts in the domain.
+func (b *Backend) ListDomainUsers(name string) ([]string, error) {
+	id, err := b.domainId("ListDomainUsers", normalizeUsername(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	rows, err := b.domainUsers.Query(id)
+	if err != nil {
+		return res, wrapErr(err, "ListDomainUsers")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return res, wrapErr(err, "ListDomainUsers")
+		}
+		res = append(res, name)
+	}
+	if err := rows.Err(); err != nil {
+		return res, wrapErr(err, "ListDomainUsers")
+	}
+	return res, nil
+}
+
+// GetDomainStats returns usage statistics for the domain.
+func (b *Backend) GetDomainStats(name string) (DomainStats, error) {
+	id, err := b.domainId("GetDomainStats", normalizeUsername(name))
+	if err != nil {
+		return DomainStats{}, err
+	}
+
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return DomainStats{}, wrapErr(err, "GetDomainStats")
+	}
+	defer tx.Rollback()
+
+	var stats DomainStats
+	if err := tx.Stmt(b.domainUsersCount).QueryRow(id).Scan(&stats.Users); err != nil {
+		return DomainStats{}, wrapErr(err, "GetDomainStats")
+	}
+	if err := tx.Stmt(b.domainMboxStats).QueryRow(id).Scan(&stats.Mailboxes); err != nil {
+		return DomainStats{}, wrapErr(err, "GetDomainStats")
+	}
+	if err := tx.Stmt(b.domainMsgStats).QueryRow(id).Scan(&stats.Messages, &stats.Bytes); err != nil {
+		return DomainStats{}, wrapErr(err, "GetDomainStats")
+	}
+	return stats, nil
+}
+
+func (b *Backend) updateDomain(stmt *sql.Stmt, op, name string, val interface{}) error {
+	res, err := stmt.Exec(val, normalizeUsername(name))
+	if err != nil {
+		return wrapErr(err, op)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(err, op)
+	}
+	if affected == 0 {
+		return ErrDomainDoesntExists
+	}
+	return nil
+}
+
+// SetDomainMaxUsers changes the maximum amount of accounts in the domain.
+// Use 0 to remove the limit. Existing accounts are not affected.
+func (b *Backend) SetDomainMaxUsers(name string, max int) error {
+	if max < 0 {
+		return errors.New("imapsql: negative account limit")
+	}
+	return b.updateDomain(b.setDomainMaxUsers, "SetDomainMaxUsers", name, max)
+}
+
+// SetDomainMessageLimit changes the APPENDLIMIT value set for new accounts in
+// the domain. Existing accounts are not affected.
+func (b *Backend) SetDomainMessageLimit(name string, val *uint32) error {
+	return b.updateDomain(b.setDomainMsgSizeLimit, "SetDomainMessageLimit", name, val)
+}
+
+// SetDomainSuspended suspends or unsuspends all accounts in the domain.
+func (b *Backend) SetDomainSuspended(name string, suspended bool) error {
+	val := 0
+	if suspended {
+		val = 1
+	}
+	return b.updateDomain(b.setDomainSuspended, "SetDomainSuspended", name, val)
+}
+
+// SetDomainCatchAll sets the catch-all account for the domain. Use empty
+// username to remove it. It is the same as CreateAlias with "@domain" alias.
+func (b *Backend) SetDomainCatchAll(name, username string) error {
+	name = normalizeUsername(name)
+	if _, err := b.domainId("SetDomainCatchAll", name); err != nil {
+		return err
+	}
+
+	if err := b.DeleteAlias("@" + name); err != nil && err != ErrAliasDoesntExists {
+		return err
+	}
+	if username == "" {
+		return nil
+	}
+	return b.CreateAlias("@"+name, username, "")
+}
+
+// DeleteDomain deletes all accounts in the domain, aliases with addresses in
+// the domain and then the domain itself. Everything is deleted in one
+// transaction, so nothing is deleted if it fails.
+//
+// ErrLegalHold is returned and nothing is deleted if any account in the
+// domain is on legal hold.
+func (b *Backend) DeleteDomain(name string) error {
+	name = normalizeUsername(name)
+	ctx := context.Background()
+
+	tx, err := b.db.BeginLevel(sql.LevelReadCommitted, false)
+	if err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	defer tx.Rollback()
+
+	id, _, err := scanDomain(tx.Stmt(b.getDomain).QueryRow(name))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrDomainDoesntExists
+		}
+		return wrapErr(err, "DeleteDomain")
+	}
+	var held int
+	if err := tx.Stmt(b.domainLegalHolds).QueryRow(id).Scan(&held); err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	if held != 0 {
+		return ErrLegalHold
+	}
+
+	var users []string
+	rows, err := tx.Stmt(b.domainUsers).Query(id)
+	if err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			rows.Close()
+			return wrapErr(err, "DeleteDomain")
+		}
+		users = append(users, username)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+
+	var keys []string
+	for _, username := range users {
+		uid, _, _, err := b.getUserMeta(ctx, tx, username)
+		if err != nil {
+			return wrapErrf(err, "DeleteDomain (DeleteUser %s)", username)
+		}
+		userKeys, err := b.deleteUser(ctx, tx, uid, username)
+		if err != nil {
+			return wrapErrf(err, "DeleteDomain (DeleteUser %s)", username)
+		}
+		keys = append(keys, userKeys...)
+	}
+
+	var remaining int
+	if err := tx.Stmt(b.domainUsersCount).QueryRow(id).Scan(&remaining); err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	if remaining != 0 {
+		return errors.New("imapsql: DeleteDomain: accounts were added to the domain concurrently")
+	}
+	if _, err := tx.Stmt(b.delDomainAliases).Exec("%@" + name); err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	if _, err := tx.Stmt(b.delDomain).Exec(id); err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	if err := tx.Commit(); err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	b.searchIndexChanged()
+	b.deleteQueuedBlobs(keys)
+	return nil
+}
+
+// linkUserDomain links the account to the domain of its username, if it
+// exists, and unlinks it from the previous one. ErrDomainFull is returned if
+// the domain has the maximum amount of accounts. If applyDefaults is set,
+// domain defaults are set for the account.
+func (b *Backend) linkUserDomain(ctx context.Context, tx *sql.Tx, uid uint64, username string, applyDefaults bool) error {
+	var (
+		domId uint64
+		dom   Domain
+		err   error
+	)
+	if name := userDomain(username); name != "" {
+		domId, dom, err = scanDomain(tx.Stmt(b.getDomain).QueryRowContext(ctx, name))
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	var oldDomId sql.NullInt64
+	if err := tx.Stmt(b.userDomainId).QueryRowContext(ctx, uid).Scan(&oldDomId); err != nil {
+		return err
+	}
+	if oldDomId.Valid && uint64(oldDomId.Int64) != domId {
+		if _, err := tx.Stmt(b.delDomainUser).ExecContext(ctx, oldDomId.Int64); err != nil {
+			return err
+		}
+	}
+
+	if domId == 0 {
+		_, err := tx.Stmt(b.setUserDomain).ExecContext(ctx, nil, uid)
+		return err
+	}
+
+	if !oldDomId.Valid || uint64(oldDomId.Int64) != domId {
+		res, err := tx.Stmt(b.addDomainUser).ExecContext(ctx, domId)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrDomainFull
+		}
+	}
+	if _, err := tx.Stmt(b.setUserDomain).ExecContext(ctx, domId, uid); err != nil {
+		return err
+	}
+	if applyDefaults && dom.MessageLimit != nil {
+		if _, err := tx.Stmt(b.setUserMsgSizeLimit).ExecContext(ctx, dom.MessageLimit, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestDomains(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("existing@example.org"))
+	assert.NilError(t, b.CreateUser("user@example.com"))
+
+	assert.Assert(t, b.CreateDomain("bad_domain") != nil)
+	assert.NilError(t, b.CreateDomain("Example.org"))
+	assert.Equal(t, b.CreateDomain("example.org"), ErrDomainAlreadyExists)
+	assert.NilError(t, b.CreateDomain("example.net"))
+
+	limit := uint32(1024)
+	assert.NilError(t, b.SetDomainMessageLimit("example.org", &limit))
+	assert.NilError(t, b.SetDomainMaxUsers("example.org", 2))
+	assert.Equal(t, b.SetDomainMaxUsers("example.com", 2), ErrDomainDoesntExists)
+
+	assert.NilError(t, b.CreateUser("new@example.org"))
+	assert.Equal(t, b.CreateUser("third@example.org"), ErrDomainFull)
+	assert.Equal(t, b.RenameUser("user@example.com", "third@example.org", false), ErrDomainFull)
+	assert.NilError(t, b.RenameUser("new@example.org", "renamed@example.org", false))
+
+	u, err := b.GetUser("renamed@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, *u.(*User).CreateMessageLimit(), limit)
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	users, err := b.ListDomainUsers("example.org")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"existing@example.org", "renamed@example.org"})
+
+	stats, err := b.GetDomainStats("example.org")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, stats, DomainStats{Users: 2, Mailboxes: 2, Messages: 1, Bytes: int64(len(testMsg))})
+
+	assert.NilError(t, b.SetDomainCatchAll("example.org", "existing@example.org"))
+	list, err := b.ListDomains()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, list, []Domain{
+		{Name: "example.net"},
+		{Name: "example.org", MaxUsers: 2, MessageLimit: &limit, CatchAll: "existing@example.org"},
+	})
+
+	// Accounts moved out of the domain or deleted free their places.
+	assert.NilError(t, b.RenameUser("renamed@example.org", "renamed@example.net", false))
+	assert.NilError(t, b.CreateUser("third@example.org"))
+	assert.Equal(t, b.CreateUser("fourth@example.org"), ErrDomainFull)
+	assert.NilError(t, b.DeleteUser("third@example.org"))
+	assert.NilError(t, b.CreateUser("fourth@example.org"))
+}
+
+func TestDomains_Suspended(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateDomain("example.org"))
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.CreateUser("user@example.com"))
+	assert.NilError(t, b.CreateAlias("alias@example.com", "user@example.org", ""))
+
+	assert.NilError(t, b.SetDomainSuspended("example.org", true))
+	_, err := b.GetUser("user@example.org")
+	assert.Equal(t, err, ErrAccountSuspended)
+	_, err = b.GetUser("user@example.com")
+	assert.NilError(t, err)
+
+	delivery := b.NewDelivery()
+	assert.Equal(t, delivery.AddRcpt("alias@example.com", textproto.Header{}), ErrAccountSuspended)
+	assert.NilError(t, delivery.Abort())
+
+	assert.NilError(t, b.SetDomainSuspended("example.org", false))
+	_, err = b.GetUser("user@example.org")
+	assert.NilError(t, err)
+}
+
+func TestDeleteDomain(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateDomain("example.org"))
+	assert.NilError(t, b.CreateUser("user1@example.org"))
+	assert.NilError(t, b.CreateUser("user2@example.org"))
+	assert.NilError(t, b.CreateUser("user@example.com"))
+	assert.NilError(t, b.CreateAlias("alias@example.org", "user@example.com", ""))
+	assert.NilError(t, b.CreateAlias("alias@example.com", "user1@example.org", ""))
+	assert.NilError(t, b.SetDomainCatchAll("example.org", "user@example.com"))
+
+	u, err := b.GetUser("user1@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	assert.NilError(t, b.DeleteDomain("example.org"))
+	assert.Equal(t, b.DeleteDomain("example.org"), ErrDomainDoesntExists)
+
+	users, err := b.ListUsers()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"user@example.com"})
+	aliases, err := b.ListAliases()
+	assert.NilError(t, err)
+	assert.Equal(t, len(aliases), 0)
+
+	// Accounts created later are not linked to the deleted domain.
+	assert.NilError(t, b.CreateUser("user1@example.org"))
+	assert.NilError(t, b.CreateDomain("example.org"))
+	users, err = b.ListDomainUsers("example.org")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"user1@example.org"})
+}
@@ -20,6 +20,9 @@ func wrapErr(err error, desc string) error {
 	if err == nil {
 		return nil
 	}
+	if de := deadlineErr(err, desc); de != nil {
+		return de
+	}
 	return fmt.Errorf(desc+": %w", err)
 }
 
@@ -30,6 +33,9 @@ func wrapErrf(err error, format string, args ...interface{}) error {
 	if isSerializationErr(err) {
 		return SerializationError{Err: err}
 	}
+	if de := deadlineErr(err, fmt.Sprintf(format, args...)); de != nil {
+		return de
+	}
 
 	args = append(args, err)
 	return fmt.Errorf(format+": %w", args...)
@@ -1,6 +1,7 @@
 package imapsql
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -57,6 +58,37 @@ type ExternalStore interface {
 	Delete(keys []string) error
 }
 
+// ContextExternalStore can be implemented by ExternalStore to allow
+// cancellation of slow operations. If the store implements it, methods below
+// are used instead of the ExternalStore ones when the context is available.
+//
+// There is no Delete counterpart since it is used to clean up after failed
+// or cancelled operations and should not be interrupted.
+type ContextExternalStore interface {
+	CreateContext(ctx context.Context, key string, objectSize int64) (ExtStoreObj, error)
+	OpenContext(ctx context.Context, key string) (ExtStoreObj, error)
+}
+
+func (b *Backend) extCreate(ctx context.Context, key string, objectSize int64) (ExtStoreObj, error) {
+	if store, ok := b.extStore.(ContextExternalStore); ok {
+		return store.CreateContext(ctx, key, objectSize)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.extStore.Create(key, objectSize)
+}
+
+func (b *Backend) extOpen(ctx context.Context, key string) (ExtStoreObj, error) {
+	if store, ok := b.extStore.(ContextExternalStore); ok {
+		return store.OpenContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.extStore.Open(key)
+}
+
 func randomKey() (string, error) {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
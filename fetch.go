@@ -3,6 +3,7 @@ package imapsql
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -17,6 +18,14 @@ import (
 )
 
 func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return m.ListMessagesContext(context.Background(), uid, seqset, items, ch)
+}
+
+// ListMessagesContext is a variant of ListMessages that aborts the operation
+// once ctx is cancelled. ch is closed in any case.
+//
+// DeadlineError is returned if ctx is cancelled or its deadline is exceeded.
+func (m *Mailbox) ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer close(ch)
 	var err error
 
@@ -40,10 +49,10 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 	}
 
 	// don't close statement, it is owned by cache
-	tx, err := m.parent.db.BeginLevel(sql.LevelReadCommitted, !setSeen)
+	tx, err := m.parent.db.BeginLevelContext(ctx, sql.LevelReadCommitted, !setSeen)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "ListMessages (tx start)", uid, seqset, items)
-		return err
+		return wrapErr(err, "ListMessages")
 	}
 	defer tx.Rollback()
 
@@ -60,26 +69,26 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 	for _, seq := range seqset.Set {
 		if setSeen {
 			params := m.makeFlagsAddStmtArgs([]string{imap.SeenFlag}, seq.Start, seq.Stop)
-			if _, err := tx.Stmt(addSeenStmt).Exec(params...); err != nil {
+			if _, err := tx.Stmt(addSeenStmt).ExecContext(ctx, params...); err != nil {
 				m.parent.logMboxErr(m, err, "ListMessages (add seen)", uid, seqset, items)
-				return err
+				return wrapErr(err, "ListMessages")
 			}
 
-			_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(1, m.id, seq.Start, seq.Stop)
+			_, err = tx.Stmt(m.parent.setSeenFlagUid).ExecContext(ctx, 1, m.id, seq.Start, seq.Stop)
 			if err != nil {
 				m.parent.logMboxErr(m, err, "ListMessages (setSeenFlag)", uid, seqset, items)
-				return err
+				return wrapErr(err, "ListMessages")
 			}
 		}
 
-		rows, err := tx.Stmt(stmt).Query(m.id, seq.Start, seq.Stop)
+		rows, err := tx.Stmt(stmt).QueryContext(ctx, m.id, seq.Start, seq.Stop)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "ListMessages", uid, seqset, items)
-			return err
+			return wrapErr(err, "ListMessages")
 		}
-		if err := m.scanMessages(rows, items, ch); err != nil {
+		if err := m.scanMessages(ctx, rows, items, ch); err != nil {
 			m.parent.logMboxErr(m, err, "ListMessages (scan)", uid, seqset, items)
-			return err
+			return wrapErr(err, "ListMessages")
 		}
 	}
 
@@ -135,7 +144,7 @@ func makeScanArgs(data *scanData, rows *sql.Rows) ([]interface{}, error) {
 	return scanOrder, nil
 }
 
-func (m *Mailbox) scanMessages(rows *sql.Rows, items []imap.FetchItem, ch chan<- *imap.Message) error {
+func (m *Mailbox) scanMessages(ctx context.Context, rows *sql.Rows, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer rows.Close()
 	data := scanData{}
 
@@ -196,7 +205,7 @@ messageLoop:
 					msg.Flags = append(msg.Flags, imap.RecentFlag)
 				}
 			default:
-				if err := m.extractBodyPart(item, &data, msg); err != nil {
+				if err := m.extractBodyPart(ctx, item, &data, msg); err != nil {
 					m.parent.logMboxErr(m, err, "failed to read body, skipping", data.seqNum, data.extBodyKey)
 					continue messageLoop
 				}
@@ -205,7 +214,11 @@ messageLoop:
 
 		m.parent.Opts.Log.Debugf("scanMessages: scanned msgId=%v (seq %v) %v", data.msgId, seqNum, items)
 
-		ch <- msg
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	if err := rows.Err(); err != nil {
 		return err
@@ -214,7 +227,7 @@ messageLoop:
 	return nil
 }
 
-func (m *Mailbox) extractBodyPart(item imap.FetchItem, data *scanData, msg *imap.Message) error {
+func (m *Mailbox) extractBodyPart(ctx context.Context, item imap.FetchItem, data *scanData, msg *imap.Message) error {
 	sect, part, err := getNeededPart(item)
 	if err != nil {
 		return err
@@ -230,7 +243,7 @@ func (m *Mailbox) extractBodyPart(item imap.FetchItem, data *scanData, msg *imap
 	case needHeader, needFullBody:
 		// We don't need to parse header once more if we already did, so we just skip it if we open body
 		// multiple times.
-		bufferedBody, err := m.openBody(data.parsedHeader == nil, data.compressAlgo, data.extBodyKey)
+		bufferedBody, err := m.openBody(ctx, data.parsedHeader == nil, data.compressAlgo, data.extBodyKey)
 		if err != nil {
 			return err
 		}
@@ -265,8 +278,12 @@ func (n nopCloser) Close() error {
 	return nil
 }
 
-func (m *Mailbox) openBody(needHeader bool, compressAlgoColumn, extBodyKey string) (BufferedReadCloser, error) {
-	rdr, err := m.parent.extStore.Open(extBodyKey)
+func (m *Mailbox) openBody(ctx context.Context, needHeader bool, compressAlgoColumn, extBodyKey string) (BufferedReadCloser, error) {
+	return m.parent.openBody(ctx, needHeader, compressAlgoColumn, extBodyKey)
+}
+
+func (b *Backend) openBody(ctx context.Context, needHeader bool, compressAlgoColumn, extBodyKey string) (BufferedReadCloser, error) {
+	rdr, err := b.extOpen(ctx, extBodyKey)
 	if err != nil {
 		return BufferedReadCloser{}, wrapErr(err, "openBody")
 	}
@@ -0,0 +1,244 @@
+package imapsql
+
+import (
+	"bytes"
+	"database/sql"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Per-user Sieve scripts are evaluated by Delivery for each recipient to
+// choose target mailboxes and flags. See sieve.go for the supported subset
+// of the language.
+
+func (b *Backend) initSieveScripts() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS sieveScripts (
+			userId BIGINT NOT NULL PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			script TEXT NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table sieveScripts")
+	}
+	return nil
+}
+
+func (b *Backend) prepareSieveStmts() error {
+	var err error
+	b.getSieveScript, err = b.db.Prepare(`
+		SELECT script
+		FROM sieveScripts
+		WHERE userId = ?`)
+	if err != nil {
+		return wrapErr(err, "getSieveScript prep")
+	}
+	b.delSieveScript, err = b.db.Prepare(`
+		DELETE FROM sieveScripts
+		WHERE userId = ?`)
+	if err != nil {
+		return wrapErr(err, "delSieveScript prep")
+	}
+	b.addSieveScript, err = b.db.Prepare(`
+		INSERT INTO sieveScripts(userId, script)
+		VALUES (?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addSieveScript prep")
+	}
+	return nil
+}
+
+// SieveScript returns the filtering script of the user, empty string if it
+// is not set.
+func (u *User) SieveScript() (string, error) {
+	var script string
+	if err := u.parent.getSieveScript.QueryRow(u.id).Scan(&script); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		u.parent.logUserErr(u, err, "SieveScript")
+		return "", wrapErr(err, "SieveScript")
+	}
+	return script, nil
+}
+
+// SetSieveScript replaces the filtering script of the user. Empty script
+// removes it.
+//
+// Script is checked before it is saved, SieveError is returned if it can
+// not be parsed or uses unsupported features.
+func (u *User) SetSieveScript(script string) error {
+	if script != "" {
+		if _, err := parseSieve(script); err != nil {
+			return err
+		}
+	}
+
+	tx, err := u.parent.db.Begin(false)
+	if err != nil {
+		u.parent.logUserErr(u, err, "SetSieveScript (tx start)")
+		return wrapErr(err, "SetSieveScript")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(u.parent.delSieveScript).Exec(u.id); err != nil {
+		u.parent.logUserErr(u, err, "SetSieveScript (delSieveScript)")
+		return wrapErr(err, "SetSieveScript")
+	}
+	if script != "" {
+		if _, err := tx.Stmt(u.parent.addSieveScript).Exec(u.id, script); err != nil {
+			u.parent.logUserErr(u, err, "SetSieveScript (addSieveScript)")
+			return wrapErr(err, "SetSieveScript")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// EnvelopeFrom sets the envelope sender address used by the "envelope"
+// test in Sieve scripts. It should be called before BodyParsed/BodyRaw.
+func (d *Delivery) EnvelopeFrom(addr string) {
+	d.envelopeFrom = addr
+}
+
+// deliveryTarget is the mailbox the message is stored into with the flags
+// set. rcpts are indexes of recipients the message is stored for, header
+// fields of the first one are added to it.
+type deliveryTarget struct {
+	mbox  Mailbox
+	flags []string
+	rcpts []int
+}
+
+// addTarget appends target to targets. If the message is already stored
+// into the same mailbox for another recipient or Sieve action, a single copy
+// is stored with flags of both.
+func addTarget(targets []deliveryTarget, target deliveryTarget) []deliveryTarget {
+	for i := range targets {
+		if targets[i].mbox.id != target.mbox.id {
+			continue
+		}
+		targets[i].flags = mergeFlags(targets[i].flags, target.flags)
+		for _, rcpt := range target.rcpts {
+			if !containsRcpt(targets[i].rcpts, rcpt) {
+				targets[i].rcpts = append(targets[i].rcpts, rcpt)
+			}
+		}
+		return targets
+	}
+	return append(targets, target)
+}
+
+func containsRcpt(rcpts []int, rcpt int) bool {
+	for _, r := range rcpts {
+		if r == rcpt {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTargets evaluates Sieve scripts of recipients and returns the list
+// of mailboxes the message should be stored into.
+//
+// It should be called before the delivery transaction is started.
+func (d *Delivery) filterTargets(header textproto.Header, bodyLen int) ([]deliveryTarget, error) {
+	var (
+		targets = make([]deliveryTarget, 0, len(d.mboxes))
+		scripts = make(map[uint64][]sieveCmd)
+	)
+	for _, mbox := range d.mboxes {
+		defaultFlags := d.flagOverrides[mbox.user.username]
+
+		cmds, ok := scripts[mbox.user.id]
+		if !ok {
+			var err error
+			cmds, err = d.loadSieve(&mbox.user)
+			if err != nil {
+				if d.perRcpt {
+					d.setResult(mbox.rcpt, rcptFailureStatus(err), err)
+					continue
+				}
+				return nil, err
+			}
+			scripts[mbox.user.id] = cmds
+		}
+		if cmds == nil {
+			targets = addTarget(targets, deliveryTarget{mbox: mbox.Mailbox, flags: defaultFlags, rcpts: []int{mbox.rcpt}})
+			continue
+		}
+
+		rcptHeader := d.rcptHeader(header, mbox.rcpt)
+		headerBlob := bytes.Buffer{}
+		if err := textproto.WriteHeader(&headerBlob, rcptHeader); err != nil {
+			return nil, wrapErr(err, "Body (WriteHeader)")
+		}
+
+		actions := runSieve(cmds, &sieveMsg{
+			header:       rcptHeader,
+			size:         int64(headerBlob.Len() + bodyLen),
+			envelopeFrom: d.envelopeFrom,
+			envelopeTo:   mbox.user.username,
+		})
+		if len(actions) == 0 {
+			d.b.Opts.Log.Debugln("delivery: message discarded by filter for", mbox.user.username)
+			if d.perRcpt {
+				d.setResult(mbox.rcpt, RcptDelivered, nil)
+			}
+			continue
+		}
+
+		for _, act := range actions {
+			target := deliveryTarget{mbox: mbox.Mailbox, flags: mergeFlags(defaultFlags, act.flags), rcpts: []int{mbox.rcpt}}
+			if act.mailbox != "" {
+				fileinto, err := d.fileintoMailbox(&mbox.user, act.mailbox)
+				if err != nil {
+					// Per RFC 5228, the message is kept if the action
+					// fails.
+					d.b.Opts.Log.Printf("delivery: fileinto %s failed for %s, keeping: %v", act.mailbox, mbox.user.username, err)
+				} else {
+					target.mbox = fileinto
+				}
+			}
+			targets = addTarget(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// loadSieve returns the parsed filtering script of the user or nil if it
+// is not set.
+func (d *Delivery) loadSieve(u *User) ([]sieveCmd, error) {
+	var script string
+	if err := d.b.getSieveScript.QueryRowContext(d.ctx, u.id).Scan(&script); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, wrapErr(err, "Body (getSieveScript)")
+	}
+
+	cmds, err := parseSieve(script)
+	if err != nil {
+		// Scripts are checked when saved so it should not happen unless
+		// the supported subset changed.
+		d.b.Opts.Log.Printf("delivery: ignoring broken filter of %s: %v", u.username, err)
+		return nil, nil
+	}
+	return cmds, nil
+}
+
+// fileintoMailbox returns the mailbox for the fileinto action, it is
+// created if it does not exist, similarly to Delivery.Mailbox.
+func (d *Delivery) fileintoMailbox(u *User, name string) (Mailbox, error) {
+	_, mbox, err := u.GetMailboxContext(d.ctx, name, true, nil)
+	if err == backend.ErrNoSuchMailbox {
+		if err := u.CreateMailbox(name); err != nil && err != backend.ErrMailboxAlreadyExists {
+			return Mailbox{}, err
+		}
+		_, mbox, err = u.GetMailboxContext(d.ctx, name, true, nil)
+	}
+	if err != nil {
+		return Mailbox{}, err
+	}
+	return *mbox.(*Mailbox), nil
+}
@@ -1,6 +1,7 @@
 package imapsql
 
 import (
+	"context"
 	"database/sql"
 	"strings"
 
@@ -8,6 +9,15 @@ import (
 )
 
 func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string) error {
+	return m.UpdateMessagesFlagsContext(context.Background(), uid, seqset, operation, silent, flags)
+}
+
+// UpdateMessagesFlagsContext is a variant of UpdateMessagesFlags that
+// aborts the transaction once ctx is cancelled.
+func (m *Mailbox) UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string) error {
+	if err := m.user.checkWritable(); err != nil {
+		return err
+	}
 	defer m.handle.Sync(uid)
 
 	seenModified := false
@@ -39,7 +49,7 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 		return wrapErr(err, "UpdateMessagesFlags")
 	}
 
-	tx, err := m.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
+	tx, err := m.parent.db.BeginLevelContext(ctx, sql.LevelRepeatableRead, false)
 	if err != nil {
 		return wrapErr(err, "UpdateMessagesFlags")
 	}
@@ -53,14 +63,14 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 	for _, seq := range seqset.Set {
 		switch operation {
 		case imap.SetFlags:
-			_, err = tx.Stmt(m.parent.massClearFlagsUid).Exec(m.id, seq.Start, seq.Stop)
+			_, err = tx.Stmt(m.parent.massClearFlagsUid).ExecContext(ctx, m.id, seq.Start, seq.Stop)
 			if err != nil {
 				return err
 			}
 			fallthrough
 		case imap.AddFlags:
 			if seenModified {
-				_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(1, m.id, seq.Start, seq.Stop)
+				_, err = tx.Stmt(m.parent.setSeenFlagUid).ExecContext(ctx, 1, m.id, seq.Start, seq.Stop)
 				if err != nil {
 					return err
 				}
@@ -71,12 +81,12 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 			}
 
 			args := m.makeFlagsAddStmtArgs(flags, seq.Start, seq.Stop)
-			if _, err := tx.Stmt(addQuery).Exec(args...); err != nil {
+			if _, err := tx.Stmt(addQuery).ExecContext(ctx, args...); err != nil {
 				return err
 			}
 		case imap.RemoveFlags:
 			if seenModified {
-				_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(0, m.id, seq.Start, seq.Stop)
+				_, err = tx.Stmt(m.parent.setSeenFlagUid).ExecContext(ctx, 0, m.id, seq.Start, seq.Stop)
 				if err != nil {
 					return err
 				}
@@ -87,7 +97,7 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 			}
 
 			args := m.makeFlagsRemStmtArgs(flags, seq.Start, seq.Stop)
-			if _, err := tx.Stmt(remQuery).Exec(args...); err != nil {
+			if _, err := tx.Stmt(remQuery).ExecContext(ctx, args...); err != nil {
 				return err
 			}
 		}
@@ -95,7 +105,7 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 
 	// We buffer updates before transaction commit so we
 	// will not send them if tx.Commit fails.
-	updatesBuffer, err := m.flagUpdates(tx, uid, seqset)
+	updatesBuffer, err := m.flagUpdates(ctx, tx, uid, seqset)
 	if err != nil {
 		return wrapErr(err, "UpdateMessagesFlags")
 	}
@@ -108,6 +118,9 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 	for _, upd := range updatesBuffer {
 		m.handle.FlagsChanged(upd.uid, upd.flags, silent)
 	}
+	if m.searchCtx != nil && len(updatesBuffer) != 0 {
+		m.searchCtx.flagsChanged = true
+	}
 	return nil
 }
 
@@ -116,14 +129,14 @@ type flagUpdate struct {
 	flags []string
 }
 
-func (m *Mailbox) flagUpdates(tx *sql.Tx, uid bool, seqset *imap.SeqSet) ([]flagUpdate, error) {
+func (m *Mailbox) flagUpdates(ctx context.Context, tx *sql.Tx, uid bool, seqset *imap.SeqSet) ([]flagUpdate, error) {
 	var updatesBuffer []flagUpdate
 
 	for _, seq := range seqset.Set {
 		var err error
 		var rows *sql.Rows
 
-		rows, err = tx.Stmt(m.parent.msgFlagsUid).Query(m.id, seq.Start, seq.Stop)
+		rows, err = tx.Stmt(m.parent.msgFlagsUid).QueryContext(ctx, m.id, seq.Start, seq.Stop)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,424 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+)
+
+// Amount of journal records after which FSIndex writes the snapshot and
+// truncates the journal.
+const fsIndexSnapshotInterval = 10000
+
+type fsIndexDoc struct {
+	Mbox  uint64   `json:"mbox"`
+	UID   uint32   `json:"uid"`
+	Grams []string `json:"grams,omitempty"`
+}
+
+type fsIndexRecord struct {
+	Seq uint64  `json:"seq"`
+	Op  IndexOp `json:"op"`
+	fsIndexDoc
+}
+
+type fsIndexSnapshot struct {
+	Seq  uint64       `json:"seq"`
+	Docs []fsIndexDoc `json:"docs"`
+}
+
+type fsDocKey struct {
+	mbox uint64
+	uid  uint32
+}
+
+// FSIndex is the SearchIndex implementation that keeps the trigram index of
+// message texts in memory and persists it in the directory on local disk.
+//
+// Changes are appended to the journal file and the full index snapshot is
+// written periodically. Changes are durable once Cursor is called.
+//
+// It is meant as a reference implementation and is suitable for small
+// installations only since the whole index is kept in memory.
+type FSIndex struct {
+	root string
+
+	lck      sync.RWMutex
+	docs     map[uint64]map[uint32][]string
+	postings map[string]map[fsDocKey]struct{}
+	lastSeq  uint64
+
+	journal        *os.File
+	journalW       *bufio.Writer
+	journalRecords int
+}
+
+// NewFSIndex opens or creates the index in the root directory.
+//
+// Changes written to the journal before the crash are replayed, the
+// incomplete last record is discarded.
+func NewFSIndex(root string) (*FSIndex, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, wrapErr(err, "NewFSIndex")
+	}
+
+	idx := &FSIndex{
+		root:     root,
+		docs:     make(map[uint64]map[uint32][]string),
+		postings: make(map[string]map[fsDocKey]struct{}),
+	}
+	if err := idx.loadSnapshot(); err != nil {
+		return nil, wrapErr(err, "NewFSIndex (snapshot)")
+	}
+	if err := idx.replayJournal(); err != nil {
+		return nil, wrapErr(err, "NewFSIndex (journal)")
+	}
+
+	var err error
+	idx.journal, err = os.OpenFile(idx.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, wrapErr(err, "NewFSIndex")
+	}
+	idx.journalW = bufio.NewWriter(idx.journal)
+	return idx, nil
+}
+
+func (idx *FSIndex) snapshotPath() string {
+	return filepath.Join(idx.root, "index.json")
+}
+
+func (idx *FSIndex) journalPath() string {
+	return filepath.Join(idx.root, "journal.jsonl")
+}
+
+func (idx *FSIndex) loadSnapshot() error {
+	f, err := os.Open(idx.snapshotPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var snapshot fsIndexSnapshot
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(&snapshot); err != nil {
+		return err
+	}
+	for _, doc := range snapshot.Docs {
+		idx.add(doc)
+	}
+	idx.lastSeq = snapshot.Seq
+	return nil
+}
+
+func (idx *FSIndex) replayJournal() error {
+	f, err := os.OpenFile(idx.journalPath(), os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var (
+		rdr    = bufio.NewReader(f)
+		offset int64
+	)
+	for {
+		line, err := rdr.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec fsIndexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// Record was not written completely, it was not acknowledged by
+			// Cursor too so it is safe to drop it.
+			break
+		}
+		offset += int64(len(line))
+		idx.journalRecords++
+
+		// Records already included in the snapshot are left in the journal
+		// if we crashed while truncating it.
+		if rec.Seq <= idx.lastSeq {
+			continue
+		}
+		idx.apply(rec)
+	}
+
+	return f.Truncate(offset)
+}
+
+func (idx *FSIndex) add(doc fsIndexDoc) {
+	idx.remove(doc.Mbox, doc.UID)
+
+	mbox := idx.docs[doc.Mbox]
+	if mbox == nil {
+		mbox = make(map[uint32][]string)
+		idx.docs[doc.Mbox] = mbox
+	}
+	mbox[doc.UID] = doc.Grams
+
+	key := fsDocKey{doc.Mbox, doc.UID}
+	for _, gram := range doc.Grams {
+		posting := idx.postings[gram]
+		if posting == nil {
+			posting = make(map[fsDocKey]struct{})
+			idx.postings[gram] = posting
+		}
+		posting[key] = struct{}{}
+	}
+}
+
+func (idx *FSIndex) remove(mboxID uint64, uid uint32) {
+	grams, ok := idx.docs[mboxID][uid]
+	if !ok {
+		return
+	}
+	delete(idx.docs[mboxID], uid)
+
+	key := fsDocKey{mboxID, uid}
+	for _, gram := range grams {
+		delete(idx.postings[gram], key)
+		if len(idx.postings[gram]) == 0 {
+			delete(idx.postings, gram)
+		}
+	}
+}
+
+func (idx *FSIndex) apply(rec fsIndexRecord) {
+	switch rec.Op {
+	case IndexAdd:
+		idx.add(rec.fsIndexDoc)
+	case IndexRemove:
+		idx.remove(rec.Mbox, rec.UID)
+	case IndexRemoveMailbox:
+		for uid := range idx.docs[rec.Mbox] {
+			idx.remove(rec.Mbox, uid)
+		}
+		delete(idx.docs, rec.Mbox)
+	}
+	idx.lastSeq = rec.Seq
+}
+
+func (idx *FSIndex) Update(change IndexChange, body io.Reader) error {
+	rec := fsIndexRecord{
+		Seq: change.Seq,
+		Op:  change.Op,
+		fsIndexDoc: fsIndexDoc{
+			Mbox: change.MboxID,
+			UID:  change.UID,
+		},
+	}
+	if change.Op == IndexAdd {
+		if body == nil {
+			// Message is already gone, just advance the cursor.
+			rec.Op = IndexRemove
+		} else {
+			text, err := fsIndexText(body)
+			if err != nil {
+				return err
+			}
+			rec.Grams = trigrams(text)
+		}
+	}
+
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+
+	recBlob, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := idx.journalW.Write(append(recBlob, '\n')); err != nil {
+		return err
+	}
+	idx.journalRecords++
+	idx.apply(rec)
+
+	if idx.journalRecords >= fsIndexSnapshotInterval {
+		return idx.writeSnapshot()
+	}
+	return nil
+}
+
+// writeSnapshot atomically replaces the snapshot with the current state of
+// the index and truncates the journal.
+func (idx *FSIndex) writeSnapshot() error {
+	snapshot := fsIndexSnapshot{Seq: idx.lastSeq}
+	for mboxID, mbox := range idx.docs {
+		for uid, grams := range mbox {
+			snapshot.Docs = append(snapshot.Docs, fsIndexDoc{Mbox: mboxID, UID: uid, Grams: grams})
+		}
+	}
+
+	tmpPath := idx.snapshotPath() + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, idx.snapshotPath()); err != nil {
+		return err
+	}
+
+	// Records buffered in journalW are included in the snapshot.
+	idx.journalW.Reset(idx.journal)
+	if err := idx.journal.Truncate(0); err != nil {
+		return err
+	}
+	idx.journalRecords = 0
+	return nil
+}
+
+func (idx *FSIndex) Cursor() (uint64, error) {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+
+	if err := idx.journalW.Flush(); err != nil {
+		return 0, err
+	}
+	if err := idx.journal.Sync(); err != nil {
+		return 0, err
+	}
+	return idx.lastSeq, nil
+}
+
+func (idx *FSIndex) Search(mboxID uint64, criteria *imap.SearchCriteria) ([]uint32, bool, error) {
+	var grams []string
+	for _, term := range textSearchTerms(criteria) {
+		grams = append(grams, trigrams(strings.ToLower(term))...)
+	}
+	if len(grams) == 0 {
+		return nil, false, nil
+	}
+
+	idx.lck.RLock()
+	defer idx.lck.RUnlock()
+
+	// Start with the smallest posting list to keep intersection cheap.
+	sort.Slice(grams, func(i, j int) bool {
+		return len(idx.postings[grams[i]]) < len(idx.postings[grams[j]])
+	})
+
+	var uids []uint32
+	for key := range idx.postings[grams[0]] {
+		if key.mbox != mboxID {
+			continue
+		}
+		matched := true
+		for _, gram := range grams[1:] {
+			if _, ok := idx.postings[gram][key]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			uids = append(uids, key.uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, true, nil
+}
+
+// Close writes all pending changes to disk and closes the journal.
+func (idx *FSIndex) Close() error {
+	if _, err := idx.Cursor(); err != nil {
+		idx.journal.Close()
+		return err
+	}
+	return idx.journal.Close()
+}
+
+// fsIndexText returns the lowercased text to be indexed by FSIndex for the
+// message.
+//
+// backendutil.Match compares criteria against both raw and decoded message
+// contents so both are included to avoid false negatives.
+func fsIndexText(r io.Reader) (string, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	text.Write(raw)
+
+	ent, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		// Raw contents are still useful.
+		return strings.ToLower(text.String()), nil
+	}
+	for fields := ent.Header.Fields(); fields.Next(); {
+		value, err := fields.Text()
+		if err != nil {
+			continue
+		}
+		text.WriteString("\n")
+		text.WriteString(fields.Key())
+		text.WriteString(": ")
+		text.WriteString(value)
+	}
+	ent.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil {
+			return nil
+		}
+		if mediaType, _, _ := part.Header.ContentType(); strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		text.WriteString("\n")
+		io.Copy(&text, part.Body) // nolint:errcheck
+		return nil
+	})
+
+	return strings.ToLower(text.String()), nil
+}
+
+// trigrams returns the set of all 3-rune substrings of s.
+func trigrams(s string) []string {
+	runes := []rune(s)
+	if len(runes) < 3 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = struct{}{}
+	}
+	grams := make([]string, 0, len(set))
+	for gram := range set {
+		grams = append(grams, gram)
+	}
+	return grams
+}
@@ -18,6 +18,10 @@ var TestDB = os.Getenv("TEST_DB")
 var TestDSN = os.Getenv("TEST_DSN")
 
 func initTestBackend() backendtests.Backend {
+	return initTestBackendOpts(Opts{})
+}
+
+func initTestBackendOpts(opts Opts) backendtests.Backend {
 	driver := TestDB
 	dsn := TestDSN
 
@@ -46,17 +50,14 @@ func initTestBackend() backendtests.Backend {
 		panic(err)
 	}
 
-	var log Logger
 	if testing.Verbose() {
-		log = globalLogger{}
+		opts.Log = globalLogger{}
 	} else {
-		log = DummyLogger{}
+		opts.Log = DummyLogger{}
 	}
+	opts.PRNG = prng
 
-	b, err := New(driver, dsn, &FSStore{Root: storeDir}, Opts{
-		PRNG:            prng,
-		Log:             log,
-	})
+	b, err := New(driver, dsn, &FSStore{Root: storeDir}, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -75,6 +76,57 @@ func cleanBackend(bi backendtests.Backend) {
 			log.Println("DELETE FROM extKeys", err)
 		}
 
+		if b.Opts.FullTextSearch {
+			if _, err := b.DB.Exec(`DROP TABLE msgsText`); err != nil {
+				log.Println("DROP TABLE msgsText", err)
+			}
+			if b.db.driver == "sqlite3" {
+				if _, err := b.DB.Exec(`DROP TABLE msgsTextFts`); err != nil {
+					log.Println("DROP TABLE msgsTextFts", err)
+				}
+			}
+		}
+		if b.Opts.SearchIndex != nil {
+			if _, err := b.DB.Exec(`DROP TABLE searchIndexLog`); err != nil {
+				log.Println("DROP TABLE searchIndexLog", err)
+			}
+		}
+		if _, err := b.DB.Exec(`DROP TABLE deliveryKeys`); err != nil {
+			log.Println("DROP TABLE deliveryKeys", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE sieveScripts`); err != nil {
+			log.Println("DROP TABLE sieveScripts", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE subaddressing`); err != nil {
+			log.Println("DROP TABLE subaddressing", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE aliases`); err != nil {
+			log.Println("DROP TABLE aliases", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE domains`); err != nil {
+			log.Println("DROP TABLE domains", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE pendingDeletions`); err != nil {
+			log.Println("DROP TABLE pendingDeletions", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE retentionPolicies`); err != nil {
+			log.Println("DROP TABLE retentionPolicies", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE legalHolds`); err != nil {
+			log.Println("DROP TABLE legalHolds", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE journal`); err != nil {
+			log.Println("DROP TABLE journal", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE deletedFlags`); err != nil {
+			log.Println("DROP TABLE deletedFlags", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE deletedMsgs`); err != nil {
+			log.Println("DROP TABLE deletedMsgs", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE deletedMboxes`); err != nil {
+			log.Println("DROP TABLE deletedMboxes", err)
+		}
 		if _, err := b.DB.Exec(`DROP TABLE flags`); err != nil {
 			log.Println("DROP TABLE flags", err)
 		}
@@ -0,0 +1,434 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+)
+
+// Full-text index contains text extracted from message blobs and is keyed
+// by extKeys.id so copies of the message share the same index entry. Index
+// entries are removed together with extKeys entries.
+//
+// Text is not guaranteed to be indexed for every message (e.g. if message
+// was added before index was enabled), so messages without index entry are
+// always considered matching.
+
+// maxIndexedText is the maximum length of text added to the full-text index.
+// Longer texts are not indexed instead of being truncated since searches
+// for the truncated part would not find the message otherwise.
+const maxIndexedText = 1 << 20
+
+func (b *Backend) initFTS() error {
+	switch b.db.driver {
+	case "sqlite3", "sqlite":
+		_, err := b.db.Exec(`
+			CREATE TABLE IF NOT EXISTS msgsText (
+				id INTEGER PRIMARY KEY,
+				extBodyKey VARCHAR(255) NOT NULL UNIQUE REFERENCES extKeys(id) ON DELETE CASCADE
+			)`)
+		if err != nil {
+			return wrapErr(err, "create table msgsText")
+		}
+		// Trigram tokenizer is used to implement substring matching
+		// required by IMAP.
+		_, err = b.db.Exec(`
+			CREATE VIRTUAL TABLE IF NOT EXISTS msgsTextFts
+			USING fts5(content, tokenize = 'trigram')`)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such module") {
+				return errors.New("create table msgsTextFts: go-sqlite3 should be built with sqlite_fts5 tag to use full-text search")
+			}
+			return wrapErr(err, "create table msgsTextFts")
+		}
+		_, err = b.db.Exec(`
+			CREATE TRIGGER IF NOT EXISTS msgsText_delete
+			AFTER DELETE ON msgsText
+			BEGIN
+				DELETE FROM msgsTextFts WHERE rowid = old.id;
+			END`)
+		if err != nil {
+			return wrapErr(err, "create trigger msgsText_delete")
+		}
+	case "postgres":
+		// Trigram index is used to implement substring matching required
+		// by IMAP, text search dictionaries match whole words only.
+		_, err := b.db.Exec(`CREATE EXTENSION IF NOT EXISTS pg_trgm`)
+		if err != nil {
+			return wrapErr(err, "create extension pg_trgm (it is required for full-text search)")
+		}
+		_, err = b.db.Exec(`
+			CREATE TABLE IF NOT EXISTS msgsText (
+				extBodyKey VARCHAR(255) NOT NULL PRIMARY KEY REFERENCES extKeys(id) ON DELETE CASCADE,
+				content TEXT NOT NULL
+			)`)
+		if err != nil {
+			return wrapErr(err, "create table msgsText")
+		}
+		_, err = b.db.Exec(`
+			CREATE INDEX IF NOT EXISTS msgsText_content
+			ON msgsText USING GIN (content gin_trgm_ops)`)
+		if err != nil {
+			return wrapErr(err, "create index msgsText_content")
+		}
+	case "mysql":
+		// ngram parser is used to implement substring matching, the
+		// default one matches whole words only.
+		//
+		// InnoDB ignores column-level REFERENCES so table-level constraint
+		// is used.
+		_, err := b.db.Exec(`
+			CREATE TABLE IF NOT EXISTS msgsText (
+				extBodyKey VARCHAR(255) NOT NULL PRIMARY KEY,
+				content LONGTEXT NOT NULL,
+				FULLTEXT msgsText_content (content) WITH PARSER ngram,
+				FOREIGN KEY (extBodyKey) REFERENCES extKeys(id) ON DELETE CASCADE
+			)`)
+		if err != nil {
+			return wrapErr(err, "create table msgsText")
+		}
+	default:
+		return errors.New("full-text search is not supported for " + b.db.driver)
+	}
+	return nil
+}
+
+func (b *Backend) prepareFTSStmts() error {
+	var err error
+
+	switch b.db.driver {
+	case "sqlite3", "sqlite":
+		b.addText, err = b.db.Prepare(`
+			INSERT INTO msgsText(extBodyKey)
+			VALUES (?)`)
+		if err != nil {
+			return wrapErr(err, "addText prep")
+		}
+		b.addTextContent, err = b.db.Prepare(`
+			INSERT INTO msgsTextFts(rowid, content)
+			SELECT id, ? FROM msgsText
+			WHERE extBodyKey = ?`)
+		if err != nil {
+			return wrapErr(err, "addTextContent prep")
+		}
+	case "postgres":
+		b.addText, err = b.db.Prepare(`
+			INSERT INTO msgsText(content, extBodyKey)
+			VALUES (?, ?)`)
+	case "mysql":
+		b.addText, err = b.db.Prepare(`
+			INSERT INTO msgsText(content, extBodyKey)
+			VALUES (?, ?)`)
+	}
+	if err != nil {
+		return wrapErr(err, "addText prep")
+	}
+
+	b.delText, err = b.db.Prepare(`
+		DELETE FROM msgsText
+		WHERE extBodyKey = ?`)
+	if err != nil {
+		return wrapErr(err, "delText prep")
+	}
+
+	var textMatch string
+	switch b.db.driver {
+	case "sqlite3", "sqlite":
+		textMatch = `
+			SELECT extBodyKey
+			FROM msgsText
+			WHERE id IN (
+				SELECT rowid
+				FROM msgsTextFts
+				WHERE msgsTextFts MATCH ?
+			)`
+	case "postgres":
+		textMatch = `
+			SELECT extBodyKey
+			FROM msgsText
+			WHERE content ILIKE ?`
+	case "mysql":
+		textMatch = `
+			SELECT extBodyKey
+			FROM msgsText
+			WHERE MATCH(content) AGAINST (? IN BOOLEAN MODE)`
+	}
+	b.searchFetchText, err = b.db.Prepare(`
+		SELECT msgs.msgId, date, bodyLen, extBodyKey, compressAlgo, cachedHeader, bodyStructure, ` + b.db.aggrValuesSet("flag", "{") + `
+		FROM msgs
+		LEFT JOIN flags
+		ON flags.msgId = msgs.msgId AND msgs.mboxId = flags.mboxId
+		WHERE msgs.mboxId = ? AND (
+			NOT EXISTS (
+				SELECT 1
+				FROM msgsText
+				WHERE msgsText.extBodyKey = msgs.extBodyKey
+			)
+			OR msgs.extBodyKey IN (` + textMatch + `)
+		)
+		GROUP BY msgs.mboxId, msgs.msgId
+		ORDER BY msgs.msgId`)
+	if err != nil {
+		return wrapErr(err, "searchFetchText prep")
+	}
+
+	b.unindexedKeys, err = b.db.Prepare(`
+		SELECT DISTINCT msgs.extBodyKey, msgs.compressAlgo
+		FROM msgs
+		INNER JOIN mboxes
+		ON mboxes.id = msgs.mboxId
+		INNER JOIN users
+		ON users.id = mboxes.uid
+		WHERE msgs.extBodyKey IS NOT NULL
+		AND (? = '' OR users.username = ?)
+		AND (? = 1 OR NOT EXISTS (
+			SELECT 1
+			FROM msgsText
+			WHERE msgsText.extBodyKey = msgs.extBodyKey
+		))`)
+	if err != nil {
+		return wrapErr(err, "unindexedKeys prep")
+	}
+
+	return nil
+}
+
+// textSearchTerms returns strings from criteria that must be present in the
+// message text for it to match.
+//
+// Only top-level criteria are considered since NOT and OR keys do not
+// restrict the result in a way that can be expressed as a set of required
+// strings.
+func textSearchTerms(criteria *imap.SearchCriteria) []string {
+	var terms []string
+	terms = append(terms, criteria.Body...)
+	terms = append(terms, criteria.Text...)
+	for key, values := range criteria.Header {
+		if isAttachmentCriterion(key) {
+			continue
+		}
+		for _, value := range values {
+			if value != "" {
+				terms = append(terms, value)
+			}
+		}
+	}
+	return terms
+}
+
+// longestTerm returns the longest of search terms. Messages matching it are
+// used as candidates if the query can contain only one term.
+func longestTerm(terms []string) string {
+	var res string
+	for _, term := range terms {
+		if len([]rune(term)) > len([]rune(res)) {
+			res = term
+		}
+	}
+	return res
+}
+
+// textQuery converts search terms into a full-text query in the syntax used
+// by the SQL engine. All engines match substrings, so messages not found by
+// the query do not match the criteria.
+//
+// Empty string is returned if index can't be used for these terms.
+func (db db) textQuery(terms []string) string {
+	var parts []string
+	switch db.driver {
+	case "sqlite3", "sqlite":
+		for _, term := range terms {
+			// Trigram index can't match strings shorter than 3 characters.
+			if len([]rune(term)) < 3 {
+				continue
+			}
+			parts = append(parts, `"`+strings.Replace(term, `"`, `""`, -1)+`"`)
+		}
+		return strings.Join(parts, " AND ")
+	case "postgres":
+		// The statement takes a single ILIKE pattern.
+		term := longestTerm(terms)
+		// Trigram index is not used for shorter patterns.
+		if len([]rune(term)) < 3 {
+			return ""
+		}
+		term = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+		return "%" + term + "%"
+	case "mysql":
+		for _, term := range terms {
+			// Terms shorter than ngram_token_size (2 by default) are not
+			// indexed. There is no way to escape quotes in phrases.
+			if len([]rune(term)) < 2 || strings.ContainsRune(term, '"') {
+				continue
+			}
+			parts = append(parts, `+"`+term+`"`)
+		}
+		return strings.Join(parts, " ")
+	}
+	return ""
+}
+
+// extractText returns the text to be added to the full-text index for the
+// message: all header fields and contents of all text/* parts, decoded.
+func extractText(r io.Reader) (string, error) {
+	ent, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return "", err
+	}
+
+	var text strings.Builder
+	for fields := ent.Header.Fields(); fields.Next(); {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		text.WriteString(fields.Key())
+		text.WriteString(": ")
+		text.WriteString(value)
+		text.WriteString("\n")
+	}
+
+	err = ent.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil {
+			// Skip parts with unknown charset or encoding.
+			return nil
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		if !strings.HasPrefix(mediaType, "text/") {
+			return nil
+		}
+		text.WriteString("\n")
+		_, err = io.Copy(&text, part.Body)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+// indexText adds the message body stored under extBodyKey to the full-text
+// index. It is no-op if index is not enabled.
+//
+// Failures are logged and otherwise ignored since the message will be still
+// found by searches, just without index help. Texts longer than
+// maxIndexedText are not indexed. Only errors that leave the transaction
+// unusable are returned.
+func (b *Backend) indexText(ctx context.Context, tx *sql.Tx, extBodyKey, compressAlgo string) error {
+	if b.searchFetchText == nil {
+		return nil
+	}
+
+	body, err := b.openBody(ctx, true, compressAlgo, extBodyKey)
+	if err != nil {
+		b.Opts.Log.Printf("indexText: failed to open %s: %v", extBodyKey, err)
+		return nil
+	}
+	defer body.Close()
+	text, err := extractText(body.Reader)
+	if err != nil {
+		b.Opts.Log.Printf("indexText: failed to parse %s: %v", extBodyKey, err)
+		return nil
+	}
+
+	if len(text) > maxIndexedText {
+		b.Opts.Log.Debugf("indexText: %s is too large (%d bytes), not indexed", extBodyKey, len(text))
+		return nil
+	}
+
+	// Failed statement aborts the whole transaction on PostgreSQL so
+	// savepoint is used to keep it usable.
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT msgs_text`); err != nil {
+		return err
+	}
+	if err := b.addTextEntry(ctx, tx, extBodyKey, text); err != nil {
+		b.Opts.Log.Printf("indexText: failed to index %s: %v", extBodyKey, err)
+		if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT msgs_text`); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `RELEASE SAVEPOINT msgs_text`)
+	return err
+}
+
+func (b *Backend) addTextEntry(ctx context.Context, tx *sql.Tx, extBodyKey, text string) error {
+	if b.addTextContent != nil {
+		if _, err := tx.Stmt(b.addText).ExecContext(ctx, extBodyKey); err != nil {
+			return err
+		}
+		_, err := tx.Stmt(b.addTextContent).ExecContext(ctx, text, extBodyKey)
+		return err
+	}
+	_, err := tx.Stmt(b.addText).ExecContext(ctx, text, extBodyKey)
+	return err
+}
+
+// Reindex adds messages missing from the full-text index to it. If rebuild
+// is true, index entries are recreated for all messages.
+//
+// Only messages of the specified user are processed, or messages of all
+// users if username is empty. Amount of indexed message bodies is
+// returned.
+//
+// Opts.FullTextSearch should be enabled to use this function.
+func (b *Backend) Reindex(username string, rebuild bool) (int, error) {
+	if b.searchFetchText == nil {
+		return 0, errors.New("Reindex: full-text search is not enabled")
+	}
+	username = normalizeUsername(username)
+
+	type blob struct {
+		key, compressAlgo string
+	}
+	var blobs []blob
+	rebuildI := 0
+	if rebuild {
+		rebuildI = 1
+	}
+	rows, err := b.unindexedKeys.Query(username, username, rebuildI)
+	if err != nil {
+		return 0, wrapErr(err, "Reindex")
+	}
+	for rows.Next() {
+		var bl blob
+		if err := rows.Scan(&bl.key, &bl.compressAlgo); err != nil {
+			rows.Close()
+			return 0, wrapErr(err, "Reindex")
+		}
+		blobs = append(blobs, bl)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, wrapErr(err, "Reindex")
+	}
+
+	// Each message is indexed in a separate transaction so reindexing
+	// large accounts does not block everything else.
+	for i, bl := range blobs {
+		if err := b.reindexBlob(bl.key, bl.compressAlgo); err != nil {
+			return i, wrapErrf(err, "Reindex %s", bl.key)
+		}
+	}
+	return len(blobs), nil
+}
+
+func (b *Backend) reindexBlob(key, compressAlgo string) error {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(b.delText).Exec(key); err != nil {
+		return err
+	}
+	if err := b.indexText(context.Background(), tx, key, compressAlgo); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
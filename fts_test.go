@@ -0,0 +1,114 @@
+package imapsql
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+func TestTextQuery(t *testing.T) {
+	terms := []string{`big "fox"`, "ab", "e-mail"}
+	assert.Equal(t, db{driver: "sqlite3"}.textQuery(terms), `"big ""fox""" AND "e-mail"`)
+	assert.Equal(t, db{driver: "postgres"}.textQuery(terms), `%big "fox"%`)
+	assert.Equal(t, db{driver: "postgres"}.textQuery([]string{"100%_"}), `%100\%\_%`)
+	assert.Equal(t, db{driver: "mysql"}.textQuery(terms), `+"ab" +"e-mail"`)
+	assert.Equal(t, db{driver: "sqlite3"}.textQuery([]string{"ab"}), "")
+	assert.Equal(t, db{driver: "postgres"}.textQuery([]string{"ab"}), "")
+}
+
+func skipIfNoFTS(t *testing.T) {
+	if TestDB != "" && TestDB != "sqlite3" {
+		return
+	}
+	d, err := sql.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	defer d.Close()
+	if _, err := d.Exec(`CREATE VIRTUAL TABLE test USING fts5(content)`); err != nil {
+		t.Skip("FTS5 is not available, build with sqlite_fts5 tag to run this test")
+	}
+}
+
+func TestFullTextSearch(t *testing.T) {
+	skipIfNoFTS(t)
+
+	b := initTestBackendOpts(Opts{FullTextSearch: true}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for _, msg := range []string{
+		"Subject: Hello\r\n\r\nThe quick brown fox\r\n",
+		"Subject: Report\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nЛиса jumps over\r\n",
+		"Subject: Other\r\n\r\nlazy dog\r\n",
+	} {
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	countText := func() int {
+		var count int
+		assert.NilError(t, b.DB.QueryRow(`SELECT count(*) FROM msgsText`).Scan(&count))
+		return count
+	}
+	search := func(crit *imap.SearchCriteria) []uint32 {
+		res, err := mbox.SearchMessages(true, crit)
+		assert.NilError(t, err)
+		return res
+	}
+
+	assert.Equal(t, countText(), 3)
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"brown"}}), []uint32{1})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Text: []string{"лиса"}}), []uint32{2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{"Subject": {"other"}}}), []uint32{3})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"brown", "dog"}}), []uint32(nil))
+	// Substrings in the middle of words are matched too.
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"uick"}}), []uint32{1})
+
+	// Messages missing from the index should be still found.
+	_, err = b.DB.Exec(`DELETE FROM msgsText`)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"brown"}}), []uint32{1})
+
+	count, err := b.Reindex(t.Name(), false)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 3)
+	count, err = b.Reindex("", false)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 0)
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"brown"}}), []uint32{1})
+
+	// Messages with text too large for the index are stored without the
+	// index entry.
+	large := "Subject: Large\r\n\r\n" + strings.Repeat("a", maxIndexedText) + " needle\r\n"
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(large), mbox))
+	assert.NilError(t, mbox.Poll(true))
+	assert.Equal(t, countText(), 3)
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"needle"}}), []uint32{4})
+
+	// Copies share the index entry with the original.
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, usr.CreateMailbox("Archive"))
+	assert.NilError(t, mbox.CopyMessages(true, seq, "Archive"))
+	assert.Equal(t, countText(), 3)
+
+	// Index entry should be removed once all copies are expunged.
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+	assert.Equal(t, countText(), 3)
+	assert.NilError(t, usr.DeleteMailbox("Archive"))
+	assert.Equal(t, countText(), 2)
+	if b.db.driver == "sqlite3" {
+		var ftsCount int
+		assert.NilError(t, b.DB.QueryRow(`SELECT count(*) FROM msgsTextFts`).Scan(&ftsCount))
+		assert.Equal(t, ftsCount, 2)
+	}
+}
@@ -20,6 +20,8 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.19
 	github.com/pierrec/lz4 v2.6.1+incompatible
 	github.com/urfave/cli v1.22.14
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	golang.org/x/text v0.14.0
 	gotest.tools v2.2.0+incompatible
 )
 
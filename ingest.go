@@ -0,0 +1,152 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+// IngestSource indicates how the message is being added to the storage.
+type IngestSource int
+
+const (
+	// Message is added using Mailbox.CreateMessage (IMAP APPEND,
+	// imapsql-ctl msgs add).
+	IngestAppend IngestSource = iota
+	// Message is added using Delivery.
+	IngestDelivery
+)
+
+// IngestMessage is the message passed to IngestHook.
+type IngestMessage struct {
+	Source IngestSource
+
+	// Mailbox owners. For IngestAppend, it is the single user, for
+	// IngestDelivery - all recipients of the delivery.
+	Users []string
+
+	// Name of the target mailbox. Empty for IngestDelivery since the
+	// mailbox is selected per recipient.
+	Mailbox string
+
+	// Message header. Hooks can add, remove or rewrite fields, changes are
+	// visible to hooks that run after and are saved to the storage.
+	Header *textproto.Header
+
+	// Message body without header. It can be opened multiple times.
+	Body    Buffer
+	BodyLen int
+
+	// Flags and keywords to set on the stored message. Hooks can append to
+	// it.
+	Flags []string
+}
+
+// IngestHook is called for each message before it is written to the
+// storage.
+//
+// Returned RejectedError prevents the message from being stored and is
+// returned to the caller as is. Other errors are handled as temporary
+// failures.
+type IngestHook interface {
+	Ingest(ctx context.Context, msg *IngestMessage) error
+}
+
+// IngestHookFunc is an adapter to allow use of ordinary functions as
+// IngestHook.
+type IngestHookFunc func(ctx context.Context, msg *IngestMessage) error
+
+func (f IngestHookFunc) Ingest(ctx context.Context, msg *IngestMessage) error {
+	return f(ctx, msg)
+}
+
+// RejectedError is returned by IngestHook to refuse the message.
+type RejectedError struct {
+	Reason string
+
+	// Temporary indicates that the message may be accepted if it is sent
+	// again later (e.g. scanner is unavailable).
+	Temporary bool
+}
+
+func (re RejectedError) Error() string {
+	return "imapsql: message rejected: " + re.Reason
+}
+
+// runIngestHooks passes msg through all Opts.IngestHooks in order.
+//
+// It should be called before the transaction is started since hooks may take
+// a while to complete.
+func (b *Backend) runIngestHooks(ctx context.Context, msg *IngestMessage) error {
+	for _, hook := range b.Opts.IngestHooks {
+		if err := hook.Ingest(ctx, msg); err != nil {
+			if _, ok := err.(RejectedError); ok {
+				return err
+			}
+			return wrapErr(err, "ingest hook")
+		}
+		if err := ctx.Err(); err != nil {
+			return wrapErr(err, "ingest hook")
+		}
+	}
+	return nil
+}
+
+// ingestAppend runs ingest hooks for the message added using
+// Mailbox.CreateMessage. The message is read into memory and returned
+// literal contains the header modified by hooks.
+func (m *Mailbox) ingestAppend(ctx context.Context, flags []string, fullBody imap.Literal) ([]string, imap.Literal, error) {
+	bufferedBody := bufio.NewReader(fullBody)
+	hdr, err := textproto.ReadHeader(bufferedBody)
+	if err != nil {
+		return nil, nil, wrapErr(err, "CreateMessage (readHeader)")
+	}
+	body, err := ioutil.ReadAll(bufferedBody)
+	if err != nil {
+		return nil, nil, wrapErr(err, "CreateMessage (ReadAll)")
+	}
+
+	msg := &IngestMessage{
+		Source:  IngestAppend,
+		Users:   []string{m.user.Username()},
+		Mailbox: m.name,
+		Header:  &hdr,
+		Body:    memoryBuffer{slice: body},
+		BodyLen: len(body),
+		Flags:   append([]string(nil), flags...),
+	}
+	if err := m.parent.runIngestHooks(ctx, msg); err != nil {
+		return nil, nil, err
+	}
+
+	msgBlob := bytes.NewBuffer(make([]byte, 0, len(body)+1024))
+	if err := textproto.WriteHeader(msgBlob, hdr); err != nil {
+		return nil, nil, wrapErr(err, "CreateMessage (WriteHeader)")
+	}
+	msgBlob.Write(body)
+	return msg.Flags, msgBlob, nil
+}
+
+// ingestDelivery runs ingest hooks for the message passed to
+// Delivery.BodyParsed. Flags set by hooks are returned.
+func (d *Delivery) ingestDelivery(header *textproto.Header, bodyLen int, body Buffer) ([]string, error) {
+	users := make([]string, 0, len(d.users))
+	for _, u := range d.users {
+		users = append(users, u.username)
+	}
+	msg := &IngestMessage{
+		Source:  IngestDelivery,
+		Users:   users,
+		Header:  header,
+		Body:    body,
+		BodyLen: bodyLen,
+	}
+	if err := d.b.runIngestHooks(d.ctx, msg); err != nil {
+		return nil, err
+	}
+	return msg.Flags, nil
+}
@@ -0,0 +1,90 @@
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestIngestHooks(t *testing.T) {
+	var sources []IngestSource
+	b := initTestBackendOpts(Opts{IngestHooks: []IngestHook{
+		IngestHookFunc(func(ctx context.Context, msg *IngestMessage) error {
+			if msg.Header.Has("X-Virus") {
+				return RejectedError{Reason: "virus found"}
+			}
+			return nil
+		}),
+		IngestHookFunc(func(ctx context.Context, msg *IngestMessage) error {
+			sources = append(sources, msg.Source)
+			// Body should be readable by every hook.
+			for i := 0; i < 2; i++ {
+				r, err := msg.Body.Open()
+				if err != nil {
+					return err
+				}
+				blob, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					return err
+				}
+				if len(blob) != msg.BodyLen {
+					return errors.New("body length mismatch")
+				}
+			}
+			msg.Header.Del("X-Strip")
+			msg.Header.Add("X-Scanned", "yes")
+			msg.Flags = append(msg.Flags, "$Scanned")
+			return nil
+		}),
+	}}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	u, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+
+	const msg = "X-Strip: 1\r\nSubject: Hello\r\n\r\nHello!\r\n"
+	assert.NilError(t, u.CreateMessage("INBOX", []string{imap.SeenFlag}, time.Now(), strings.NewReader(msg), nil))
+	err = u.CreateMessage("INBOX", nil, time.Now(), strings.NewReader("X-Virus: 1\r\n"+msg), nil)
+	assert.Equal(t, err, error(RejectedError{Reason: "virus found"}))
+
+	delivery := b.NewDelivery()
+	delivery.PerRecipient()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	err = delivery.BodyRaw(strings.NewReader("X-Virus: 1\r\n" + msg))
+	assert.Assert(t, errors.As(err, &RejectedError{}))
+	assert.Equal(t, delivery.Results()[0].Status, RcptPermFailed)
+	assert.NilError(t, delivery.Abort())
+
+	delivery = b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(msg)))
+	assert.NilError(t, delivery.Commit())
+
+	assert.DeepEqual(t, sources, []IngestSource{IngestAppend, IngestDelivery})
+
+	_, mbox, err := u.GetMailbox("INBOX", true, nil)
+	assert.NilError(t, err)
+	section, err := imap.ParseBodySectionName("BODY.PEEK[HEADER]")
+	assert.NilError(t, err)
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags, section.FetchItem()}, ch))
+	assert.Equal(t, len(ch), 2)
+	for msg := range ch {
+		assert.Assert(t, containsFold(msg.Flags, "$Scanned"), "flags = %v", msg.Flags)
+		assert.Equal(t, len(msg.Body), 1)
+		for _, literal := range msg.Body {
+			blob, err := ioutil.ReadAll(literal)
+			assert.NilError(t, err)
+			assert.Equal(t, string(blob), "X-Scanned: yes\r\nSubject: Hello\r\n\r\n")
+		}
+	}
+}
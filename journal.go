@@ -0,0 +1,214 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// If the journal is configured, a copy of each message added using Delivery
+// or CreateMessage is stored in the journal mailbox. The copy gets its own
+// blob in ExternalStore since blobs are owned by a single account.
+
+func (b *Backend) initJournal() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS journal (
+			userId BIGINT NOT NULL PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			mailbox VARCHAR(255) NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table journal")
+	}
+	return nil
+}
+
+func (b *Backend) prepareJournalStmts() error {
+	var err error
+	b.setJournal, err = b.db.Prepare(`
+		INSERT INTO journal(userId, mailbox)
+		VALUES (?, ?)`)
+	if err != nil {
+		return wrapErr(err, "setJournal prep")
+	}
+	b.delJournal, err = b.db.Prepare(`
+		DELETE FROM journal`)
+	if err != nil {
+		return wrapErr(err, "delJournal prep")
+	}
+	b.getJournal, err = b.db.Prepare(`
+		SELECT username, mailbox
+		FROM journal
+		INNER JOIN users
+		ON users.id = journal.userId`)
+	if err != nil {
+		return wrapErr(err, "getJournal prep")
+	}
+	b.journalTarget, err = b.db.Prepare(`
+		SELECT journal.userId, mboxes.id
+		FROM journal
+		LEFT JOIN mboxes
+		ON mboxes.uid = journal.userId
+		AND mboxes.name = journal.mailbox`)
+	if err != nil {
+		return wrapErr(err, "journalTarget prep")
+	}
+	b.addJournalMsg, err = b.db.Prepare(`
+		INSERT INTO msgs(mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent,
+			sentDate, sortSubject, sortFrom, sortTo, sortCc, sortDisplayFrom, sortDisplayTo)
+		SELECT ?, ?, date, bodyLen, bodyStructure, cachedHeader, ?, 0, compressAlgo, ?,
+			sentDate, sortSubject, sortFrom, sortTo, sortCc, sortDisplayFrom, sortDisplayTo
+		FROM msgs
+		WHERE mboxId = ? AND msgId = ?`)
+	if err != nil {
+		return wrapErr(err, "addJournalMsg prep")
+	}
+	return nil
+}
+
+// SetJournal enables journaling of all messages into the mailbox of the
+// specified account, replacing the previous journal target. The mailbox
+// should exist.
+func (b *Backend) SetJournal(username, mailbox string) error {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "SetJournal")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	uid, _, _, err := b.getUserMeta(context.Background(), tx, normalizeUsername(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "SetJournal")
+	}
+	var mboxId uint64
+	if err := tx.Stmt(b.mboxId).QueryRow(uid, mailbox).Scan(&mboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return backend.ErrNoSuchMailbox
+		}
+		return wrapErr(err, "SetJournal")
+	}
+
+	if _, err := tx.Stmt(b.delJournal).Exec(); err != nil {
+		return wrapErr(err, "SetJournal")
+	}
+	if _, err := tx.Stmt(b.setJournal).Exec(uid, mailbox); err != nil {
+		return wrapErr(err, "SetJournal")
+	}
+	return wrapErr(tx.Commit(), "SetJournal")
+}
+
+// DisableJournal stops journaling of messages. Messages already in the
+// journal mailbox are not affected.
+func (b *Backend) DisableJournal() error {
+	_, err := b.delJournal.Exec()
+	return wrapErr(err, "DisableJournal")
+}
+
+// Journal returns the account and mailbox messages are journaled into.
+// Empty strings are returned if journaling is disabled.
+func (b *Backend) Journal() (username, mailbox string, err error) {
+	if err := b.getJournal.QueryRow().Scan(&username, &mailbox); err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", nil
+		}
+		return "", "", wrapErr(err, "Journal")
+	}
+	return username, mailbox, nil
+}
+
+// journalMessage adds a copy of the message stored in mboxId with the
+// specified UID to the journal mailbox, if journaling is enabled. The message
+// should be added within the same transaction.
+//
+// The key of the created blob is returned so it can be removed if the
+// transaction fails to commit.
+func (b *Backend) journalMessage(ctx context.Context, tx *sql.Tx, mboxId uint64, msgId uint32, extBodyKey string) (string, error) {
+	var (
+		journalUid    uint64
+		journalMboxId sql.NullInt64
+	)
+	if err := tx.Stmt(b.journalTarget).QueryRowContext(ctx).Scan(&journalUid, &journalMboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	if !journalMboxId.Valid {
+		b.Opts.Log.Printf("journal: mailbox does not exist, message (mboxId %d, uid %d) is not journaled", mboxId, msgId)
+		return "", nil
+	}
+	journal := &Mailbox{parent: b, id: uint64(journalMboxId.Int64)}
+	if journal.id == mboxId {
+		return "", nil
+	}
+
+	key, err := b.copyBlob(ctx, extBodyKey)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Stmt(b.addExtKey).ExecContext(ctx, key, journalUid, 1); err != nil {
+		b.extStore.Delete([]string{key})
+		return "", err
+	}
+	journalMsgId, err := journal.incrementMsgCounters(ctx, tx)
+	if err != nil {
+		b.extStore.Delete([]string{key})
+		return "", err
+	}
+	recent := 0
+	if b.mngr.NewMessage(journal.id, journalMsgId) {
+		recent = 1
+	}
+	if _, err := tx.Stmt(b.addJournalMsg).ExecContext(ctx, journal.id, journalMsgId, key, recent, mboxId, msgId); err != nil {
+		b.extStore.Delete([]string{key})
+		return "", err
+	}
+	if err := b.indexText(ctx, tx, key, b.Opts.CompressAlgo); err != nil {
+		b.extStore.Delete([]string{key})
+		return "", err
+	}
+	if err := b.logIndex(ctx, tx, b.logIndexChange, IndexAdd, journal.id, journalMsgId); err != nil {
+		b.extStore.Delete([]string{key})
+		return "", err
+	}
+	return key, nil
+}
+
+// copyBlob copies the blob as is to a new key.
+func (b *Backend) copyBlob(ctx context.Context, key string) (string, error) {
+	newKey, err := randomKey()
+	if err != nil {
+		return "", err
+	}
+
+	src, err := b.extOpen(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := b.extCreate(ctx, newKey, -1)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		b.extStore.Delete([]string{newKey})
+		return "", err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		b.extStore.Delete([]string{newKey})
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		b.extStore.Delete([]string{newKey})
+		return "", err
+	}
+	return newKey, nil
+}
@@ -0,0 +1,79 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestJournal(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("journal"))
+	assert.NilError(t, b.CreateUser("user1"))
+	assert.NilError(t, b.CreateUser("user2"))
+	usr, err := b.GetUser("journal")
+	assert.NilError(t, err)
+	j := usr.(*User)
+	assert.NilError(t, j.CreateMailbox("Journal"))
+	usr, err = b.GetUser("user1")
+	assert.NilError(t, err)
+	u1 := usr.(*User)
+
+	assert.Equal(t, b.SetJournal("journal", "Missing"), backend.ErrNoSuchMailbox)
+	assert.NilError(t, b.SetJournal("journal", "Journal"))
+	username, mailbox, err := b.Journal()
+	assert.NilError(t, err)
+	assert.Equal(t, username, "journal")
+	assert.Equal(t, mailbox, "Journal")
+
+	assert.NilError(t, u1.CreateMessage("INBOX", []string{imap.SeenFlag}, time.Now(), strings.NewReader(testMsg), nil))
+
+	// Only one copy is journaled for all recipients.
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt("user1", textproto.Header{}))
+	assert.NilError(t, delivery.AddRcpt("user2", textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	// Messages appended to the journal mailbox itself are not duplicated.
+	assert.NilError(t, j.CreateMessage("Journal", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.Assert(t, checkKeysCount(b, 6))
+
+	status, err := j.Status("Journal", []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(3))
+	assert.Equal(t, status.Unseen, uint32(3))
+
+	// Journaled copies are kept when the account is deleted.
+	assert.NilError(t, b.DeleteUser("user1"))
+	assert.Assert(t, checkKeysCount(b, 4))
+
+	_, mbox, err := j.GetMailbox("Journal", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{"BODY.PEEK[]"}, ch))
+	msg := <-ch
+	for _, literal := range msg.Body {
+		blob, err := ioutil.ReadAll(literal)
+		assert.NilError(t, err)
+		assert.Equal(t, string(blob), testMsg)
+	}
+
+	assert.NilError(t, b.DisableJournal())
+	username, _, err = b.Journal()
+	assert.NilError(t, err)
+	assert.Equal(t, username, "")
+	usr, err = b.GetUser("user2")
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.Assert(t, checkKeysCount(b, 5))
+}
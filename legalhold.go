@@ -0,0 +1,182 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Accounts on legal hold never lose data permanently. Messages and
+// mailboxes removed from them are kept in the deletedMsgs and deletedMboxes
+// tables as if Opts.DeletedRetention was set, PurgeDeleted skips them while
+// the hold is in place. DeleteUser only marks such accounts for deletion.
+
+// ErrLegalHold is returned for operations that would permanently remove
+// data of the account on legal hold.
+var ErrLegalHold = errors.New("imapsql: account is on legal hold")
+
+// LegalHold describes the legal hold placed on the account.
+type LegalHold struct {
+	Username string
+	Since    time.Time
+
+	// Free-form description, such as the case number.
+	Reason string
+}
+
+func (b *Backend) initLegalHolds() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS legalHolds (
+			userId BIGINT NOT NULL PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			since BIGINT NOT NULL,
+			reason VARCHAR(255) NOT NULL DEFAULT ''
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table legalHolds")
+	}
+	return nil
+}
+
+func (b *Backend) prepareLegalHoldStmts() error {
+	var err error
+	b.addLegalHold, err = b.db.Prepare(`
+		INSERT INTO legalHolds(userId, since, reason)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addLegalHold prep")
+	}
+	b.setLegalHoldReason, err = b.db.Prepare(`
+		UPDATE legalHolds
+		SET reason = ?
+		WHERE userId = ?`)
+	if err != nil {
+		return wrapErr(err, "setLegalHoldReason prep")
+	}
+	b.delLegalHold, err = b.db.Prepare(`
+		DELETE FROM legalHolds
+		WHERE userId = ?`)
+	if err != nil {
+		return wrapErr(err, "delLegalHold prep")
+	}
+	b.isOnLegalHold, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM legalHolds
+		WHERE userId = ?`)
+	if err != nil {
+		return wrapErr(err, "isOnLegalHold prep")
+	}
+	b.listLegalHolds, err = b.db.Prepare(`
+		SELECT username, since, reason
+		FROM legalHolds
+		INNER JOIN users
+		ON users.id = legalHolds.userId
+		ORDER BY username`)
+	if err != nil {
+		return wrapErr(err, "listLegalHolds prep")
+	}
+	b.domainLegalHolds, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM legalHolds
+		INNER JOIN users
+		ON users.id = legalHolds.userId
+		WHERE users.domainId = ?`)
+	if err != nil {
+		return wrapErr(err, "domainLegalHolds prep")
+	}
+	return nil
+}
+
+func (b *Backend) onLegalHold(ctx context.Context, tx *sql.Tx, uid uint64) (bool, error) {
+	var count int
+	if err := tx.Stmt(b.isOnLegalHold).QueryRowContext(ctx, uid).Scan(&count); err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// keepDeleted reports whether messages and mailboxes removed from the
+// account should be moved to deletedMsgs and deletedMboxes instead of being
+// removed.
+func (b *Backend) keepDeleted(ctx context.Context, tx *sql.Tx, uid uint64) (bool, error) {
+	if b.Opts.DeletedRetention > 0 {
+		return true, nil
+	}
+	return b.onLegalHold(ctx, tx, uid)
+}
+
+// SetLegalHold places the account on legal hold. If the account is already
+// on hold, only the reason is changed.
+func (b *Backend) SetLegalHold(username, reason string) error {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "SetLegalHold")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	uid, _, _, err := b.getUserMeta(context.Background(), tx, normalizeUsername(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "SetLegalHold")
+	}
+
+	res, err := tx.Stmt(b.setLegalHoldReason).Exec(reason, uid)
+	if err != nil {
+		return wrapErr(err, "SetLegalHold")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "SetLegalHold")
+	}
+	if affected == 0 {
+		if _, err := tx.Stmt(b.addLegalHold).Exec(uid, time.Now().Unix(), reason); err != nil {
+			return wrapErr(err, "SetLegalHold")
+		}
+	}
+	return wrapErr(tx.Commit(), "SetLegalHold")
+}
+
+// ReleaseLegalHold removes the legal hold from the account. Messages and
+// mailboxes removed while it was in place are purged by the next PurgeDeleted
+// call, it is not called periodically unless Opts.DeletedRetention is set.
+// Accounts marked for deletion by DeleteUser are kept until DeleteUser is
+// called again.
+func (b *Backend) ReleaseLegalHold(username string) error {
+	uid, _, _, err := b.getUserMeta(context.Background(), nil, normalizeUsername(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "ReleaseLegalHold")
+	}
+	_, err = b.delLegalHold.Exec(uid)
+	return wrapErr(err, "ReleaseLegalHold")
+}
+
+// LegalHolds returns all accounts on legal hold.
+func (b *Backend) LegalHolds() ([]LegalHold, error) {
+	rows, err := b.listLegalHolds.Query()
+	if err != nil {
+		return nil, wrapErr(err, "LegalHolds")
+	}
+	defer rows.Close()
+
+	var res []LegalHold
+	for rows.Next() {
+		var (
+			hold  LegalHold
+			since int64
+		)
+		if err := rows.Scan(&hold.Username, &since, &hold.Reason); err != nil {
+			return nil, wrapErr(err, "LegalHolds")
+		}
+		hold.Since = time.Unix(since, 0)
+		res = append(res, hold)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(err, "LegalHolds")
+	}
+	return res, nil
+}
@@ -0,0 +1,77 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+func TestLegalHold(t *testing.T) {
+	b := initTestBackendOpts(Opts{PurgeInterval: -1, RetentionInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateDomain("example.org"))
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	usr, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	u := usr.(*User)
+
+	assert.Equal(t, b.SetLegalHold("nobody@example.org", ""), ErrUserDoesntExists)
+	assert.NilError(t, b.SetLegalHold("user@example.org", "case 1"))
+	assert.NilError(t, b.SetLegalHold("user@example.org", "case 2"))
+	holds, err := b.LegalHolds()
+	assert.NilError(t, err)
+	assert.Equal(t, len(holds), 1)
+	assert.Equal(t, holds[0].Username, "user@example.org")
+	assert.Equal(t, holds[0].Reason, "case 2")
+
+	assert.NilError(t, u.CreateMailbox("Box"))
+	assert.NilError(t, u.CreateMessage("Box", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now().Add(-48*time.Hour), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now().Add(-48*time.Hour), strings.NewReader(testMsg), nil))
+
+	_, mbox, err := u.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	assert.NilError(t, mbox.Expunge())
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, mbox.(*Mailbox).DelMessages(false, seq))
+
+	assert.NilError(t, u.SetRetentionPolicy("INBOX", time.Hour))
+	removed, err := b.ApplyRetentionPolicies()
+	assert.NilError(t, err)
+	assert.Equal(t, removed, 1)
+
+	assert.NilError(t, u.DeleteMailbox("Box"))
+
+	// Removed data is not purged while the hold is in place.
+	purged, err := b.PurgeDeleted(time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, purged, 0)
+	assert.Assert(t, checkKeysCount(b, 4))
+	count, err := u.DeletedMessages("INBOX")
+	assert.NilError(t, err)
+	assert.Equal(t, count, 3)
+
+	assert.Equal(t, b.DeleteDomain("example.org"), ErrLegalHold)
+	assert.NilError(t, b.DeleteUser("user@example.org"))
+	state, err := b.UserState("user@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, state.Status, StatusPendingDeletion)
+
+	assert.NilError(t, b.ReleaseLegalHold("user@example.org"))
+	holds, err = b.LegalHolds()
+	assert.NilError(t, err)
+	assert.Equal(t, len(holds), 0)
+	purged, err = b.PurgeDeleted(time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, purged, 4)
+	assert.Assert(t, checkKeysCount(b, 0))
+
+	assert.NilError(t, b.DeleteDomain("example.org"))
+	_, err = b.UserState("user@example.org")
+	assert.Equal(t, err, ErrUserDoesntExists)
+}
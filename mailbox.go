@@ -3,6 +3,7 @@ package imapsql
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"io"
@@ -31,6 +32,9 @@ type Mailbox struct {
 
 	conn   backend.Conn
 	handle *mess.MailboxHandle
+
+	// Cached result for SearchPartial and SortPartial.
+	searchCtx *searchContext
 }
 
 func (m *Mailbox) Close() error {
@@ -50,7 +54,10 @@ func (m *Mailbox) Name() string {
 }
 
 func (m *Mailbox) Conn() backend.Conn {
-	return m.conn
+	if m.conn == nil {
+		return nil
+	}
+	return updatesConn{Conn: m.conn, mbox: m}
 }
 
 func (m *Mailbox) Info() (*imap.MailboxInfo, error) {
@@ -65,10 +72,10 @@ var standardFlags = map[string]struct{}{
 	imap.DraftFlag:    {},
 }
 
-func (m *Mailbox) readUids() (uids []uint32, recent *imap.SeqSet, err error) {
+func (m *Mailbox) readUids(ctx context.Context) (uids []uint32, recent *imap.SeqSet, err error) {
 	recent = new(imap.SeqSet)
 	var recentCount uint32
-	rows, err := m.parent.listMsgUidsRecent.Query(m.id)
+	rows, err := m.parent.listMsgUidsRecent.QueryContext(ctx, m.id)
 	if err != nil && err != sql.ErrNoRows {
 		m.parent.logMboxErr(m, err, "readUids (listMsgUidsRecent)")
 		return nil, nil, wrapErrf(err, "readUids %s", m.name)
@@ -94,12 +101,12 @@ func (m *Mailbox) readUids() (uids []uint32, recent *imap.SeqSet, err error) {
 	return uids, recent, nil
 }
 
-func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.SeqSet, status *imap.MailboxStatus, err error) {
+func (m *Mailbox) initSelected(ctx context.Context, unsetRecent bool) (uids []uint32, recent *imap.SeqSet, status *imap.MailboxStatus, err error) {
 	if m.parent.Opts.DisableRecent {
 		unsetRecent = false
 	}
 
-	tx, err := m.parent.db.Begin(!unsetRecent)
+	tx, err := m.parent.db.BeginContext(ctx, !unsetRecent)
 	if err != nil {
 		return nil, nil, nil, wrapErrf(err, "statusInit %s", m.name)
 	}
@@ -118,7 +125,7 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 		`\*`,
 	}
 
-	rows, err := tx.Stmt(m.parent.usedFlags).Query(m.id)
+	rows, err := tx.Stmt(m.parent.usedFlags).QueryContext(ctx, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "initSelected (used flags)")
 		return nil, nil, nil, wrapErrf(err, "initSelected (usedFlags) %s", m.name)
@@ -138,13 +145,13 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 	}
 
 	var unseenUid uint32
-	err = tx.Stmt(m.parent.firstUnseenUid).QueryRow(m.id).Scan(&unseenUid)
+	err = tx.Stmt(m.parent.firstUnseenUid).QueryRowContext(ctx, m.id).Scan(&unseenUid)
 	if err != nil && err != sql.ErrNoRows {
 		m.parent.logMboxErr(m, err, "initSelected (first unseen)")
 		return nil, nil, nil, wrapErrf(err, "initSelected %s", m.name)
 	}
 
-	row := tx.Stmt(m.parent.unseenCount).QueryRow(m.id)
+	row := tx.Stmt(m.parent.unseenCount).QueryRowContext(ctx, m.id)
 	if err := row.Scan(&status.Unseen); err != nil {
 		if err != sql.ErrNoRows {
 			m.parent.logMboxErr(m, err, "initSelected (unseen count)")
@@ -162,7 +169,7 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 
 	recent = new(imap.SeqSet)
 	var recentCount uint32
-	rows, err = tx.Stmt(m.parent.listMsgUidsRecent).Query(m.id)
+	rows, err = tx.Stmt(m.parent.listMsgUidsRecent).QueryContext(ctx, m.id)
 	if err != nil && err != sql.ErrNoRows {
 		m.parent.logMboxErr(m, err, "initSelected (listMsgUidsRecent)")
 		return nil, nil, nil, wrapErrf(err, "initSelected %s", m.name)
@@ -201,12 +208,12 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 	status.Recent = recentCount
 
 	if unsetRecent {
-		if _, err := tx.Stmt(m.parent.clearRecent).Exec(m.id); err != nil {
+		if _, err := tx.Stmt(m.parent.clearRecent).ExecContext(ctx, m.id); err != nil {
 			m.parent.logMboxErr(m, err, "initSelected (clearRecent)")
 		}
 	}
 
-	if err := tx.Stmt(m.parent.uidNext).QueryRow(m.id).Scan(&status.UidNext); err != nil {
+	if err := tx.Stmt(m.parent.uidNext).QueryRowContext(ctx, m.id).Scan(&status.UidNext); err != nil {
 		if err != sql.ErrNoRows {
 			m.parent.logMboxErr(m, err, "initSelected (uidNext scan)")
 			return nil, nil, nil, wrapErrf(err, "initSelected %s", m.name)
@@ -214,7 +221,7 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 		status.UidNext = 1
 	}
 
-	row = tx.Stmt(m.parent.uidValidity).QueryRow(m.id)
+	row = tx.Stmt(m.parent.uidValidity).QueryRowContext(ctx, m.id)
 	if err := row.Scan(&status.UidValidity); err != nil {
 		m.parent.logMboxErr(m, err, "initSelected (uidValidity)")
 		return nil, nil, nil, wrapErrf(err, "initSelected (uidvalidity) %s", m.name)
@@ -229,23 +236,23 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 	return uids, recent, status, nil
 }
 
-func (m *Mailbox) incrementMsgCounters(tx *sql.Tx) (uint32, error) {
+func (m *Mailbox) incrementMsgCounters(ctx context.Context, tx *sql.Tx) (uint32, error) {
 	// On PostgreSQL we can just do everything in one query.
 	// Increment both uidNext and msgsCount and return previous uidNext.
 	if m.parent.db.driver == "postgres" {
 		var nextId uint32
-		err := tx.Stmt(m.parent.increaseMsgCount).QueryRow(1, 1, m.id).Scan(&nextId)
+		err := tx.Stmt(m.parent.increaseMsgCount).QueryRowContext(ctx, 1, 1, m.id).Scan(&nextId)
 		return nextId, err
 	}
 
 	// For other DBs we fallback to using a query with explicit locking.
 
 	res := sql.NullInt64{}
-	if err := tx.Stmt(m.parent.uidNextLocked).QueryRow(m.id).Scan(&res); err != nil {
+	if err := tx.Stmt(m.parent.uidNextLocked).QueryRowContext(ctx, m.id).Scan(&res); err != nil {
 		return 0, err
 	}
 
-	if _, err := tx.Stmt(m.parent.increaseMsgCount).Exec(1, 1, m.id); err != nil {
+	if _, err := tx.Stmt(m.parent.increaseMsgCount).ExecContext(ctx, 1, 1, m.id); err != nil {
 		return 0, err
 	}
 
@@ -285,7 +292,7 @@ func (m *Mailbox) SetMessageLimit(val *uint32) error {
 	return err
 }
 
-func extractCachedData(hdr textproto.Header, bufferedBody *bufio.Reader) (bodyStructBlob, cachedHeadersBlob []byte, err error) {
+func extractCachedData(hdr textproto.Header, bufferedBody *bufio.Reader) (bodyStructBlob, cachedHeadersBlob []byte, keys sortKeys, err error) {
 	hdrs := make(map[string][]string, len(cachedHeaderFields))
 	for field := hdr.Fields(); field.Next(); {
 		cKey := nettextproto.CanonicalMIMEHeaderKey(field.Key())
@@ -297,7 +304,7 @@ func extractCachedData(hdr textproto.Header, bufferedBody *bufio.Reader) (bodySt
 
 	bodyStruct, err := backendutil.FetchBodyStructure(hdr, bufferedBody, true)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, sortKeys{}, err
 	}
 
 	jw := jwriter.Writer{}
@@ -310,13 +317,15 @@ func extractCachedData(hdr textproto.Header, bufferedBody *bufio.Reader) (bodySt
 	easyjsonMarshalCachedHeader(&jw, hdrs)
 	jw.DumpTo(buf)
 	cachedHeadersBlob = buf.Bytes()
+
+	keys = makeSortKeys(hdrs)
 	return
 }
 
-func (b *Backend) processBody(literal imap.Literal) (bodyStruct, cachedHeader []byte, extBodyKey string, err error) {
+func (b *Backend) processBody(ctx context.Context, literal imap.Literal) (bodyStruct, cachedHeader []byte, keys sortKeys, extBodyKey string, err error) {
 	extBodyKey, err = randomKey()
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 
 	objSize := literal.Len()
@@ -324,15 +333,15 @@ func (b *Backend) processBody(literal imap.Literal) (bodyStruct, cachedHeader []
 		objSize = 0
 	}
 
-	extWriter, err := b.extStore.Create(extBodyKey, int64(objSize))
+	extWriter, err := b.extCreate(ctx, extBodyKey, int64(objSize))
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 	defer extWriter.Close()
 
 	compressW, err := b.compressAlgo.WrapCompress(extWriter, b.Opts.CompressAlgoParams)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, sortKeys{}, "", err
 	}
 	defer compressW.Close()
 
@@ -341,13 +350,13 @@ func (b *Backend) processBody(literal imap.Literal) (bodyStruct, cachedHeader []
 	hdr, err := textproto.ReadHeader(bufferedBody)
 	if err != nil {
 		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", wrapErr(err, "CreateMessage (readHeader)")
+		return nil, nil, sortKeys{}, "", wrapErr(err, "CreateMessage (readHeader)")
 	}
 
-	bodyStruct, cachedHeader, err = extractCachedData(hdr, bufferedBody)
+	bodyStruct, cachedHeader, keys, err = extractCachedData(hdr, bufferedBody)
 	if err != nil {
 		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", wrapErr(err, "CreateMessage (extractCachedData)")
+		return nil, nil, sortKeys{}, "", wrapErr(err, "CreateMessage (extractCachedData)")
 	}
 
 	// Consume all remaining body so io.TeeReader used with external store will
@@ -355,11 +364,11 @@ func (b *Backend) processBody(literal imap.Literal) (bodyStruct, cachedHeader []
 	_, err = io.Copy(ioutil.Discard, bufferedBody)
 	if err != nil {
 		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", wrapErr(err, "CreateMessage (ReadAll consume)")
+		return nil, nil, sortKeys{}, "", wrapErr(err, "CreateMessage (ReadAll consume)")
 	}
 
 	if err := extWriter.Sync(); err != nil {
-		return nil, nil, "", wrapErr(err, "CreateMessage (Sync)")
+		return nil, nil, sortKeys{}, "", wrapErr(err, "CreateMessage (Sync)")
 	}
 
 	return
@@ -383,11 +392,33 @@ func (m *Mailbox) checkAppendLimit(length int) error {
 }
 
 func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Literal) error {
+	return m.CreateMessageContext(context.Background(), flags, date, fullBody)
+}
+
+// CreateMessageContext is a variant of CreateMessage that aborts the
+// transaction once ctx is cancelled.
+func (m *Mailbox) CreateMessageContext(ctx context.Context, flags []string, date time.Time, fullBody imap.Literal) error {
+	if err := m.user.checkWritable(); err != nil {
+		return err
+	}
 	if err := m.checkAppendLimit(fullBody.Len()); err != nil {
 		m.parent.logMboxErr(m, errors.New("appendlimit hit"), "CreateMessage (checkAppendLimit)")
 		return err
 	}
 
+	if len(m.parent.Opts.IngestHooks) != 0 {
+		var err error
+		flags, fullBody, err = m.ingestAppend(ctx, flags, fullBody)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "CreateMessage (ingest hooks)")
+			return err
+		}
+		if err := m.checkAppendLimit(fullBody.Len()); err != nil {
+			m.parent.logMboxErr(m, errors.New("appendlimit hit"), "CreateMessage (checkAppendLimit)")
+			return err
+		}
+	}
+
 	if date.IsZero() {
 		date = time.Now()
 	}
@@ -417,26 +448,26 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		}
 	}
 
-	tx, err := m.parent.db.BeginLevel(sql.LevelReadCommitted, false)
+	tx, err := m.parent.db.BeginLevelContext(ctx, sql.LevelReadCommitted, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "CreateMessage (tx start)")
 		return wrapErr(err, "CreateMessage (tx begin)")
 	}
 	defer tx.Rollback() // nolint:errcheck
 
-	msgId, err := m.incrementMsgCounters(tx)
+	msgId, err := m.incrementMsgCounters(ctx, tx)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "CreateMessage (uidNext)")
 		return wrapErr(err, "CreateMessage (uidNext)")
 	}
 
 	bodyLen := fullBody.Len()
-	bodyStruct, cachedHdr, extBodyKey, err := m.parent.processBody(fullBody)
+	bodyStruct, cachedHdr, keys, extBodyKey, err := m.parent.processBody(ctx, fullBody)
 	if err != nil {
 		return err
 	}
 
-	if _, err = tx.Stmt(m.parent.addExtKey).Exec(extBodyKey, m.user.id, 1); err != nil {
+	if _, err = tx.Stmt(m.parent.addExtKey).ExecContext(ctx, extBodyKey, m.user.id, 1); err != nil {
 		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
 			m.parent.logMboxErr(m, err, "delete extBodyKey)")
 		}
@@ -449,13 +480,13 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 	if recent {
 		recentI = 1
 	}
-	_, err = tx.Stmt(m.parent.addMsg).Exec(
+	_, err = tx.Stmt(m.parent.addMsg).ExecContext(ctx, append([]interface{}{
 		m.id, msgId, date.Unix(),
 		bodyLen,
 		bodyStruct, cachedHdr, extBodyKey,
 		haveSeen, m.parent.Opts.CompressAlgo,
 		recentI,
-	)
+	}, keys.values(date)...)...)
 	if err != nil {
 		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
 			m.parent.logMboxErr(m, err, "delete extBodyKey)")
@@ -464,9 +495,25 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		return wrapErr(err, "CreateMessage (addMsg)")
 	}
 
+	if err := m.parent.indexText(ctx, tx, extBodyKey, m.parent.Opts.CompressAlgo); err != nil {
+		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+			m.parent.logMboxErr(m, err, "delete extBodyKey)")
+		}
+		m.parent.logMboxErr(m, err, "CreateMessage (indexText)")
+		return wrapErr(err, "CreateMessage (indexText)")
+	}
+
+	if err := m.parent.logIndex(ctx, tx, m.parent.logIndexChange, IndexAdd, m.id, msgId); err != nil {
+		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+			m.parent.logMboxErr(m, err, "delete extBodyKey)")
+		}
+		m.parent.logMboxErr(m, err, "CreateMessage (logIndex)")
+		return wrapErr(err, "CreateMessage (logIndex)")
+	}
+
 	if len(flags) != 0 {
 		params := m.makeFlagsAddStmtArgs(flags, msgId, msgId)
-		if _, err = tx.Stmt(flagsAddStmt).Exec(params...); err != nil {
+		if _, err = tx.Stmt(flagsAddStmt).ExecContext(ctx, params...); err != nil {
 			if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
 				m.parent.logMboxErr(m, err, "delete extBodyKey)")
 			}
@@ -475,21 +522,44 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		}
 	}
 
-	if err = tx.Commit(); err != nil {
+	journalKey, err := m.parent.journalMessage(ctx, tx, m.id, msgId, extBodyKey)
+	if err != nil {
 		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
 			m.parent.logMboxErr(m, err, "delete extBodyKey)")
 		}
+		m.parent.logMboxErr(m, err, "CreateMessage (journal)")
+		return wrapErr(err, "CreateMessage (journal)")
+	}
+
+	if err = tx.Commit(); err != nil {
+		keys := []string{extBodyKey}
+		if journalKey != "" {
+			keys = append(keys, journalKey)
+		}
+		if err := m.parent.extStore.Delete(keys); err != nil {
+			m.parent.logMboxErr(m, err, "delete extBodyKey)")
+		}
 		m.parent.logMboxErr(m, err, "CreateMessage (tx commit)")
 		return wrapErr(err, "CreateMessage (tx commit)")
 	}
+	m.parent.searchIndexChanged()
 
 	return nil
 }
 
 func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return m.MoveMessagesContext(context.Background(), uid, seqset, dest)
+}
+
+// MoveMessagesContext is a variant of MoveMessages that aborts the
+// transaction once ctx is cancelled.
+func (m *Mailbox) MoveMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := m.user.checkWritable(); err != nil {
+		return err
+	}
 	defer m.handle.Sync(true)
 
-	tx, err := m.parent.db.Begin(false)
+	tx, err := m.parent.db.BeginContext(ctx, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (tx start)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (tx start)")
@@ -502,7 +572,7 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 	}
 
 	for _, seq := range seqset.Set {
-		_, err = tx.Stmt(m.parent.markUid).Exec(m.id, seq.Start, seq.Stop)
+		_, err = tx.Stmt(m.parent.markUid).ExecContext(ctx, m.id, seq.Start, seq.Stop)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (mark)", uid, seqset, dest)
 			return wrapErr(err, "MoveMessages (mark)")
@@ -514,7 +584,7 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 	// copy and removal logic, though.
 
 	var destID uint64
-	if err := tx.Stmt(m.parent.mboxId).QueryRow(m.user.id, dest).Scan(&destID); err != nil {
+	if err := tx.Stmt(m.parent.mboxId).QueryRowContext(ctx, m.user.id, dest).Scan(&destID); err != nil {
 		if err == sql.ErrNoRows {
 			return backend.ErrNoSuchMailbox
 		}
@@ -525,12 +595,12 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 	// Copy messages and flags...
 	copiedCount := uint32(0)
 	for _, seq := range seqset.Set {
-		stats, err := tx.Stmt(m.parent.copyMsgsUid).Exec(destID, destID, copiedCount, m.id, seq.Start, seq.Stop)
+		stats, err := tx.Stmt(m.parent.copyMsgsUid).ExecContext(ctx, destID, destID, copiedCount, m.id, seq.Start, seq.Stop)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (copy msgs)", uid, seqset, dest)
 			return wrapErr(err, "MoveMessages (copy msgs)")
 		}
-		if _, err := tx.Stmt(m.parent.copyMsgFlagsUid).Exec(destID, destID, copiedCount, m.id, seq.Start, seq.Stop); err != nil {
+		if _, err := tx.Stmt(m.parent.copyMsgFlagsUid).ExecContext(ctx, destID, destID, copiedCount, m.id, seq.Start, seq.Stop); err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (copy msg flags)", uid, seqset, dest)
 			return wrapErr(err, "MoveMessages (copy msg flags)")
 		}
@@ -544,7 +614,7 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 	m.parent.Opts.Log.Debugf("copied %v messages to mboxId=%v", copiedCount, destID)
 
 	var expunged []uint32
-	rows, err := tx.Stmt(m.parent.markedUids).Query(m.id)
+	rows, err := tx.Stmt(m.parent.markedUids).QueryContext(ctx, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (marked uids)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (marked uids)")
@@ -560,35 +630,48 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 		expunged = append(expunged, msgId)
 	}
 
+	if err := m.parent.logIndex(ctx, tx, m.parent.logIndexRemoveMarked, m.id); err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (logIndex)", uid, seqset, dest)
+		return wrapErr(err, "MoveMessages (logIndex)")
+	}
+
 	// Delete marked messages (copies in the source mailbox)
-	if _, err := tx.Stmt(m.parent.delMarked).Exec(); err != nil {
+	if _, err := tx.Stmt(m.parent.delMarked).ExecContext(ctx); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (decrease counters)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (decrease counters)")
 	}
 
 	// Decrease MESSAGES for the source mailbox.
-	_, err = tx.Stmt(m.parent.decreaseMsgCount).Exec(copiedCount, m.id)
+	_, err = tx.Stmt(m.parent.decreaseMsgCount).ExecContext(ctx, copiedCount, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (decrease counters)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (decrease counters)")
 	}
 
 	var oldUidNext uint32
-	if err := tx.Stmt(m.parent.uidNext).QueryRow(destID).Scan(&oldUidNext); err != nil {
+	if err := tx.Stmt(m.parent.uidNext).QueryRowContext(ctx, destID).Scan(&oldUidNext); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (old uidNext)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (old uidNext)")
 	}
 
 	// Increase UIDNEXT and MESSAGES for the target mailbox.
-	if _, err := tx.Stmt(m.parent.increaseMsgCount).Exec(copiedCount, copiedCount, destID); err != nil {
+	if _, err := tx.Stmt(m.parent.increaseMsgCount).ExecContext(ctx, copiedCount, copiedCount, destID); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (increase counters)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (increase counters)")
 	}
 
+	if copiedCount != 0 {
+		if err := m.parent.logIndex(ctx, tx, m.parent.logIndexAddUid, destID, oldUidNext, oldUidNext+copiedCount-1); err != nil {
+			m.parent.logMboxErr(m, err, "MoveMessages (logIndex)", uid, seqset, dest)
+			return wrapErr(err, "MoveMessages (logIndex)")
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (tx commit)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (tx commit)")
 	}
+	m.parent.searchIndexChanged()
 
 	for _, uid := range expunged {
 		m.handle.Removed(uid)
@@ -599,7 +682,16 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 }
 
 func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
-	tx, err := m.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
+	return m.CopyMessagesContext(context.Background(), uid, seqset, dest)
+}
+
+// CopyMessagesContext is a variant of CopyMessages that aborts the
+// transaction once ctx is cancelled.
+func (m *Mailbox) CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := m.user.checkWritable(); err != nil {
+		return err
+	}
+	tx, err := m.parent.db.BeginLevelContext(ctx, sql.LevelRepeatableRead, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "CopyMessages (tx start)", uid, seqset, dest)
 		return wrapErr(err, "CopyMessages")
@@ -614,7 +706,7 @@ func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error
 		return err
 	}
 
-	firstCopy, lastCopy, destID, err := m.copyMessages(tx, seqset, dest)
+	firstCopy, lastCopy, destID, err := m.copyMessages(ctx, tx, seqset, dest)
 	if err != nil {
 		if err == backend.ErrNoSuchMailbox {
 			return err
@@ -623,9 +715,16 @@ func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error
 		return wrapErr(err, "CopyMessages")
 	}
 
+	if lastCopy >= firstCopy {
+		if err := m.parent.logIndex(ctx, tx, m.parent.logIndexAddUid, destID, firstCopy, lastCopy); err != nil {
+			m.parent.logMboxErr(m, err, "CopyMessages (logIndex)", uid, seqset, dest)
+			return wrapErr(err, "CopyMessages")
+		}
+	}
+
 	persistRecent := m.parent.mngr.NewMessages(destID, imap.SeqSet{Set: []imap.Seq{{Start: firstCopy, Stop: lastCopy}}})
 	if persistRecent {
-		if _, err := tx.Stmt(m.parent.addRecentToLast).Exec(destID, destID, lastCopy-firstCopy+1); err != nil {
+		if _, err := tx.Stmt(m.parent.addRecentToLast).ExecContext(ctx, destID, destID, lastCopy-firstCopy+1); err != nil {
 			m.parent.logMboxErr(m, err, "CopyMessages (persistRecent)", uid, seqset, dest)
 			return wrapErr(err, "CopyMessages")
 		}
@@ -635,11 +734,15 @@ func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error
 		m.parent.logMboxErr(m, err, "CopyMessages (tx commit)", uid, seqset, dest)
 		return wrapErr(err, "CopyMessages")
 	}
+	m.parent.searchIndexChanged()
 
 	return nil
 }
 
 func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
+	if err := m.user.checkWritable(); err != nil {
+		return err
+	}
 	tx, err := m.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "DelMessages (tx start)", uid, seqset)
@@ -652,7 +755,7 @@ func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
 		return err
 	}
 
-	deleted, err := m.delMessages(tx, seqset)
+	deleted, keys, err := m.delMessages(context.Background(), tx, seqset)
 	if err != nil {
 		if err == backend.ErrNoSuchMailbox {
 			return err
@@ -665,18 +768,20 @@ func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
 		m.parent.logMboxErr(m, err, "DelMessages (tx commit)", uid, seqset)
 		return wrapErr(err, "DelMessages")
 	}
+	m.parent.searchIndexChanged()
+	m.parent.deleteQueuedBlobs(keys)
 
 	m.handle.RemovedSet(deleted)
 
 	return nil
 }
 
-func (m *Mailbox) delMessages(tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, error) {
+func (m *Mailbox) delMessages(ctx context.Context, tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, []string, error) {
 	for _, seq := range seqset.Set {
 		m.parent.Opts.Log.Println("delMessages: marking SQL window range", seq.Start, seq.Stop, "for deletion")
-		_, err := tx.Stmt(m.parent.markUid).Exec(m.id, seq.Start, seq.Stop)
+		_, err := tx.Stmt(m.parent.markUid).ExecContext(ctx, m.id, seq.Start, seq.Stop)
 		if err != nil {
-			return imap.SeqSet{}, err
+			return imap.SeqSet{}, nil, err
 		}
 	}
 
@@ -686,15 +791,15 @@ func (m *Mailbox) delMessages(tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, err
 		deletedCount   uint32
 	)
 
-	rows, err := tx.Stmt(m.parent.markedUids).Query(m.id)
+	rows, err := tx.Stmt(m.parent.markedUids).QueryContext(ctx, m.id)
 	if err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
 	}
 	for rows.Next() {
 		var uid uint32
 		var extKey sql.NullString
 		if err := rows.Scan(&uid, &extKey); err != nil {
-			return imap.SeqSet{}, err
+			return imap.SeqSet{}, nil, err
 		}
 		m.parent.Opts.Log.Println("delMessages:", uid, extKey, "is marked")
 
@@ -703,25 +808,40 @@ func (m *Mailbox) delMessages(tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, err
 		deletedCount++
 	}
 	if err := rows.Err(); err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
 	}
 
-	m.parent.Opts.Log.Println("delMessages: deleting storage keys: ", deletedExtKeys)
-	if err := m.parent.extStore.Delete(deletedExtKeys); err != nil {
-		return imap.SeqSet{}, err
+	keepDeleted, err := m.parent.keepDeleted(ctx, tx, m.user.id)
+	if err != nil {
+		return imap.SeqSet{}, nil, err
+	}
+	if keepDeleted {
+		// Blobs are still referenced by tombstones.
+		if err := m.tombstoneMarked(ctx, tx); err != nil {
+			return imap.SeqSet{}, nil, err
+		}
+		deletedExtKeys = nil
+	} else {
+		m.parent.Opts.Log.Println("delMessages: deleting storage keys: ", deletedExtKeys)
+		if err := m.parent.queueBlobDeletion(ctx, tx, deletedExtKeys); err != nil {
+			return imap.SeqSet{}, nil, err
+		}
 	}
 
-	if _, err := tx.Stmt(m.parent.delMarked).Exec(); err != nil {
-		return imap.SeqSet{}, err
+	if err := m.parent.logIndex(ctx, tx, m.parent.logIndexRemoveMarked, m.id); err != nil {
+		return imap.SeqSet{}, nil, err
+	}
+	if _, err := tx.Stmt(m.parent.delMarked).ExecContext(ctx); err != nil {
+		return imap.SeqSet{}, nil, err
 	}
 
 	m.parent.Opts.Log.Println("delMessages: deleted", deletedCount, "messages")
-	_, err = tx.Stmt(m.parent.decreaseMsgCount).Exec(deletedCount, m.id)
-	return deletedUids, err
+	_, err = tx.Stmt(m.parent.decreaseMsgCount).ExecContext(ctx, deletedCount, m.id)
+	return deletedUids, deletedExtKeys, err
 }
 
-func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (firstCopy, lastCopy uint32, destID uint64, err error) {
-	row := tx.Stmt(m.parent.mboxId).QueryRow(m.user.id, dest)
+func (m *Mailbox) copyMessages(ctx context.Context, tx *sql.Tx, seqset *imap.SeqSet, dest string) (firstCopy, lastCopy uint32, destID uint64, err error) {
+	row := tx.Stmt(m.parent.mboxId).QueryRowContext(ctx, m.user.id, dest)
 	if err := row.Scan(&destID); err != nil {
 		if err == sql.ErrNoRows {
 			return 0, 0, 0, backend.ErrNoSuchMailbox
@@ -733,11 +853,11 @@ func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (fi
 	srcId := m.id
 	var totalCopied uint32
 	for _, seq := range seqset.Set {
-		stats, err := tx.Stmt(m.parent.copyMsgsUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop)
+		stats, err := tx.Stmt(m.parent.copyMsgsUid).ExecContext(ctx, destID, destID, totalCopied, srcId, seq.Start, seq.Stop)
 		if err != nil {
 			return 0, 0, 0, err
 		}
-		if _, err := tx.Stmt(m.parent.copyMsgFlagsUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop); err != nil {
+		if _, err := tx.Stmt(m.parent.copyMsgFlagsUid).ExecContext(ctx, destID, destID, totalCopied, srcId, seq.Start, seq.Stop); err != nil {
 			return 0, 0, 0, err
 		}
 
@@ -748,17 +868,17 @@ func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (fi
 		totalCopied += uint32(affected)
 		m.parent.Opts.Log.Debugln("copyMessages: copied", affected, "messages for range", seq, "SQL:", seq.Start, seq.Stop)
 
-		if _, err := tx.Stmt(m.parent.incrementRefUid).Exec(m.user.id, srcId, seq.Start, seq.Stop); err != nil {
+		if _, err := tx.Stmt(m.parent.incrementRefUid).ExecContext(ctx, m.user.id, srcId, seq.Start, seq.Stop); err != nil {
 			return 0, 0, 0, err
 		}
 	}
 
 	var oldUidNext uint32
-	if err := tx.Stmt(m.parent.uidNext).QueryRow(destID).Scan(&oldUidNext); err != nil {
+	if err := tx.Stmt(m.parent.uidNext).QueryRowContext(ctx, destID).Scan(&oldUidNext); err != nil {
 		return 0, 0, 0, err
 	}
 
-	if _, err := tx.Stmt(m.parent.increaseMsgCount).Exec(totalCopied, totalCopied, destID); err != nil {
+	if _, err := tx.Stmt(m.parent.increaseMsgCount).ExecContext(ctx, totalCopied, totalCopied, destID); err != nil {
 		return 0, 0, 0, err
 	}
 
@@ -766,9 +886,18 @@ func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (fi
 }
 
 func (m *Mailbox) Expunge() error {
+	return m.ExpungeContext(context.Background())
+}
+
+// ExpungeContext is a variant of Expunge that aborts the transaction once
+// ctx is cancelled.
+func (m *Mailbox) ExpungeContext(ctx context.Context) error {
+	if err := m.user.checkWritable(); err != nil {
+		return err
+	}
 	defer m.handle.Sync(true)
 
-	tx, err := m.parent.db.Begin(false)
+	tx, err := m.parent.db.BeginContext(ctx, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (tx start)")
 		return wrapErr(err, "Expunge")
@@ -779,7 +908,7 @@ func (m *Mailbox) Expunge() error {
 		uids          imap.SeqSet
 		expungedCount uint32
 	)
-	rows, err := tx.Stmt(m.parent.deletedUids).Query(m.id)
+	rows, err := tx.Stmt(m.parent.deletedUids).QueryContext(ctx, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (deletedUids)")
 		return wrapErr(err, "Expunge")
@@ -802,49 +931,71 @@ func (m *Mailbox) Expunge() error {
 
 	rows.Close()
 
-	keys, err := m.expungeExternal(tx)
+	keepDeleted, err := m.parent.keepDeleted(ctx, tx, m.user.id)
 	if err != nil {
-		m.parent.logMboxErr(m, err, "Expunge (external prepare)")
-		return err
+		m.parent.logMboxErr(m, err, "Expunge (keepDeleted)")
+		return wrapErr(err, "Expunge")
 	}
 
-	_, err = tx.Stmt(m.parent.expungeMbox).Exec(m.id, m.id)
+	var keys []string
+	if keepDeleted {
+		if err := m.tombstoneExpunged(ctx, tx); err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (tombstone)")
+			return err
+		}
+	} else {
+		keys, err = m.expungeExternal(ctx, tx)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (external prepare)")
+			return err
+		}
+	}
+
+	if err := m.parent.logIndex(ctx, tx, m.parent.logIndexRemoveDeleted, m.id); err != nil {
+		m.parent.logMboxErr(m, err, "Expunge (logIndex)")
+		return wrapErr(err, "Expunge")
+	}
+
+	_, err = tx.Stmt(m.parent.expungeMbox).ExecContext(ctx, m.id, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (expunge)")
 		return wrapErr(err, "Expunge")
 	}
 
-	_, err = tx.Stmt(m.parent.decreaseMsgCount).Exec(expungedCount, m.id)
+	_, err = tx.Stmt(m.parent.decreaseMsgCount).ExecContext(ctx, expungedCount, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (decrease counters)", m.id, expungedCount)
 		return wrapErr(err, "Expunge (decrease counters)")
 	}
 
-	if _, err := tx.Stmt(m.parent.deleteZeroRef).Exec(m.user.id); err != nil {
+	if _, err := tx.Stmt(m.parent.deleteZeroRef).ExecContext(ctx, m.user.id); err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (deleteZeroRef)")
 		return wrapErr(err, "Expunge")
 	}
 
-	if err := tx.Commit(); err != nil {
-		m.parent.logMboxErr(m, err, "Expunge (tx commit)")
+	if err := m.parent.queueBlobDeletion(ctx, tx, keys); err != nil {
+		m.parent.logMboxErr(m, err, "Expunge (queue deletion)")
 		return wrapErr(err, "Expunge")
 	}
 
-	if err := m.parent.extStore.Delete(keys); err != nil {
-		return wrapErr(err, "Expunge (external)")
+	if err := tx.Commit(); err != nil {
+		m.parent.logMboxErr(m, err, "Expunge (tx commit)")
+		return wrapErr(err, "Expunge")
 	}
+	m.parent.searchIndexChanged()
+	m.parent.deleteQueuedBlobs(keys)
 
 	m.handle.RemovedSet(uids)
 
 	return nil
 }
 
-func (m *Mailbox) expungeExternal(tx *sql.Tx) ([]string, error) {
-	if _, err := tx.Stmt(m.parent.decreaseRefForDeleted).Exec(m.user.id, m.id); err != nil {
+func (m *Mailbox) expungeExternal(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	if _, err := tx.Stmt(m.parent.decreaseRefForDeleted).ExecContext(ctx, m.user.id, m.id); err != nil {
 		return nil, wrapErr(err, "Expunge (external decrease for deleted)")
 	}
 
-	rows, err := tx.Stmt(m.parent.zeroRef).Query(m.user.id, m.id)
+	rows, err := tx.Stmt(m.parent.zeroRef).QueryContext(ctx, m.user.id, m.id)
 	if err != nil {
 		return nil, wrapErr(err, "Expunge (external zeroRef collect)")
 	}
@@ -0,0 +1,186 @@
+package imapsql
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PassHashAlgo is the password hashing algorithm used for user passwords.
+type PassHashAlgo interface {
+	// Hash returns the encoded hash of the password, including salt and
+	// algorithm parameters.
+	Hash(pass string) (string, error)
+
+	// Verify checks whether pass matches the hash returned by Hash.
+	// Comparison should be done in constant time. Error is returned only
+	// if the hash is malformed.
+	Verify(hash, pass string) (bool, error)
+}
+
+var passHashAlgos = map[string]PassHashAlgo{
+	"bcrypt":   bcryptHash{},
+	"argon2id": argon2idHash{},
+}
+
+// RegisterPassHashAlgo adds a new password hashing algorithm to the registry
+// so it can be used in Opts.PassHashAlgo.
+//
+// Algorithms used for existing hashes should stay registered, otherwise users
+// will not be able to log in.
+func RegisterPassHashAlgo(name string, algo PassHashAlgo) {
+	passHashAlgos[name] = algo
+}
+
+// hashPassword returns the hash of pass in the format stored in the users
+// table: the algorithm name followed by colon and the algorithm-specific
+// hash.
+func hashPassword(algoName, pass string) (string, error) {
+	algo, ok := passHashAlgos[algoName]
+	if !ok {
+		return "", fmt.Errorf("imapsql: unknown password hash algorithm: %s", algoName)
+	}
+	hash, err := algo.Hash(pass)
+	if err != nil {
+		return "", err
+	}
+	return algoName + ":" + hash, nil
+}
+
+func verifyPassword(stored, pass string) (bool, error) {
+	parts := strings.SplitN(stored, ":", 2)
+	if len(parts) != 2 {
+		return false, errors.New("imapsql: malformed password hash")
+	}
+	algo, ok := passHashAlgos[parts[0]]
+	if !ok {
+		return false, fmt.Errorf("imapsql: unknown password hash algorithm: %s", parts[0])
+	}
+	return algo.Verify(parts[1], pass)
+}
+
+var (
+	dummyPassHash     string
+	dummyPassHashOnce sync.Once
+)
+
+// verifyDummyPassword spends roughly the same time as verifyPassword for the
+// hash generated using the default algorithm.
+func verifyDummyPassword(pass string) {
+	dummyPassHashOnce.Do(func() {
+		dummyPassHash, _ = hashPassword(defaultPassHashAlgo, "dummy password")
+	})
+	verifyPassword(dummyPassHash, pass) // nolint:errcheck
+}
+
+// SetPassword sets the password used to log in as the user. It is hashed
+// using Opts.PassHashAlgo. Empty password disables login.
+func (u *User) SetPassword(pass string) error {
+	var hash sql.NullString
+	if pass != "" {
+		algo := u.parent.Opts.PassHashAlgo
+		if algo == "" {
+			algo = defaultPassHashAlgo
+		}
+		var err error
+		hash.String, err = hashPassword(algo, pass)
+		if err != nil {
+			return err
+		}
+		hash.Valid = true
+	}
+
+	if _, err := u.parent.setUserPassHash.Exec(hash, u.id); err != nil {
+		u.parent.logUserErr(u, err, "SetPassword")
+		return wrapErr(err, "SetPassword")
+	}
+	return nil
+}
+
+type bcryptHash struct{}
+
+func (bcryptHash) Hash(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (bcryptHash) Verify(hash, pass string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// argon2idHash uses parameters recommended by OWASP: 19 MiB of memory,
+// 2 iterations, 1 thread. Hash is encoded in the PHC string format.
+type argon2idHash struct{}
+
+const (
+	argon2idMemory  = 19 * 1024
+	argon2idTime    = 2
+	argon2idThreads = 1
+	argon2idKeyLen  = 32
+	argon2idSaltLen = 16
+)
+
+func (argon2idHash) Hash(pass string) (string, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pass), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2idMemory, argon2idTime, argon2idThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (argon2idHash) Verify(hash, pass string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("imapsql: malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("imapsql: unsupported argon2id version")
+	}
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errors.New("imapsql: malformed argon2id parameters")
+	}
+	if time < 1 || threads < 1 {
+		return false, errors.New("imapsql: malformed argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.New("imapsql: malformed argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errors.New("imapsql: malformed argon2id key")
+	}
+	if len(key) == 0 {
+		return false, errors.New("imapsql: malformed argon2id key")
+	}
+
+	actual := argon2.IDKey([]byte(pass), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
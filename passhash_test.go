@@ -0,0 +1,85 @@
+package imapsql
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"gotest.tools/assert"
+)
+
+func TestPassHashAlgos(t *testing.T) {
+	for _, algo := range []string{"bcrypt", "argon2id"} {
+		hash, err := hashPassword(algo, "secret")
+		assert.NilError(t, err, algo)
+
+		ok, err := verifyPassword(hash, "secret")
+		assert.NilError(t, err, algo)
+		assert.Assert(t, ok, algo)
+
+		ok, err = verifyPassword(hash, "Secret")
+		assert.NilError(t, err, algo)
+		assert.Assert(t, !ok, algo)
+	}
+
+	_, err := hashPassword("unknown", "secret")
+	assert.Assert(t, err != nil)
+
+	for _, hash := range []string{
+		"",
+		"secret",
+		"unknown:secret",
+		"argon2id:",
+		"argon2id:$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5",
+		"argon2id:$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+		"argon2id:$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5",
+	} {
+		_, err := verifyPassword(hash, "secret")
+		assert.Assert(t, err != nil, hash)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+
+	assert.NilError(t, b.CreateUser(t.Name()))
+	u, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+
+	// No password set.
+	_, err = b.Login(nil, t.Name(), "")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	assert.NilError(t, u.(*User).SetPassword("secret"))
+	_, err = b.Login(nil, t.Name(), "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	u2, err := b.Login(nil, t.Name(), "secret")
+	assert.NilError(t, err)
+	assert.Equal(t, u2.Username(), u.Username())
+
+	b.Opts.PassHashAlgo = "argon2id"
+	assert.NilError(t, u.(*User).SetPassword("secret2"))
+	_, err = b.Login(nil, t.Name(), "secret")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.Login(nil, t.Name(), "secret2")
+	assert.NilError(t, err)
+
+	assert.NilError(t, u.(*User).SetPassword(""))
+	_, err = b.Login(nil, t.Name(), "secret2")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	_, err = b.Login(nil, t.Name()+"-new", "secret")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.GetUser(t.Name() + "-new")
+	assert.Equal(t, err, ErrUserDoesntExists)
+
+	b.Opts.AutoCreateUsers = true
+	_, err = b.Login(nil, t.Name()+"-new", "")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.Login(nil, t.Name()+"-new", "secret")
+	assert.NilError(t, err)
+	_, err = b.Login(nil, t.Name()+"-new", "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.Login(nil, t.Name()+"-new", "secret")
+	assert.NilError(t, err)
+}
@@ -0,0 +1,499 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+// Retention policies are stored in the retentionPolicies table. Global
+// policies use userId 0. Policies are matched against mailbox names and
+// SPECIAL-USE attributes (e.g. \Trash). A policy set for the user takes
+// precedence over a global one and a policy for the mailbox name takes
+// precedence over a policy for its attribute.
+
+const retentionBatch = 100
+
+// RetentionPolicy describes how long messages are kept in a mailbox.
+type RetentionPolicy struct {
+	// Mailbox name or SPECIAL-USE attribute, such as \Trash.
+	Mailbox string
+
+	// Messages with internal date older than that are removed.
+	MaxAge time.Duration
+}
+
+func (b *Backend) initRetentionPolicies() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS retentionPolicies (
+			userId BIGINT NOT NULL DEFAULT 0,
+			mailbox VARCHAR(255) NOT NULL,
+			maxAge BIGINT NOT NULL,
+
+			PRIMARY KEY(userId, mailbox)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table retentionPolicies")
+	}
+	return nil
+}
+
+func (b *Backend) prepareRetentionStmts() error {
+	var err error
+	b.addRetentionPolicy, err = b.db.Prepare(`
+		INSERT INTO retentionPolicies(userId, mailbox, maxAge)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addRetentionPolicy prep")
+	}
+	b.delRetentionPolicy, err = b.db.Prepare(`
+		DELETE FROM retentionPolicies
+		WHERE userId = ? AND mailbox = ?`)
+	if err != nil {
+		return wrapErr(err, "delRetentionPolicy prep")
+	}
+	b.delUserRetentionPolicies, err = b.db.Prepare(`
+		DELETE FROM retentionPolicies
+		WHERE userId = (SELECT id FROM users WHERE username = ?)`)
+	if err != nil {
+		return wrapErr(err, "delUserRetentionPolicies prep")
+	}
+	b.listRetentionPolicies, err = b.db.Prepare(`
+		SELECT mailbox, maxAge
+		FROM retentionPolicies
+		WHERE userId = ?
+		ORDER BY mailbox`)
+	if err != nil {
+		return wrapErr(err, "listRetentionPolicies prep")
+	}
+	b.allRetentionPolicies, err = b.db.Prepare(`
+		SELECT userId, mailbox, maxAge
+		FROM retentionPolicies`)
+	if err != nil {
+		return wrapErr(err, "allRetentionPolicies prep")
+	}
+	b.retentionMboxes, err = b.db.Prepare(`
+		SELECT id, uid, name, specialuse
+		FROM mboxes
+		WHERE msgsCount > 0
+		AND (specialuse IS NOT NULL OR name IN (
+			SELECT mailbox
+			FROM retentionPolicies
+		))
+		ORDER BY id`)
+	if err != nil {
+		return wrapErr(err, "retentionMboxes prep")
+	}
+	b.expiredUids, err = b.db.Prepare(`
+		SELECT msgId
+		FROM msgs
+		WHERE mboxId = ? AND date < ?
+		ORDER BY msgId
+		LIMIT ` + strconv.Itoa(retentionBatch))
+	if err != nil {
+		return wrapErr(err, "expiredUids prep")
+	}
+	b.tombstoneExpired, err = b.db.Prepare(`
+		INSERT INTO deletedMsgs(mboxId, msgId, uid, deletedAt, ` + msgsTombstoneCols + `)
+		SELECT mboxId, msgId, ?, ?, ` + msgsTombstoneCols + `
+		FROM msgs
+		WHERE mboxId = ? AND date < ? AND msgId <= ?`)
+	if err != nil {
+		return wrapErr(err, "tombstoneExpired prep")
+	}
+	b.tombstoneExpiredFlags, err = b.db.Prepare(`
+		INSERT INTO deletedFlags(mboxId, msgId, flag)
+		SELECT mboxId, msgId, flag
+		FROM flags
+		WHERE mboxId = ? AND msgId IN (
+			SELECT msgId
+			FROM msgs
+			WHERE mboxId = ? AND date < ? AND msgId <= ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "tombstoneExpiredFlags prep")
+	}
+	b.decreaseRefForExpired, err = b.db.Prepare(`
+		UPDATE extKeys
+		SET refs = refs - (
+			SELECT count(*)
+			FROM msgs
+			WHERE extBodyKey = extKeys.id
+			AND mboxId = ? AND date < ? AND msgId <= ?
+		)
+		WHERE uid = ?
+		AND id IN (
+			SELECT extBodyKey
+			FROM msgs
+			WHERE mboxId = ? AND date < ? AND msgId <= ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "decreaseRefForExpired prep")
+	}
+	b.delExpired, err = b.db.Prepare(`
+		DELETE FROM msgs
+		WHERE mboxId = ? AND date < ? AND msgId <= ?`)
+	if err != nil {
+		return wrapErr(err, "delExpired prep")
+	}
+	return nil
+}
+
+func checkRetentionPolicy(mailbox string, maxAge time.Duration) error {
+	if mailbox == "" {
+		return errors.New("imapsql: empty mailbox name")
+	}
+	if maxAge < time.Second {
+		return errors.New("imapsql: retention period should be at least one second")
+	}
+	return nil
+}
+
+func (b *Backend) setRetentionPolicy(userId uint64, mailbox string, maxAge time.Duration) error {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Stmt(b.delRetentionPolicy).Exec(userId, mailbox); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(b.addRetentionPolicy).Exec(userId, mailbox, int64(maxAge/time.Second)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *Backend) retentionPolicies(userId uint64) ([]RetentionPolicy, error) {
+	rows, err := b.listRetentionPolicies.Query(userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []RetentionPolicy
+	for rows.Next() {
+		var (
+			policy RetentionPolicy
+			maxAge int64
+		)
+		if err := rows.Scan(&policy.Mailbox, &maxAge); err != nil {
+			return nil, err
+		}
+		policy.MaxAge = time.Duration(maxAge) * time.Second
+		res = append(res, policy)
+	}
+	return res, rows.Err()
+}
+
+// SetRetentionPolicy sets the retention period for the mailbox name or
+// SPECIAL-USE attribute for all users. It is overridden by policies set
+// using User.SetRetentionPolicy.
+func (b *Backend) SetRetentionPolicy(mailbox string, maxAge time.Duration) error {
+	if err := checkRetentionPolicy(mailbox, maxAge); err != nil {
+		return err
+	}
+	return wrapErrf(b.setRetentionPolicy(0, mailbox, maxAge), "SetRetentionPolicy %s", mailbox)
+}
+
+// RemoveRetentionPolicy removes the global retention policy for the mailbox
+// name or SPECIAL-USE attribute.
+func (b *Backend) RemoveRetentionPolicy(mailbox string) error {
+	_, err := b.delRetentionPolicy.Exec(0, mailbox)
+	return wrapErrf(err, "RemoveRetentionPolicy %s", mailbox)
+}
+
+// RetentionPolicies returns global retention policies.
+func (b *Backend) RetentionPolicies() ([]RetentionPolicy, error) {
+	res, err := b.retentionPolicies(0)
+	return res, wrapErr(err, "RetentionPolicies")
+}
+
+// SetRetentionPolicy sets the retention period for the mailbox name or
+// SPECIAL-USE attribute. It overrides the global policy for the same
+// mailbox.
+func (u *User) SetRetentionPolicy(mailbox string, maxAge time.Duration) error {
+	if err := checkRetentionPolicy(mailbox, maxAge); err != nil {
+		return err
+	}
+	err := u.parent.setRetentionPolicy(u.id, mailbox, maxAge)
+	u.parent.logUserErr(u, err, "SetRetentionPolicy", mailbox)
+	return wrapErrf(err, "SetRetentionPolicy %s", mailbox)
+}
+
+// RemoveRetentionPolicy removes the retention policy set for the user.
+func (u *User) RemoveRetentionPolicy(mailbox string) error {
+	_, err := u.parent.delRetentionPolicy.Exec(u.id, mailbox)
+	u.parent.logUserErr(u, err, "RemoveRetentionPolicy", mailbox)
+	return wrapErrf(err, "RemoveRetentionPolicy %s", mailbox)
+}
+
+// RetentionPolicies returns retention policies set for the user. Global
+// policies are not included.
+func (u *User) RetentionPolicies() ([]RetentionPolicy, error) {
+	res, err := u.parent.retentionPolicies(u.id)
+	u.parent.logUserErr(u, err, "RetentionPolicies")
+	return res, wrapErr(err, "RetentionPolicies")
+}
+
+// policySet maps user ID (0 for global policies) to policies by mailbox.
+type policySet map[uint64]map[string]time.Duration
+
+func (p policySet) lookup(uid uint64, name string, specialUse sql.NullString) (time.Duration, bool) {
+	for _, id := range [2]uint64{uid, 0} {
+		policies := p[id]
+		if maxAge, ok := policies[name]; ok {
+			return maxAge, true
+		}
+		if !specialUse.Valid {
+			continue
+		}
+		if maxAge, ok := policies[specialUse.String]; ok {
+			return maxAge, true
+		}
+	}
+	return 0, false
+}
+
+func (b *Backend) loadRetentionPolicies() (policySet, error) {
+	rows, err := b.allRetentionPolicies.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(policySet)
+	for rows.Next() {
+		var (
+			userId  uint64
+			mailbox string
+			maxAge  int64
+		)
+		if err := rows.Scan(&userId, &mailbox, &maxAge); err != nil {
+			return nil, err
+		}
+		if res[userId] == nil {
+			res[userId] = make(map[string]time.Duration)
+		}
+		res[userId][mailbox] = time.Duration(maxAge) * time.Second
+	}
+	return res, rows.Err()
+}
+
+type retentionMbox struct {
+	id, uid    uint64
+	name       string
+	specialUse sql.NullString
+}
+
+func (b *Backend) policyMailboxes() ([]retentionMbox, error) {
+	rows, err := b.retentionMboxes.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []retentionMbox
+	for rows.Next() {
+		var mbox retentionMbox
+		if err := rows.Scan(&mbox.id, &mbox.uid, &mbox.name, &mbox.specialUse); err != nil {
+			return nil, err
+		}
+		res = append(res, mbox)
+	}
+	return res, rows.Err()
+}
+
+// ApplyRetentionPolicies removes messages older than the retention period
+// from all mailboxes that have a retention policy. Removed messages are kept
+// for Opts.DeletedRetention, if it is set. The amount of removed messages is
+// returned.
+//
+// Unless Opts.RetentionInterval is negative, it is called periodically in
+// background.
+func (b *Backend) ApplyRetentionPolicies() (int, error) {
+	b.retentionLck.Lock()
+	defer b.retentionLck.Unlock()
+
+	policies, err := b.loadRetentionPolicies()
+	if err != nil {
+		return 0, wrapErr(err, "ApplyRetentionPolicies")
+	}
+	if len(policies) == 0 {
+		return 0, nil
+	}
+	mboxes, err := b.policyMailboxes()
+	if err != nil {
+		return 0, wrapErr(err, "ApplyRetentionPolicies")
+	}
+
+	total := 0
+	var lastErr error
+	for _, mbox := range mboxes {
+		maxAge, ok := policies.lookup(mbox.uid, mbox.name, mbox.specialUse)
+		if !ok {
+			continue
+		}
+
+		removed, err := b.expireMessages(mbox, time.Now().Add(-maxAge).Unix())
+		total += removed
+		if err != nil {
+			b.Opts.Log.Printf("failed to apply retention policy for mailbox %d (user %d): %v", mbox.id, mbox.uid, err)
+			lastErr = err
+		}
+	}
+
+	return total, wrapErr(lastErr, "ApplyRetentionPolicies")
+}
+
+func (b *Backend) expireMessages(mbox retentionMbox, cutoff int64) (int, error) {
+	total := 0
+	for {
+		removed, err := b.expireBatch(mbox, cutoff)
+		total += removed
+		if err != nil {
+			return total, err
+		}
+		if removed < retentionBatch {
+			return total, nil
+		}
+	}
+}
+
+// expireBatch removes up to retentionBatch messages with internal date
+// before cutoff and notifies connected sessions about them.
+func (b *Backend) expireBatch(mbox retentionMbox, cutoff int64) (int, error) {
+	tx, err := b.db.BeginLevel(sql.LevelRepeatableRead, false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	rows, err := tx.Stmt(b.expiredUids).Query(mbox.id, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		uids    imap.SeqSet
+		count   int
+		lastUid uint32
+	)
+	for rows.Next() {
+		if err := rows.Scan(&lastUid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		uids.AddNum(lastUid)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+	if count == 0 {
+		return 0, nil
+	}
+
+	keepDeleted, err := b.keepDeleted(context.Background(), tx, mbox.uid)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	if keepDeleted {
+		if _, err := tx.Stmt(b.tombstoneExpired).Exec(mbox.uid, time.Now().Unix(), mbox.id, cutoff, lastUid); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Stmt(b.tombstoneExpiredFlags).Exec(mbox.id, mbox.id, cutoff, lastUid); err != nil {
+			return 0, err
+		}
+	} else {
+		if _, err := tx.Stmt(b.decreaseRefForExpired).Exec(mbox.id, cutoff, lastUid, mbox.uid, mbox.id, cutoff, lastUid); err != nil {
+			return 0, err
+		}
+		keys, err = b.zeroRefKeys(tx, mbox.uid)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := b.logIndex(context.Background(), tx, b.logIndexRemoveExpired, mbox.id, cutoff, lastUid); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Stmt(b.delExpired).Exec(mbox.id, cutoff, lastUid); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Stmt(b.decreaseMsgCount).Exec(count, mbox.id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Stmt(b.deleteZeroRef).Exec(mbox.uid); err != nil {
+		return 0, err
+	}
+	if err := b.queueBlobDeletion(context.Background(), tx, keys); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	b.searchIndexChanged()
+	b.deleteQueuedBlobs(keys)
+	b.notifyRemoved(mbox.id, uids)
+
+	return count, nil
+}
+
+func (b *Backend) zeroRefKeys(tx *sql.Tx, uid uint64) ([]string, error) {
+	rows, err := tx.Stmt(b.zeroRefUser).Query(uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// notifyRemoved dispatches EXPUNGE updates for messages removed without a
+// mailbox handle to connected sessions and to the external sink, if any.
+func (b *Backend) notifyRemoved(mboxId uint64, uids imap.SeqSet) {
+	b.mngr.ExternalUpdate(mess.Update{
+		Type:   mess.UpdRemoved,
+		Key:    mboxId,
+		SeqSet: uids.String(),
+	})
+	b.mngr.ManagementHandle(mboxId, nil, nil).RemovedSet(uids)
+}
+
+func (b *Backend) retentionLoop() {
+	interval := b.Opts.RetentionInterval
+	if interval == 0 {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := b.ApplyRetentionPolicies(); err != nil {
+				b.Opts.Log.Printf("%v", err)
+			}
+		case <-b.retentionLoopStop:
+			return
+		}
+	}
+}
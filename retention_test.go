@@ -0,0 +1,86 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	b := initTestBackendOpts(Opts{RetentionInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user1"))
+	assert.NilError(t, b.CreateUser("user2"))
+	usr1, err := b.GetUser("user1")
+	assert.NilError(t, err)
+	u1 := usr1.(*User)
+	usr2, err := b.GetUser("user2")
+	assert.NilError(t, err)
+	u2 := usr2.(*User)
+
+	assert.Assert(t, b.SetRetentionPolicy(imap.TrashAttr, 0) != nil)
+	assert.NilError(t, b.SetRetentionPolicy(imap.TrashAttr, 24*time.Hour))
+	assert.NilError(t, b.SetRetentionPolicy("Old", time.Hour))
+	assert.NilError(t, u2.SetRetentionPolicy(imap.TrashAttr, 72*time.Hour))
+	policies, err := b.RetentionPolicies()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, policies, []RetentionPolicy{{Mailbox: "Old", MaxAge: time.Hour}, {Mailbox: imap.TrashAttr, MaxAge: 24 * time.Hour}})
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, u := range []*User{u1, u2} {
+		assert.NilError(t, u.CreateMailboxSpecial("Bin", imap.TrashAttr))
+		assert.NilError(t, u.CreateMessage("Bin", []string{}, old, strings.NewReader(testMsg), nil))
+		assert.NilError(t, u.CreateMessage("Bin", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+		assert.NilError(t, u.CreateMessage("INBOX", []string{}, old, strings.NewReader(testMsg), nil))
+	}
+
+	_, mbox, err := u1.GetMailbox("Bin", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	removed, err := b.ApplyRetentionPolicies()
+	assert.NilError(t, err)
+	assert.Equal(t, removed, 1)
+	assert.Assert(t, checkKeysCount(b, 5))
+
+	// Connected sessions get EXPUNGE for removed messages.
+	assert.Equal(t, mbox.(*Mailbox).handle.MsgsCount(), 2)
+	assert.NilError(t, mbox.Poll(true))
+	assert.Equal(t, mbox.(*Mailbox).handle.MsgsCount(), 1)
+
+	status, err := u2.Status("Bin", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(2))
+
+	assert.NilError(t, u2.RemoveRetentionPolicy(imap.TrashAttr))
+	removed, err = b.ApplyRetentionPolicies()
+	assert.NilError(t, err)
+	assert.Equal(t, removed, 1)
+	assert.Assert(t, checkKeysCount(b, 4))
+}
+
+func TestRetentionPolicies_DeletedRetention(t *testing.T) {
+	b := initTestBackendOpts(Opts{RetentionInterval: -1, DeletedRetention: time.Hour, PurgeInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	u := usr.(*User)
+
+	assert.NilError(t, u.SetRetentionPolicy("INBOX", time.Hour))
+	for i := 0; i < retentionBatch+1; i++ {
+		assert.NilError(t, u.CreateMessage("INBOX", []string{imap.SeenFlag}, time.Now().Add(-2*time.Hour), strings.NewReader(testMsg), nil))
+	}
+
+	removed, err := b.ApplyRetentionPolicies()
+	assert.NilError(t, err)
+	assert.Equal(t, removed, retentionBatch+1)
+	assert.Assert(t, checkKeysCount(b, retentionBatch+1))
+
+	count, err := u.DeletedMessages("INBOX")
+	assert.NilError(t, err)
+	assert.Equal(t, count, retentionBatch+1)
+}
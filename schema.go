@@ -2,7 +2,9 @@ package imapsql
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"time"
 )
 
 func (b *Backend) schemaVersion() (int, error) {
@@ -70,8 +72,125 @@ func (b *Backend) upgradeSchema(currentVer int) error {
 		currentVer = 6
 	}
 
+	if currentVer == 6 {
+		if err := b.schemaUpgrade6To7(tx); err != nil {
+			return wrapErr(err, "6->7 upgrade")
+		}
+		currentVer = 7
+	}
+
+	if currentVer == 7 {
+		if _, err := tx.Exec(b.db.rewriteSQL(`ALTER TABLE users ADD COLUMN password VARCHAR(255) DEFAULT NULL`)); err != nil {
+			return wrapErr(err, "7->8 upgrade")
+		}
+		currentVer = 8
+	}
+
+	if currentVer == 8 {
+		for _, col := range []string{
+			`status INTEGER NOT NULL DEFAULT 0`,
+			`failedLogins INTEGER NOT NULL DEFAULT 0`,
+			`lockedUntil BIGINT NOT NULL DEFAULT 0`,
+		} {
+			if _, err := tx.Exec(b.db.rewriteSQL(`ALTER TABLE users ADD COLUMN ` + col)); err != nil {
+				return wrapErr(err, "8->9 upgrade")
+			}
+		}
+		currentVer = 9
+	}
+
+	if currentVer == 9 {
+		if _, err := tx.Exec(b.db.rewriteSQL(`ALTER TABLE users ADD COLUMN domainId BIGINT DEFAULT NULL`)); err != nil {
+			return wrapErr(err, "9->10 upgrade")
+		}
+		currentVer = 10
+	}
+
 	if currentVer != SchemaVersion {
 		return errors.New("database schema version is too old and can't be upgraded using this go-imap-sql version")
 	}
 	return tx.Commit()
 }
+
+// schemaUpgrade6To7 adds sort key columns to msgs and fills them using
+// cached headers of existing messages.
+func (b *Backend) schemaUpgrade6To7(tx *sql.Tx) error {
+	for _, col := range []string{
+		`sentDate BIGINT NOT NULL DEFAULT 0`,
+		`sortSubject ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT ''`,
+		`sortFrom ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT ''`,
+		`sortTo ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT ''`,
+		`sortCc ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT ''`,
+		`sortDisplayFrom ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT ''`,
+		`sortDisplayTo ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT ''`,
+	} {
+		if _, err := tx.Exec(b.db.rewriteSQL(`ALTER TABLE msgs ADD COLUMN ` + col)); err != nil {
+			return err
+		}
+	}
+
+	list, err := tx.Prepare(b.db.rewriteSQL(`
+		SELECT mboxId, msgId, cachedHeader, date
+		FROM msgs
+		WHERE mboxId > ? OR (mboxId = ? AND msgId > ?)
+		ORDER BY mboxId, msgId
+		LIMIT 1000`))
+	if err != nil {
+		return err
+	}
+	defer list.Close()
+	update, err := tx.Prepare(b.db.rewriteSQL(`
+		UPDATE msgs
+		SET sentDate = ?, sortSubject = ?, sortFrom = ?, sortTo = ?, sortCc = ?, sortDisplayFrom = ?, sortDisplayTo = ?
+		WHERE mboxId = ? AND msgId = ?`))
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+
+	type msgRow struct {
+		mboxId    uint64
+		msgId     uint32
+		cachedHdr []byte
+		dateUnix  int64
+	}
+	var lastMbox uint64
+	var lastMsg uint32
+	for {
+		// Rows are read in batches since some drivers do not allow
+		// executing other queries while result set is not consumed.
+		rows, err := list.Query(lastMbox, lastMbox, lastMsg)
+		if err != nil {
+			return err
+		}
+		var batch []msgRow
+		for rows.Next() {
+			var row msgRow
+			if err := rows.Scan(&row.mboxId, &row.msgId, &row.cachedHdr, &row.dateUnix); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, row := range batch {
+			var hdrs map[string][]string
+			if err := json.Unmarshal(row.cachedHdr, &hdrs); err != nil {
+				b.Opts.Log.Printf("schemaUpgrade6To7: malformed cachedHeader (mbox %d, msg %d): %v", row.mboxId, row.msgId, err)
+			}
+			args := append(makeSortKeys(hdrs).values(time.Unix(row.dateUnix, 0)), row.mboxId, row.msgId)
+			if _, err := update.Exec(args...); err != nil {
+				return err
+			}
+		}
+
+		lastMbox, lastMsg = batch[len(batch)-1].mboxId, batch[len(batch)-1].msgId
+	}
+}
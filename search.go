@@ -1,8 +1,13 @@
 package imapsql
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	nettextproto "net/textproto"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -12,26 +17,100 @@ import (
 )
 
 func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return m.SearchMessagesContext(context.Background(), uid, criteria)
+}
+
+// SearchMessagesContext is a variant of SearchMessages that stops scanning
+// messages once ctx is cancelled, e.g. when the client disconnects.
+func (m *Mailbox) SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
 	if searchOnlyWithFlags(criteria) {
 		if criteria.Not == nil && criteria.Or == nil && criteria.WithFlags == nil && criteria.WithoutFlags == nil {
-			return m.allSearch(uid)
+			return m.allSearch(ctx, uid)
 		}
 
-		return m.flagSearch(uid, criteria.WithFlags, criteria.WithoutFlags)
+		return m.flagSearch(ctx, uid, criteria.WithFlags, criteria.WithoutFlags)
 	}
 
 	m.handle.ResolveCriteria(criteria)
 
-	needBody := searchNeedsBody(criteria)
-	rows, err := m.parent.searchFetchNoSeq.Query(m.id)
+	if m.parent.Opts.SearchIndex != nil {
+		uids, ok, err := m.searchIndexCandidates(ctx, criteria)
+		if err != nil {
+			// Fallback to the full scan, index is only an optimization.
+			m.parent.logMboxErr(m, err, "search index query failed")
+		} else if ok {
+			return m.searchCandidates(ctx, uid, criteria, uids)
+		}
+	}
+
+	if m.parent.searchFetchText != nil {
+		if query := m.parent.db.textQuery(textSearchTerms(criteria)); query != "" {
+			m.parent.Opts.Log.Debugln("SearchMessages: using full-text query", query)
+			rows, err := m.parent.searchFetchText.QueryContext(ctx, m.id, query)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+
+			return m.searchRows(ctx, uid, rows, criteria)
+		}
+	}
+
+	rows, err := m.parent.searchFetchNoSeq.QueryContext(ctx, m.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return m.searchRows(ctx, uid, rows, criteria)
+}
+
+// searchUidRange is a variant of SearchMessages that only considers messages
+// with UIDs in the [start, stop] range.
+//
+// Passed criteria should be already resolved using ResolveCriteria.
+func (m *Mailbox) searchUidRange(ctx context.Context, uid bool, criteria *imap.SearchCriteria, start, stop uint32) ([]uint32, error) {
+	rows, err := m.parent.searchFetchUidRange.QueryContext(ctx, m.id, start, stop)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return m.searchRows(ctx, uid, rows, criteria)
+}
+
+// searchRow is a row returned by searchFetch* statements.
+type searchRow struct {
+	msgId           uint32
+	dateUnix        int64
+	bodyLen         int
+	flagStr         string
+	extBodyKey      string
+	compressAlgo    string
+	cachedHeaderRaw []byte
+	bodyStructRaw   []byte
+}
+
+func (m *Mailbox) searchRows(ctx context.Context, uid bool, rows *sql.Rows, criteria *imap.SearchCriteria) ([]uint32, error) {
+	needBody := searchNeedsBody(criteria)
+	needHeader := !needBody && searchNeedsHeader(criteria)
+	needAttachments := searchNeedsAttachments(criteria)
+
+	if needBody && m.parent.Opts.SearchWorkers > 1 {
+		return m.searchRowsParallel(ctx, uid, needAttachments, rows, criteria)
+	}
+
 	var res []uint32
 	for rows.Next() {
-		id, err := m.searchMatches(uid, needBody, rows, criteria)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var row searchRow
+		if err := row.scan(rows); err != nil {
+			return nil, err
+		}
+		id, err := m.searchMatches(ctx, uid, needBody, needHeader, needAttachments, &row, criteria)
 		if err != nil {
 			return nil, err
 		}
@@ -46,21 +125,90 @@ func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 	return res, nil
 }
 
-func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *imap.SearchCriteria) (uint32, error) {
+// searchRowsParallel is a variant of searchRows that reads and matches
+// message bodies using Opts.SearchWorkers goroutines.
+func (m *Mailbox) searchRowsParallel(ctx context.Context, uid, needAttachments bool, rows *sql.Rows, criteria *imap.SearchCriteria) ([]uint32, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var (
-		msgId        uint32
-		dateUnix     int64
-		bodyLen      int
-		flagStr      string
-		extBodyKey   string
-		compressAlgo string
+		jobs = make(chan *searchRow, m.parent.Opts.SearchWorkers)
+		wg   sync.WaitGroup
+
+		resLck   sync.Mutex
+		res      []uint32
+		firstErr error
 	)
+	for i := 0; i < m.parent.Opts.SearchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range jobs {
+				id, err := m.searchMatches(ctx, uid, true, false, needAttachments, row, criteria)
+				resLck.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				if id != 0 {
+					res = append(res, id)
+				}
+				resLck.Unlock()
+			}
+		}()
+	}
 
-	if err := rows.Scan(&msgId, &dateUnix, &bodyLen, &extBodyKey, &compressAlgo, &flagStr); err != nil {
-		return 0, err
+	var err error
+scan:
+	for rows.Next() {
+		row := &searchRow{}
+		if err = row.scan(rows); err != nil {
+			break
+		}
+		select {
+		case jobs <- row:
+		case <-ctx.Done():
+			break scan
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	flags := strings.Split(flagStr, flagsSep)
+	// Rows are ordered by UID and sequence numbers are ordered the same
+	// way so sorting restores the original order.
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+func (row *searchRow) scan(rows *sql.Rows) error {
+	return rows.Scan(&row.msgId, &row.dateUnix, &row.bodyLen, &row.extBodyKey, &row.compressAlgo, &row.cachedHeaderRaw, &row.bodyStructRaw, &row.flagStr)
+}
+
+func (m *Mailbox) searchMatches(ctx context.Context, uid, needBody, needHeader, needAttachments bool, row *searchRow, criteria *imap.SearchCriteria) (uint32, error) {
+	meta := searchMeta{size: uint32(row.bodyLen)}
+	if needAttachments {
+		var err error
+		meta.attachments, meta.largestPart, err = parseAttachments(row.bodyStructRaw)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "failed to parse body structure, skipping", row.msgId)
+			return 0, nil
+		}
+	}
+
+	flags := strings.Split(row.flagStr, flagsSep)
 	if len(flags) == 1 && flags[0] == "" {
 		flags = nil
 	}
@@ -68,24 +216,31 @@ func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *im
 	var ent *message.Entity
 	var err error
 	if needBody {
-		bufferedBody, err := m.openBody(true, compressAlgo, extBodyKey)
+		bufferedBody, err := m.openBody(ctx, true, row.compressAlgo, row.extBodyKey)
 		if err != nil {
-			m.parent.logMboxErr(m, err, "failed to read body, skipping", extBodyKey)
+			m.parent.logMboxErr(m, err, "failed to read body, skipping", row.extBodyKey)
 			return 0, nil
 		}
 		defer bufferedBody.Close()
 
 		hdr, err := textproto.ReadHeader(bufferedBody.Reader)
 		if err != nil {
-			m.parent.logMboxErr(m, err, "failed to parse body, skipping", extBodyKey)
+			m.parent.logMboxErr(m, err, "failed to parse body, skipping", row.extBodyKey)
 			return 0, nil
 		}
 
 		ent, err = message.New(message.Header{Header: hdr}, bufferedBody.Reader)
 		if err != nil {
-			m.parent.logMboxErr(m, err, "failed to parse body, skipping", extBodyKey)
+			m.parent.logMboxErr(m, err, "failed to parse body, skipping", row.extBodyKey)
+			return 0, nil
+		}
+	} else if needHeader {
+		var cachedHeader map[string][]string
+		if err := json.Unmarshal(row.cachedHeaderRaw, &cachedHeader); err != nil {
+			m.parent.logMboxErr(m, err, "failed to parse cached header, skipping", row.msgId)
 			return 0, nil
 		}
+		ent, _ = message.New(message.Header{Header: headerFromCached(cachedHeader)}, nil)
 	} else {
 		// XXX: This assumes backendutil.Match will not touch body unless it is needed for criteria.
 		ent, _ = message.New(message.Header{}, nil)
@@ -94,14 +249,14 @@ func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *im
 	var seqNum uint32
 	if !uid {
 		var ok bool
-		seqNum, ok = m.handle.UidAsSeq(msgId)
+		seqNum, ok = m.handle.UidAsSeq(row.msgId)
 		if !ok {
 			// Wtf
 			return 0, nil
 		}
 	}
 
-	matched, err := backendutil.Match(ent, seqNum, msgId, time.Unix(dateUnix, 0), flags, criteria)
+	matched, err := matchMessage(ent, seqNum, row.msgId, time.Unix(row.dateUnix, 0), &meta, flags, criteria)
 	if err != nil {
 		return 0, err
 	}
@@ -110,23 +265,104 @@ func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *im
 	}
 
 	if uid {
-		return msgId, nil
+		return row.msgId, nil
 	} else {
 		return seqNum, nil
 	}
 }
 
-func searchNeedsBody(criteria *imap.SearchCriteria) bool {
-	if criteria.Header != nil ||
-		criteria.Body != nil ||
-		criteria.Text != nil ||
-		!criteria.SentSince.IsZero() ||
-		!criteria.SentBefore.IsZero() ||
-		criteria.Smaller != 0 ||
-		criteria.Larger != 0 {
+// searchMeta contains message data used to check criteria without reading
+// the message body.
+type searchMeta struct {
+	size uint32
+
+	// Set only if criteria contain attachment pseudo-header fields.
+	attachments []Attachment
+	largestPart uint32
+}
+
+// matchMessage is a wrapper for backendutil.Match that checks LARGER and
+// SMALLER criteria against the stored message size so the message body is
+// not required for them. It also handles attachment pseudo-header fields.
+func matchMessage(ent *message.Entity, seqNum, uid uint32, date time.Time, meta *searchMeta, flags []string, criteria *imap.SearchCriteria) (bool, error) {
+	if criteria.Larger != 0 && meta.size <= criteria.Larger {
+		return false, nil
+	}
+	if criteria.Smaller != 0 && meta.size >= criteria.Smaller {
+		return false, nil
+	}
+
+	rest := *criteria
+	rest.Larger = 0
+	rest.Smaller = 0
+	rest.Not = nil
+	rest.Or = nil
+	if rest.Header != nil {
+		rest.Header = make(map[string][]string, len(criteria.Header))
+		for key, values := range criteria.Header {
+			if !isAttachmentCriterion(key) {
+				rest.Header[key] = values
+				continue
+			}
+			for _, value := range values {
+				if !matchAttachmentCriterion(key, value, meta.attachments, meta.largestPart) {
+					return false, nil
+				}
+			}
+		}
+	}
+	matched, err := backendutil.Match(ent, seqNum, uid, date, flags, &rest)
+	if err != nil || !matched {
+		return false, err
+	}
+
+	for _, not := range criteria.Not {
+		matched, err := matchMessage(ent, seqNum, uid, date, meta, flags, not)
+		if err != nil || matched {
+			return false, err
+		}
+	}
+	for _, or := range criteria.Or {
+		matched1, err := matchMessage(ent, seqNum, uid, date, meta, flags, or[0])
+		if err != nil {
+			return false, err
+		}
+		matched2, err := matchMessage(ent, seqNum, uid, date, meta, flags, or[1])
+		if err != nil || (!matched1 && !matched2) {
+			return false, err
+		}
+	}
 
+	return true, nil
+}
+
+// headerFromCached reconstructs the header from msgs.cachedHeader. Only
+// fields listed in cachedHeaderFields are present.
+func headerFromCached(cachedHeader map[string][]string) textproto.Header {
+	hdr := textproto.Header{}
+	for key, values := range cachedHeader {
+		for i := len(values) - 1; i >= 0; i-- {
+			hdr.Add(key, values[i])
+		}
+	}
+	return hdr
+}
+
+// searchNeedsBody reports whether the message body should be read to check
+// criteria. Header fields present in msgs.cachedHeader and the message size
+// are not considered as they are available without reading the body.
+func searchNeedsBody(criteria *imap.SearchCriteria) bool {
+	if criteria.Body != nil || criteria.Text != nil {
 		return true
 	}
+	for key := range criteria.Header {
+		if isAttachmentCriterion(key) {
+			continue
+		}
+		if _, ok := cachedHeaderFields[nettextproto.CanonicalMIMEHeaderKey(key)]; !ok {
+			return true
+		}
+	}
 
 	for _, crit := range criteria.Not {
 		if searchNeedsBody(crit) {
@@ -142,6 +378,55 @@ func searchNeedsBody(criteria *imap.SearchCriteria) bool {
 	return false
 }
 
+// searchNeedsHeader reports whether header fields are needed to check
+// criteria.
+func searchNeedsHeader(criteria *imap.SearchCriteria) bool {
+	if !criteria.SentSince.IsZero() || !criteria.SentBefore.IsZero() {
+		return true
+	}
+	for key := range criteria.Header {
+		if !isAttachmentCriterion(key) {
+			return true
+		}
+	}
+
+	for _, crit := range criteria.Not {
+		if searchNeedsHeader(crit) {
+			return true
+		}
+	}
+	for _, crit := range criteria.Or {
+		if searchNeedsHeader(crit[0]) || searchNeedsHeader(crit[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// searchNeedsAttachments reports whether criteria contain attachment
+// pseudo-header fields.
+func searchNeedsAttachments(criteria *imap.SearchCriteria) bool {
+	for key := range criteria.Header {
+		if isAttachmentCriterion(key) {
+			return true
+		}
+	}
+
+	for _, crit := range criteria.Not {
+		if searchNeedsAttachments(crit) {
+			return true
+		}
+	}
+	for _, crit := range criteria.Or {
+		if searchNeedsAttachments(crit[0]) || searchNeedsAttachments(crit[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func searchOnlyWithFlags(criteria *imap.SearchCriteria) bool {
 	if criteria.Header != nil ||
 		criteria.Body != nil ||
@@ -182,7 +467,7 @@ func noSeqNumNeeded(criteria *imap.SearchCriteria) bool {
 	return true
 }
 
-func (m *Mailbox) allSearch(uid bool) ([]uint32, error) {
+func (m *Mailbox) allSearch(ctx context.Context, uid bool) ([]uint32, error) {
 	if !uid {
 		count := m.handle.MsgsCount()
 		seqs := make([]uint32, 0, count)
@@ -192,7 +477,7 @@ func (m *Mailbox) allSearch(uid bool) ([]uint32, error) {
 		return seqs, nil
 	}
 
-	rows, err := m.parent.listMsgUids.Query(m.id)
+	rows, err := m.parent.listMsgUids.QueryContext(ctx, m.id)
 	if err != nil {
 		return nil, err
 	}
@@ -209,10 +494,10 @@ func (m *Mailbox) allSearch(uid bool) ([]uint32, error) {
 	return uids, nil
 }
 
-func (m *Mailbox) flagSearch(uid bool, withFlags, withoutFlags []string) ([]uint32, error) {
+func (m *Mailbox) flagSearch(ctx context.Context, uid bool, withFlags, withoutFlags []string) ([]uint32, error) {
 	recentRequired := false
 	recentExcluded := false
-	newWithFlags := withFlags[:0]
+	newWithFlags := make([]string, 0, len(withFlags))
 	for _, f := range withFlags {
 		if f == imap.RecentFlag {
 			recentRequired = true
@@ -221,7 +506,7 @@ func (m *Mailbox) flagSearch(uid bool, withFlags, withoutFlags []string) ([]uint
 		newWithFlags = append(newWithFlags, f)
 	}
 	withFlags = newWithFlags
-	newWithoutFlags := withoutFlags[:0]
+	newWithoutFlags := make([]string, 0, len(withoutFlags))
 	for _, f := range withoutFlags {
 		if f == imap.RecentFlag {
 			recentExcluded = true
@@ -237,7 +522,7 @@ func (m *Mailbox) flagSearch(uid bool, withFlags, withoutFlags []string) ([]uint
 	}
 
 	args := m.buildFlagSearchQueryArgs(withFlags, withoutFlags)
-	rows, err := stmt.Query(args...)
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return nil, err
 	}
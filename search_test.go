@@ -0,0 +1,124 @@
+package imapsql
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+func TestSearchNeedsBody(t *testing.T) {
+	assert.Assert(t, !searchNeedsBody(&imap.SearchCriteria{
+		Header:  map[string][]string{"From": {"alice"}, "subject": {"invoice"}},
+		Larger:  100,
+		Smaller: 200,
+	}))
+	assert.Assert(t, searchNeedsBody(&imap.SearchCriteria{Header: map[string][]string{"X-Custom": {"a"}}}))
+	assert.Assert(t, searchNeedsBody(&imap.SearchCriteria{
+		Or: [][2]*imap.SearchCriteria{{{}, {Body: []string{"a"}}}},
+	}))
+	assert.Assert(t, searchNeedsHeader(&imap.SearchCriteria{
+		Not: []*imap.SearchCriteria{{SentSince: time.Now()}},
+	}))
+	assert.Assert(t, !searchNeedsHeader(&imap.SearchCriteria{Larger: 100}))
+}
+
+func TestSearchCachedHeader(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for _, msg := range []string{
+		"From: alice@example.org\r\nSubject: Invoice\r\nDate: Mon, 02 Jan 2006 15:04:05 +0000\r\nX-Custom: a\r\n\r\nHello!\r\n",
+		"From: bob@example.org\r\nSubject: =?utf-8?q?Re=3A_invoice?=\r\nDate: Fri, 01 Jan 2010 15:04:05 +0000\r\n\r\n" + strings.Repeat("Long message. ", 100) + "\r\n",
+		"From: carol@example.org\r\nSubject: Other\r\n\r\nHello!\r\n",
+	} {
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	// Make sure the bodies are not read.
+	root := b.extStore.(*FSStore).Root
+	files, err := ioutil.ReadDir(root)
+	assert.NilError(t, err)
+	for _, f := range files {
+		assert.NilError(t, os.Remove(filepath.Join(root, f.Name())))
+	}
+
+	search := func(crit *imap.SearchCriteria) []uint32 {
+		res, err := mbox.SearchMessages(true, crit)
+		assert.NilError(t, err)
+		return res
+	}
+
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{"From": {"ALICE"}}}), []uint32{1})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{"Subject": {"invoice"}}}), []uint32{1, 2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{
+		Not: []*imap.SearchCriteria{{Header: map[string][]string{"Subject": {"invoice"}}}},
+	}), []uint32{3})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{
+		Header:    map[string][]string{"Subject": {"invoice"}},
+		SentSince: time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC),
+	}), []uint32{2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Larger: 500}), []uint32{2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{
+		Or: [][2]*imap.SearchCriteria{{{Larger: 500}, {Header: map[string][]string{"From": {"carol"}}}}},
+	}), []uint32{2, 3})
+
+	// Uncached fields still require the body.
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{"X-Custom": {"a"}}}), []uint32(nil))
+}
+
+func TestSearchParallel(t *testing.T) {
+	b := initTestBackendOpts(Opts{SearchWorkers: 4}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	var expected []uint32
+	for i := 1; i <= 50; i++ {
+		body := "Hello!"
+		if i%3 == 0 {
+			body = "Needle"
+			expected = append(expected, uint32(i))
+		}
+		msg := "Subject: Test\r\n\r\n" + body + "\r\n"
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	crit := &imap.SearchCriteria{Body: []string{"needle"}}
+	res, err := mbox.SearchMessages(true, crit)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, expected)
+
+	// Unreadable messages are skipped.
+	var extKey string
+	assert.NilError(t, b.DB.QueryRow(`SELECT extBodyKey FROM msgs WHERE msgId = 3`).Scan(&extKey))
+	assert.NilError(t, os.Remove(filepath.Join(b.extStore.(*FSStore).Root, extKey)))
+	res, err = mbox.SearchMessages(false, crit)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, expected[1:])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = mbox.SearchMessagesContext(ctx, true, crit)
+	assert.Equal(t, err, context.Canceled)
+}
@@ -0,0 +1,407 @@
+package imapsql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap/backend"
+)
+
+// PartialRange is the RFC 9394 PARTIAL range of search or sort results.
+//
+// First and Last are 1-based positions in the complete result. Negative
+// values count from the end of the result, -1 being the last message
+// (e.g. -1:-100 requests 100 last messages).
+type PartialRange struct {
+	First, Last int
+}
+
+// ResultPage is the part of search or sort result returned by SearchPartial
+// and SortPartial.
+type ResultPage struct {
+	// UIDs or sequence numbers of messages within requested range, in
+	// result order.
+	IDs []uint32
+
+	// Total amount of messages in the complete result (ESEARCH COUNT).
+	Total int
+}
+
+// ContextChange is the RFC 5267 ADDTO or REMOVEFROM notification for the
+// cached result.
+type ContextChange struct {
+	// true for REMOVEFROM, false for ADDTO.
+	Removed bool
+
+	// 1-based position of the message in the result. For removals it is the
+	// position right before the message was removed, for additions it is
+	// the position right after it was added.
+	Position int
+
+	// Message UID. Note that sequence numbers of removed messages are not
+	// meaningful anymore so UIDs are always used here.
+	UID uint32
+}
+
+// searchContext is the cached result of the last SearchPartial or
+// SortPartial call in the session.
+type searchContext struct {
+	// key is the fingerprint of criteria and sortCrit.
+	key      string
+	criteria *imap.SearchCriteria
+	sortCrit []sortthread.SortCriterion
+
+	// entries contains all matched messages in the result order.
+	entries []sortEntry
+	// lastUid is the highest message UID that was considered for the
+	// result.
+	lastUid uint32
+
+	// pending contains changes not yet returned by ContextChanges.
+	pending []ContextChange
+
+	// flagsChanged is set when flags of any message are changed after the
+	// result was built, results that depend on flags are recomputed then.
+	flagsChanged bool
+}
+
+// updatesConn passes updates from the mailbox handle to the connection and
+// tracks flag changes for the cached result.
+type updatesConn struct {
+	backend.Conn
+	mbox *Mailbox
+}
+
+func (c updatesConn) SendUpdate(upd backend.Update) error {
+	if _, ok := upd.(*backend.MessageUpdate); ok && c.mbox.searchCtx != nil {
+		c.mbox.searchCtx.flagsChanged = true
+	}
+	return c.Conn.SendUpdate(upd)
+}
+
+func contextKey(criteria *imap.SearchCriteria, sortCrit []sortthread.SortCriterion) (string, error) {
+	blob, err := json.Marshal(struct {
+		Criteria *imap.SearchCriteria
+		Sort     []sortthread.SortCriterion
+	}{criteria, sortCrit})
+	if err != nil {
+		return "", err
+	}
+	return string(blob), nil
+}
+
+// SearchPartial is a variant of SearchMessages that returns only the
+// requested range of the result.
+//
+// Complete result is cached for the session and is reused for subsequent
+// calls with the same criteria, so paging through a large result does not
+// repeat the search. Messages added to and removed from the mailbox and
+// flag changes are reflected in the cached result once they are seen by this
+// session (e.g. after Poll).
+func (m *Mailbox) SearchPartial(uid bool, criteria *imap.SearchCriteria, rng PartialRange) (*ResultPage, error) {
+	return m.partialResult(uid, nil, criteria, rng)
+}
+
+// SortPartial is a variant of Sort that returns only the requested range of
+// the result.
+//
+// See SearchPartial for caching details. Sort keys of cached messages are
+// retained so new messages are inserted into the cached result without
+// sorting it again.
+func (m *Mailbox) SortPartial(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria, rng PartialRange) (*ResultPage, error) {
+	return m.partialResult(uid, sortCrit, searchCrit, rng)
+}
+
+// ContextChanges returns changes made to the cached result (see
+// SearchPartial) since the last ContextChanges call. It should be called
+// after Poll to implement RFC 5267 CONTEXT updates.
+//
+// Messages that no longer match criteria because their flags were changed
+// are reported as well.
+func (m *Mailbox) ContextChanges() ([]ContextChange, error) {
+	if m.searchCtx == nil {
+		return nil, nil
+	}
+	if err := m.refreshContext(m.searchCtx); err != nil {
+		return nil, err
+	}
+	changes := m.searchCtx.pending
+	m.searchCtx.pending = nil
+	return changes, nil
+}
+
+// DiscardContext drops the cached result, if any.
+func (m *Mailbox) DiscardContext() {
+	m.searchCtx = nil
+}
+
+func (m *Mailbox) partialResult(uid bool, sortCrit []sortthread.SortCriterion, criteria *imap.SearchCriteria, rng PartialRange) (*ResultPage, error) {
+	if rng.First == 0 || rng.Last == 0 || (rng.First < 0) != (rng.Last < 0) {
+		return nil, errors.New("imapsql: invalid partial range")
+	}
+
+	// Sequence numbers in criteria are resolved to UIDs before fingerprinting
+	// since they change meaning with each expunge.
+	m.handle.ResolveCriteria(criteria)
+
+	key, err := contextKey(criteria, sortCrit)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.searchCtx == nil || m.searchCtx.key != key {
+		m.parent.Opts.Log.Debugln("partialResult: building new context", key)
+		ctx, err := m.buildContext(key, sortCrit, criteria)
+		if err != nil {
+			return nil, err
+		}
+		m.searchCtx = ctx
+	} else if err := m.refreshContext(m.searchCtx); err != nil {
+		return nil, err
+	}
+
+	return m.searchCtx.page(m, uid, rng), nil
+}
+
+func (m *Mailbox) buildContext(key string, sortCrit []sortthread.SortCriterion, criteria *imap.SearchCriteria) (*searchContext, error) {
+	ctx := &searchContext{
+		key:      key,
+		criteria: criteria,
+		sortCrit: sortCrit,
+	}
+
+	ctx.lastUid = m.lastSeenUid()
+
+	var err error
+	if sortCrit != nil {
+		ctx.entries, err = m.sortedEntries(context.Background(), sortCrit, criteria, 0)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		uids, err := m.SearchMessages(true, criteria)
+		if err != nil {
+			return nil, err
+		}
+		ctx.entries = make([]sortEntry, 0, len(uids))
+		for _, uid := range uids {
+			ctx.entries = append(ctx.entries, sortEntry{ID: uid})
+		}
+	}
+
+	// Messages not yet seen by the session will be added by refreshContext
+	// later.
+	kept := ctx.entries[:0]
+	for _, entry := range ctx.entries {
+		if entry.ID <= ctx.lastUid {
+			kept = append(kept, entry)
+		}
+	}
+	ctx.entries = kept
+
+	return ctx, nil
+}
+
+// lastSeenUid returns the highest UID of messages known to the session.
+func (m *Mailbox) lastSeenUid() uint32 {
+	count := m.handle.MsgsCount()
+	if count == 0 {
+		return 0
+	}
+	last, err := m.handle.ResolveSeq(false, &imap.SeqSet{Set: []imap.Seq{{Start: uint32(count), Stop: uint32(count)}}})
+	if err != nil || len(last.Set) == 0 {
+		return 0
+	}
+	return last.Set[0].Stop
+}
+
+// sessionHasUid reports whether the message with the specified UID is known
+// to the session.
+func (m *Mailbox) sessionHasUid(uid uint32) bool {
+	// UidAsSeq returns the position of the next message for missing UIDs so
+	// we have to check the reverse mapping too.
+	seq, ok := m.handle.UidAsSeq(uid)
+	if !ok {
+		return false
+	}
+	res, err := m.handle.ResolveSeq(false, &imap.SeqSet{Set: []imap.Seq{{Start: seq, Stop: seq}}})
+	return err == nil && len(res.Set) == 1 && res.Set[0].Start == uid
+}
+
+// refreshContext brings the cached result in sync with the mailbox state
+// as seen by the session.
+func (m *Mailbox) refreshContext(ctx *searchContext) error {
+	if ctx.flagsChanged && searchNeedsFlags(ctx.criteria) {
+		// Flags can change for any message so we have to run search
+		// again. Sort keys are never changed so we still save on sorting.
+		ctx.flagsChanged = false
+		ctx.lastUid = m.lastSeenUid()
+		uids, err := m.SearchMessages(true, ctx.criteria)
+		if err != nil {
+			return err
+		}
+		seen := uids[:0]
+		for _, uid := range uids {
+			if uid <= ctx.lastUid {
+				seen = append(seen, uid)
+			}
+		}
+		return m.reconcileContext(ctx, seen)
+	}
+
+	// Criteria does not depend on mutable message data or flags were not
+	// changed so we need to check only new and removed messages.
+	kept := ctx.entries[:0]
+	for _, entry := range ctx.entries {
+		if !m.sessionHasUid(entry.ID) {
+			ctx.pending = append(ctx.pending, ContextChange{
+				Removed:  true,
+				Position: len(kept) + 1,
+				UID:      entry.ID,
+			})
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	ctx.entries = kept
+
+	lastUid := m.lastSeenUid()
+	if lastUid <= ctx.lastUid {
+		return nil
+	}
+	uids, err := m.searchUidRange(context.Background(), true, ctx.criteria, ctx.lastUid+1, lastUid)
+	if err != nil {
+		return err
+	}
+	ctx.lastUid = lastUid
+	return m.insertIntoContext(ctx, uids)
+}
+
+// reconcileContext updates the cached result to contain exactly the
+// messages from uids (sorted in ascending order).
+func (m *Mailbox) reconcileContext(ctx *searchContext, uids []uint32) error {
+	matched := make(map[uint32]struct{}, len(uids))
+	for _, uid := range uids {
+		matched[uid] = struct{}{}
+	}
+
+	kept := ctx.entries[:0]
+	for _, entry := range ctx.entries {
+		if _, ok := matched[entry.ID]; !ok {
+			ctx.pending = append(ctx.pending, ContextChange{
+				Removed:  true,
+				Position: len(kept) + 1,
+				UID:      entry.ID,
+			})
+			continue
+		}
+		delete(matched, entry.ID)
+		kept = append(kept, entry)
+	}
+	ctx.entries = kept
+
+	added := make([]uint32, 0, len(matched))
+	for _, uid := range uids {
+		if _, ok := matched[uid]; ok {
+			added = append(added, uid)
+		}
+	}
+	return m.insertIntoContext(ctx, added)
+}
+
+// insertIntoContext adds messages with specified UIDs (sorted in ascending
+// order) to the cached result preserving its order.
+func (m *Mailbox) insertIntoContext(ctx *searchContext, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	var newEntries []sortEntry
+	if ctx.sortCrit != nil {
+		var err error
+		newEntries, err = m.loadSortEntries(context.Background(), uids, ctx.sortCrit, 0)
+		if err != nil {
+			return err
+		}
+	} else {
+		newEntries = make([]sortEntry, 0, len(uids))
+		for _, uid := range uids {
+			newEntries = append(newEntries, sortEntry{ID: uid})
+		}
+	}
+
+	for _, entry := range newEntries {
+		entry := entry
+		i := sort.Search(len(ctx.entries), func(i int) bool {
+			return sortEntryLess(&entry, &ctx.entries[i], ctx.sortCrit)
+		})
+		ctx.entries = append(ctx.entries, sortEntry{})
+		copy(ctx.entries[i+1:], ctx.entries[i:])
+		ctx.entries[i] = entry
+
+		ctx.pending = append(ctx.pending, ContextChange{
+			Position: i + 1,
+			UID:      entry.ID,
+		})
+	}
+	return nil
+}
+
+func (ctx *searchContext) page(m *Mailbox, uid bool, rng PartialRange) *ResultPage {
+	total := len(ctx.entries)
+	res := &ResultPage{Total: total}
+
+	first, last := rng.First, rng.Last
+	if first < 0 {
+		first, last = total+1+first, total+1+last
+	}
+	if first > last {
+		first, last = last, first
+	}
+	if first < 1 {
+		first = 1
+	}
+	if last > total {
+		last = total
+	}
+	if first > last {
+		return res
+	}
+
+	res.IDs = make([]uint32, 0, last-first+1)
+	for _, entry := range ctx.entries[first-1 : last] {
+		id := entry.ID
+		if !uid {
+			var ok bool
+			id, ok = m.handle.UidAsSeq(id)
+			if !ok {
+				continue
+			}
+		}
+		res.IDs = append(res.IDs, id)
+	}
+	return res
+}
+
+func searchNeedsFlags(criteria *imap.SearchCriteria) bool {
+	if criteria.WithFlags != nil || criteria.WithoutFlags != nil {
+		return true
+	}
+
+	for _, crit := range criteria.Not {
+		if searchNeedsFlags(crit) {
+			return true
+		}
+	}
+	for _, crit := range criteria.Or {
+		if searchNeedsFlags(crit[0]) || searchNeedsFlags(crit[1]) {
+			return true
+		}
+	}
+
+	return false
+}
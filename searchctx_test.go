@@ -0,0 +1,128 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"gotest.tools/assert"
+)
+
+func TestSortPartial(t *testing.T) {
+	b := initTestBackend()
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mboxI, err := usr.GetMailbox(t.Name(), true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for _, subj := range []string{"d", "b", "e", "a"} {
+		msg := "Subject: " + subj + "\r\n\r\nHello!\r\n"
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	sortCrit := []sortthread.SortCriterion{{Field: sortthread.SortSubject}}
+
+	page, err := mbox.SortPartial(true, sortCrit, &imap.SearchCriteria{}, PartialRange{First: 1, Last: 2})
+	assert.NilError(t, err)
+	assert.Equal(t, page.Total, 4)
+	assert.DeepEqual(t, page.IDs, []uint32{4, 2})
+
+	page, err = mbox.SortPartial(true, sortCrit, &imap.SearchCriteria{}, PartialRange{First: -1, Last: -2})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, page.IDs, []uint32{1, 3})
+
+	// New message should be inserted into the cached result.
+	msg := "Subject: c\r\n\r\nHello!\r\n"
+	assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(msg), mbox))
+	assert.NilError(t, mbox.Poll(true))
+
+	changes, err := mbox.ContextChanges()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []ContextChange{{Position: 3, UID: 5}})
+
+	page, err = mbox.SortPartial(true, sortCrit, &imap.SearchCriteria{}, PartialRange{First: 1, Last: 10})
+	assert.NilError(t, err)
+	assert.Equal(t, page.Total, 5)
+	assert.DeepEqual(t, page.IDs, []uint32{4, 2, 5, 1, 3})
+
+	// Expunged messages should be removed from it.
+	seq, _ := imap.ParseSeqSet("2")
+	assert.NilError(t, mbox.DelMessages(true, seq))
+	assert.NilError(t, mbox.Poll(true))
+
+	changes, err = mbox.ContextChanges()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []ContextChange{{Removed: true, Position: 2, UID: 2}})
+
+	page, err = mbox.SortPartial(false, sortCrit, &imap.SearchCriteria{}, PartialRange{First: 1, Last: 2})
+	assert.NilError(t, err)
+	assert.Equal(t, page.Total, 4)
+	assert.DeepEqual(t, page.IDs, []uint32{3, 4})
+}
+
+func TestSearchPartialFlags(t *testing.T) {
+	b := initTestBackend()
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	crit := func() *imap.SearchCriteria {
+		return &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}}
+	}
+
+	page, err := mbox.SearchPartial(true, crit(), PartialRange{First: 1, Last: 3})
+	assert.NilError(t, err)
+	assert.Equal(t, page.Total, 4)
+	assert.DeepEqual(t, page.IDs, []uint32{1, 2, 3})
+
+	seq, _ := imap.ParseSeqSet("2")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.SeenFlag}))
+
+	page, err = mbox.SearchPartial(true, crit(), PartialRange{First: 1, Last: 3})
+	assert.NilError(t, err)
+	assert.Equal(t, page.Total, 3)
+	assert.DeepEqual(t, page.IDs, []uint32{1, 3, 4})
+
+	changes, err := mbox.ContextChanges()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []ContextChange{{Removed: true, Position: 2, UID: 2}})
+
+	// Changes made by other sessions are applied once they are seen by this
+	// one, the cached result is used until then.
+	_, otherI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer otherI.Close()
+	seq, _ = imap.ParseSeqSet("3")
+	assert.NilError(t, otherI.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.SeenFlag}))
+
+	page, err = mbox.SearchPartial(true, crit(), PartialRange{First: 1, Last: 3})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, page.IDs, []uint32{1, 3, 4})
+
+	assert.NilError(t, mbox.Poll(true))
+	changes, err = mbox.ContextChanges()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []ContextChange{{Removed: true, Position: 2, UID: 3}})
+	page, err = mbox.SearchPartial(true, crit(), PartialRange{First: 1, Last: 3})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, page.IDs, []uint32{1, 4})
+}
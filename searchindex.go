@@ -0,0 +1,455 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// IndexOp is the type of change passed to SearchIndex.
+type IndexOp int
+
+const (
+	// IndexAdd is the addition of a new message.
+	IndexAdd IndexOp = 1
+	// IndexRemove is the removal of a message.
+	IndexRemove IndexOp = 2
+	// IndexRemoveMailbox is the removal of all messages of a mailbox. UID
+	// is not used.
+	IndexRemoveMailbox IndexOp = 3
+)
+
+// IndexChange describes a change that should be applied to SearchIndex.
+type IndexChange struct {
+	// Seq is the position of the change in the change log. It increases
+	// with each change.
+	Seq uint64
+
+	Op IndexOp
+
+	// MboxID is the internal mailbox identifier, it does not change when
+	// the mailbox is renamed and is never reused.
+	MboxID uint64
+	UID    uint32
+}
+
+// SearchIndex is an interface for external search engines used to find
+// candidate messages for SEARCH with BODY, TEXT and HEADER criteria.
+//
+// Changes to indexed messages are recorded in the change log in the same
+// transaction as the change itself and are passed to the index
+// asynchronously. Index is expected to persist the Seq of the last applied
+// change and it is used as the cursor to continue after restart or crash.
+type SearchIndex interface {
+	// Update applies the change to the index.
+	//
+	// For IndexAdd, body contains the full message. body is nil if the
+	// message was removed before the change was passed to the index or
+	// can't be read, only the cursor should be updated in this case.
+	Update(change IndexChange, body io.Reader) error
+
+	// Cursor returns the Seq of the last change applied to the index that
+	// will not be lost on crash. Changes up to the cursor are removed from
+	// the log.
+	Cursor() (uint64, error)
+
+	// Search returns UIDs of messages in the mailbox that may match the
+	// criteria. Returned messages are checked against the criteria again
+	// so false positives are allowed, false negatives are not.
+	//
+	// ok is false if index can't be used for these criteria.
+	Search(mboxID uint64, criteria *imap.SearchCriteria) (uids []uint32, ok bool, err error)
+}
+
+func (b *Backend) initSearchIndexLog() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS searchIndexLog (
+			id BIGSERIAL NOT NULL PRIMARY KEY AUTOINCREMENT,
+			seq BIGINT DEFAULT NULL UNIQUE,
+			op INTEGER NOT NULL,
+			mboxId BIGINT NOT NULL,
+			msgId BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table searchIndexLog")
+	}
+	if err := b.createIndex("searchIndexLog_mboxId", "searchIndexLog", "mboxId, op"); err != nil {
+		return wrapErr(err, "create index searchIndexLog_mboxId")
+	}
+	return nil
+}
+
+func (b *Backend) prepareSearchIndexStmts() error {
+	var err error
+	b.logIndexChange, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "logIndexChange prep")
+	}
+	b.logIndexAddUid, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		SELECT 1, mboxId, msgId
+		FROM msgs
+		WHERE mboxId = ? AND msgId BETWEEN ? AND ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "logIndexAddUid prep")
+	}
+	b.logIndexRemoveMarked, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		SELECT 2, mboxId, msgId
+		FROM msgs
+		WHERE mboxId = ? AND mark = 1
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "logIndexRemoveMarked prep")
+	}
+	b.logIndexRemoveDeleted, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		SELECT 2, mboxId, msgId
+		FROM flags
+		WHERE mboxId = ? AND flag = '\Deleted'
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "logIndexRemoveDeleted prep")
+	}
+	b.logIndexRemoveExpired, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		SELECT 2, mboxId, msgId
+		FROM msgs
+		WHERE mboxId = ? AND date < ? AND msgId <= ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "logIndexRemoveExpired prep")
+	}
+	b.logIndexRemoveMbox, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		SELECT 3, id, 0
+		FROM mboxes
+		WHERE uid = ? AND name = ?`)
+	if err != nil {
+		return wrapErr(err, "logIndexRemoveMbox prep")
+	}
+	b.logIndexRemoveUser, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		SELECT 3, id, 0
+		FROM mboxes
+		WHERE uid = (SELECT id FROM users WHERE username = ?)`)
+	if err != nil {
+		return wrapErr(err, "logIndexRemoveUser prep")
+	}
+	b.logIndexAddAll, err = b.db.Prepare(`
+		INSERT INTO searchIndexLog(op, mboxId, msgId)
+		SELECT 1, mboxId, msgId
+		FROM msgs
+		ORDER BY mboxId, msgId`)
+	if err != nil {
+		return wrapErr(err, "logIndexAddAll prep")
+	}
+	b.unsequencedIndexLog, err = b.db.Prepare(`
+		SELECT min(id), (SELECT max(seq) FROM searchIndexLog)
+		FROM searchIndexLog
+		WHERE seq IS NULL`)
+	if err != nil {
+		return wrapErr(err, "unsequencedIndexLog prep")
+	}
+	b.sequenceIndexLog, err = b.db.Prepare(`
+		UPDATE searchIndexLog
+		SET seq = id + ?
+		WHERE seq IS NULL AND id >= ?`)
+	if err != nil {
+		return wrapErr(err, "sequenceIndexLog prep")
+	}
+	b.indexChanges, err = b.db.Prepare(`
+		SELECT seq, op, searchIndexLog.mboxId, searchIndexLog.msgId, extBodyKey, compressAlgo
+		FROM searchIndexLog
+		LEFT JOIN msgs
+		ON searchIndexLog.op = 1
+		AND msgs.mboxId = searchIndexLog.mboxId
+		AND msgs.msgId = searchIndexLog.msgId
+		WHERE seq > ?
+		ORDER BY seq
+		LIMIT 1000`)
+	if err != nil {
+		return wrapErr(err, "indexChanges prep")
+	}
+	b.pruneIndexLog, err = b.db.Prepare(`
+		DELETE FROM searchIndexLog
+		WHERE seq <= ?`)
+	if err != nil {
+		return wrapErr(err, "pruneIndexLog prep")
+	}
+	b.indexLag, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM searchIndexLog
+		WHERE seq IS NULL OR seq > ?`)
+	if err != nil {
+		return wrapErr(err, "indexLag prep")
+	}
+	b.pendingIndexUids, err = b.db.Prepare(`
+		SELECT msgId
+		FROM searchIndexLog
+		WHERE mboxId = ? AND op = 1`)
+	if err != nil {
+		return wrapErr(err, "pendingIndexUids prep")
+	}
+	return nil
+}
+
+// logIndex executes the change log statement in the transaction. It is
+// no-op if Opts.SearchIndex is not set.
+func (b *Backend) logIndex(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, args ...interface{}) error {
+	if stmt == nil {
+		return nil
+	}
+	_, err := tx.Stmt(stmt).ExecContext(ctx, args...)
+	return err
+}
+
+// searchIndexChanged wakes up the background goroutine that passes changes
+// to the SearchIndex. It should be called after the transaction that
+// records changes is committed.
+func (b *Backend) searchIndexChanged() {
+	if b.Opts.SearchIndex == nil {
+		return
+	}
+	select {
+	case b.searchIndexNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Backend) searchIndexLoop() {
+	interval := b.Opts.SearchIndexInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.searchIndexNotify:
+		case <-b.searchIndexLoopStop:
+			return
+		}
+		if _, err := b.SyncSearchIndex(); err != nil {
+			b.Opts.Log.Printf("search index update failed: %v", err)
+		}
+	}
+}
+
+// SyncSearchIndex passes all pending changes to Opts.SearchIndex and returns
+// the amount of passed changes.
+//
+// Concurrent transactions may commit changes out of the order they were
+// recorded in, so Seq is assigned by SyncSearchIndex only to the changes
+// that are already committed. Changes committed later get greater Seq values
+// and the cursor never moves past the change that is not yet committed.
+//
+// It is called automatically in background unless Opts.SearchIndexInterval
+// is negative.
+func (b *Backend) SyncSearchIndex() (int, error) {
+	if b.Opts.SearchIndex == nil {
+		return 0, errors.New("SyncSearchIndex: search index is not configured")
+	}
+
+	b.searchIndexLck.Lock()
+	defer b.searchIndexLck.Unlock()
+
+	cursor, err := b.Opts.SearchIndex.Cursor()
+	if err != nil {
+		return 0, wrapErr(err, "SyncSearchIndex (cursor)")
+	}
+	if err := b.sequenceIndexChanges(cursor); err != nil {
+		return 0, wrapErr(err, "SyncSearchIndex (sequence)")
+	}
+
+	total := 0
+	for {
+		applied, last, err := b.applyIndexChanges(cursor)
+		total += applied
+		if err != nil {
+			return total, err
+		}
+		if applied == 0 {
+			break
+		}
+		cursor = last
+	}
+
+	// Index may keep some changes in memory, these should stay in the log
+	// until persisted.
+	persisted, err := b.Opts.SearchIndex.Cursor()
+	if err != nil {
+		return total, wrapErr(err, "SyncSearchIndex (cursor)")
+	}
+	if _, err := b.pruneIndexLog.Exec(persisted); err != nil {
+		return total, wrapErr(err, "SyncSearchIndex (prune)")
+	}
+	return total, nil
+}
+
+// sequenceIndexChanges assigns Seq values to committed changes that have
+// none. Values are greater than any Seq assigned before and than the cursor,
+// which may be ahead of the log if it was pruned.
+func (b *Backend) sequenceIndexChanges(cursor uint64) error {
+	var minID, maxSeq sql.NullInt64
+	if err := b.unsequencedIndexLog.QueryRow().Scan(&minID, &maxSeq); err != nil {
+		return err
+	}
+	if !minID.Valid {
+		return nil
+	}
+
+	last := int64(cursor)
+	if maxSeq.Int64 > last {
+		last = maxSeq.Int64
+	}
+	offset := last + 1 - minID.Int64
+	if offset < 0 {
+		offset = 0
+	}
+	// Changes with lower IDs committed after the query are left for the
+	// next call.
+	_, err := b.sequenceIndexLog.Exec(offset, minID.Int64)
+	return err
+}
+
+type pendingIndexChange struct {
+	IndexChange
+	extBodyKey, compressAlgo sql.NullString
+}
+
+// applyIndexChanges passes the next batch of changes after the cursor to
+// the index. The amount of applied changes and the Seq of the last applied
+// change are returned.
+func (b *Backend) applyIndexChanges(cursor uint64) (int, uint64, error) {
+	var changes []pendingIndexChange
+
+	rows, err := b.indexChanges.Query(cursor)
+	if err != nil {
+		return 0, cursor, wrapErr(err, "SyncSearchIndex")
+	}
+	for rows.Next() {
+		var change pendingIndexChange
+		if err := rows.Scan(&change.Seq, &change.Op, &change.MboxID, &change.UID, &change.extBodyKey, &change.compressAlgo); err != nil {
+			rows.Close()
+			return 0, cursor, wrapErr(err, "SyncSearchIndex")
+		}
+		changes = append(changes, change)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, cursor, wrapErr(err, "SyncSearchIndex")
+	}
+
+	for i, change := range changes {
+		if err := b.applyIndexChange(change); err != nil {
+			return i, cursor, wrapErrf(err, "SyncSearchIndex (update %d)", change.Seq)
+		}
+		cursor = change.Seq
+	}
+	return len(changes), cursor, nil
+}
+
+func (b *Backend) applyIndexChange(change pendingIndexChange) error {
+	if change.Op != IndexAdd || !change.extBodyKey.Valid {
+		return b.Opts.SearchIndex.Update(change.IndexChange, nil)
+	}
+
+	body, err := b.openBody(context.Background(), true, change.compressAlgo.String, change.extBodyKey.String)
+	if err != nil {
+		b.Opts.Log.Printf("SyncSearchIndex: failed to open %s, skipping: %v", change.extBodyKey.String, err)
+		return b.Opts.SearchIndex.Update(change.IndexChange, nil)
+	}
+	defer body.Close()
+
+	return b.Opts.SearchIndex.Update(change.IndexChange, body.Reader)
+}
+
+// SearchIndexLag returns the amount of changes not yet applied to
+// Opts.SearchIndex.
+func (b *Backend) SearchIndexLag() (int, error) {
+	if b.Opts.SearchIndex == nil {
+		return 0, errors.New("SearchIndexLag: search index is not configured")
+	}
+	cursor, err := b.Opts.SearchIndex.Cursor()
+	if err != nil {
+		return 0, wrapErr(err, "SearchIndexLag")
+	}
+	var lag int
+	if err := b.indexLag.QueryRow(cursor).Scan(&lag); err != nil {
+		return 0, wrapErr(err, "SearchIndexLag")
+	}
+	return lag, nil
+}
+
+// ResyncSearchIndex adds all stored messages to the change log so they will
+// be added to Opts.SearchIndex. It is meant to be used to populate a new
+// index.
+func (b *Backend) ResyncSearchIndex() error {
+	if b.Opts.SearchIndex == nil {
+		return errors.New("ResyncSearchIndex: search index is not configured")
+	}
+	if _, err := b.logIndexAddAll.Exec(); err != nil {
+		return wrapErr(err, "ResyncSearchIndex")
+	}
+	b.searchIndexChanged()
+	return nil
+}
+
+// searchIndexCandidates returns UIDs of messages that may match criteria
+// according to Opts.SearchIndex, including messages not yet indexed.
+func (m *Mailbox) searchIndexCandidates(ctx context.Context, criteria *imap.SearchCriteria) ([]uint32, bool, error) {
+	// Pending changes are read first so changes applied concurrently are
+	// seen by the index query.
+	var pending []uint32
+	rows, err := m.parent.pendingIndexUids.QueryContext(ctx, m.id)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, false, err
+		}
+		pending = append(pending, uid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	uids, ok, err := m.parent.Opts.SearchIndex.Search(m.id, criteria)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	uids = append(uids, pending...)
+
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, true, nil
+}
+
+// searchCandidates checks messages with specified UIDs (sorted in ascending
+// order) against criteria.
+func (m *Mailbox) searchCandidates(ctx context.Context, uid bool, criteria *imap.SearchCriteria, uids []uint32) ([]uint32, error) {
+	var seqSet imap.SeqSet
+	seqSet.AddNum(uids...)
+
+	var res []uint32
+	for _, seq := range seqSet.Set {
+		matched, err := m.searchUidRange(ctx, uid, criteria, seq.Start, seq.Stop)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, matched...)
+	}
+	return res, nil
+}
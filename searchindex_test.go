@@ -0,0 +1,222 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+func TestTrigrams(t *testing.T) {
+	assert.Equal(t, len(trigrams("ab")), 0)
+	assert.Equal(t, len(trigrams("лиса")), 2)
+	assert.Equal(t, len(trigrams("aaaa")), 1)
+}
+
+func TestSearchIndex(t *testing.T) {
+	indexDir, err := ioutil.TempDir("", "go-imap-sql-index-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(indexDir)
+	idx, err := NewFSIndex(indexDir)
+	assert.NilError(t, err)
+
+	b := initTestBackendOpts(Opts{SearchIndex: idx, SearchIndexInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for _, msg := range []string{
+		"Subject: Hello\r\n\r\nThe quick brown fox\r\n",
+		"Subject: Report\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n0JvQuNGB0LAganVtcHMgb3Zlcg==\r\n",
+		"Subject: Other\r\n\r\nlazy dog\r\n",
+	} {
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	lag := func() int {
+		lag, err := b.SearchIndexLag()
+		assert.NilError(t, err)
+		return lag
+	}
+	sync := func(expected int) {
+		count, err := b.SyncSearchIndex()
+		assert.NilError(t, err)
+		assert.Equal(t, count, expected)
+		assert.Equal(t, lag(), 0)
+	}
+	search := func(crit *imap.SearchCriteria) []uint32 {
+		res, err := mbox.SearchMessages(true, crit)
+		assert.NilError(t, err)
+		return res
+	}
+	indexed := func(mboxID uint64, term string) []uint32 {
+		uids, ok, err := idx.Search(mboxID, &imap.SearchCriteria{Body: []string{term}})
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+		return uids
+	}
+
+	// Messages not yet indexed should be still found.
+	assert.Equal(t, lag(), 3)
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"brown"}}), []uint32{1})
+
+	sync(3)
+	assert.DeepEqual(t, indexed(mbox.id, "brown"), []uint32{1})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"brown"}}), []uint32{1})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Text: []string{"лиса"}}), []uint32{2})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Header: map[string][]string{"Subject": {"other"}}}), []uint32{3})
+	assert.DeepEqual(t, search(&imap.SearchCriteria{Body: []string{"brown", "dog"}}), []uint32(nil))
+
+	assert.NilError(t, usr.CreateMailbox("Archive"))
+	var archiveID uint64
+	assert.NilError(t, b.DB.QueryRow(`SELECT id FROM mboxes WHERE name = 'Archive'`).Scan(&archiveID))
+	seq, _ := imap.ParseSeqSet("1:2")
+	assert.NilError(t, mbox.CopyMessages(true, seq, "Archive"))
+	sync(2)
+	assert.DeepEqual(t, indexed(archiveID, "brown"), []uint32{1})
+
+	seq, _ = imap.ParseSeqSet("1")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+	seq, _ = imap.ParseSeqSet("3")
+	assert.NilError(t, mbox.MoveMessages(true, seq, "Archive"))
+	sync(3)
+	assert.DeepEqual(t, indexed(mbox.id, "brown"), []uint32(nil))
+	assert.DeepEqual(t, indexed(mbox.id, "lazy"), []uint32(nil))
+	assert.DeepEqual(t, indexed(archiveID, "lazy"), []uint32{3})
+
+	// Index is restored from the journal and the truncated last record is
+	// discarded.
+	assert.NilError(t, idx.Close())
+	journal, err := os.OpenFile(filepath.Join(indexDir, "journal.jsonl"), os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NilError(t, err)
+	_, err = journal.WriteString(`{"seq":100,"op":3,"mbo`)
+	assert.NilError(t, err)
+	assert.NilError(t, journal.Close())
+	idx, err = NewFSIndex(indexDir)
+	assert.NilError(t, err)
+	defer idx.Close()
+	b.Opts.SearchIndex = idx
+	assert.Equal(t, lag(), 0)
+	assert.DeepEqual(t, indexed(archiveID, "lazy"), []uint32{3})
+
+	// Snapshot is used together with the journal.
+	assert.NilError(t, idx.writeSnapshot())
+	assert.NilError(t, usr.DeleteMailbox("Archive"))
+	sync(1)
+	assert.NilError(t, idx.Close())
+	idx, err = NewFSIndex(indexDir)
+	assert.NilError(t, err)
+	defer idx.Close()
+	b.Opts.SearchIndex = idx
+	assert.DeepEqual(t, indexed(archiveID, "lazy"), []uint32(nil))
+	assert.DeepEqual(t, indexed(mbox.id, "лиса"), []uint32{2})
+
+	// Lost index can be repopulated.
+	assert.NilError(t, os.RemoveAll(indexDir))
+	idx, err = NewFSIndex(indexDir)
+	assert.NilError(t, err)
+	defer idx.Close()
+	b.Opts.SearchIndex = idx
+	assert.NilError(t, b.ResyncSearchIndex())
+	sync(1)
+	assert.DeepEqual(t, indexed(mbox.id, "лиса"), []uint32{2})
+}
+
+func TestSearchIndexOutOfOrderCommit(t *testing.T) {
+	indexDir, err := ioutil.TempDir("", "go-imap-sql-index-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(indexDir)
+	idx, err := NewFSIndex(indexDir)
+	assert.NilError(t, err)
+	defer idx.Close()
+
+	b := initTestBackendOpts(Opts{SearchIndex: idx, SearchIndexInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	create := func(body string) {
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader("Subject: Test\r\n\r\n"+body+"\r\n"), mbox))
+	}
+	sync := func(expected int) {
+		count, err := b.SyncSearchIndex()
+		assert.NilError(t, err)
+		assert.Equal(t, count, expected)
+	}
+	indexed := func(term string) []uint32 {
+		uids, ok, err := idx.Search(mbox.id, &imap.SearchCriteria{Body: []string{term}})
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+		return uids
+	}
+	// uncommit removes the log record of the message as if the transaction
+	// that added it was not committed yet. Returned function commits it.
+	uncommit := func(uid uint32) func() {
+		var id uint64
+		assert.NilError(t, b.DB.QueryRow(`SELECT id FROM searchIndexLog WHERE msgId = ?`, uid).Scan(&id))
+		_, err := b.DB.Exec(`DELETE FROM searchIndexLog WHERE id = ?`, id)
+		assert.NilError(t, err)
+		return func() {
+			_, err := b.DB.Exec(`INSERT INTO searchIndexLog(id, op, mboxId, msgId) VALUES (?, 1, ?, ?)`, id, mbox.id, uid)
+			assert.NilError(t, err)
+		}
+	}
+
+	create("first")
+	sync(1)
+
+	// Transaction that recorded the change first is committed after the
+	// other one.
+	create("second")
+	create("third")
+	commit := uncommit(2)
+	sync(1)
+	assert.DeepEqual(t, indexed("third"), []uint32{3})
+	assert.DeepEqual(t, indexed("second"), []uint32(nil))
+
+	commit()
+	lag, err := b.SearchIndexLag()
+	assert.NilError(t, err)
+	assert.Equal(t, lag, 1)
+	sync(1)
+	assert.DeepEqual(t, indexed("second"), []uint32{2})
+
+	// Change that never appears (rolled back transaction) does not stop
+	// the index.
+	create("fourth")
+	create("fifth")
+	uncommit(4)
+	sync(1)
+	assert.DeepEqual(t, indexed("fifth"), []uint32{5})
+
+	// Changes committed after the log was pruned are not lost.
+	create("sixth")
+	commit = uncommit(6)
+	create("seventh")
+	sync(1)
+	_, err = b.DB.Exec(`DELETE FROM searchIndexLog WHERE seq IS NOT NULL`)
+	assert.NilError(t, err)
+	commit()
+	sync(1)
+	assert.DeepEqual(t, indexed("sixth"), []uint32{6})
+	lag, err = b.SearchIndexLag()
+	assert.NilError(t, err)
+	assert.Equal(t, lag, 0)
+}
@@ -0,0 +1,923 @@
+package imapsql
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// This file implements the subset of Sieve mail filtering language (RFC
+// 5228) used to filter messages during delivery.
+//
+// Supported commands are require, if/elsif/else, stop, keep, discard,
+// fileinto and setflag/addflag/removeflag from RFC 5232 (without variable
+// name argument).
+//
+// Supported tests are header, address, envelope, exists, size, allof, anyof,
+// not, true and false. Match types are :is, :contains and :matches,
+// comparators are "i;ascii-casemap" (default) and "i;octet".
+
+// SieveError is returned for scripts that can not be parsed or use
+// unsupported features.
+type SieveError struct {
+	Line int
+	Msg  string
+}
+
+func (err SieveError) Error() string {
+	return fmt.Sprintf("sieve: line %d: %s", err.Line, err.Msg)
+}
+
+var sieveExtensions = map[string]struct{}{
+	"fileinto":   {},
+	"envelope":   {},
+	"imap4flags": {},
+}
+
+type sieveTokenKind int
+
+const (
+	sieveEOF sieveTokenKind = iota
+	sieveIdent
+	sieveTag
+	sieveNumber
+	sieveString
+	sievePunct
+)
+
+type sieveToken struct {
+	kind sieveTokenKind
+	// Lowercase identifier or tag name, string value or punctuation
+	// character.
+	str  string
+	num  int64
+	line int
+}
+
+func sieveLex(script string) ([]sieveToken, error) {
+	var (
+		toks []sieveToken
+		line = 1
+		i    = 0
+	)
+	for i < len(script) {
+		chr := script[i]
+		switch {
+		case chr == '\n':
+			line++
+			i++
+		case chr == ' ' || chr == '\t' || chr == '\r':
+			i++
+		case chr == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end == -1 {
+				return nil, SieveError{Line: line, Msg: "unterminated comment"}
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += 2 + end + 2
+		case chr == '"':
+			startLine := line
+			var val strings.Builder
+			i++
+			for {
+				if i >= len(script) {
+					return nil, SieveError{Line: startLine, Msg: "unterminated string"}
+				}
+				if script[i] == '"' {
+					i++
+					break
+				}
+				if script[i] == '\\' && i+1 < len(script) {
+					i++
+				}
+				if script[i] == '\n' {
+					line++
+				}
+				val.WriteByte(script[i])
+				i++
+			}
+			toks = append(toks, sieveToken{kind: sieveString, str: val.String(), line: startLine})
+		case chr >= '0' && chr <= '9':
+			start := i
+			for i < len(script) && script[i] >= '0' && script[i] <= '9' {
+				i++
+			}
+			num, err := strconv.ParseInt(script[start:i], 10, 64)
+			if err != nil {
+				return nil, SieveError{Line: line, Msg: "invalid number"}
+			}
+			if i < len(script) {
+				switch script[i] {
+				case 'k', 'K':
+					num *= 1024
+					i++
+				case 'm', 'M':
+					num *= 1024 * 1024
+					i++
+				case 'g', 'G':
+					num *= 1024 * 1024 * 1024
+					i++
+				}
+			}
+			toks = append(toks, sieveToken{kind: sieveNumber, num: num, line: line})
+		case chr == ':' || isSieveIdentChar(chr, true):
+			kind := sieveIdent
+			if chr == ':' {
+				kind = sieveTag
+				i++
+			}
+			start := i
+			for i < len(script) && isSieveIdentChar(script[i], i == start) {
+				i++
+			}
+			if start == i {
+				return nil, SieveError{Line: line, Msg: "unexpected character ':'"}
+			}
+			name := strings.ToLower(script[start:i])
+
+			if kind == sieveIdent && name == "text" && i < len(script) && script[i] == ':' {
+				val, read, lines, err := sieveMultiline(script[i+1:])
+				if err != nil {
+					return nil, SieveError{Line: line, Msg: err.Error()}
+				}
+				toks = append(toks, sieveToken{kind: sieveString, str: val, line: line})
+				line += lines
+				i += 1 + read
+				continue
+			}
+
+			toks = append(toks, sieveToken{kind: kind, str: name, line: line})
+		case strings.IndexByte(";,()[]{}", chr) != -1:
+			toks = append(toks, sieveToken{kind: sievePunct, str: string(chr), line: line})
+			i++
+		default:
+			return nil, SieveError{Line: line, Msg: fmt.Sprintf("unexpected character %q", chr)}
+		}
+	}
+	return append(toks, sieveToken{kind: sieveEOF, line: line}), nil
+}
+
+func isSieveIdentChar(chr byte, first bool) bool {
+	return chr == '_' || (chr >= 'a' && chr <= 'z') || (chr >= 'A' && chr <= 'Z') ||
+		(!first && chr >= '0' && chr <= '9')
+}
+
+// sieveMultiline reads the multi-line string following the "text:" prefix.
+// It returns the value, amount of consumed bytes and lines.
+func sieveMultiline(script string) (string, int, int, error) {
+	eol := strings.IndexByte(script, '\n')
+	if eol == -1 {
+		return "", 0, 0, fmt.Errorf("unterminated multi-line string")
+	}
+	if rest := strings.TrimSpace(script[:eol]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", 0, 0, fmt.Errorf("unexpected data after text:")
+	}
+
+	var (
+		val   strings.Builder
+		pos   = eol + 1
+		lines = 1
+	)
+	for {
+		eol := strings.IndexByte(script[pos:], '\n')
+		if eol == -1 {
+			return "", 0, 0, fmt.Errorf("unterminated multi-line string")
+		}
+		lineStr := strings.TrimSuffix(script[pos:pos+eol], "\r")
+		pos += eol + 1
+		lines++
+		if lineStr == "." {
+			return val.String(), pos, lines, nil
+		}
+		val.WriteString(strings.TrimPrefix(lineStr, "."))
+		val.WriteString("\r\n")
+	}
+}
+
+// sieveArg is the argument of the command or test.
+type sieveArg struct {
+	tag  string
+	num  int64
+	strs []string
+	line int
+
+	isNum bool
+}
+
+type sieveParser struct {
+	toks    []sieveToken
+	pos     int
+	require map[string]struct{}
+}
+
+func (p *sieveParser) peek() sieveToken {
+	return p.toks[p.pos]
+}
+
+func (p *sieveParser) next() sieveToken {
+	tok := p.toks[p.pos]
+	if tok.kind != sieveEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *sieveParser) isPunct(chr string) bool {
+	tok := p.peek()
+	return tok.kind == sievePunct && tok.str == chr
+}
+
+func (p *sieveParser) expectPunct(chr string) error {
+	tok := p.next()
+	if tok.kind != sievePunct || tok.str != chr {
+		return SieveError{Line: tok.line, Msg: fmt.Sprintf("expected '%s'", chr)}
+	}
+	return nil
+}
+
+func (p *sieveParser) checkRequired(ext string, line int) error {
+	if _, ok := p.require[ext]; !ok {
+		return SieveError{Line: line, Msg: fmt.Sprintf("missing require %q", ext)}
+	}
+	return nil
+}
+
+// parseArgs reads arguments until the test, test list, block or the end of
+// the command.
+func (p *sieveParser) parseArgs() ([]sieveArg, error) {
+	var args []sieveArg
+	for {
+		tok := p.peek()
+		switch {
+		case tok.kind == sieveTag:
+			p.next()
+			args = append(args, sieveArg{tag: tok.str, line: tok.line})
+		case tok.kind == sieveNumber:
+			p.next()
+			args = append(args, sieveArg{num: tok.num, isNum: true, line: tok.line})
+		case tok.kind == sieveString:
+			p.next()
+			args = append(args, sieveArg{strs: []string{tok.str}, line: tok.line})
+		case tok.kind == sievePunct && tok.str == "[":
+			p.next()
+			arg := sieveArg{line: tok.line}
+			for {
+				tok := p.next()
+				if tok.kind != sieveString {
+					return nil, SieveError{Line: tok.line, Msg: "expected string in the list"}
+				}
+				arg.strs = append(arg.strs, tok.str)
+				if p.isPunct("]") {
+					p.next()
+					break
+				}
+				if err := p.expectPunct(","); err != nil {
+					return nil, err
+				}
+			}
+			args = append(args, arg)
+		default:
+			return args, nil
+		}
+	}
+}
+
+func (p *sieveParser) parseBlock() ([]sieveCmd, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	return p.parseCommands(true)
+}
+
+func (p *sieveParser) parseCommands(inBlock bool) ([]sieveCmd, error) {
+	var cmds []sieveCmd
+	for {
+		tok := p.next()
+		switch {
+		case tok.kind == sieveEOF:
+			if inBlock {
+				return nil, SieveError{Line: tok.line, Msg: "missing '}'"}
+			}
+			return cmds, nil
+		case tok.kind == sievePunct && tok.str == "}":
+			if !inBlock {
+				return nil, SieveError{Line: tok.line, Msg: "unexpected '}'"}
+			}
+			return cmds, nil
+		case tok.kind != sieveIdent:
+			return nil, SieveError{Line: tok.line, Msg: "expected command"}
+		}
+
+		if tok.str == "require" {
+			if len(cmds) != 0 {
+				return nil, SieveError{Line: tok.line, Msg: "require should be used before other commands"}
+			}
+		}
+
+		cmd, err := p.parseCommand(tok)
+		if err != nil {
+			return nil, err
+		}
+		if cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+	}
+}
+
+func (p *sieveParser) parseCommand(name sieveToken) (sieveCmd, error) {
+	if name.str == "if" {
+		return p.parseIf()
+	}
+
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct(";"); err != nil {
+		return nil, err
+	}
+
+	stringArg := func() ([]string, error) {
+		if len(args) != 1 || args[0].isNum || args[0].tag != "" {
+			return nil, SieveError{Line: name.line, Msg: name.str + " expects a single string argument"}
+		}
+		return args[0].strs, nil
+	}
+
+	switch name.str {
+	case "require":
+		exts, err := stringArg()
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range exts {
+			if _, ok := sieveExtensions[ext]; !ok {
+				return nil, SieveError{Line: name.line, Msg: fmt.Sprintf("unsupported extension %q", ext)}
+			}
+			p.require[ext] = struct{}{}
+		}
+		return nil, nil
+	case "stop", "keep", "discard":
+		if len(args) != 0 {
+			return nil, SieveError{Line: name.line, Msg: name.str + " takes no arguments"}
+		}
+		return sieveSimpleCmd(name.str), nil
+	case "fileinto":
+		if err := p.checkRequired("fileinto", name.line); err != nil {
+			return nil, err
+		}
+		mbox, err := stringArg()
+		if err != nil {
+			return nil, err
+		}
+		if len(mbox) != 1 {
+			return nil, SieveError{Line: name.line, Msg: "fileinto expects a single mailbox name"}
+		}
+		return sieveFileinto{mailbox: mbox[0]}, nil
+	case "setflag", "addflag", "removeflag":
+		if err := p.checkRequired("imap4flags", name.line); err != nil {
+			return nil, err
+		}
+		flags, err := stringArg()
+		if err != nil {
+			return nil, err
+		}
+		return sieveFlagCmd{op: name.str, flags: flags}, nil
+	case "elsif", "else":
+		return nil, SieveError{Line: name.line, Msg: name.str + " without if"}
+	}
+	return nil, SieveError{Line: name.line, Msg: fmt.Sprintf("unsupported command %q", name.str)}
+}
+
+func (p *sieveParser) parseIf() (sieveCmd, error) {
+	var cmd sieveIf
+	for {
+		test, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		block, err := p.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+		cmd.branches = append(cmd.branches, sieveBranch{test: test, block: block})
+
+		tok := p.peek()
+		if tok.kind != sieveIdent {
+			return cmd, nil
+		}
+		switch tok.str {
+		case "elsif":
+			p.next()
+		case "else":
+			p.next()
+			block, err := p.parseBlock()
+			if err != nil {
+				return nil, err
+			}
+			cmd.elseBlock = block
+			return cmd, nil
+		default:
+			return cmd, nil
+		}
+	}
+}
+
+func (p *sieveParser) parseTestList() ([]sieveTest, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var tests []sieveTest
+	for {
+		test, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if p.isPunct(")") {
+			p.next()
+			return tests, nil
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *sieveParser) parseTest() (sieveTest, error) {
+	name := p.next()
+	if name.kind != sieveIdent {
+		return nil, SieveError{Line: name.line, Msg: "expected test"}
+	}
+
+	switch name.str {
+	case "allof", "anyof":
+		tests, err := p.parseTestList()
+		if err != nil {
+			return nil, err
+		}
+		return sieveListTest{all: name.str == "allof", tests: tests}, nil
+	case "not":
+		test, err := p.parseTest()
+		if err != nil {
+			return nil, err
+		}
+		return sieveNotTest{test: test}, nil
+	}
+
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	switch name.str {
+	case "true", "false":
+		if len(args) != 0 {
+			return nil, SieveError{Line: name.line, Msg: name.str + " takes no arguments"}
+		}
+		return sieveConstTest(name.str == "true"), nil
+	case "exists":
+		if len(args) != 1 || args[0].isNum || args[0].tag != "" {
+			return nil, SieveError{Line: name.line, Msg: "exists expects a list of header names"}
+		}
+		return sieveExistsTest{headers: args[0].strs}, nil
+	case "size":
+		if len(args) != 2 || (args[0].tag != "over" && args[0].tag != "under") || !args[1].isNum {
+			return nil, SieveError{Line: name.line, Msg: "size expects :over or :under and a number"}
+		}
+		return sieveSizeTest{over: args[0].tag == "over", limit: args[1].num}, nil
+	case "header", "address", "envelope":
+		if name.str == "envelope" {
+			if err := p.checkRequired("envelope", name.line); err != nil {
+				return nil, err
+			}
+		}
+		return parseSieveMatchTest(name, args)
+	}
+	return nil, SieveError{Line: name.line, Msg: fmt.Sprintf("unsupported test %q", name.str)}
+}
+
+func parseSieveMatchTest(name sieveToken, args []sieveArg) (sieveTest, error) {
+	test := sieveMatchTest{
+		kind:      name.str,
+		matchType: "is",
+		part:      "all",
+	}
+
+	var positional []sieveArg
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg.tag {
+		case "":
+			positional = append(positional, arg)
+		case "is", "contains", "matches":
+			test.matchType = arg.tag
+		case "comparator":
+			if i+1 >= len(args) || args[i+1].isNum || args[i+1].tag != "" || len(args[i+1].strs) != 1 {
+				return nil, SieveError{Line: arg.line, Msg: ":comparator expects a string"}
+			}
+			i++
+			switch args[i].strs[0] {
+			case "i;ascii-casemap":
+				test.caseSensitive = false
+			case "i;octet":
+				test.caseSensitive = true
+			default:
+				return nil, SieveError{Line: arg.line, Msg: fmt.Sprintf("unsupported comparator %q", args[i].strs[0])}
+			}
+		case "all", "localpart", "domain":
+			if name.str == "header" {
+				return nil, SieveError{Line: arg.line, Msg: "address part can't be used with header test"}
+			}
+			test.part = arg.tag
+		default:
+			return nil, SieveError{Line: arg.line, Msg: fmt.Sprintf("unsupported tag :%s", arg.tag)}
+		}
+	}
+
+	if len(positional) != 2 || positional[0].isNum || positional[1].isNum {
+		return nil, SieveError{Line: name.line, Msg: name.str + " expects header names and keys lists"}
+	}
+	test.headers = positional[0].strs
+	test.keys = positional[1].strs
+
+	if name.str == "envelope" {
+		for i, part := range test.headers {
+			test.headers[i] = strings.ToLower(part)
+			if test.headers[i] != "from" && test.headers[i] != "to" {
+				return nil, SieveError{Line: name.line, Msg: fmt.Sprintf("unsupported envelope part %q", part)}
+			}
+		}
+	}
+
+	return test, nil
+}
+
+// parseSieve parses the script and checks whether it uses only supported
+// features.
+func parseSieve(script string) ([]sieveCmd, error) {
+	toks, err := sieveLex(script)
+	if err != nil {
+		return nil, err
+	}
+	p := sieveParser{toks: toks, require: make(map[string]struct{})}
+	return p.parseCommands(false)
+}
+
+// sieveMsg is the message being filtered.
+type sieveMsg struct {
+	header       textproto.Header
+	size         int64
+	envelopeFrom string
+	envelopeTo   string
+}
+
+// sieveAction is the result of script evaluation: the message should be
+// stored into the mailbox with the flags set.
+type sieveAction struct {
+	// Empty for the keep action, which means the mailbox selected for the
+	// delivery without filtering.
+	mailbox string
+	flags   []string
+}
+
+type sieveState struct {
+	msg          *sieveMsg
+	flags        []string
+	implicitKeep bool
+	actions      []sieveAction
+}
+
+func (s *sieveState) store(mailbox string) {
+	s.implicitKeep = false
+	for i, act := range s.actions {
+		if act.mailbox == mailbox {
+			s.actions[i].flags = mergeFlags(act.flags, s.flags)
+			return
+		}
+	}
+	s.actions = append(s.actions, sieveAction{mailbox: mailbox, flags: append([]string(nil), s.flags...)})
+}
+
+// runSieve executes the script and returns the list of actions. Empty list
+// means the message should be discarded.
+func runSieve(cmds []sieveCmd, msg *sieveMsg) []sieveAction {
+	state := sieveState{msg: msg, implicitKeep: true}
+	sieveExec(cmds, &state)
+	if state.implicitKeep {
+		state.store("")
+	}
+	return state.actions
+}
+
+// sieveExec executes commands and reports whether execution should
+// continue.
+func sieveExec(cmds []sieveCmd, state *sieveState) bool {
+	for _, cmd := range cmds {
+		if !cmd.exec(state) {
+			return false
+		}
+	}
+	return true
+}
+
+type sieveCmd interface {
+	exec(state *sieveState) bool
+}
+
+type sieveSimpleCmd string
+
+func (cmd sieveSimpleCmd) exec(state *sieveState) bool {
+	switch cmd {
+	case "stop":
+		return false
+	case "keep":
+		state.store("")
+	case "discard":
+		state.implicitKeep = false
+	}
+	return true
+}
+
+type sieveFileinto struct {
+	mailbox string
+}
+
+func (cmd sieveFileinto) exec(state *sieveState) bool {
+	state.store(cmd.mailbox)
+	return true
+}
+
+type sieveFlagCmd struct {
+	op    string
+	flags []string
+}
+
+func (cmd sieveFlagCmd) exec(state *sieveState) bool {
+	var flags []string
+	for _, flagList := range cmd.flags {
+		flags = append(flags, strings.Fields(flagList)...)
+	}
+
+	switch cmd.op {
+	case "setflag":
+		state.flags = mergeFlags(nil, flags)
+	case "addflag":
+		state.flags = mergeFlags(state.flags, flags)
+	case "removeflag":
+		res := state.flags[:0]
+		for _, flag := range state.flags {
+			if !containsFold(flags, flag) {
+				res = append(res, flag)
+			}
+		}
+		state.flags = res
+	}
+	return true
+}
+
+type sieveBranch struct {
+	test  sieveTest
+	block []sieveCmd
+}
+
+type sieveIf struct {
+	branches  []sieveBranch
+	elseBlock []sieveCmd
+}
+
+func (cmd sieveIf) exec(state *sieveState) bool {
+	for _, branch := range cmd.branches {
+		if branch.test.eval(state.msg) {
+			return sieveExec(branch.block, state)
+		}
+	}
+	return sieveExec(cmd.elseBlock, state)
+}
+
+type sieveTest interface {
+	eval(msg *sieveMsg) bool
+}
+
+type sieveConstTest bool
+
+func (test sieveConstTest) eval(*sieveMsg) bool {
+	return bool(test)
+}
+
+type sieveNotTest struct {
+	test sieveTest
+}
+
+func (test sieveNotTest) eval(msg *sieveMsg) bool {
+	return !test.test.eval(msg)
+}
+
+type sieveListTest struct {
+	all   bool
+	tests []sieveTest
+}
+
+func (test sieveListTest) eval(msg *sieveMsg) bool {
+	for _, t := range test.tests {
+		if t.eval(msg) != test.all {
+			return !test.all
+		}
+	}
+	return test.all
+}
+
+type sieveExistsTest struct {
+	headers []string
+}
+
+func (test sieveExistsTest) eval(msg *sieveMsg) bool {
+	for _, name := range test.headers {
+		if !msg.header.Has(name) {
+			return false
+		}
+	}
+	return true
+}
+
+type sieveSizeTest struct {
+	over  bool
+	limit int64
+}
+
+func (test sieveSizeTest) eval(msg *sieveMsg) bool {
+	if test.over {
+		return msg.size > test.limit
+	}
+	return msg.size < test.limit
+}
+
+// sieveMatchTest implements header, address and envelope tests.
+type sieveMatchTest struct {
+	kind          string
+	matchType     string
+	caseSensitive bool
+	part          string
+	headers       []string
+	keys          []string
+}
+
+var sieveWordDecoder = mime.WordDecoder{}
+
+func (test sieveMatchTest) values(msg *sieveMsg) []string {
+	var values []string
+	for _, name := range test.headers {
+		switch test.kind {
+		case "envelope":
+			addr := msg.envelopeFrom
+			if name == "to" {
+				addr = msg.envelopeTo
+			}
+			values = append(values, addressPart(addr, test.part))
+			continue
+		}
+
+		for _, value := range msg.header.Values(name) {
+			if decoded, err := sieveWordDecoder.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			if test.kind == "header" {
+				values = append(values, strings.TrimSpace(value))
+				continue
+			}
+
+			addrs, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				values = append(values, addressPart(addr.Address, test.part))
+			}
+		}
+	}
+	return values
+}
+
+func (test sieveMatchTest) eval(msg *sieveMsg) bool {
+	for _, value := range test.values(msg) {
+		for _, key := range test.keys {
+			if sieveMatch(test.matchType, test.caseSensitive, value, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addressPart(addr, part string) string {
+	at := strings.LastIndexByte(addr, '@')
+	switch part {
+	case "localpart":
+		if at == -1 {
+			return addr
+		}
+		return addr[:at]
+	case "domain":
+		if at == -1 {
+			return ""
+		}
+		return addr[at+1:]
+	}
+	return addr
+}
+
+func sieveMatch(matchType string, caseSensitive bool, value, key string) bool {
+	if !caseSensitive {
+		value = asciiLower(value)
+		key = asciiLower(key)
+	}
+	switch matchType {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return sieveWildcardMatch(value, key)
+	}
+	return value == key
+}
+
+// sieveWildcardMatch matches value against the pattern with "*" matching
+// any sequence of characters and "?" matching a single character. Wildcards
+// can be escaped using backslash.
+func sieveWildcardMatch(value, pattern string) bool {
+	v, p := []rune(value), []rune(pattern)
+	// Positions to backtrack to after the last "*".
+	starP, starV := -1, 0
+	vi, pi := 0, 0
+	for vi < len(v) {
+		if pi < len(p) {
+			switch {
+			case p[pi] == '*':
+				starP, starV = pi, vi
+				pi++
+				continue
+			case p[pi] == '?':
+				vi++
+				pi++
+				continue
+			case p[pi] == '\\' && pi+1 < len(p):
+				if p[pi+1] == v[vi] {
+					vi++
+					pi += 2
+					continue
+				}
+			case p[pi] == v[vi]:
+				vi++
+				pi++
+				continue
+			}
+		}
+		if starP == -1 {
+			return false
+		}
+		starV++
+		vi = starV
+		pi = starP + 1
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, s)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFlags returns the union of flag lists, flags are compared
+// case-insensitively.
+func mergeFlags(flags, add []string) []string {
+	res := append([]string(nil), flags...)
+	for _, flag := range add {
+		if !containsFold(res, flag) {
+			res = append(res, flag)
+		}
+	}
+	return res
+}
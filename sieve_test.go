@@ -0,0 +1,222 @@
+package imapsql
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestSieveParseErrors(t *testing.T) {
+	for _, script := range []string{
+		`keep`,
+		`fileinto "Junk";`,
+		`require "vacation";`,
+		`require "fileinto"; if true { fileinto "a" "b"; }`,
+		`if true { keep; `,
+		`keep; }`,
+		`elsif true { keep; }`,
+		`if header :regex "Subject" "x" { keep; }`,
+		`if header :comparator "i;unknown" "Subject" "x" { keep; }`,
+		`if size :over "1K" { keep; }`,
+		`require "envelope"; if envelope "cc" "x" { keep; }`,
+		`keep; require "fileinto";`,
+		`"unterminated`,
+		`/* unterminated`,
+		`redirect "a@example.org";`,
+	} {
+		_, err := parseSieve(script)
+		_, ok := err.(SieveError)
+		assert.Assert(t, ok, "script %q, err = %v", script, err)
+	}
+}
+
+func TestSieveWildcardMatch(t *testing.T) {
+	for _, c := range []struct {
+		value, pattern string
+		match          bool
+	}{
+		{"", "", true},
+		{"", "*", true},
+		{"abc", "a*", true},
+		{"abc", "*c", true},
+		{"abc", "a?c", true},
+		{"abc", "a??c", false},
+		{"abcbc", "a*bc", true},
+		{"abd", "a*c", false},
+		{"a*c", `a\*c`, true},
+		{"abc", `a\*c`, false},
+		{"[list] hello", "[list]*", true},
+	} {
+		assert.Equal(t, sieveWildcardMatch(c.value, c.pattern), c.match, "%q %q", c.value, c.pattern)
+	}
+}
+
+func TestSieveRun(t *testing.T) {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(
+		"From: \"Foo\" <foo@Example.org>\r\n" +
+			"To: bar@example.com, baz@example.net\r\n" +
+			"Subject: =?utf-8?q?=5Blist=5D_Caf=C3=A9?=\r\n" +
+			"X-Spam: yes\r\n" +
+			"\r\n")))
+	assert.NilError(t, err)
+	msg := &sieveMsg{
+		header:       hdr,
+		size:         2000,
+		envelopeFrom: "bounces@lists.example.org",
+		envelopeTo:   "bar@example.com",
+	}
+
+	for _, c := range []struct {
+		script  string
+		actions []sieveAction
+	}{
+		{``, []sieveAction{{}}},
+		{`discard;`, nil},
+		{`keep; discard;`, []sieveAction{{}}},
+		{`require "fileinto"; fileinto "A"; fileinto "A"; stop; keep;`, []sieveAction{{mailbox: "A"}}},
+		{`require "fileinto";
+		  if header :matches "subject" "[LIST] *" { fileinto "List"; }`,
+			[]sieveAction{{mailbox: "List"}}},
+		{`require "fileinto";
+		  if header :comparator "i;octet" :contains "Subject" "Café" { fileinto "Octet"; }`,
+			[]sieveAction{{mailbox: "Octet"}}},
+		{`require "fileinto";
+		  if header :comparator "i;octet" :contains "Subject" "CAFÉ" { fileinto "Octet"; }`,
+			[]sieveAction{{}}},
+		{`require "fileinto";
+		  if address :domain :is "from" "example.org" { fileinto "Domain"; }`,
+			[]sieveAction{{mailbox: "Domain"}}},
+		{`require "fileinto";
+		  if address :localpart "to" "baz" { fileinto "Local"; }`,
+			[]sieveAction{{mailbox: "Local"}}},
+		{`require ["fileinto", "envelope"];
+		  if envelope :domain "from" "lists.example.org" { fileinto "Lists"; }
+		  elsif true { fileinto "Other"; }`,
+			[]sieveAction{{mailbox: "Lists"}}},
+		{`require "fileinto";
+		  if anyof (size :over 10K, not exists "X-Spam") { fileinto "A"; }
+		  elsif allof (size :under 2K, exists ["X-Spam", "From"]) { fileinto "B"; }
+		  else { fileinto "C"; }`,
+			[]sieveAction{{mailbox: "B"}}},
+		{`require ["fileinto", "imap4flags"];
+		  addflag "\\Flagged $Spam";
+		  fileinto "Junk";
+		  removeflag "$spam";
+		  keep;`,
+			[]sieveAction{
+				{mailbox: "Junk", flags: []string{`\Flagged`, "$Spam"}},
+				{flags: []string{`\Flagged`}},
+			}},
+		{"require \"fileinto\";\r\nif header :is \"subject\" text:\r\n..dot\r\n.\r\n{ fileinto \"X\"; }",
+			[]sieveAction{{}}},
+	} {
+		cmds, err := parseSieve(c.script)
+		assert.NilError(t, err, c.script)
+		assert.Equal(t, fmt.Sprint(runSieve(cmds, msg)), fmt.Sprint(c.actions), c.script)
+	}
+}
+
+func TestDelivery_Sieve(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+
+	u1, err := b.GetUser(t.Name() + "-1")
+	assert.NilError(t, err)
+	u2, err := b.GetUser(t.Name() + "-2")
+	assert.NilError(t, err)
+
+	err = u1.(*User).SetSieveScript(`fileinto "Junk";`)
+	_, isSieveErr := err.(SieveError)
+	assert.Assert(t, isSieveErr, "err = %v", err)
+
+	script := `require ["fileinto", "imap4flags", "envelope"];
+	if envelope :localpart "from" "spammer" { discard; stop; }
+	if header :contains "Subject" "hello" {
+		addflag "\\Flagged";
+		fileinto "Filtered";
+		keep;
+	}`
+	assert.NilError(t, u1.(*User).SetSieveScript(script))
+	stored, err := u1.(*User).SieveScript()
+	assert.NilError(t, err)
+	assert.Equal(t, stored, script)
+	stored, err = u2.(*User).SieveScript()
+	assert.NilError(t, err)
+	assert.Equal(t, stored, "")
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", textproto.Header{}))
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-2", textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	checkFlagged := func(u *User, mboxName string, flagged bool) {
+		t.Helper()
+		_, mbox, err := u.GetMailbox(mboxName, true, nil)
+		assert.NilError(t, err)
+		seq, _ := imap.ParseSeqSet("*")
+		ch := make(chan *imap.Message, 10)
+		assert.NilError(t, mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags}, ch))
+		assert.Equal(t, len(ch), 1)
+		assert.Equal(t, containsFold((<-ch).Flags, imap.FlaggedFlag), flagged)
+	}
+	checkFlagged(u1.(*User), "Filtered", true)
+	checkFlagged(u1.(*User), "INBOX", true)
+	checkFlagged(u2.(*User), "INBOX", false)
+
+	delivery = b.NewDelivery()
+	delivery.EnvelopeFrom("spammer@example.org")
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	status, err := u1.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(1))
+
+	assert.NilError(t, u1.(*User).SetSieveScript(""))
+	stored, err = u1.(*User).SieveScript()
+	assert.NilError(t, err)
+	assert.Equal(t, stored, "")
+}
+
+func TestDelivery_SievePerRecipient(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	u, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, u.CreateMailbox("Filtered"))
+	assert.NilError(t, u.(*User).SetSieveScript(`require "fileinto"; fileinto "Filtered"; keep;`))
+
+	_, inbox, err := u.GetMailbox("INBOX", true, nil)
+	assert.NilError(t, err)
+	limit := uint32(10)
+	assert.NilError(t, inbox.(*Mailbox).SetMessageLimit(&limit))
+
+	// Failure of any target fails the recipient and reverts other targets.
+	delivery := b.NewDelivery()
+	delivery.PerRecipient()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+	results := delivery.Results()
+	assert.Equal(t, results[0].Status, RcptPermFailed)
+	assert.Assert(t, errors.Is(results[0].Err, backend.ErrTooBig))
+
+	for _, name := range []string{"INBOX", "Filtered"} {
+		status, err := u.Status(name, []imap.StatusItem{imap.StatusMessages})
+		assert.NilError(t, err)
+		assert.Equal(t, status.Messages, uint32(0), name)
+	}
+	assert.Assert(t, checkKeysCount(b, 0))
+}
@@ -0,0 +1,139 @@
+package imapsql
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SortDisplayCapability is the capability name for RFC 5957 SORT=DISPLAY
+// extension. Mailbox.Sort accepts SortDisplayFrom and SortDisplayTo
+// criteria.
+const SortDisplayCapability = "SORT=DISPLAY"
+
+// RFC 5957 sort fields.
+const (
+	SortDisplayFrom sortthread.SortField = "DISPLAYFROM"
+	SortDisplayTo   sortthread.SortField = "DISPLAYTO"
+)
+
+var (
+	wordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+	addrParser  = &mail.AddressParser{WordDecoder: wordDecoder}
+)
+
+// maxSortKeyLen is the maximum length of string sort keys, in runes. Longer
+// keys are truncated so they fit into indexed msgs columns.
+const maxSortKeyLen = 255
+
+// unicodeCasemap returns the i;unicode-casemap (RFC 5051) collation key for
+// the string.
+//
+// Keys can be compared byte-wise, so they can be stored in a column
+// using binary collation and sorted by the SQL engine.
+func unicodeCasemap(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		b.WriteRune(unicode.ToTitle(r))
+	}
+	return truncateSortKey(norm.NFKD.String(b.String()))
+}
+
+func truncateSortKey(s string) string {
+	runes := 0
+	for i := range s {
+		if runes == maxSortKeyLen {
+			return s[:i]
+		}
+		runes++
+	}
+	return s
+}
+
+func firstAddress(all []string) *mail.Address {
+	list, err := addrParser.ParseList(firstHeaderField(all))
+	if err != nil || len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// sortKeyAddress returns the key for FROM, TO and CC sort criteria.
+func sortKeyAddress(all []string) string {
+	addr := firstAddress(all)
+	if addr == nil {
+		return ""
+	}
+	return unicodeCasemap(addr.Address)
+}
+
+// sortKeyDisplay returns the key for DISPLAYFROM and DISPLAYTO sort criteria
+// (RFC 5957): the decoded display name of the first address or the address
+// itself if there is no display name.
+func sortKeyDisplay(all []string) string {
+	addr := firstAddress(all)
+	if addr == nil {
+		return ""
+	}
+	if addr.Name != "" {
+		return unicodeCasemap(addr.Name)
+	}
+	return unicodeCasemap(addr.Address)
+}
+
+// sortKeySubject returns the key for SUBJECT sort criterion.
+func sortKeySubject(all []string) string {
+	subject := firstHeaderField(all)
+	if decoded, err := wordDecoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	baseSubject, _ := sortthread.GetBaseSubject(subject)
+	return unicodeCasemap(baseSubject)
+}
+
+// sortKeys contains sort keys stored in msgs table so SORT can be executed
+// using ORDER BY without loading cached headers.
+type sortKeys struct {
+	// SentDate is zero if Date header field is missing or malformed.
+	SentDate int64
+
+	Subject                string
+	From, To, Cc           string
+	DisplayFrom, DisplayTo string
+}
+
+func makeSortKeys(hdrs map[string][]string) sortKeys {
+	keys := sortKeys{
+		Subject:     sortKeySubject(hdrs["Subject"]),
+		From:        sortKeyAddress(hdrs["From"]),
+		To:          sortKeyAddress(hdrs["To"]),
+		Cc:          sortKeyAddress(hdrs["Cc"]),
+		DisplayFrom: sortKeyDisplay(hdrs["From"]),
+		DisplayTo:   sortKeyDisplay(hdrs["To"]),
+	}
+	if t, err := parseMessageDateTime(firstHeaderField(hdrs["Date"])); err == nil {
+		keys.SentDate = t.Unix()
+	}
+	return keys
+}
+
+// values returns values for sort key columns in the order used by addMsg.
+//
+// Arrival date is used as the sent date if Date header field is not usable
+// (RFC 5256).
+func (k sortKeys) values(arrival time.Time) []interface{} {
+	sentDate := k.SentDate
+	if sentDate == 0 {
+		sentDate = arrival.Unix()
+	}
+	return []interface{}{
+		sentDate, k.Subject, k.From, k.To, k.Cc, k.DisplayFrom, k.DisplayTo,
+	}
+}
@@ -1,11 +1,10 @@
 package imapsql
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
-	"net/mail"
 	"sort"
 	"time"
 
@@ -20,76 +19,175 @@ type msgKey struct {
 	CachedHeader map[string][]string
 }
 
+// headerScanLimit is the maximum amount of messages loaded by headerMetaScan
+// for SORT and THREAD commands.
+const headerScanLimit = 10000
+
 func (m *Mailbox) Sort(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	return m.SortContext(context.Background(), uid, sortCrit, searchCrit)
+}
+
+// SortContext is a variant of Sort that stops once ctx is cancelled.
+func (m *Mailbox) SortContext(ctx context.Context, uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
 	m.parent.Opts.Log.Debugln("Sort: SORT", uid, sortCrit, searchCrit)
-	msgs, err := m.SearchMessages(true, searchCrit)
+	entries, err := m.sortedEntries(ctx, sortCrit, searchCrit, headerScanLimit)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(msgs) == 0 {
+	if len(entries) == 0 {
 		if uid {
 			return nil, nil
 		}
 		return nil, errors.New("No messages matched the criteria")
 	}
 
-	// IDs in msgs are sorted so this will 'compress' adjacent IDs into ranges.
-	seqSet := imap.SeqSet{}
-	seqSet.AddNum(msgs...)
+	ids := make([]uint32, 0, len(entries))
+	for _, entry := range entries {
+		id := entry.ID
+		if !uid {
+			var ok bool
+			id, ok = m.handle.UidAsSeq(id)
+			if !ok {
+				continue // Wtf
+			}
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
 
-	m.parent.Opts.Log.Debugln("Sort: SORT found uids", seqSet)
+// sortedEntries runs the search and returns sort keys for all matched
+// messages, ordered according to sortCrit.
+//
+// limit applies only if sorting can't be done by SQL engine and cached
+// headers have to be loaded.
+func (m *Mailbox) sortedEntries(ctx context.Context, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria, limit int) ([]sortEntry, error) {
+	stmt, ok, err := m.parent.getSortStmt(sortCrit)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "sortedEntries (getSortStmt)", sortCrit)
+		return nil, err
+	}
+	if ok {
+		return m.sqlSortedEntries(ctx, stmt, sortCrit, searchCrit)
+	}
+
+	msgs, err := m.SearchMessagesContext(ctx, true, searchCrit)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, nil
+	}
 
 	// XXX: Split SearchMessages to allow it running in the same transaction.
 
-	resultCount := len(msgs)
-	if resultCount > 1000 {
-		resultCount = 1000
+	entries, err := m.loadSortEntries(ctx, msgs, sortCrit, limit)
+	if err != nil {
+		return nil, err
 	}
-	sortBuffer := make([]*msgKey, 0, resultCount)
 
-	_, err = m.headerMetaScan(nil, &seqSet, func(k *msgKey) error {
-		sortBuffer = append(sortBuffer, k)
-		return nil
-	})
+	m.parent.Opts.Log.Debugln("Sort: sorting", len(entries), "messages")
+
+	sort.Slice(entries, messageCompare(entries, sortCrit))
+	return entries, nil
+}
+
+// sqlSortedEntries is the sortedEntries implementation that uses persisted
+// sort keys and lets SQL engine do the sorting.
+func (m *Mailbox) sqlSortedEntries(ctx context.Context, stmt *sql.Stmt, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]sortEntry, error) {
+	// Search is not needed at all for the most common case of
+	// SORT (...) UTF-8 ALL.
+	var matched map[uint32]struct{}
+	if !searchOnlyWithFlags(searchCrit) || searchCrit.WithFlags != nil || searchCrit.WithoutFlags != nil {
+		uids, err := m.SearchMessagesContext(ctx, true, searchCrit)
+		if err != nil {
+			return nil, err
+		}
+		if len(uids) == 0 {
+			return nil, nil
+		}
+		matched = make(map[uint32]struct{}, len(uids))
+		for _, uid := range uids {
+			matched[uid] = struct{}{}
+		}
+	}
+
+	rows, err := stmt.QueryContext(ctx, m.id)
 	if err != nil {
-		return nil, errors.New("Internal server error")
+		m.parent.logMboxErr(m, err, "sqlSortedEntries", sortCrit)
+		return nil, err
 	}
+	defer rows.Close()
 
-	m.parent.Opts.Log.Debugln("Sort: sorting", len(sortBuffer), "messages")
+	var entries []sortEntry
+	if matched != nil {
+		entries = make([]sortEntry, 0, len(matched))
+	}
+	scanArgs := make([]interface{}, len(sortCrit)+1)
+	for rows.Next() {
+		entry := sortEntry{Keys: make([]sortValue, len(sortCrit))}
+		scanArgs[0] = &entry.ID
+		for i, crit := range sortCrit {
+			if _, numeric, _ := sortColumn(crit.Field); numeric {
+				scanArgs[i+1] = &entry.Keys[i].Num
+			} else {
+				scanArgs[i+1] = &entry.Keys[i].Str
+			}
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			m.parent.logMboxErr(m, err, "sqlSortedEntries (scan)", sortCrit)
+			return nil, err
+		}
 
-	sort.Slice(sortBuffer, messageCompare(sortBuffer, sortCrit))
-	ids := make([]uint32, len(sortBuffer))
-	for i, msg := range sortBuffer {
-		id := msg.ID
-		if !uid {
-			var ok bool
-			id, ok = m.handle.UidAsSeq(id)
-			if !ok {
-				continue // Wtf
+		if matched != nil {
+			if _, ok := matched[entry.ID]; !ok {
+				continue
 			}
 		}
-		ids[i] = id
+		entries = append(entries, entry)
 	}
-	return ids, nil
+	if err := rows.Err(); err != nil {
+		m.parent.logMboxErr(m, err, "sqlSortedEntries", sortCrit)
+		return nil, err
+	}
+
+	m.parent.Opts.Log.Debugln("Sort: sorted", len(entries), "messages using SQL")
+	return entries, nil
 }
 
-func firstHeaderField(all []string) string {
-	if len(all) > 0 {
-		return all[0]
+// loadSortEntries computes sort keys for messages with the specified UIDs.
+//
+// UIDs should be sorted in ascending order. Returned entries are in the
+// same order.
+func (m *Mailbox) loadSortEntries(ctx context.Context, uids []uint32, sortCrit []sortthread.SortCriterion, limit int) ([]sortEntry, error) {
+	// IDs in uids are sorted so this will 'compress' adjacent IDs into ranges.
+	seqSet := imap.SeqSet{}
+	seqSet.AddNum(uids...)
+
+	m.parent.Opts.Log.Debugln("Sort: loading sort keys for uids", seqSet)
+
+	resultCount := len(uids)
+	if limit != 0 && resultCount > limit {
+		resultCount = limit
 	}
-	return ""
-}
+	entries := make([]sortEntry, 0, resultCount)
 
-func firstAddrFromList(all []string) string {
-	list, err := mail.ParseAddressList(firstHeaderField(all))
+	_, err := m.headerMetaScan(ctx, nil, &seqSet, limit, func(k *msgKey) error {
+		entries = append(entries, makeSortEntry(k, sortCrit))
+		return nil
+	})
 	if err != nil {
-		return ""
+		return nil, errors.New("Internal server error") // headerMetaScan logs the actual error
 	}
-	if len(list) == 0 {
-		return ""
+	return entries, nil
+}
+
+func firstHeaderField(all []string) string {
+	if len(all) > 0 {
+		return all[0]
 	}
-	return list[0].Address
+	return ""
 }
 
 func sentDate(dateHeaders []string, arrivalUnix int64) time.Time {
@@ -100,87 +198,72 @@ func sentDate(dateHeaders []string, arrivalUnix int64) time.Time {
 	return t.UTC()
 }
 
-func messageCompare(buf []*msgKey, sortCrit []sortthread.SortCriterion) func(i, j int) bool {
-	return func(i, j int) bool {
-		for _, crit := range sortCrit {
-			switch crit.Field {
-			case "ARRIVAL":
-				if buf[i].ArrivalUnix == buf[j].ArrivalUnix {
-					continue
-				}
-				if crit.Reverse {
-					return buf[i].ArrivalUnix > buf[j].ArrivalUnix
-				} else {
-					return buf[i].ArrivalUnix < buf[j].ArrivalUnix
-				}
-			case "CC":
-				iAddr := firstAddrFromList(buf[i].CachedHeader["Cc"])
-				jAddr := firstAddrFromList(buf[j].CachedHeader["Cc"])
-				if iAddr == jAddr {
-					continue
-				}
-				if crit.Reverse {
-					return iAddr > jAddr
-				} else {
-					return iAddr < jAddr
-				}
-			case "DATE":
-				iDate := sentDate(buf[i].CachedHeader["Date"], buf[i].ArrivalUnix)
-				jDate := sentDate(buf[j].CachedHeader["Date"], buf[j].ArrivalUnix)
-				if iDate == jDate {
-					continue
-				}
-				if crit.Reverse {
-					return iDate.After(jDate)
-				} else {
-					return iDate.Before(jDate)
-				}
-			case "FROM":
-				iAddr := firstAddrFromList(buf[i].CachedHeader["From"])
-				jAddr := firstAddrFromList(buf[j].CachedHeader["From"])
-				log.Println(iAddr, "vs", jAddr, "=>", iAddr < jAddr)
-				if iAddr == jAddr {
-					continue
-				}
-				if crit.Reverse {
-					return iAddr > jAddr
-				} else {
-					return iAddr < jAddr
-				}
-			case "SIZE":
-				if buf[i].BodyLen == buf[j].BodyLen {
-					continue
-				}
-				if crit.Reverse {
-					return buf[i].BodyLen > buf[j].BodyLen
-				} else {
-					return buf[i].BodyLen < buf[j].BodyLen
-				}
-			case "SUBJECT":
-				iSubj, _ := sortthread.GetBaseSubject(firstHeaderField(buf[i].CachedHeader["Subject"]))
-				jSubj, _ := sortthread.GetBaseSubject(firstHeaderField(buf[j].CachedHeader["Subject"]))
-				if iSubj == jSubj {
-					continue
-				}
-				if crit.Reverse {
-					return iSubj > jSubj
-				} else {
-					return iSubj < jSubj
-				}
-			case "TO":
-				iAddr := firstAddrFromList(buf[i].CachedHeader["To"])
-				jAddr := firstAddrFromList(buf[j].CachedHeader["To"])
-				if iAddr == jAddr {
-					continue
-				}
-				if crit.Reverse {
-					return iAddr > jAddr
-				} else {
-					return iAddr < jAddr
-				}
-			}
+// sortEntry contains pre-computed sort keys for a single message so they
+// are not recomputed (and headers are not re-parsed) for each comparison.
+type sortEntry struct {
+	ID uint32
+
+	// Keys contains one value per each used SortCriterion, in the same order.
+	Keys []sortValue
+}
+
+// sortValue is the value of a single sort key. Only one of the fields is
+// used depending on the criterion.
+type sortValue struct {
+	Str string
+	Num int64
+}
+
+func makeSortEntry(k *msgKey, sortCrit []sortthread.SortCriterion) sortEntry {
+	entry := sortEntry{
+		ID:   k.ID,
+		Keys: make([]sortValue, len(sortCrit)),
+	}
+	for i, crit := range sortCrit {
+		switch crit.Field {
+		case "ARRIVAL":
+			entry.Keys[i].Num = k.ArrivalUnix
+		case "CC":
+			entry.Keys[i].Str = sortKeyAddress(k.CachedHeader["Cc"])
+		case "DATE":
+			entry.Keys[i].Num = sentDate(k.CachedHeader["Date"], k.ArrivalUnix).Unix()
+		case SortDisplayFrom:
+			entry.Keys[i].Str = sortKeyDisplay(k.CachedHeader["From"])
+		case SortDisplayTo:
+			entry.Keys[i].Str = sortKeyDisplay(k.CachedHeader["To"])
+		case "FROM":
+			entry.Keys[i].Str = sortKeyAddress(k.CachedHeader["From"])
+		case "SIZE":
+			entry.Keys[i].Num = int64(k.BodyLen)
+		case "SUBJECT":
+			entry.Keys[i].Str = sortKeySubject(k.CachedHeader["Subject"])
+		case "TO":
+			entry.Keys[i].Str = sortKeyAddress(k.CachedHeader["To"])
+		}
+	}
+	return entry
+}
+
+// sortEntryLess reports whether entry a should be sorted before entry b.
+// Messages with equal keys are ordered by UID.
+func sortEntryLess(a, b *sortEntry, sortCrit []sortthread.SortCriterion) bool {
+	for i, crit := range sortCrit {
+		aKey, bKey := a.Keys[i], b.Keys[i]
+		if aKey == bKey {
+			continue
+		}
+		less := aKey.Num < bKey.Num || (aKey.Num == bKey.Num && aKey.Str < bKey.Str)
+		if crit.Reverse {
+			return !less
 		}
-		return buf[i].ID < buf[j].ID
+		return less
+	}
+	return a.ID < b.ID
+}
+
+func messageCompare(buf []sortEntry, sortCrit []sortthread.SortCriterion) func(i, j int) bool {
+	return func(i, j int) bool {
+		return sortEntryLess(&buf[i], &buf[j], sortCrit)
 	}
 }
 
@@ -222,7 +305,7 @@ func (m *Mailbox) orderedSubjThread(tx *sql.Tx, uid bool, seqSet *imap.SeqSet, m
 	// based on assumption that most messages do not have replies or forwards.
 	threads := make(map[string][]msg, msgCount/9*10)
 
-	count, err := m.headerMetaScan(tx, seqSet, func(k *msgKey) error {
+	count, err := m.headerMetaScan(context.Background(), tx, seqSet, headerScanLimit, func(k *msgKey) error {
 		subject, _ := sortthread.GetBaseSubject(firstHeaderField(k.CachedHeader["Subject"]))
 		sentDate := sentDate(k.CachedHeader["Date"], k.ArrivalUnix)
 
@@ -295,11 +378,14 @@ func (m *Mailbox) orderedSubjThread(tx *sql.Tx, uid bool, seqSet *imap.SeqSet, m
 	return result, nil
 }
 
-func (m *Mailbox) headerMetaScan(tx *sql.Tx, seqSet *imap.SeqSet, callback func(k *msgKey) error) (int, error) {
+// headerMetaScan calls callback for each message in seqSet (UIDs) with
+// cached header data loaded. Scan stops after limit messages, zero means no
+// limit.
+func (m *Mailbox) headerMetaScan(ctx context.Context, tx *sql.Tx, seqSet *imap.SeqSet, limit int, callback func(k *msgKey) error) (int, error) {
 	count := 0
 	if tx == nil {
 		var err error
-		tx, err = m.parent.db.BeginLevel(sql.LevelReadCommitted, true)
+		tx, err = m.parent.db.BeginLevelContext(ctx, sql.LevelReadCommitted, true)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "headerMetaScan (tx start)", seqSet)
 			return 0, err
@@ -309,7 +395,7 @@ func (m *Mailbox) headerMetaScan(tx *sql.Tx, seqSet *imap.SeqSet, callback func(
 
 outerLoop:
 	for _, seq := range seqSet.Set {
-		rows, err := tx.Stmt(m.parent.cachedHeaderUid).Query(m.id, seq.Start, seq.Stop)
+		rows, err := tx.Stmt(m.parent.cachedHeaderUid).QueryContext(ctx, m.id, seq.Start, seq.Stop)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "headerMetaScan: cachedHeader", seqSet)
 			return 0, err
@@ -336,7 +422,7 @@ outerLoop:
 			}
 
 			count++
-			if count == 10000 {
+			if count == limit {
 				rows.Close()
 				break outerLoop
 			}
@@ -0,0 +1,176 @@
+package imapsql
+
+import (
+	"context"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"gotest.tools/assert"
+)
+
+func TestUnicodeCasemap(t *testing.T) {
+	assert.Equal(t, unicodeCasemap("abc"), unicodeCasemap("ABC"))
+	assert.Equal(t, unicodeCasemap("ǆemal"), unicodeCasemap("ǅemal"))
+	assert.Equal(t, unicodeCasemap("Ölaf"), unicodeCasemap("ölaf"))
+	assert.Assert(t, unicodeCasemap("Ölaf") < unicodeCasemap("Pete"))
+}
+
+func TestSortKeyDisplay(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		key    string
+	}{
+		{"Alice <zed@example.org>", "ALICE"},
+		{"<bob@example.org>", "BOB@EXAMPLE.ORG"},
+		{"=?utf-8?q?=C3=96laf?= <olaf@example.org>", unicodeCasemap("Ölaf")},
+		{"", ""},
+	} {
+		assert.Equal(t, sortKeyDisplay([]string{c.header}), c.key, c.header)
+	}
+}
+
+func TestSortDisplayFrom(t *testing.T) {
+	b := initTestBackend()
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mbox, err := usr.GetMailbox(t.Name(), true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	for _, from := range []string{
+		"Zed <a@example.org>",
+		"=?utf-8?q?=C3=A9mile?= <z@example.org>",
+		"<bob@example.org>",
+		"alice <y@example.org>",
+	} {
+		msg := "From: " + from + "\r\n\r\nHello!\r\n"
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	sortMbox := mbox.(*Mailbox)
+	res, err := sortMbox.Sort(true, []sortthread.SortCriterion{{Field: SortDisplayFrom}}, &imap.SearchCriteria{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{4, 3, 2, 1})
+
+	res, err = sortMbox.Sort(true, []sortthread.SortCriterion{{Field: sortthread.SortFrom}}, &imap.SearchCriteria{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1, 3, 4, 2})
+}
+
+func TestSortSQLMatchesHeaderScan(t *testing.T) {
+	b := initTestBackend()
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mboxI, err := usr.GetMailbox(t.Name(), true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for _, hdr := range []string{
+		"Subject: Re: beta\r\nFrom: Carol <c@example.org>\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\n",
+		"Subject: alpha\r\nFrom: bob@example.org\r\nTo: x@example.org\r\n",
+		"Subject: BETA\r\nFrom: Alice <a@example.org>\r\nDate: Sun, 1 Jan 2006 15:04:05 +0000\r\n",
+		"Subject: gamma\r\nCc: z@example.org\r\nDate: not a date\r\n",
+		"Subject: [list] Alpha\r\nFrom: Dave <d@example.org>\r\nDate: Sun, 1 Jan 2006 15:04:05 +0000\r\n",
+	} {
+		msg := hdr + "\r\n" + strings.Repeat("Hello!\r\n", len(hdr)%3)
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	allUids := []uint32{1, 2, 3, 4, 5}
+	for _, sortCrit := range [][]sortthread.SortCriterion{
+		{{Field: sortthread.SortDate, Reverse: true}},
+		{{Field: sortthread.SortSubject}, {Field: sortthread.SortSize, Reverse: true}},
+		{{Field: sortthread.SortFrom}},
+		{{Field: SortDisplayFrom, Reverse: true}},
+		{{Field: sortthread.SortCc}, {Field: sortthread.SortTo}},
+		{{Field: sortthread.SortArrival, Reverse: true}},
+	} {
+		stmt, ok, err := b.(*Backend).getSortStmt(sortCrit)
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+		sqlEntries, err := mbox.sqlSortedEntries(context.Background(), stmt, sortCrit, &imap.SearchCriteria{})
+		assert.NilError(t, err)
+
+		goEntries, err := mbox.loadSortEntries(context.Background(), allUids, sortCrit, 0)
+		assert.NilError(t, err)
+		sort.Slice(goEntries, messageCompare(goEntries, sortCrit))
+
+		assert.DeepEqual(t, sqlEntries, goEntries)
+	}
+
+	res, err := mbox.Sort(true, []sortthread.SortCriterion{{Field: sortthread.SortSubject}}, &imap.SearchCriteria{
+		WithoutFlags: []string{imap.DeletedFlag},
+		Header:       textproto.MIMEHeader{"Subject": {"beta"}},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1, 3})
+}
+
+func TestSchemaUpgrade6To7(t *testing.T) {
+	if TestDB != "" && TestDB != "sqlite3" {
+		t.Skip("Test uses SQLite-specific schema manipulation")
+	}
+
+	dir, err := ioutil.TempDir("", "go-imap-sql-tests-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "test.db")
+	store := &FSStore{Root: filepath.Join(dir, "store")}
+	assert.NilError(t, os.MkdirAll(store.Root, os.ModePerm))
+
+	b, err := New("sqlite3", dsn, store, Opts{Log: DummyLogger{}})
+	assert.NilError(t, err)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	for _, subj := range []string{"b", "a"} {
+		msg := "Subject: " + subj + "\r\nDate: Sun, 1 Jan 2006 15:04:05 +0000\r\n\r\nHello!\r\n"
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), nil))
+	}
+
+	// Roll back the schema to version 6.
+	for _, col := range sortColumns {
+		_, err = b.DB.Exec(`DROP INDEX msgs_` + col)
+		assert.NilError(t, err)
+		if col == "date" || col == "bodyLen" {
+			continue
+		}
+		_, err = b.DB.Exec(`ALTER TABLE msgs DROP COLUMN ` + col)
+		assert.NilError(t, err)
+	}
+	_, err = b.DB.Exec(`DROP INDEX users_domainId`)
+	assert.NilError(t, err)
+	for _, col := range []string{"password", "status", "failedLogins", "lockedUntil", "domainId"} {
+		_, err = b.DB.Exec(`ALTER TABLE users DROP COLUMN ` + col)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, b.setSchemaVersion(6))
+	assert.NilError(t, b.Close())
+
+	b, err = New("sqlite3", dsn, store, Opts{Log: DummyLogger{}})
+	assert.NilError(t, err)
+	defer b.Close()
+
+	var subject string
+	var sentDate int64
+	assert.NilError(t, b.DB.QueryRow(`SELECT sortSubject, sentDate FROM msgs WHERE msgId = 2`).Scan(&subject, &sentDate))
+	assert.Equal(t, subject, "A")
+	assert.Equal(t, sentDate, int64(1136127845))
+}
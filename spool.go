@@ -0,0 +1,88 @@
+package imapsql
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultSpoolMemoryLimit is the amount of bytes SpoolBuffer keeps in memory
+// if Opts.SpoolMemoryLimit is not set.
+const DefaultSpoolMemoryLimit = 1 << 20
+
+// SpoolBuffer is the Buffer implementation that keeps small bodies in memory
+// and spools larger ones to a temporary file.
+//
+// Body is opened using the separate file descriptor for each Open call so
+// it can be read concurrently and the content is never copied into memory
+// as a whole.
+//
+// SpoolBuffer passed to Delivery.BodyParsed is removed by Delivery when
+// Commit or Abort is called. Otherwise, Remove should be called once the
+// buffer is no longer needed.
+type SpoolBuffer struct {
+	mem  []byte
+	path string
+	size int
+}
+
+// NewSpoolBuffer reads r until EOF into SpoolBuffer.
+//
+// If r contains more than memLimit bytes, it is written to the temporary
+// file in the dir directory (os.TempDir() if empty). If memLimit is 0 or
+// negative, the file is always used.
+func NewSpoolBuffer(r io.Reader, memLimit int, dir string) (*SpoolBuffer, error) {
+	if memLimit < 0 {
+		memLimit = 0
+	}
+
+	mem, err := ioutil.ReadAll(io.LimitReader(r, int64(memLimit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(mem) <= memLimit && memLimit != 0 {
+		return &SpoolBuffer{mem: mem, size: len(mem)}, nil
+	}
+
+	f, err := ioutil.TempFile(dir, "imapsql-spool-")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(f, io.MultiReader(bytes.NewReader(mem), r))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &SpoolBuffer{path: f.Name(), size: int(size)}, nil
+}
+
+func (sb *SpoolBuffer) Open() (io.ReadCloser, error) {
+	if sb.path == "" {
+		return ioutil.NopCloser(bytes.NewReader(sb.mem)), nil
+	}
+	return os.Open(sb.path)
+}
+
+// Len returns the amount of bytes stored in the buffer.
+func (sb *SpoolBuffer) Len() int {
+	return sb.size
+}
+
+// Remove deletes the temporary file used by the buffer, if any. Buffer
+// should not be used after Remove is called.
+func (sb *SpoolBuffer) Remove() error {
+	sb.mem = nil
+	if sb.path == "" {
+		return nil
+	}
+	path := sb.path
+	sb.path = ""
+	return os.Remove(path)
+}
@@ -0,0 +1,99 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestSpoolBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-sql-spool-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	readAll := func(sb *SpoolBuffer) string {
+		t.Helper()
+		r, err := sb.Open()
+		assert.NilError(t, err)
+		defer r.Close()
+		blob, err := ioutil.ReadAll(r)
+		assert.NilError(t, err)
+		return string(blob)
+	}
+	countFiles := func() int {
+		t.Helper()
+		files, err := ioutil.ReadDir(dir)
+		assert.NilError(t, err)
+		return len(files)
+	}
+
+	for _, c := range []struct {
+		data     string
+		memLimit int
+		file     bool
+	}{
+		{"", 16, false},
+		{"0123456789", 16, false},
+		{"0123456789abcdef", 16, false},
+		{"0123456789abcdefg", 16, true},
+		{"", 0, true},
+		{"0123456789", -1, true},
+	} {
+		sb, err := NewSpoolBuffer(strings.NewReader(c.data), c.memLimit, dir)
+		assert.NilError(t, err)
+		assert.Equal(t, sb.Len(), len(c.data))
+		assert.Equal(t, countFiles() == 1, c.file, "%q %d", c.data, c.memLimit)
+		assert.Equal(t, readAll(sb), c.data)
+		assert.Equal(t, readAll(sb), c.data)
+		assert.NilError(t, sb.Remove())
+		assert.NilError(t, sb.Remove())
+		assert.Equal(t, countFiles(), 0)
+	}
+}
+
+func TestDelivery_Spool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-sql-spool-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	b := initTestBackendOpts(Opts{SpoolMemoryLimit: -1, SpoolDir: dir}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+
+	for _, commit := range []bool{true, false} {
+		delivery := b.NewDelivery()
+		assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", textproto.Header{}))
+		assert.NilError(t, delivery.AddRcpt(t.Name()+"-2", textproto.Header{}))
+		assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+
+		files, err := ioutil.ReadDir(dir)
+		assert.NilError(t, err)
+		assert.Equal(t, len(files), 1)
+
+		if commit {
+			assert.NilError(t, delivery.Commit())
+		} else {
+			assert.NilError(t, delivery.Abort())
+		}
+
+		files, err = ioutil.ReadDir(dir)
+		assert.NilError(t, err)
+		assert.Equal(t, len(files), 0)
+	}
+
+	u, err := b.GetUser(t.Name() + "-2")
+	assert.NilError(t, err)
+	_, mbox, err := u.GetMailbox("INBOX", true, nil)
+	assert.NilError(t, err)
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchRFC822Size}, ch))
+	assert.Equal(t, len(ch), 1)
+	assert.Equal(t, (<-ch).Size, uint32(len(testMsg)))
+}
@@ -81,6 +81,11 @@ func (b *Backend) initSchema() error {
 			id BIGSERIAL NOT NULL PRIMARY KEY AUTOINCREMENT,
 			username VARCHAR(255) NOT NULL UNIQUE,
 			msgsizelimit INTEGER DEFAULT NULL,
+			password VARCHAR(255) DEFAULT NULL,
+			status INTEGER NOT NULL DEFAULT 0,
+			failedLogins INTEGER NOT NULL DEFAULT 0,
+			lockedUntil BIGINT NOT NULL DEFAULT 0,
+			domainId BIGINT DEFAULT NULL,
 
             -- It does not reference mboxes, since otherwise there will
             -- be recursive foreign key constraint.
@@ -157,6 +162,15 @@ func (b *Backend) initSchema() error {
 
 			recent INTEGER NOT NULL DEFAULT 1,
 
+			-- Sort keys, see sortKeys.
+			sentDate BIGINT NOT NULL DEFAULT 0,
+			sortSubject ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortFrom ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortTo ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortCc ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortDisplayFrom ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortDisplayTo ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+
 			PRIMARY KEY(mboxId, msgId)
 		)`)
 	if err != nil {
@@ -191,19 +205,99 @@ func (b *Backend) initSchema() error {
 		return wrapErr(err, "create index seen_msgs")
 	}
 
+	for _, col := range sortColumns {
+		if err := b.createIndex("msgs_"+col, "msgs", "mboxId, "+col); err != nil {
+			return wrapErr(err, "create index msgs_"+col)
+		}
+	}
+
+	if err := b.initDeliveryKeys(); err != nil {
+		return err
+	}
+	if err := b.initSieveScripts(); err != nil {
+		return err
+	}
+	if err := b.initSubaddressing(); err != nil {
+		return err
+	}
+	if err := b.initAliases(); err != nil {
+		return err
+	}
+	if err := b.initDomains(); err != nil {
+		return err
+	}
+	if err := b.initPendingDeletions(); err != nil {
+		return err
+	}
+	if err := b.initTombstones(); err != nil {
+		return err
+	}
+	if err := b.initRetentionPolicies(); err != nil {
+		return err
+	}
+	if err := b.initLegalHolds(); err != nil {
+		return err
+	}
+	if err := b.initJournal(); err != nil {
+		return err
+	}
+
+	if b.Opts.FullTextSearch {
+		if err := b.initFTS(); err != nil {
+			return err
+		}
+	}
+	if b.Opts.SearchIndex != nil {
+		if err := b.initSearchIndexLog(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+func (b *Backend) createIndex(name, table, cols string) error {
+	_, err := b.db.Exec(`
+		CREATE INDEX IF NOT EXISTS ` + name + `
+		ON ` + table + `(` + cols + `)`)
+	// MySQL does not support "IF NOT EXISTS", but MariaDB does.
+	if err != nil && b.db.driver == "mysql" {
+		_, err = b.db.Exec(`
+			CREATE INDEX ` + name + `
+			ON ` + table + `(` + cols + `)`)
+		if err != nil && strings.HasPrefix(err.Error(), "Error 1061: Duplicate key name") {
+			err = nil
+		}
+	}
+	return err
+}
+
 func (b *Backend) prepareStmts() error {
 	var err error
 
 	b.userMeta, err = b.db.Prepare(`
-		SELECT id, inboxId
+		SELECT users.id, users.inboxId, users.status, coalesce(domains.suspended, 0)
 		FROM users
+		LEFT JOIN domains
+		ON users.domainId = domains.id
 		WHERE username = ?`)
 	if err != nil {
 		return wrapErr(err, "userMeta prep")
 	}
+	b.userPassHash, err = b.db.Prepare(`
+		SELECT password
+		FROM users
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "userPassHash prep")
+	}
+	b.setUserPassHash, err = b.db.Prepare(`
+		UPDATE users
+		SET password = ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "setUserPassHash prep")
+	}
 	b.listUsers, err = b.db.Prepare(`
 		SELECT id, username
 		FROM users
@@ -223,6 +317,13 @@ func (b *Backend) prepareStmts() error {
 	if err != nil {
 		return wrapErr(err, "addUser prep")
 	}
+	b.renameUser, err = b.db.Prepare(`
+		UPDATE users
+		SET username = ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "renameUser prep")
+	}
 	b.listMboxes, err = b.db.Prepare(`
 		SELECT id, name
 		FROM mboxes
@@ -411,18 +512,21 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "mboxId prep")
 	}
 	b.addMsg, err = b.db.Prepare(`
-		INSERT INTO msgs(mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		INSERT INTO msgs(mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent,
+			sentDate, sortSubject, sortFrom, sortTo, sortCc, sortDisplayFrom, sortDisplayTo)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return wrapErr(err, "addMsg prep")
 	}
 	b.copyMsgsUid, err = b.db.Prepare(`
-		INSERT INTO msgs
+		INSERT INTO msgs(mboxId, msgId, date, bodyLen, mark, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent,
+			sentDate, sortSubject, sortFrom, sortTo, sortCc, sortDisplayFrom, sortDisplayTo)
 		SELECT ? AS mboxId, (
 			SELECT uidnext - 1
 			FROM mboxes
 			WHERE id = ?
-		) + row_number() OVER (ORDER BY msgId) + ?, date, bodyLen, 0 AS mark, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, 0
+		) + row_number() OVER (ORDER BY msgId) + ?, date, bodyLen, 0 AS mark, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, 0,
+			sentDate, sortSubject, sortFrom, sortTo, sortCc, sortDisplayFrom, sortDisplayTo
 		FROM msgs
 		WHERE mboxId = ? AND msgId BETWEEN ? AND ? ORDER BY msgId`)
 	if err != nil {
@@ -560,7 +664,7 @@ func (b *Backend) prepareStmts() error {
 	}
 
 	b.searchFetchNoSeq, err = b.db.Prepare(`
-		SELECT msgs.msgId, date, bodyLen, extBodyKey, compressAlgo, ` + b.db.aggrValuesSet("flag", "{") + `
+		SELECT msgs.msgId, date, bodyLen, extBodyKey, compressAlgo, cachedHeader, bodyStructure, ` + b.db.aggrValuesSet("flag", "{") + `
 		FROM msgs
 		LEFT JOIN flags
 		ON flags.msgId = msgs.msgId AND msgs.mboxId = flags.mboxId
@@ -570,6 +674,36 @@ func (b *Backend) prepareStmts() error {
 	if err != nil {
 		return wrapErr(err, "searchFetchNoSeq prep")
 	}
+	b.searchFetchUidRange, err = b.db.Prepare(`
+		SELECT msgs.msgId, date, bodyLen, extBodyKey, compressAlgo, cachedHeader, bodyStructure, ` + b.db.aggrValuesSet("flag", "{") + `
+		FROM msgs
+		LEFT JOIN flags
+		ON flags.msgId = msgs.msgId AND msgs.mboxId = flags.mboxId
+		WHERE msgs.mboxId = ? AND msgs.msgId BETWEEN ? AND ?
+		GROUP BY msgs.mboxId, msgs.msgId
+		ORDER BY msgs.msgId`)
+	if err != nil {
+		return wrapErr(err, "searchFetchUidRange prep")
+	}
+
+	b.bodyStructUid, err = b.db.Prepare(`
+		SELECT msgId, bodyLen, bodyStructure
+		FROM msgs
+		WHERE mboxId = ? AND msgId BETWEEN ? AND ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "bodyStructUid prep")
+	}
+	b.userBodyStructs, err = b.db.Prepare(`
+		SELECT mboxes.name, msgs.msgId, msgs.bodyLen, msgs.bodyStructure
+		FROM msgs
+		INNER JOIN mboxes
+		ON mboxes.id = msgs.mboxId
+		WHERE mboxes.uid = ?
+		ORDER BY mboxes.name, msgs.msgId`)
+	if err != nil {
+		return wrapErr(err, "userBodyStructs prep")
+	}
 
 	b.addExtKey, err = b.db.Prepare(`
 		INSERT INTO extKeys(id, uid, refs)
@@ -717,6 +851,51 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "cachedHeaderUid prep")
 	}
 
+	if err := b.prepareDeliveryKeysStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareSieveStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareSubaddressStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareAliasStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareAccountStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareDomainStmts(); err != nil {
+		return err
+	}
+	if err := b.preparePendingDeletionsStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareTombstonesStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareRetentionStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareLegalHoldStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareJournalStmts(); err != nil {
+		return err
+	}
+
+	if b.Opts.FullTextSearch {
+		if err := b.prepareFTSStmts(); err != nil {
+			return err
+		}
+	}
+	if b.Opts.SearchIndex != nil {
+		if err := b.prepareSearchIndexStmts(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
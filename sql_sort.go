@@ -0,0 +1,93 @@
+package imapsql
+
+import (
+	"database/sql"
+
+	sortthread "github.com/emersion/go-imap-sortthread"
+)
+
+// sortColumns contains msgs columns used to execute SORT using ORDER BY.
+// Each of them is indexed together with mboxId.
+var sortColumns = []string{
+	"date", "sentDate", "bodyLen",
+	"sortSubject", "sortFrom", "sortTo", "sortCc",
+	"sortDisplayFrom", "sortDisplayTo",
+}
+
+// sortColumn returns the msgs column with the sort key for the criterion
+// and whether the key is numeric.
+func sortColumn(field sortthread.SortField) (col string, numeric bool, ok bool) {
+	switch field {
+	case sortthread.SortArrival:
+		return "date", true, true
+	case sortthread.SortCc:
+		return "sortCc", false, true
+	case sortthread.SortDate:
+		return "sentDate", true, true
+	case SortDisplayFrom:
+		return "sortDisplayFrom", false, true
+	case SortDisplayTo:
+		return "sortDisplayTo", false, true
+	case sortthread.SortFrom:
+		return "sortFrom", false, true
+	case sortthread.SortSize:
+		return "bodyLen", true, true
+	case sortthread.SortSubject:
+		return "sortSubject", false, true
+	case sortthread.SortTo:
+		return "sortTo", false, true
+	}
+	return "", false, false
+}
+
+// buildSortStmt returns the query that lists all messages in mailbox along
+// with their sort keys, ordered according to sortCrit.
+//
+// ok is false if some criteria can't be executed using ORDER BY.
+func buildSortStmt(sortCrit []sortthread.SortCriterion) (stmt string, ok bool) {
+	cols := ""
+	order := ""
+	for _, crit := range sortCrit {
+		col, _, ok := sortColumn(crit.Field)
+		if !ok {
+			return "", false
+		}
+		cols += ", " + col
+		order += col
+		if crit.Reverse {
+			order += " DESC"
+		}
+		order += ", "
+	}
+
+	// Messages with equal keys are ordered by UID, regardless of REVERSE,
+	// same as in sortEntryLess.
+	return `SELECT msgId` + cols + `
+		FROM msgs
+		WHERE mboxId = ?
+		ORDER BY ` + order + `msgId`, true
+}
+
+func (b *Backend) getSortStmt(sortCrit []sortthread.SortCriterion) (*sql.Stmt, bool, error) {
+	str, ok := buildSortStmt(sortCrit)
+	if !ok {
+		return nil, false, nil
+	}
+
+	b.sortStmtsLck.RLock()
+	stmt := b.sortStmtsCache[str]
+	b.sortStmtsLck.RUnlock()
+	if stmt != nil {
+		return stmt, true, nil
+	}
+
+	stmt, err := b.db.Prepare(str)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b.sortStmtsLck.Lock()
+	b.sortStmtsCache[str] = stmt
+	b.sortStmtsLck.Unlock()
+	return stmt, true, nil
+}
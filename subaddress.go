@@ -0,0 +1,150 @@
+package imapsql
+
+import (
+	"database/sql"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// Users can enable routing of messages sent to subaddresses (e.g.
+// user+lists@example.org) into separate mailboxes. Subaddresses are
+// recognized by Delivery only if Opts.SubaddressSeparator is set.
+
+func (b *Backend) initSubaddressing() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS subaddressing (
+			userId BIGINT NOT NULL PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			mboxPrefix VARCHAR(255) NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table subaddressing")
+	}
+	return nil
+}
+
+func (b *Backend) prepareSubaddressStmts() error {
+	var err error
+	b.getSubaddressing, err = b.db.Prepare(`
+		SELECT mboxPrefix
+		FROM subaddressing
+		WHERE userId = ?`)
+	if err != nil {
+		return wrapErr(err, "getSubaddressing prep")
+	}
+	b.delSubaddressing, err = b.db.Prepare(`
+		DELETE FROM subaddressing
+		WHERE userId = ?`)
+	if err != nil {
+		return wrapErr(err, "delSubaddressing prep")
+	}
+	b.addSubaddressing, err = b.db.Prepare(`
+		INSERT INTO subaddressing(userId, mboxPrefix)
+		VALUES (?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addSubaddressing prep")
+	}
+	return nil
+}
+
+// SplitSubaddress splits the address into the account username and the
+// subaddress detail using Opts.SubaddressSeparator. Detail is empty if the
+// address has none or subaddresses are not enabled.
+//
+// It can be used to construct per-recipient header fields passed to
+// Delivery.AddRcpt. Subaddresses of the same account in one delivery keep
+// their own fields unless they are routed into the same mailbox.
+func (b *Backend) SplitSubaddress(addr string) (username, detail string) {
+	if b.Opts.SubaddressSeparator == "" {
+		return addr, ""
+	}
+
+	localPart, domain := addr, ""
+	if at := strings.LastIndexByte(addr, '@'); at != -1 {
+		localPart, domain = addr[:at], addr[at:]
+	}
+	sep := strings.IndexAny(localPart, b.Opts.SubaddressSeparator)
+	if sep <= 0 {
+		return addr, ""
+	}
+	_, sepLen := utf8.DecodeRuneInString(localPart[sep:])
+	return localPart[:sep] + domain, localPart[sep+sepLen:]
+}
+
+// Subaddressing returns the prefix of mailbox names used for messages sent
+// to the user subaddresses. enabled is false if subaddresses routing is
+// disabled for the user.
+func (u *User) Subaddressing() (prefix string, enabled bool, err error) {
+	if err := u.parent.getSubaddressing.QueryRow(u.id).Scan(&prefix); err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		u.parent.logUserErr(u, err, "Subaddressing")
+		return "", false, wrapErr(err, "Subaddressing")
+	}
+	return prefix, true, nil
+}
+
+// EnableSubaddressing enables routing of messages sent to the user
+// subaddresses. The message sent to user+detail is stored into the mailbox
+// named prefix+detail (e.g. "Lists.detail" for "Lists." prefix or "detail"
+// for empty prefix).
+//
+// The mailbox is not created automatically, messages are stored into the
+// mailbox selected by Delivery (usually INBOX) if it does not exist.
+func (u *User) EnableSubaddressing(prefix string) error {
+	tx, err := u.parent.db.Begin(false)
+	if err != nil {
+		u.parent.logUserErr(u, err, "EnableSubaddressing (tx start)")
+		return wrapErr(err, "EnableSubaddressing")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(u.parent.delSubaddressing).Exec(u.id); err != nil {
+		u.parent.logUserErr(u, err, "EnableSubaddressing (delSubaddressing)")
+		return wrapErr(err, "EnableSubaddressing")
+	}
+	if _, err := tx.Stmt(u.parent.addSubaddressing).Exec(u.id, prefix); err != nil {
+		u.parent.logUserErr(u, err, "EnableSubaddressing (addSubaddressing)")
+		return wrapErr(err, "EnableSubaddressing")
+	}
+
+	return tx.Commit()
+}
+
+// DisableSubaddressing disables routing of messages sent to the user
+// subaddresses, they are handled as if they were sent to the user address.
+func (u *User) DisableSubaddressing() error {
+	if _, err := u.parent.delSubaddressing.Exec(u.id); err != nil {
+		u.parent.logUserErr(u, err, "DisableSubaddressing")
+		return wrapErr(err, "DisableSubaddressing")
+	}
+	return nil
+}
+
+// subaddressMailbox returns the mailbox for the recipient subaddress detail,
+// nil if the subaddress routing is disabled for the user or mailbox does not
+// exist.
+func (d *Delivery) subaddressMailbox(u User, detail string) (*Mailbox, error) {
+	if detail == "" {
+		return nil, nil
+	}
+
+	var prefix string
+	if err := d.b.getSubaddressing.QueryRowContext(d.ctx, u.id).Scan(&prefix); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, wrapErr(err, "Mailbox (getSubaddressing)")
+	}
+
+	_, mboxI, err := u.GetMailboxContext(d.ctx, prefix+detail, true, nil)
+	if err != nil {
+		if err == backend.ErrNoSuchMailbox {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return mboxI.(*Mailbox), nil
+}
@@ -0,0 +1,119 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestSplitSubaddress(t *testing.T) {
+	b := &Backend{Opts: Opts{SubaddressSeparator: "+-"}}
+	for _, c := range []struct {
+		addr, username, detail string
+	}{
+		{"user@example.org", "user@example.org", ""},
+		{"user+lists@example.org", "user@example.org", "lists"},
+		{"user-lists@example.org", "user@example.org", "lists"},
+		{"user+a+b@example.org", "user@example.org", "a+b"},
+		{"user+@example.org", "user@example.org", ""},
+		{"+lists@example.org", "+lists@example.org", ""},
+		{"user+lists", "user", "lists"},
+	} {
+		username, detail := b.SplitSubaddress(c.addr)
+		assert.Equal(t, username, c.username, c.addr)
+		assert.Equal(t, detail, c.detail, c.addr)
+	}
+
+	b.Opts.SubaddressSeparator = ""
+	username, detail := b.SplitSubaddress("user+lists@example.org")
+	assert.Equal(t, username, "user+lists@example.org")
+	assert.Equal(t, detail, "")
+}
+
+func TestDelivery_Subaddress(t *testing.T) {
+	b := initTestBackendOpts(Opts{SubaddressSeparator: "+"}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.CreateUser("user+exact@example.org"))
+	u, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.CreateMailbox("Lists.golang"))
+
+	countMsgs := func(username, mbox string) uint32 {
+		t.Helper()
+		u, err := b.GetUser(username)
+		assert.NilError(t, err)
+		status, err := u.Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		assert.NilError(t, err)
+		return status.Messages
+	}
+	deliver := func(rcpts ...string) Delivery {
+		t.Helper()
+		delivery := b.NewDelivery()
+		for _, rcpt := range rcpts {
+			assert.NilError(t, delivery.AddRcpt(rcpt, textproto.Header{}))
+		}
+		assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+		assert.NilError(t, delivery.Commit())
+		return delivery
+	}
+
+	// Routing is disabled, detail is ignored.
+	delivery := deliver("user+golang@example.org")
+	assert.Equal(t, delivery.Results()[0].Username, "user@example.org")
+	assert.Equal(t, delivery.Results()[0].Detail, "golang")
+	assert.Equal(t, countMsgs("user@example.org", "INBOX"), uint32(1))
+
+	prefix, enabled, err := u.(*User).Subaddressing()
+	assert.NilError(t, err)
+	assert.Assert(t, !enabled)
+	assert.NilError(t, u.(*User).EnableSubaddressing("Lists."))
+	prefix, enabled, err = u.(*User).Subaddressing()
+	assert.NilError(t, err)
+	assert.Assert(t, enabled)
+	assert.Equal(t, prefix, "Lists.")
+
+	// Existing mailbox is used, missing one falls back to INBOX and exact
+	// account match takes precedence.
+	deliver("user+golang@example.org", "user+other@example.org", "user+exact@example.org")
+	assert.Equal(t, countMsgs("user@example.org", "Lists.golang"), uint32(1))
+	assert.Equal(t, countMsgs("user@example.org", "INBOX"), uint32(2))
+	assert.Equal(t, countMsgs("user+exact@example.org", "INBOX"), uint32(1))
+
+	assert.NilError(t, u.(*User).DisableSubaddressing())
+	deliver("user+golang@example.org")
+	assert.Equal(t, countMsgs("user@example.org", "Lists.golang"), uint32(1))
+	assert.Equal(t, countMsgs("user@example.org", "INBOX"), uint32(3))
+}
+
+func TestDelivery_SubaddressHeaders(t *testing.T) {
+	b := initTestBackendOpts(Opts{SubaddressSeparator: "+"}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	u, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.(*User).EnableSubaddressing("Lists."))
+	assert.NilError(t, u.CreateMailbox("Lists.a"))
+	assert.NilError(t, u.CreateMailbox("Lists.b"))
+
+	delivery := b.NewDelivery()
+	for _, rcpt := range []string{
+		"user+a@example.org", "user+b@example.org",
+		"user+c@example.org", "user+d@example.org",
+	} {
+		_, detail := b.SplitSubaddress(rcpt)
+		hdr := textproto.Header{}
+		hdr.Add("X-Detail", detail)
+		assert.NilError(t, delivery.AddRcpt(rcpt, hdr))
+	}
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	assert.DeepEqual(t, headerValues(t, b, "user@example.org", "Lists.a", "X-Detail"), []string{"a"})
+	assert.DeepEqual(t, headerValues(t, b, "user@example.org", "Lists.b", "X-Detail"), []string{"b"})
+	// Both fall back to INBOX and get a single copy.
+	assert.DeepEqual(t, headerValues(t, b, "user@example.org", "INBOX", "X-Detail"), []string{"c"})
+}
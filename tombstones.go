@@ -0,0 +1,620 @@
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// If Opts.DeletedRetention is set, expunged messages and deleted mailboxes
+// are moved to the deletedMsgs and deletedMboxes tables instead of being
+// removed. Rows there keep their references to extKeys, so blobs stay in
+// ExternalStore until the rows are purged by PurgeDeleted.
+//
+// deletedMsgs rows use mboxId and msgId of the removed message. Since
+// mailbox IDs are never reused, mboxId identifies the mailbox the message
+// was expunged from, even if that mailbox was deleted later.
+
+// DeletedMailbox is a mailbox kept after deletion because of
+// Opts.DeletedRetention.
+type DeletedMailbox struct {
+	Name      string
+	DeletedAt time.Time
+
+	// Amount of messages that will be restored with the mailbox.
+	Messages int
+}
+
+const msgsTombstoneCols = `date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo,
+	sentDate, sortSubject, sortFrom, sortTo, sortCc, sortDisplayFrom, sortDisplayTo`
+
+func (b *Backend) initTombstones() error {
+	_, err := b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS deletedMboxes (
+			id BIGINT NOT NULL PRIMARY KEY,
+			uid BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			specialuse VARCHAR(255) DEFAULT NULL,
+			deletedAt BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table deletedMboxes")
+	}
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS deletedMsgs (
+			mboxId BIGINT NOT NULL,
+			msgId BIGINT NOT NULL,
+			uid BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			deletedAt BIGINT NOT NULL,
+
+			date BIGINT NOT NULL,
+			bodyLen INTEGER NOT NULL,
+			bodyStructure LONGTEXT NOT NULL,
+			cachedHeader LONGTEXT NOT NULL,
+			extBodyKey VARCHAR(255) DEFAULT NULL,
+			seen INTEGER NOT NULL DEFAULT 0,
+			compressAlgo VARCHAR(255),
+
+			sentDate BIGINT NOT NULL DEFAULT 0,
+			sortSubject ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortFrom ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortTo ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortCc ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortDisplayFrom ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+			sortDisplayTo ` + b.db.binaryString(maxSortKeyLen) + ` NOT NULL DEFAULT '',
+
+			PRIMARY KEY(mboxId, msgId)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table deletedMsgs")
+	}
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS deletedFlags (
+			mboxId BIGINT NOT NULL,
+			msgId BIGINT NOT NULL,
+			flag VARCHAR(255) NOT NULL,
+
+			FOREIGN KEY (mboxId, msgId) REFERENCES deletedMsgs(mboxId, msgId) ON DELETE CASCADE,
+			UNIQUE (mboxId, msgId, flag)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table deletedFlags")
+	}
+	return nil
+}
+
+func (b *Backend) prepareTombstonesStmts() error {
+	var err error
+	b.tombstoneExpunged, err = b.db.Prepare(`
+		INSERT INTO deletedMsgs(mboxId, msgId, uid, deletedAt, ` + msgsTombstoneCols + `)
+		SELECT mboxId, msgId, ?, ?, ` + msgsTombstoneCols + `
+		FROM msgs
+		WHERE mboxId = ? AND msgId IN (
+			SELECT msgId
+			FROM flags
+			WHERE mboxId = ?
+			AND flag = '\Deleted'
+		)`)
+	if err != nil {
+		return wrapErr(err, "tombstoneExpunged prep")
+	}
+	b.tombstoneExpungedFlags, err = b.db.Prepare(`
+		INSERT INTO deletedFlags(mboxId, msgId, flag)
+		SELECT mboxId, msgId, flag
+		FROM flags
+		WHERE mboxId = ?
+		AND flag <> '\Deleted'
+		AND msgId IN (
+			SELECT msgId
+			FROM flags
+			WHERE mboxId = ?
+			AND flag = '\Deleted'
+		)`)
+	if err != nil {
+		return wrapErr(err, "tombstoneExpungedFlags prep")
+	}
+	b.tombstoneMarked, err = b.db.Prepare(`
+		INSERT INTO deletedMsgs(mboxId, msgId, uid, deletedAt, ` + msgsTombstoneCols + `)
+		SELECT mboxId, msgId, ?, ?, ` + msgsTombstoneCols + `
+		FROM msgs
+		WHERE mboxId = ? AND mark = 1`)
+	if err != nil {
+		return wrapErr(err, "tombstoneMarked prep")
+	}
+	b.tombstoneMarkedFlags, err = b.db.Prepare(`
+		INSERT INTO deletedFlags(mboxId, msgId, flag)
+		SELECT mboxId, msgId, flag
+		FROM flags
+		WHERE mboxId = ?
+		AND msgId IN (
+			SELECT msgId
+			FROM msgs
+			WHERE mboxId = ? AND mark = 1
+		)`)
+	if err != nil {
+		return wrapErr(err, "tombstoneMarkedFlags prep")
+	}
+	b.tombstoneMbox, err = b.db.Prepare(`
+		INSERT INTO deletedMboxes(id, uid, name, specialuse, deletedAt)
+		SELECT id, uid, name, specialuse, ?
+		FROM mboxes
+		WHERE uid = ? AND name = ?`)
+	if err != nil {
+		return wrapErr(err, "tombstoneMbox prep")
+	}
+	b.tombstoneMboxMsgs, err = b.db.Prepare(`
+		INSERT INTO deletedMsgs(mboxId, msgId, uid, deletedAt, ` + msgsTombstoneCols + `)
+		SELECT mboxId, msgId, ?, ?, ` + msgsTombstoneCols + `
+		FROM msgs
+		WHERE mboxId = (SELECT id FROM mboxes WHERE uid = ? AND name = ?)`)
+	if err != nil {
+		return wrapErr(err, "tombstoneMboxMsgs prep")
+	}
+	b.tombstoneMboxFlags, err = b.db.Prepare(`
+		INSERT INTO deletedFlags(mboxId, msgId, flag)
+		SELECT mboxId, msgId, flag
+		FROM flags
+		WHERE mboxId = (SELECT id FROM mboxes WHERE uid = ? AND name = ?)`)
+	if err != nil {
+		return wrapErr(err, "tombstoneMboxFlags prep")
+	}
+	b.restoreMsgs, err = b.db.Prepare(`
+		INSERT INTO msgs(mboxId, msgId, recent, ` + msgsTombstoneCols + `)
+		SELECT ? AS mboxId, (
+			SELECT uidnext - 1
+			FROM mboxes
+			WHERE id = ?
+		) + row_number() OVER (ORDER BY msgId), 0, ` + msgsTombstoneCols + `
+		FROM deletedMsgs
+		WHERE mboxId = ? AND deletedAt >= ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "restoreMsgs prep")
+	}
+	b.restoreFlags, err = b.db.Prepare(`
+		INSERT INTO flags
+		SELECT ?, new_msgId AS msgId, flag
+		FROM deletedFlags
+		INNER JOIN (
+			SELECT (
+				SELECT uidnext - 1
+				FROM mboxes
+				WHERE id = ?
+			) + row_number() OVER (ORDER BY msgId) AS new_msgId, msgId, mboxId
+			FROM deletedMsgs
+			WHERE mboxId = ? AND deletedAt >= ?
+			ORDER BY msgId
+		) map ON map.msgId = deletedFlags.msgId
+		AND map.mboxId = deletedFlags.mboxId`)
+	if err != nil {
+		return wrapErr(err, "restoreFlags prep")
+	}
+	b.delRestoredMsgs, err = b.db.Prepare(`
+		DELETE FROM deletedMsgs
+		WHERE mboxId = ? AND deletedAt >= ?`)
+	if err != nil {
+		return wrapErr(err, "delRestoredMsgs prep")
+	}
+	b.deletedMsgsCount, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM deletedMsgs
+		WHERE mboxId = ?`)
+	if err != nil {
+		return wrapErr(err, "deletedMsgsCount prep")
+	}
+	b.getDeletedMbox, err = b.db.Prepare(`
+		SELECT id, specialuse
+		FROM deletedMboxes
+		WHERE uid = ? AND name = ?
+		ORDER BY deletedAt DESC, id DESC`)
+	if err != nil {
+		return wrapErr(err, "getDeletedMbox prep")
+	}
+	b.delDeletedMbox, err = b.db.Prepare(`
+		DELETE FROM deletedMboxes
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "delDeletedMbox prep")
+	}
+	b.listDeletedMboxes, err = b.db.Prepare(`
+		SELECT name, deletedAt, (
+			SELECT count(*)
+			FROM deletedMsgs
+			WHERE deletedMsgs.mboxId = deletedMboxes.id
+		)
+		FROM deletedMboxes
+		WHERE uid = ?
+		ORDER BY name, deletedAt`)
+	if err != nil {
+		return wrapErr(err, "listDeletedMboxes prep")
+	}
+	b.purgeDecreaseRef, err = b.db.Prepare(`
+		UPDATE extKeys
+		SET refs = refs - (
+			SELECT count(*)
+			FROM deletedMsgs
+			WHERE extBodyKey = extKeys.id
+			AND deletedAt < ?
+			AND uid NOT IN (SELECT userId FROM legalHolds)
+		)
+		WHERE id IN (
+			SELECT extBodyKey
+			FROM deletedMsgs
+			WHERE deletedAt < ?
+			AND uid NOT IN (SELECT userId FROM legalHolds)
+		)`)
+	if err != nil {
+		return wrapErr(err, "purgeDecreaseRef prep")
+	}
+	b.purgeZeroRef, err = b.db.Prepare(`
+		SELECT id
+		FROM extKeys
+		WHERE refs = 0
+		AND id IN (
+			SELECT extBodyKey
+			FROM deletedMsgs
+			WHERE deletedAt < ?
+			AND uid NOT IN (SELECT userId FROM legalHolds)
+		)`)
+	if err != nil {
+		return wrapErr(err, "purgeZeroRef prep")
+	}
+	b.purgeDeleteZeroRef, err = b.db.Prepare(`
+		DELETE FROM extKeys
+		WHERE refs = 0
+		AND id IN (
+			SELECT extBodyKey
+			FROM deletedMsgs
+			WHERE deletedAt < ?
+			AND uid NOT IN (SELECT userId FROM legalHolds)
+		)`)
+	if err != nil {
+		return wrapErr(err, "purgeDeleteZeroRef prep")
+	}
+	b.purgeMsgs, err = b.db.Prepare(`
+		DELETE FROM deletedMsgs
+		WHERE deletedAt < ?
+		AND uid NOT IN (SELECT userId FROM legalHolds)`)
+	if err != nil {
+		return wrapErr(err, "purgeMsgs prep")
+	}
+	b.purgeMboxes, err = b.db.Prepare(`
+		DELETE FROM deletedMboxes
+		WHERE deletedAt < ?
+		AND uid NOT IN (SELECT userId FROM legalHolds)`)
+	if err != nil {
+		return wrapErr(err, "purgeMboxes prep")
+	}
+	return nil
+}
+
+// tombstoneExpunged moves messages with \Deleted flag to deletedMsgs. It
+// should be called instead of expungeExternal since references to blobs are
+// kept.
+func (m *Mailbox) tombstoneExpunged(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.Stmt(m.parent.tombstoneExpunged).ExecContext(ctx, m.user.id, time.Now().Unix(), m.id, m.id); err != nil {
+		return wrapErr(err, "Expunge (tombstone)")
+	}
+	if _, err := tx.Stmt(m.parent.tombstoneExpungedFlags).ExecContext(ctx, m.id, m.id); err != nil {
+		return wrapErr(err, "Expunge (tombstone flags)")
+	}
+	return nil
+}
+
+// tombstoneMarked is a variant of tombstoneExpunged for messages marked by
+// delMessages.
+func (m *Mailbox) tombstoneMarked(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.Stmt(m.parent.tombstoneMarked).ExecContext(ctx, m.user.id, time.Now().Unix(), m.id); err != nil {
+		return err
+	}
+	_, err := tx.Stmt(m.parent.tombstoneMarkedFlags).ExecContext(ctx, m.id, m.id)
+	return err
+}
+
+// tombstoneMbox copies the mailbox and its messages to the deletedMboxes and
+// deletedMsgs tables. It should be called instead of the extKeys cleanup
+// since references to blobs are kept.
+func (u *User) tombstoneMbox(ctx context.Context, tx *sql.Tx, name string) error {
+	now := time.Now().Unix()
+	if _, err := tx.Stmt(u.parent.tombstoneMbox).ExecContext(ctx, now, u.id, name); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(u.parent.tombstoneMboxMsgs).ExecContext(ctx, u.id, now, u.id, name); err != nil {
+		return err
+	}
+	_, err := tx.Stmt(u.parent.tombstoneMboxFlags).ExecContext(ctx, u.id, name)
+	return err
+}
+
+// restoreMsgs moves messages removed from the mailbox srcId at or after
+// the since timestamp to the end of the mailbox destId.
+func (u *User) restoreMsgs(tx *sql.Tx, srcId, destId uint64, since int64) (firstUid, lastUid uint32, err error) {
+	var uidNext uint32
+	if err := tx.Stmt(u.parent.uidNext).QueryRow(destId).Scan(&uidNext); err != nil {
+		return 0, 0, err
+	}
+
+	stats, err := tx.Stmt(u.parent.restoreMsgs).Exec(destId, destId, srcId, since)
+	if err != nil {
+		return 0, 0, err
+	}
+	restored, err := stats.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	if restored == 0 {
+		return 0, 0, nil
+	}
+	if _, err := tx.Stmt(u.parent.restoreFlags).Exec(destId, destId, srcId, since); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Stmt(u.parent.delRestoredMsgs).Exec(srcId, since); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Stmt(u.parent.increaseMsgCount).Exec(restored, restored, destId); err != nil {
+		return 0, 0, err
+	}
+	if err := u.parent.logIndex(context.Background(), tx, u.parent.logIndexAddUid, destId, uidNext, uidNext+uint32(restored)-1); err != nil {
+		return 0, 0, err
+	}
+	return uidNext, uidNext + uint32(restored) - 1, nil
+}
+
+// DeletedMessages returns the amount of messages expunged from the mailbox
+// that can be restored using RestoreMessages.
+func (u *User) DeletedMessages(mbox string) (int, error) {
+	var mboxId uint64
+	if err := u.parent.mboxId.QueryRow(u.id, mbox).Scan(&mboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		u.parent.logUserErr(u, err, "DeletedMessages (mboxId)", mbox)
+		return 0, wrapErrf(err, "DeletedMessages %s", mbox)
+	}
+
+	var count int
+	if err := u.parent.deletedMsgsCount.QueryRow(mboxId).Scan(&count); err != nil {
+		u.parent.logUserErr(u, err, "DeletedMessages", mbox)
+		return 0, wrapErrf(err, "DeletedMessages %s", mbox)
+	}
+	return count, nil
+}
+
+// RestoreMessages moves messages expunged from the mailbox at or after since
+// back to it. Restored messages get new UIDs. The amount of restored
+// messages is returned.
+//
+// Only messages expunged while Opts.DeletedRetention was set and not purged
+// yet can be restored.
+func (u *User) RestoreMessages(mbox string, since time.Time) (int, error) {
+	if err := u.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	tx, err := u.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
+	if err != nil {
+		u.parent.logUserErr(u, err, "RestoreMessages (tx start)", mbox)
+		return 0, wrapErrf(err, "RestoreMessages %s", mbox)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var mboxId uint64
+	if err := tx.Stmt(u.parent.mboxId).QueryRow(u.id, mbox).Scan(&mboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		u.parent.logUserErr(u, err, "RestoreMessages (mboxId)", mbox)
+		return 0, wrapErrf(err, "RestoreMessages %s", mbox)
+	}
+
+	firstUid, lastUid, err := u.restoreMsgs(tx, mboxId, mboxId, since.Unix())
+	if err != nil {
+		u.parent.logUserErr(u, err, "RestoreMessages", mbox)
+		return 0, wrapErrf(err, "RestoreMessages %s", mbox)
+	}
+	if firstUid == 0 {
+		return 0, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		u.parent.logUserErr(u, err, "RestoreMessages (tx commit)", mbox)
+		return 0, wrapErrf(err, "RestoreMessages %s", mbox)
+	}
+	u.parent.searchIndexChanged()
+
+	u.parent.mngr.NewMessages(mboxId, imap.SeqSet{Set: []imap.Seq{{Start: firstUid, Stop: lastUid}}})
+
+	return int(lastUid - firstUid + 1), nil
+}
+
+// RestoreMailbox recreates the deleted mailbox with all messages it
+// contained, including ones expunged before the mailbox was deleted. If the
+// mailbox was deleted several times, the latest version is restored. If
+// newName is not empty, the mailbox is restored under that name.
+//
+// Only mailboxes deleted while Opts.DeletedRetention was set and not purged
+// yet can be restored. backend.ErrNoSuchMailbox is returned if there is no
+// such mailbox.
+func (u *User) RestoreMailbox(name, newName string) error {
+	if err := u.checkWritable(); err != nil {
+		return err
+	}
+	if newName == "" {
+		newName = name
+	}
+
+	tx, err := u.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
+	if err != nil {
+		u.parent.logUserErr(u, err, "RestoreMailbox (tx start)", name)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var (
+		oldId      uint64
+		specialUse sql.NullString
+	)
+	if err := tx.Stmt(u.parent.getDeletedMbox).QueryRow(u.id, name).Scan(&oldId, &specialUse); err != nil {
+		if err == sql.ErrNoRows {
+			return backend.ErrNoSuchMailbox
+		}
+		u.parent.logUserErr(u, err, "RestoreMailbox (getDeletedMbox)", name)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+
+	if err := u.createParentDirs(context.Background(), tx, newName); err != nil {
+		u.parent.logUserErr(u, err, "RestoreMailbox (parents)", name, newName)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+	if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, newName, u.parent.prng.Uint32(), specialUse); err != nil {
+		if isForeignKeyErr(err) {
+			return backend.ErrMailboxAlreadyExists
+		}
+		u.parent.logUserErr(u, err, "RestoreMailbox (createMbox)", name, newName)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+	var newId uint64
+	if err := tx.Stmt(u.parent.mboxId).QueryRow(u.id, newName).Scan(&newId); err != nil {
+		u.parent.logUserErr(u, err, "RestoreMailbox (mboxId)", name, newName)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+
+	if _, _, err := u.restoreMsgs(tx, oldId, newId, 0); err != nil {
+		u.parent.logUserErr(u, err, "RestoreMailbox (restoreMsgs)", name, newName)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+	if _, err := tx.Stmt(u.parent.delDeletedMbox).Exec(oldId); err != nil {
+		u.parent.logUserErr(u, err, "RestoreMailbox (delDeletedMbox)", name, newName)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		u.parent.logUserErr(u, err, "RestoreMailbox (tx commit)", name, newName)
+		return wrapErrf(err, "RestoreMailbox %s", name)
+	}
+	u.parent.searchIndexChanged()
+	return nil
+}
+
+// ListDeletedMailboxes returns mailboxes that can be restored using
+// RestoreMailbox.
+func (u *User) ListDeletedMailboxes() ([]DeletedMailbox, error) {
+	rows, err := u.parent.listDeletedMboxes.Query(u.id)
+	if err != nil {
+		u.parent.logUserErr(u, err, "ListDeletedMailboxes")
+		return nil, wrapErr(err, "ListDeletedMailboxes")
+	}
+	defer rows.Close()
+
+	var res []DeletedMailbox
+	for rows.Next() {
+		var (
+			mbox      DeletedMailbox
+			deletedAt int64
+		)
+		if err := rows.Scan(&mbox.Name, &deletedAt, &mbox.Messages); err != nil {
+			u.parent.logUserErr(u, err, "ListDeletedMailboxes (scan)")
+			return nil, wrapErr(err, "ListDeletedMailboxes")
+		}
+		mbox.DeletedAt = time.Unix(deletedAt, 0)
+		res = append(res, mbox)
+	}
+	if err := rows.Err(); err != nil {
+		u.parent.logUserErr(u, err, "ListDeletedMailboxes")
+		return nil, wrapErr(err, "ListDeletedMailboxes")
+	}
+	return res, nil
+}
+
+// PurgeDeleted permanently removes messages and mailboxes deleted before the
+// specified time. The amount of removed messages is returned. Messages and
+// mailboxes of accounts on legal hold are not removed.
+//
+// Unless Opts.PurgeInterval is negative, it is called periodically to remove
+// messages and mailboxes kept longer than Opts.DeletedRetention.
+func (b *Backend) PurgeDeleted(before time.Time) (int, error) {
+	cutoff := before.Unix()
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (tx start)")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Stmt(b.purgeDecreaseRef).Exec(cutoff, cutoff); err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (decrease ref)")
+	}
+
+	rows, err := tx.Stmt(b.purgeZeroRef).Query(cutoff)
+	if err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (zero ref)")
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return 0, wrapErr(err, "PurgeDeleted (zero ref scan)")
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (zero ref)")
+	}
+	rows.Close()
+
+	if _, err := tx.Stmt(b.purgeDeleteZeroRef).Exec(cutoff); err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (delete zero ref)")
+	}
+	if err := b.queueBlobDeletion(context.Background(), tx, keys); err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (queue deletion)")
+	}
+
+	stats, err := tx.Stmt(b.purgeMsgs).Exec(cutoff)
+	if err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (msgs)")
+	}
+	purged, err := stats.RowsAffected()
+	if err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (msgs)")
+	}
+	if _, err := tx.Stmt(b.purgeMboxes).Exec(cutoff); err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (mboxes)")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, wrapErr(err, "PurgeDeleted (tx commit)")
+	}
+	b.deleteQueuedBlobs(keys)
+
+	return int(purged), nil
+}
+
+func (b *Backend) purgeExpired() {
+	if b.Opts.DeletedRetention <= 0 {
+		return
+	}
+	if _, err := b.PurgeDeleted(time.Now().Add(-b.Opts.DeletedRetention)); err != nil {
+		b.Opts.Log.Printf("%v", err)
+	}
+}
+
+func (b *Backend) purgeLoop() {
+	interval := b.Opts.PurgeInterval
+	if interval == 0 {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.purgeExpired()
+		case <-b.purgeLoopStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestRestoreMessages(t *testing.T) {
+	b := initTestBackendOpts(Opts{DeletedRetention: time.Hour, PurgeInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	u := usr.(*User)
+
+	assert.NilError(t, u.CreateMessage("INBOX", []string{imap.SeenFlag, imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	_, mbox, err := u.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	assert.NilError(t, mbox.Expunge())
+
+	// Blobs are kept until restored messages are purged.
+	assert.Assert(t, checkKeysCount(b, 3))
+	count, err := u.DeletedMessages("INBOX")
+	assert.NilError(t, err)
+	assert.Equal(t, count, 2)
+
+	restored, err := u.RestoreMessages("INBOX", time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, restored, 2)
+	count, err = u.DeletedMessages("INBOX")
+	assert.NilError(t, err)
+	assert.Equal(t, count, 0)
+	assert.NilError(t, mbox.Poll(true))
+
+	seq, _ := imap.ParseSeqSet("4:5")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch))
+	assert.Assert(t, is.Len(ch, 2))
+	msg := <-ch
+	assert.Equal(t, msg.Uid, uint32(4))
+	assert.Assert(t, is.Contains(msg.Flags, imap.SeenFlag))
+	assert.Assert(t, !isFlagSet(msg.Flags, imap.DeletedFlag))
+	msg = <-ch
+	assert.Equal(t, msg.Uid, uint32(5))
+	assert.Assert(t, !isFlagSet(msg.Flags, imap.DeletedFlag))
+}
+
+func TestDelMessagesRetention(t *testing.T) {
+	b := initTestBackendOpts(Opts{DeletedRetention: time.Hour, PurgeInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	u := usr.(*User)
+
+	assert.NilError(t, u.CreateMessage("INBOX", []string{imap.FlaggedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	_, mbox, err := u.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, mbox.(*Mailbox).DelMessages(true, seq))
+
+	assert.Assert(t, checkKeysCount(b, 2))
+	count, err := u.DeletedMessages("INBOX")
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+
+	restored, err := u.RestoreMessages("INBOX", time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, restored, 1)
+	assert.NilError(t, mbox.Poll(true))
+
+	seq, _ = imap.ParseSeqSet("3")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch))
+	assert.Assert(t, is.Len(ch, 1))
+	msg := <-ch
+	assert.Assert(t, is.Contains(msg.Flags, imap.FlaggedFlag))
+}
+
+func TestRestoreMailbox(t *testing.T) {
+	b := initTestBackendOpts(Opts{DeletedRetention: time.Hour, PurgeInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	u := usr.(*User)
+
+	assert.NilError(t, u.CreateMailbox("Box"))
+	assert.NilError(t, u.CreateMessage("Box", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("Box", []string{imap.FlaggedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+
+	// Messages expunged earlier are restored with the mailbox.
+	_, mbox, err := u.GetMailbox("Box", false, &noopConn{})
+	assert.NilError(t, err)
+	assert.NilError(t, mbox.Expunge())
+	assert.NilError(t, mbox.Close())
+	assert.NilError(t, u.DeleteMailbox("Box"))
+	assert.Assert(t, checkKeysCount(b, 2))
+
+	deleted, err := u.ListDeletedMailboxes()
+	assert.NilError(t, err)
+	assert.Equal(t, len(deleted), 1)
+	assert.Equal(t, deleted[0].Name, "Box")
+	assert.Equal(t, deleted[0].Messages, 2)
+
+	assert.NilError(t, u.CreateMailbox("Box"))
+	assert.Equal(t, u.RestoreMailbox("Box", ""), backend.ErrMailboxAlreadyExists)
+	assert.Equal(t, u.RestoreMailbox("Other", ""), backend.ErrNoSuchMailbox)
+	assert.NilError(t, u.RestoreMailbox("Box", "Old/Box"))
+
+	status, err := u.Status("Old/Box", []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(2))
+	assert.Equal(t, status.UidNext, uint32(3))
+	deleted, err = u.ListDeletedMailboxes()
+	assert.NilError(t, err)
+	assert.Equal(t, len(deleted), 0)
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	b := initTestBackendOpts(Opts{DeletedRetention: time.Hour, PurgeInterval: -1}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	u := usr.(*User)
+
+	assert.NilError(t, u.CreateMailbox("Box"))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, u.CreateMessage("Box", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	_, mbox, err := u.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	assert.NilError(t, mbox.CopyMessages(false, &imap.SeqSet{Set: []imap.Seq{{Start: 1, Stop: 1}}}, "Box"))
+	assert.NilError(t, mbox.Expunge())
+	assert.NilError(t, u.DeleteMailbox("Box"))
+
+	purged, err := b.PurgeDeleted(time.Now().Add(-time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, purged, 0)
+	assert.Assert(t, checkKeysCount(b, 2))
+
+	purged, err = b.PurgeDeleted(time.Now().Add(time.Second))
+	assert.NilError(t, err)
+	assert.Equal(t, purged, 3)
+	assert.Assert(t, checkKeysCount(b, 0))
+
+	deleted, err := u.ListDeletedMailboxes()
+	assert.NilError(t, err)
+	assert.Equal(t, len(deleted), 0)
+	restored, err := u.RestoreMessages("INBOX", time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, restored, 0)
+}
+
+func isFlagSet(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
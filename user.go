@@ -1,6 +1,7 @@
 package imapsql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"strings"
@@ -18,10 +19,13 @@ type User struct {
 	username string
 	inboxId  uint64
 	parent   *Backend
+	status   AccountStatus
 }
 
+// Username returns the current name of the account. It reflects
+// RenameUser calls made after the User object was created.
 func (u *User) Username() string {
-	return u.username
+	return u.parent.currentUsername(u.id, u.username)
 }
 
 func (u *User) ID() uint64 {
@@ -29,14 +33,20 @@ func (u *User) ID() uint64 {
 }
 
 func (u *User) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
+	return u.ListMailboxesContext(context.Background(), subscribed)
+}
+
+// ListMailboxesContext is a variant of ListMailboxes that aborts database
+// queries once ctx is cancelled.
+func (u *User) ListMailboxesContext(ctx context.Context, subscribed bool) ([]imap.MailboxInfo, error) {
 	var (
 		rows *sql.Rows
 		err  error
 	)
 	if subscribed {
-		rows, err = u.parent.listSubbedMboxes.Query(u.id)
+		rows, err = u.parent.listSubbedMboxes.QueryContext(ctx, u.id)
 	} else {
-		rows, err = u.parent.listMboxes.Query(u.id)
+		rows, err = u.parent.listMboxes.QueryContext(ctx, u.id)
 	}
 	if err != nil {
 		u.parent.logUserErr(u, err, "ListMailboxes", subscribed)
@@ -65,7 +75,7 @@ func (u *User) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
 	}
 
 	for i, info := range res {
-		row := u.parent.getMboxAttrs.QueryRow(u.id, info.Name)
+		row := u.parent.getMboxAttrs.QueryRowContext(ctx, u.id, info.Name)
 		var mark int
 		var specialUse sql.NullString
 		if err := row.Scan(&mark, &specialUse); err != nil {
@@ -79,7 +89,7 @@ func (u *User) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
 			info.Attributes = []string{specialUse.String}
 		}
 
-		row = u.parent.hasChildren.QueryRow(info.Name+MailboxPathSep+"%", u.id)
+		row = u.parent.hasChildren.QueryRowContext(ctx, info.Name+MailboxPathSep+"%", u.id)
 		childrenCount := 0
 		if err := row.Scan(&childrenCount); err != nil {
 			u.parent.logUserErr(u, err, "ListMailboxes (children count)")
@@ -98,12 +108,18 @@ func (u *User) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
 }
 
 func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	return u.GetMailboxContext(context.Background(), name, readOnly, conn)
+}
+
+// GetMailboxContext is a variant of GetMailbox that aborts database queries
+// once ctx is cancelled.
+func (u *User) GetMailboxContext(ctx context.Context, name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
 	var mbox *Mailbox
 
 	if strings.EqualFold(name, "INBOX") {
 		mbox = &Mailbox{user: *u, id: u.inboxId, name: name, parent: u.parent}
 	} else {
-		row := u.parent.mboxId.QueryRow(u.id, name)
+		row := u.parent.mboxId.QueryRowContext(ctx, u.id, name)
 		id := uint64(0)
 		if err := row.Scan(&id); err != nil {
 			if err == sql.ErrNoRows {
@@ -114,10 +130,11 @@ func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.
 		}
 		mbox = &Mailbox{user: *u, id: id, name: name, parent: u.parent}
 	}
-	mbox.readOnly = readOnly
+	// All mailboxes of read-only accounts are read-only.
+	mbox.readOnly = readOnly || u.status == StatusReadOnly
 
 	if conn == nil {
-		uids, recent, err := mbox.readUids()
+		uids, recent, err := mbox.readUids(ctx)
 		if err != nil {
 			u.parent.logUserErr(u, err, "GetMailbox", name)
 			return nil, nil, wrapErrf(err, "GetMailbox %s", name)
@@ -128,11 +145,12 @@ func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.
 	}
 
 	mbox.conn = conn
-	uids, recent, status, err := mbox.initSelected(!readOnly)
+	uids, recent, status, err := mbox.initSelected(ctx, !mbox.readOnly)
 	if err != nil {
 		u.parent.logUserErr(u, err, "GetMailbox", name)
 		return nil, nil, wrapErrf(err, "GetMailbox %s", name)
 	}
+	status.ReadOnly = mbox.readOnly
 
 	handle, err := u.parent.mngr.Mailbox(mbox.id, mbox, uids, recent)
 	if err != nil {
@@ -166,19 +184,28 @@ func (u *User) SetMessageLimit(val *uint32) error {
 }
 
 func (u *User) CreateMailbox(name string) error {
-	tx, err := u.parent.db.Begin(false)
+	return u.CreateMailboxContext(context.Background(), name)
+}
+
+// CreateMailboxContext is a variant of CreateMailbox that aborts the
+// transaction once ctx is cancelled.
+func (u *User) CreateMailboxContext(ctx context.Context, name string) error {
+	if err := u.checkWritable(); err != nil {
+		return err
+	}
+	tx, err := u.parent.db.BeginContext(ctx, false)
 	if err != nil {
 		u.parent.logUserErr(u, err, "CreateMailbox (tx start)", name)
 		return wrapErrf(err, "CreateMailbox %s", name)
 	}
 	defer tx.Rollback() //nolint:errcheck
 
-	if err := u.createParentDirs(tx, name); err != nil {
+	if err := u.createParentDirs(ctx, tx, name); err != nil {
 		u.parent.logUserErr(u, err, "CreateMailbox (parents)", name)
 		return wrapErrf(err, "CreateMailbox (parents) %s", name)
 	}
 
-	if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, name, u.parent.prng.Uint32(), nil); err != nil {
+	if _, err := tx.Stmt(u.parent.createMbox).ExecContext(ctx, u.id, name, u.parent.prng.Uint32(), nil); err != nil {
 		if isForeignKeyErr(err) {
 			return backend.ErrMailboxAlreadyExists
 		}
@@ -195,6 +222,12 @@ var ErrUnsupportedSpecialAttr = errors.New("imap: special attribute is not suppo
 
 // CreateMailboxSpecial creates a mailbox with SPECIAL-USE attribute set.
 func (u *User) CreateMailboxSpecial(name, specialUseAttr string) error {
+	return u.CreateMailboxSpecialContext(context.Background(), name, specialUseAttr)
+}
+
+// CreateMailboxSpecialContext is a variant of CreateMailboxSpecial that
+// aborts the transaction once ctx is cancelled.
+func (u *User) CreateMailboxSpecialContext(ctx context.Context, name, specialUseAttr string) error {
 	switch specialUseAttr {
 	case imap.AllAttr, imap.FlaggedAttr:
 		return ErrUnsupportedSpecialAttr
@@ -202,18 +235,21 @@ func (u *User) CreateMailboxSpecial(name, specialUseAttr string) error {
 	default:
 		return ErrUnsupportedSpecialAttr
 	}
+	if err := u.checkWritable(); err != nil {
+		return err
+	}
 
-	tx, err := u.parent.db.Begin(false)
+	tx, err := u.parent.db.BeginContext(ctx, false)
 	if err != nil {
 		return wrapErrf(err, "CreateMailboxSpecial %s", name)
 	}
 	defer tx.Rollback() //nolint:errcheck
 
-	if err := u.createParentDirs(tx, name); err != nil {
+	if err := u.createParentDirs(ctx, tx, name); err != nil {
 		return wrapErrf(err, "CreateMailboxSpecial (parents) %s", name)
 	}
 
-	if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, name, u.parent.prng.Uint32(), specialUseAttr); err != nil {
+	if _, err := tx.Stmt(u.parent.createMbox).ExecContext(ctx, u.id, name, u.parent.prng.Uint32(), specialUseAttr); err != nil {
 		if isForeignKeyErr(err) {
 			return backend.ErrMailboxAlreadyExists
 		}
@@ -224,47 +260,58 @@ func (u *User) CreateMailboxSpecial(name, specialUseAttr string) error {
 }
 
 func (u *User) DeleteMailbox(name string) error {
+	return u.DeleteMailboxContext(context.Background(), name)
+}
+
+// DeleteMailboxContext is a variant of DeleteMailbox that aborts the
+// transaction once ctx is cancelled.
+func (u *User) DeleteMailboxContext(ctx context.Context, name string) error {
+	if err := u.checkWritable(); err != nil {
+		return err
+	}
 	if strings.ToLower(name) == "inbox" {
 		return errors.New("DeleteMailbox: can't delete INBOX")
 	}
 
-	tx, err := u.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
+	tx, err := u.parent.db.BeginLevelContext(ctx, sql.LevelRepeatableRead, false)
 	if err != nil {
 		u.parent.logUserErr(u, err, "DeleteMailbox (tx start)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.Stmt(u.parent.decreaseRefForMbox).Exec(u.id, name); err != nil {
-		u.parent.logUserErr(u, err, "DeleteMailbox (decrease ref)", name)
-		return wrapErrf(err, "DeleteMailbox %s", name)
-	}
-
-	rows, err := tx.Stmt(u.parent.zeroRefUser).Query(u.id)
+	keepDeleted, err := u.parent.keepDeleted(ctx, tx, u.id)
 	if err != nil {
-		u.parent.logUserErr(u, err, "DeleteMailbox (zero ref user)", name)
+		u.parent.logUserErr(u, err, "DeleteMailbox (keepDeleted)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
-	defer rows.Close()
 
-	keys := make([]string, 0, 16)
-	for rows.Next() {
-		var extKey string
-		if err := rows.Scan(&extKey); err != nil {
-			u.parent.logUserErr(u, err, "DeleteMailbox (extkeys scan)", name)
+	var keys []string
+	if keepDeleted {
+		if err := u.tombstoneMbox(ctx, tx, name); err != nil {
+			u.parent.logUserErr(u, err, "DeleteMailbox (tombstone)", name)
 			return wrapErrf(err, "DeleteMailbox %s", name)
 		}
-		keys = append(keys, extKey)
+	} else {
+		keys, err = u.deleteMboxExternal(ctx, tx, name)
+		if err != nil {
+			u.parent.logUserErr(u, err, "DeleteMailbox (external)", name)
+			return wrapErrf(err, "DeleteMailbox %s", name)
+		}
+	}
 
+	if err := u.parent.queueBlobDeletion(ctx, tx, keys); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (queue deletion)", name)
+		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 
-	if err := u.parent.extStore.Delete(keys); err != nil {
-		u.parent.logUserErr(u, err, "DeleteMailbox (extstore delete)", name)
+	if err := u.parent.logIndex(ctx, tx, u.parent.logIndexRemoveMbox, u.id, name); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (logIndex)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 
 	// TODO: Grab mboxId along the way on PostgreSQL?
-	stats, err := tx.Stmt(u.parent.deleteMbox).Exec(u.id, name)
+	stats, err := tx.Stmt(u.parent.deleteMbox).ExecContext(ctx, u.id, name)
 	if err != nil {
 		u.parent.logUserErr(u, err, "DeleteMailbox (delete mbox)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
@@ -278,30 +325,43 @@ func (u *User) DeleteMailbox(name string) error {
 		return backend.ErrNoSuchMailbox
 	}
 
-	if _, err := tx.Stmt(u.parent.deleteZeroRef).Exec(u.id); err != nil {
+	if _, err := tx.Stmt(u.parent.deleteZeroRef).ExecContext(ctx, u.id); err != nil {
 		u.parent.logUserErr(u, err, "DeleteMailbox (delete zero ref)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 
-	err = tx.Commit()
-	u.parent.logUserErr(u, err, "DeleteMailbox (tx commit)", name)
-	return err
+	if err := tx.Commit(); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (tx commit)", name)
+		return err
+	}
+	u.parent.searchIndexChanged()
+	u.parent.deleteQueuedBlobs(keys)
+	return nil
 }
 
 func (u *User) RenameMailbox(existingName, newName string) error {
-	tx, err := u.parent.db.Begin(false)
+	return u.RenameMailboxContext(context.Background(), existingName, newName)
+}
+
+// RenameMailboxContext is a variant of RenameMailbox that aborts the
+// transaction once ctx is cancelled.
+func (u *User) RenameMailboxContext(ctx context.Context, existingName, newName string) error {
+	if err := u.checkWritable(); err != nil {
+		return err
+	}
+	tx, err := u.parent.db.BeginContext(ctx, false)
 	if err != nil {
 		u.parent.logUserErr(u, err, "RenameMailbox (tx start)", existingName, newName)
 		return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
 	}
 	defer tx.Rollback() //nolint:errcheck
 
-	if err := u.createParentDirs(tx, newName); err != nil {
+	if err := u.createParentDirs(ctx, tx, newName); err != nil {
 		u.parent.logUserErr(u, err, "RenameMailbox (create parents)", existingName, newName)
 		return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
 	}
 
-	if _, err := tx.Stmt(u.parent.renameMbox).Exec(newName, u.id, existingName); err != nil {
+	if _, err := tx.Stmt(u.parent.renameMbox).ExecContext(ctx, newName, u.id, existingName); err != nil {
 		u.parent.logUserErr(u, err, "RenameMailbox", existingName, newName)
 		return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
 	}
@@ -310,24 +370,24 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 	existingPattern := existingName + MailboxPathSep + "%"
 	newPrefix := newName + MailboxPathSep
 	existingPrefixLen := len(existingName + MailboxPathSep)
-	if _, err := tx.Stmt(u.parent.renameMboxChilds).Exec(newPrefix, existingPrefixLen, existingPattern, u.id); err != nil {
+	if _, err := tx.Stmt(u.parent.renameMboxChilds).ExecContext(ctx, newPrefix, existingPrefixLen, existingPattern, u.id); err != nil {
 		u.parent.logUserErr(u, err, "RenameMailbox (childs)", existingName, newName)
 		return wrapErrf(err, "RenameMailbox (childs) %s, %s", existingName, newName)
 	}
 
 	if strings.EqualFold(existingName, "INBOX") {
-		if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, existingName, u.parent.prng.Uint32(), nil); err != nil {
+		if _, err := tx.Stmt(u.parent.createMbox).ExecContext(ctx, u.id, existingName, u.parent.prng.Uint32(), nil); err != nil {
 			u.parent.logUserErr(u, err, "RenameMailbox (create inbox)", existingName, newName)
 			return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
 		}
 
 		// TODO: Cut a query here by using RETURNING on PostgreSQL
 		var inboxId uint64
-		if err = tx.Stmt(u.parent.mboxId).QueryRow(u.id, "INBOX").Scan(&inboxId); err != nil {
+		if err = tx.Stmt(u.parent.mboxId).QueryRowContext(ctx, u.id, "INBOX").Scan(&inboxId); err != nil {
 			u.parent.logUserErr(u, err, "RenameMailbox (query mboxid id)", existingName, newName)
 			return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
 		}
-		if _, err := tx.Stmt(u.parent.setInboxId).Exec(inboxId, u.id); err != nil {
+		if _, err := tx.Stmt(u.parent.setInboxId).ExecContext(ctx, inboxId, u.id); err != nil {
 			u.parent.logUserErr(u, err, "RenameMailbox (set inbox id)", existingName, newName)
 			return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
 		}
@@ -342,7 +402,31 @@ func (u *User) Logout() error {
 	return nil
 }
 
-func (u *User) createParentDirs(tx *sql.Tx, name string) error {
+// deleteMboxExternal decreases references to blobs of messages in the
+// mailbox and returns keys of blobs that are no longer referenced.
+func (u *User) deleteMboxExternal(ctx context.Context, tx *sql.Tx, name string) ([]string, error) {
+	if _, err := tx.Stmt(u.parent.decreaseRefForMbox).ExecContext(ctx, u.id, name); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Stmt(u.parent.zeroRefUser).QueryContext(ctx, u.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0, 16)
+	for rows.Next() {
+		var extKey string
+		if err := rows.Scan(&extKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, extKey)
+	}
+	return keys, rows.Err()
+}
+
+func (u *User) createParentDirs(ctx context.Context, tx *sql.Tx, name string) error {
 	parts := strings.Split(name, MailboxPathSep)
 	curDir := ""
 	for i, part := range parts[:len(parts)-1] {
@@ -351,7 +435,7 @@ func (u *User) createParentDirs(tx *sql.Tx, name string) error {
 		}
 		curDir += part
 
-		if _, err := tx.Stmt(u.parent.createMboxExistsOk).Exec(u.id, curDir, u.parent.prng.Uint32()); err != nil {
+		if _, err := tx.Stmt(u.parent.createMboxExistsOk).ExecContext(ctx, u.id, curDir, u.parent.prng.Uint32()); err != nil {
 			return err
 		}
 	}
@@ -368,16 +452,28 @@ func (u *User) Namespaces() (personal, other, shared []namespace.Namespace, err
 }
 
 func (u *User) CreateMessage(mboxName string, flags []string, date time.Time, fullBody imap.Literal, _ backend.Mailbox) error {
-	_, box, err := u.GetMailbox(mboxName, false, nil)
+	return u.CreateMessageContext(context.Background(), mboxName, flags, date, fullBody)
+}
+
+// CreateMessageContext is a variant of CreateMessage that aborts the
+// operation once ctx is cancelled.
+func (u *User) CreateMessageContext(ctx context.Context, mboxName string, flags []string, date time.Time, fullBody imap.Literal) error {
+	if err := u.checkWritable(); err != nil {
+		return err
+	}
+	_, box, err := u.GetMailboxContext(ctx, mboxName, false, nil)
 	if err != nil {
 		return err
 	}
 	defer box.Close()
 
-	return box.(*Mailbox).CreateMessage(flags, date, fullBody)
+	return box.(*Mailbox).CreateMessageContext(ctx, flags, date, fullBody)
 }
 
 func (u *User) SetSubscribed(mboxName string, sub bool) error {
+	if err := u.checkWritable(); err != nil {
+		return err
+	}
 	i := 0
 	if sub {
 		i = 1
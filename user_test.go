@@ -1,8 +1,12 @@
 package imapsql
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
 	"gotest.tools/assert"
 )
 
@@ -11,10 +15,11 @@ func TestUserCaseInsensitivity(t *testing.T) {
 	defer cleanBackend(b)
 
 	assert.NilError(t, b.CreateUser("foXcpp"))
-	_, err := b.Login(nil, "foXCpp", "")
-	assert.NilError(t, err, "b.Login")
 	u1, err := b.GetUser("Foxcpp")
 	assert.NilError(t, err, "b.GetUser")
+	assert.NilError(t, u1.(*User).SetPassword("pass"))
+	_, err = b.Login(nil, "foXCpp", "pass")
+	assert.NilError(t, err, "b.Login")
 	u2, err := b.GetOrCreateUser("FOXcpp")
 	assert.NilError(t, err, "b.GetOrCreateUser")
 
@@ -37,3 +42,48 @@ func TestInboxCreation(t *testing.T) {
 	assert.NilError(t, err, "u.GetMailbox")
 	defer mbox.Close()
 }
+
+func TestRenameUser(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+
+	assert.NilError(t, b.CreateUser("old@example.org"))
+	assert.NilError(t, b.CreateUser("other@example.org"))
+	assert.NilError(t, b.CreateAlias("new@example.org", "old@example.org", ""))
+	assert.NilError(t, b.CreateAlias("taken@example.org", "other@example.org", ""))
+	u, err := b.GetUser("old@example.org")
+	assert.NilError(t, err)
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	assert.Equal(t, b.RenameUser("nobody@example.org", "new@example.org", false), ErrUserDoesntExists)
+	assert.Equal(t, b.RenameUser("old@example.org", "Other@example.org", false), ErrUserAlreadyExists)
+	assert.Equal(t, b.RenameUser("old@example.org", "taken@example.org", false), ErrAliasAlreadyExists)
+
+	_, mbox, err := u.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	assert.NilError(t, b.RenameUser("Old@example.org", "New@example.org", true))
+	// Open sessions see the new name.
+	assert.Equal(t, u.Username(), "new@example.org")
+	assert.Equal(t, mbox.(*Mailbox).user.Username(), "new@example.org")
+	_, err = b.GetUser("old@example.org")
+	assert.Equal(t, err, ErrUserDoesntExists)
+	u, err = b.GetUser("new@example.org")
+	assert.NilError(t, err)
+	status, err := u.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(1))
+
+	aliases, err := b.ListAliases()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, aliases, []Alias{
+		{Alias: "old@example.org", Username: "new@example.org"},
+		{Alias: "taken@example.org", Username: "other@example.org"},
+	})
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt("old@example.org", textproto.Header{}))
+	assert.Equal(t, delivery.Results()[0].Username, "new@example.org")
+	assert.NilError(t, delivery.Abort())
+}